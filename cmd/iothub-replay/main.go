@@ -0,0 +1,173 @@
+// Command iothub-replay sends the uplink events archived by iothub in a
+// time range to the core topic again, e.g. after core failed to process
+// them. Events keep their id and sequence and carry the replayed extension.
+//
+//	iothub-replay -config iothub.yaml -from 2022-03-01T00:00:00Z -to 2022-03-02T00:00:00Z -tenant t1 -dry_run
+//	iothub-replay -config iothub.yaml -from 6h -device dev1 -types telemetry -rate 200
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/pkg/errors"
+	"github.com/tkeel-io/iothub/pkg/archive"
+	"github.com/tkeel-io/iothub/pkg/config"
+	"github.com/tkeel-io/iothub/pkg/service"
+	"github.com/tkeel-io/kit/log"
+)
+
+var (
+	configPath   = flag.String("config", os.Getenv(config.EnvConfigFile), "iothub config file of the archive and kafka.")
+	from         = flag.String("from", "", "start of the range, RFC3339 or a duration before now like 24h.")
+	to           = flag.String("to", "", "end of the range, exclusive, now if empty.")
+	device       = flag.String("device", "", "only events of this device.")
+	tenant       = flag.String("tenant", "", "only events of this tenant.")
+	eventTypes   = flag.String("types", "", "only events of these comma separated types, e.g. telemetry,attributes.")
+	rate         = flag.Float64("rate", 500, "events per second at most, 0 for no limit.")
+	limit        = flag.Int("limit", 0, "events at most, 0 for no limit.")
+	dryRun       = flag.Bool("dry_run", false, "print the events as json lines instead of sending them.")
+	source       = flag.String("source", "", "archive to read, file or kafka, archive.type if empty.")
+	dir          = flag.String("dir", "", "archive dir of source file, archive.dir if empty.")
+	archiveTopic = flag.String("archive_topic", "", "archive topic of source kafka, archive.topic if empty.")
+	topic        = flag.String("topic", "", "core topic to send to, kafka.topic if empty.")
+	logLevel     = flag.String("log_level", "info", "log level.")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func readerConfig(c *config.Config) archive.Config {
+	conf := archive.Config{
+		Type:    c.Archive.Type,
+		Dir:     c.Archive.Dir,
+		Brokers: c.Kafka.Brokers,
+		Version: c.Kafka.Version,
+		Topic:   c.Archive.Topic,
+	}
+	if *source != "" {
+		conf.Type = *source
+	}
+	if *dir != "" {
+		conf.Dir = *dir
+	}
+	if *archiveTopic != "" {
+		conf.Topic = *archiveTopic
+	}
+	return conf
+}
+
+func forwarderConfig(c *config.Config) service.ForwarderConfig {
+	conf := service.ForwarderConfig{
+		Brokers:        c.Kafka.Brokers,
+		Version:        c.Kafka.Version,
+		Topic:          c.Kafka.Topic,
+		PubsubName:     c.Dapr.PubsubName,
+		CloudEventMode: c.Kafka.CloudEventMode,
+	}
+	if *topic != "" {
+		conf.Topic = *topic
+	}
+	return conf
+}
+
+func parseFilter() (archive.Filter, error) {
+	now := time.Now()
+	start, err := parseTime(*from, now)
+	if err != nil {
+		return archive.Filter{}, err
+	}
+	if start.IsZero() {
+		return archive.Filter{}, errors.New("-from is required")
+	}
+	end, err := parseTime(*to, now)
+	if err != nil {
+		return archive.Filter{}, err
+	}
+	if end.IsZero() {
+		end = now
+	}
+	if !start.Before(end) {
+		return archive.Filter{}, errors.Errorf("-from %s is not before -to %s", start, end)
+	}
+	return archive.Filter{
+		From:     start,
+		To:       end,
+		DeviceID: *device,
+		TenantID: *tenant,
+		Types:    parseTypes(*eventTypes),
+	}, nil
+}
+
+func run() error {
+	if err := log.InitLoggerByConf(&log.Conf{App: "iothub-replay", Level: *logLevel}); err != nil {
+		return err
+	}
+	conf, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	filter, err := parseFilter()
+	if err != nil {
+		return err
+	}
+	reader, err := archive.NewReader(readerConfig(conf))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var send func(*archive.Record) error
+	target := forwarderConfig(conf)
+	if *dryRun {
+		enc := json.NewEncoder(os.Stdout)
+		send = func(rec *archive.Record) error { return enc.Encode(rec) }
+	} else {
+		forwarder, err := service.NewForwarder(target)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			closeCtx, cancel := context.WithTimeout(context.Background(), conf.Server.ShutdownTimeout.Duration)
+			defer cancel()
+			if err := forwarder.Close(closeCtx); err != nil {
+				log.Errorf("flush replayed events err, %v", err)
+			}
+		}()
+		send = func(rec *archive.Record) error {
+			ev := cloudevents.NewEvent()
+			if err := json.Unmarshal(rec.Event, &ev); err != nil {
+				return errors.Wrap(err, "decode archived cloudevent")
+			}
+			return forwarder.Resend(ctx, ev)
+		}
+	}
+
+	log.Infof("replay %s to %s of device %q tenant %q types %v", filter.From.Format(time.RFC3339), filter.To.Format(time.RFC3339), filter.DeviceID, filter.TenantID, filter.Types)
+	res, err := replay(ctx, reader, filter, *rate, *limit, send)
+	verb := "replayed"
+	if *dryRun {
+		verb = "would replay"
+	}
+	fmt.Fprintf(os.Stderr, "%s %d events of %d devices to %s", verb, res.Events, len(res.Devices), target.Topic)
+	if res.Events > 0 {
+		fmt.Fprintf(os.Stderr, ", from %s to %s", res.First.Format(time.RFC3339), res.Last.Format(time.RFC3339))
+	}
+	fmt.Fprintln(os.Stderr)
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tkeel-io/iothub/pkg/archive"
+)
+
+// errLimit stops the read at the -limit events.
+var errLimit = errors.New("limit reached")
+
+// eventTypePrefix completes the short event types of -types.
+const eventTypePrefix = "io.tkeel.iothub."
+
+// parseTypes returns the event types of a comma separated list, e.g.
+// telemetry,io.tkeel.iothub.attributes.
+func parseTypes(s string) []string {
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if !strings.HasPrefix(t, eventTypePrefix) {
+			t = eventTypePrefix + t
+		}
+		types = append(types, t)
+	}
+	return types
+}
+
+// parseTime reads an RFC3339 time, or a duration before now like 24h.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t, errors.Wrapf(err, "time %s is neither RFC3339 nor a duration", s)
+}
+
+// pacer spaces calls to at most rate per second.
+type pacer struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newPacer(rate float64) *pacer {
+	p := &pacer{}
+	if rate > 0 {
+		p.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return p
+}
+
+func (p *pacer) wait(ctx context.Context) error {
+	if p.interval == 0 {
+		return ctx.Err()
+	}
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	if d := p.next.Sub(now); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	p.next = p.next.Add(p.interval)
+	return nil
+}
+
+// result counts the events replayed.
+type result struct {
+	Events  int
+	Devices map[string]int
+	First   time.Time
+	Last    time.Time
+}
+
+// replay sends the records of r matching filter, at most limit if not 0,
+// paced at rate per second if not 0.
+func replay(ctx context.Context, r archive.Reader, filter archive.Filter, rate float64, limit int, send func(*archive.Record) error) (*result, error) {
+	res := &result{Devices: make(map[string]int)}
+	p := newPacer(rate)
+	err := r.Read(ctx, filter, func(rec *archive.Record) error {
+		if limit > 0 && res.Events >= limit {
+			return errLimit
+		}
+		if err := p.wait(ctx); err != nil {
+			return err
+		}
+		if err := send(rec); err != nil {
+			return errors.Wrapf(err, "replay event of %s at %s", rec.DeviceID, rec.Time)
+		}
+		res.Events++
+		res.Devices[rec.DeviceID]++
+		if res.First.IsZero() || rec.Time.Before(res.First) {
+			res.First = rec.Time
+		}
+		if rec.Time.After(res.Last) {
+			res.Last = rec.Time
+		}
+		return nil
+	})
+	if err == errLimit {
+		err = nil
+	}
+	return res, err
+}
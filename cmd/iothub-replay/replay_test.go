@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tkeel-io/iothub/pkg/archive"
+)
+
+func TestParseTypes(t *testing.T) {
+	got := parseTypes(" telemetry,,io.tkeel.iothub.attributes ")
+	want := []string{"io.tkeel.iothub.telemetry", "io.tkeel.iothub.attributes"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("types %v, want %v", got, want)
+	}
+	if got := parseTypes(""); got != nil {
+		t.Fatalf("types of empty %v", got)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Time
+		err  bool
+	}{
+		{"", time.Time{}, false},
+		{"6h", now.Add(-6 * time.Hour), false},
+		{"2022-03-01T08:30:00Z", time.Date(2022, 3, 1, 8, 30, 0, 0, time.UTC), false},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTime(tt.in, now)
+		if (err != nil) != tt.err || !got.Equal(tt.want) {
+			t.Errorf("%q: %s, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	w, err := archive.NewFileWriter(dir, 0, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	t0 := time.Now().UTC().Truncate(time.Second)
+	for i, dev := range []string{"dev1", "dev2", "dev1", "dev3", "dev1"} {
+		tenant := "t1"
+		if dev == "dev3" {
+			tenant = "t2"
+		}
+		err := w.Write(ctx, &archive.Record{
+			Time:     t0.Add(time.Duration(i) * time.Second),
+			DeviceID: dev,
+			TenantID: tenant,
+			Type:     "io.tkeel.iothub.telemetry",
+			Event:    json.RawMessage(`{}`),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := archive.NewFileReader(dir)
+
+	var sent []string
+	send := func(rec *archive.Record) error {
+		sent = append(sent, rec.DeviceID)
+		return nil
+	}
+	start := time.Now()
+	res, err := replay(ctx, r, archive.Filter{TenantID: "t1"}, 20, 0, send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first event is not delayed
+	if d := time.Since(start); d < 3*50*time.Millisecond {
+		t.Fatalf("4 events at 20/s in %s", d)
+	}
+	if res.Events != 4 || res.Devices["dev1"] != 3 || res.Devices["dev2"] != 1 {
+		t.Fatalf("result %+v", res)
+	}
+	if !res.First.Equal(t0) || !res.Last.Equal(t0.Add(4*time.Second)) {
+		t.Fatalf("range %s to %s", res.First, res.Last)
+	}
+
+	sent = nil
+	res, err = replay(ctx, r, archive.Filter{DeviceID: "dev1"}, 0, 2, send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Events != 2 || !reflect.DeepEqual(sent, []string{"dev1", "dev1"}) {
+		t.Fatalf("limit sent %v", sent)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := replay(cancelled, r, archive.Filter{}, 0, 0, send); err == nil {
+		t.Fatal("replay of cancelled context")
+	}
+}
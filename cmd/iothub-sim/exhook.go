@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+	"github.com/tkeel-io/iothub/pkg/exhooktest"
+	"github.com/tkeel-io/iothub/pkg/service"
+	pb "github.com/tkeel-io/iothub/protobuf"
+	"google.golang.org/grpc"
+)
+
+// owner and tenant of the devices of the local stand-ins
+const localOwner = "iothub-sim"
+
+// ExhookDriver calls the exhook gRPC API of iothub the way EMQX does for
+// the MQTT clients of the devices, without a broker.
+type ExhookDriver struct {
+	hook pb.HookProviderClient
+	conn *grpc.ClientConn
+}
+
+// DialExhook connects to the exhook server of a running iothub.
+func DialExhook(ctx context.Context, addr string) (*ExhookDriver, error) {
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return nil, errors.Wrapf(err, "dial exhook %s", addr)
+	}
+	return &ExhookDriver{hook: pb.NewHookProviderClient(conn), conn: conn}, nil
+}
+
+func (d *ExhookDriver) Dial(cred Credential) Conn {
+	return &exhookConn{dev: exhooktest.NewDevice(d.hook, cred.ID, cred.Token)}
+}
+
+// Run does nothing, commands of core are published through the EMQX
+// management api which the devices do not reach.
+func (d *ExhookDriver) Run(ctx context.Context) {}
+
+func (d *ExhookDriver) Close() error {
+	return d.conn.Close()
+}
+
+type exhookConn struct {
+	dev *exhooktest.Device
+
+	lock   sync.Mutex
+	handle func(payload []byte)
+}
+
+// deliver passes a command to the device once it is connected.
+func (c *exhookConn) deliver(payload []byte) {
+	c.lock.Lock()
+	handle := c.handle
+	c.lock.Unlock()
+	if handle != nil {
+		handle(payload)
+	}
+}
+
+func (c *exhookConn) Connect(ctx context.Context, handle func(payload []byte)) error {
+	ok, err := c.dev.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("not authorized")
+	}
+	c.lock.Lock()
+	c.handle = handle
+	c.lock.Unlock()
+	granted, err := c.dev.Subscribe(ctx, service.CommandTopic)
+	if err != nil {
+		return errors.Wrap(err, "subscribe commands")
+	}
+	if !granted[0] {
+		return errors.New("subscribe commands denied")
+	}
+	return nil
+}
+
+func (c *exhookConn) Publish(ctx context.Context, topic string, payload []byte) error {
+	ok, err := c.dev.Publish(ctx, topic, payload)
+	if err == nil && !ok {
+		err = errors.Errorf("publish to %s denied", topic)
+	}
+	return err
+}
+
+func (c *exhookConn) Close(ctx context.Context) error {
+	return c.dev.Disconnect(ctx)
+}
+
+// LocalDriver runs iothub in process with stand-ins of keel, dapr, EMQX
+// and kafka, see pkg/exhooktest. Commands are sent to the devices as core
+// events and measured until their response reaches kafka.
+type LocalDriver struct {
+	*ExhookDriver
+	h           *exhooktest.Harness
+	stats       *Stats
+	commandRate float64
+	timeout     time.Duration
+
+	lock    sync.Mutex
+	conns   map[string]*exhookConn
+	ids     []string
+	pending map[string]time.Time
+	seq     int
+}
+
+// StartLocal starts the stand-ins, the devices of creds are accepted.
+func StartLocal(creds []Credential, commandRate float64, timeout time.Duration, stats *Stats) (*LocalDriver, error) {
+	h, err := exhooktest.Start()
+	if err != nil {
+		return nil, err
+	}
+	for _, cred := range creds {
+		h.Keel.AddToken(cred.Token, cred.ID, localOwner, localOwner)
+	}
+	d := &LocalDriver{
+		ExhookDriver: &ExhookDriver{hook: h.Hook},
+		h:            h,
+		stats:        stats,
+		commandRate:  commandRate,
+		timeout:      timeout,
+		conns:        make(map[string]*exhookConn),
+		pending:      make(map[string]time.Time),
+	}
+	h.Emqx.OnPublish(d.deliver)
+	h.Producer.OnMessage(d.received)
+	return d, nil
+}
+
+func (d *LocalDriver) Dial(cred Credential) Conn {
+	return &localConn{exhookConn: d.ExhookDriver.Dial(cred).(*exhookConn), d: d, id: cred.ID}
+}
+
+// localConn is a device commands are sent to while it is connected.
+type localConn struct {
+	*exhookConn
+	d  *LocalDriver
+	id string
+}
+
+func (c *localConn) Connect(ctx context.Context, handle func(payload []byte)) error {
+	if err := c.exhookConn.Connect(ctx, handle); err != nil {
+		return err
+	}
+	c.d.lock.Lock()
+	defer c.d.lock.Unlock()
+	c.d.conns[c.id] = c.exhookConn
+	c.d.ids = append(c.d.ids, c.id)
+	return nil
+}
+
+func (c *localConn) Close(ctx context.Context) error {
+	c.d.lock.Lock()
+	delete(c.d.conns, c.id)
+	for i, id := range c.d.ids {
+		if id == c.id {
+			c.d.ids = append(c.d.ids[:i], c.d.ids[i+1:]...)
+			break
+		}
+	}
+	c.d.lock.Unlock()
+	return c.exhookConn.Close(ctx)
+}
+
+// deliver passes a message iothub published to EMQX to its device.
+func (d *LocalDriver) deliver(p exhooktest.Published) {
+	// mounted topic, devId/v1/devices/me/commands
+	kv := strings.SplitN(p.Topic, "/", 2)
+	if len(kv) != 2 || kv[1] != service.CommandTopic {
+		return
+	}
+	d.lock.Lock()
+	conn := d.conns[kv[0]]
+	d.lock.Unlock()
+	if conn != nil {
+		conn.deliver(p.Payload)
+	}
+}
+
+// received measures the command responses sent to kafka.
+func (d *LocalDriver) received(msg *sarama.ProducerMessage) {
+	value, err := msg.Value.Encode()
+	if err != nil {
+		return
+	}
+	ev := gjson.ParseBytes(value)
+	if ev.Get("type").String() != service.EventTypeCommandResponse {
+		return
+	}
+	payload, err := base64.StdEncoding.DecodeString(ev.Get("data.data.rawData.values").String())
+	if err != nil {
+		d.stats.Error(opRPC, errors.Wrap(err, "decode command response"))
+		return
+	}
+	now := time.Now()
+	gjson.ParseBytes(payload).ForEach(func(_, resp gjson.Result) bool {
+		id := resp.Get("id").String()
+		d.lock.Lock()
+		start, ok := d.pending[id]
+		delete(d.pending, id)
+		d.lock.Unlock()
+		if ok {
+			d.stats.Observe(opRPC, now.Sub(start))
+		}
+		return true
+	})
+}
+
+// Run sends commands to random devices until ctx is done.
+func (d *LocalDriver) Run(ctx context.Context) {
+	if d.commandRate <= 0 {
+		return
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / d.commandRate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		d.expire()
+		d.lock.Lock()
+		if len(d.ids) == 0 {
+			d.lock.Unlock()
+			continue
+		}
+		devId := d.ids[rnd.Intn(len(d.ids))]
+		d.seq++
+		id := strconv.Itoa(d.seq)
+		d.pending[id] = time.Now()
+		d.lock.Unlock()
+		d.command(ctx, devId, id)
+	}
+}
+
+func (d *LocalDriver) command(ctx context.Context, devId, id string) {
+	evCtx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	resp, err := d.h.CoreEvent(evCtx, exhooktest.CoreTopic, map[string]interface{}{
+		"id":    devId,
+		"owner": localOwner,
+		"properties": map[string]interface{}{
+			"commands": map[string]interface{}{
+				"reboot": map[string]interface{}{"id": id, "input": map[string]interface{}{"delay": 1}},
+			},
+		},
+	})
+	// iothub drops the events it published, retry is a failure
+	if err == nil && resp.GetStatus() == service.SubscriptionResponseStatusRetry {
+		err = errors.Errorf("core event %s", resp.GetStatus())
+	}
+	if err != nil {
+		d.lock.Lock()
+		delete(d.pending, id)
+		d.lock.Unlock()
+		if ctx.Err() == nil {
+			d.stats.Error(opRPC, err)
+		}
+	}
+}
+
+// expire counts the commands without response in time as errors.
+func (d *LocalDriver) expire() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for id, start := range d.pending {
+		if time.Since(start) > d.timeout {
+			delete(d.pending, id)
+			d.stats.Error(opRPC, errors.Errorf("command %s timed out", id))
+		}
+	}
+}
+
+func (d *LocalDriver) Close() error {
+	return d.h.Close()
+}
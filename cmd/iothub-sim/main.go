@@ -0,0 +1,154 @@
+// Command iothub-sim simulates devices to load test iothub. The devices
+// connect over MQTT to a broker running the iothub exhook, call the exhook
+// gRPC API of iothub directly like EMQX does, or run against iothub in
+// process with local stand-ins of keel, dapr, EMQX and kafka.
+//
+//	iothub-sim -mode local -devices 100 -rate 10 -duration 1m
+//	iothub-sim -mode mqtt -broker tcp://127.0.0.1:1883 -credentials devices.csv
+//	iothub-sim -mode exhook -exhook_addr 127.0.0.1:31233 -credentials devices.csv
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tkeel-io/kit/log"
+)
+
+// drivers of the -mode flag
+const (
+	modeLocal  = "local"
+	modeMQTT   = "mqtt"
+	modeExhook = "exhook"
+)
+
+var (
+	mode            = flag.String("mode", modeLocal, "local, in process iothub with stand-ins; mqtt, through a broker; exhook, calling the exhook api of iothub.")
+	broker          = flag.String("broker", "tcp://127.0.0.1:1883", "mqtt broker of mode mqtt.")
+	exhookAddr      = flag.String("exhook_addr", "127.0.0.1:31233", "exhook grpc address of iothub of mode exhook.")
+	credentials     = flag.String("credentials", "", "file of the devices, one id,token per line. Generated when empty.")
+	devices         = flag.Int("devices", 10, "devices simulated, 0 for every device of -credentials.")
+	devicePrefix    = flag.String("device_prefix", "sim-", "id prefix of the generated devices.")
+	rate            = flag.Float64("rate", 1, "messages per second of each device, 0 to only connect.")
+	connectRate     = flag.Float64("connect_rate", 100, "devices connecting per second, 0 for all at once.")
+	mix             = flag.String("mix", "telemetry=6,attributes=3,gateway-telemetry=1", "weights of the payloads of telemetry, attributes, gateway-telemetry and gateway-attributes.")
+	keys            = flag.Int("keys", 4, "values in each payload.")
+	gatewayChildren = flag.Int("gateway_children", 2, "child devices in each gateway payload.")
+	commandRate     = flag.Float64("command_rate", 1, "commands per second sent to the devices of mode local.")
+	qos             = flag.Int("qos", 1, "mqtt qos of mode mqtt.")
+	keepAlive       = flag.Duration("keepalive", 60*time.Second, "mqtt keepalive of mode mqtt.")
+	duration        = flag.Duration("duration", time.Minute, "duration of the run, 0 until interrupted.")
+	reportInterval  = flag.Duration("report_interval", 10*time.Second, "interval of the progress reports.")
+	timeout         = flag.Duration("timeout", 10*time.Second, "timeout of each operation.")
+	logLevel        = flag.String("log_level", "error", "log level, of iothub as well in mode local.")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func deviceCredentials() ([]Credential, error) {
+	if *credentials == "" {
+		if *devices <= 0 {
+			return nil, errors.New("-devices must be positive without -credentials")
+		}
+		return GenerateCredentials(*devicePrefix, *devices), nil
+	}
+	creds, err := LoadCredentials(*credentials)
+	if err != nil {
+		return nil, err
+	}
+	if *devices > len(creds) {
+		return nil, errors.Errorf("-devices %d, %s has %d devices", *devices, *credentials, len(creds))
+	}
+	if *devices > 0 {
+		creds = creds[:*devices]
+	}
+	return creds, nil
+}
+
+func newDriver(ctx context.Context, creds []Credential, stats *Stats) (Driver, error) {
+	switch *mode {
+	case modeLocal:
+		return StartLocal(creds, *commandRate, *timeout, stats)
+	case modeMQTT:
+		if *qos < 0 || *qos > 2 {
+			return nil, errors.Errorf("invalid -qos %d", *qos)
+		}
+		return NewMQTTDriver(*broker, byte(*qos), *keepAlive, *timeout, stats), nil
+	case modeExhook:
+		ctx, cancel := context.WithTimeout(ctx, *timeout)
+		defer cancel()
+		return DialExhook(ctx, *exhookAddr)
+	}
+	return nil, errors.Errorf("unknown -mode %s", *mode)
+}
+
+func run() error {
+	if err := log.InitLoggerByConf(&log.Conf{App: "iothub-sim", Level: *logLevel}); err != nil {
+		return err
+	}
+	payloads, err := ParseMix(*mix)
+	if err != nil {
+		return err
+	}
+	creds, err := deviceCredentials()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	stats := NewStats()
+	driver, err := newDriver(ctx, creds, stats)
+	if err != nil {
+		return err
+	}
+	defer driver.Close()
+
+	fmt.Printf("simulating %d devices in mode %s, %.1f msg/s each\n", len(creds), *mode, *rate)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewSim(driver, Options{
+			Rate:        *rate,
+			ConnectRate: *connectRate,
+			Timeout:     *timeout,
+			Mix:         payloads,
+			Keys:        *keys,
+			Children:    *gatewayChildren,
+		}, stats).Run(ctx, creds)
+	}()
+
+	ticker := time.NewTicker(*reportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			stats.Report(os.Stdout, len(creds))
+			continue
+		case <-done:
+		}
+		break
+	}
+	stats.Summary(os.Stdout)
+	if n, _ := stats.Count(opConnect); n == 0 {
+		return errors.New("no device connected")
+	}
+	return nil
+}
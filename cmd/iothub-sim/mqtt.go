@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+	"github.com/tkeel-io/iothub/pkg/service"
+)
+
+// MQTTDriver connects devices to a broker, e.g. EMQX with the iothub
+// exhook, or any local broker.
+type MQTTDriver struct {
+	broker    string
+	qos       byte
+	keepAlive time.Duration
+	timeout   time.Duration
+	stats     *Stats
+}
+
+func NewMQTTDriver(broker string, qos byte, keepAlive, timeout time.Duration, stats *Stats) *MQTTDriver {
+	return &MQTTDriver{broker: broker, qos: qos, keepAlive: keepAlive, timeout: timeout, stats: stats}
+}
+
+func (d *MQTTDriver) Dial(cred Credential) Conn {
+	opts := mqtt.NewClientOptions().
+		AddBroker(d.broker).
+		SetClientID(cred.ID).
+		SetUsername(cred.ID).
+		SetPassword(cred.Token).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetOrderMatters(false).
+		SetKeepAlive(d.keepAlive).
+		SetConnectTimeout(d.timeout).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			d.stats.Error(opConnect, errors.Wrapf(err, "%s connection lost", cred.ID))
+		})
+	return &mqttConn{client: mqtt.NewClient(opts), qos: d.qos}
+}
+
+// Run does nothing, commands are sent by the platform.
+func (d *MQTTDriver) Run(ctx context.Context) {}
+
+func (d *MQTTDriver) Close() error {
+	return nil
+}
+
+type mqttConn struct {
+	client mqtt.Client
+	qos    byte
+}
+
+func wait(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *mqttConn) Connect(ctx context.Context, handle func(payload []byte)) error {
+	if err := wait(ctx, c.client.Connect()); err != nil {
+		return err
+	}
+	token := c.client.Subscribe(service.CommandTopic, c.qos, func(_ mqtt.Client, msg mqtt.Message) {
+		handle(msg.Payload())
+	})
+	if err := wait(ctx, token); err != nil {
+		c.client.Disconnect(0)
+		return errors.Wrap(err, "subscribe commands")
+	}
+	// EMQX answers a denied subscription with failure code 0x80
+	if st, ok := token.(*mqtt.SubscribeToken); ok {
+		if qos := st.Result()[service.CommandTopic]; qos == 0x80 {
+			c.client.Disconnect(0)
+			return errors.New("subscribe commands denied")
+		}
+	}
+	return nil
+}
+
+func (c *mqttConn) Publish(ctx context.Context, topic string, payload []byte) error {
+	return wait(ctx, c.client.Publish(topic, c.qos, false, payload))
+}
+
+func (c *mqttConn) Close(ctx context.Context) error {
+	c.client.Disconnect(250)
+	return nil
+}
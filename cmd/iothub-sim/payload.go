@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tkeel-io/iothub/pkg/service"
+)
+
+// gateway topics, children data is keyed by child device name, see
+// example/emq-pub.py
+const (
+	gatewayAttributesTopic = "v1/gateway/attributes"
+	gatewayTelemetryTopic  = "v1/gateway/telemetry"
+)
+
+// payload kinds of the -mix flag
+const (
+	kindTelemetry         = "telemetry"
+	kindAttributes        = "attributes"
+	kindGatewayTelemetry  = "gateway-telemetry"
+	kindGatewayAttributes = "gateway-attributes"
+)
+
+var kindTopics = map[string]string{
+	kindTelemetry:         service.TelemetryTopic,
+	kindAttributes:        service.AttributesTopic,
+	kindGatewayTelemetry:  gatewayTelemetryTopic,
+	kindGatewayAttributes: gatewayAttributesTopic,
+}
+
+// Mix picks payload kinds by weight.
+type Mix struct {
+	kinds   []string
+	weights []int
+	total   int
+}
+
+// ParseMix parses kind=weight pairs, e.g. telemetry=6,attributes=3,gateway-telemetry=1.
+func ParseMix(s string) (*Mix, error) {
+	m := &Mix{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		kind, weight := kv[0], 1
+		if _, ok := kindTopics[kind]; !ok {
+			return nil, errors.Errorf("unknown payload kind %s", kind)
+		}
+		if len(kv) == 2 {
+			w, err := strconv.Atoi(kv[1])
+			if err != nil || w < 0 {
+				return nil, errors.Errorf("invalid weight of %s", item)
+			}
+			weight = w
+		}
+		if weight == 0 {
+			continue
+		}
+		m.kinds = append(m.kinds, kind)
+		m.weights = append(m.weights, weight)
+		m.total += weight
+	}
+	if m.total == 0 {
+		return nil, errors.New("empty payload mix")
+	}
+	return m, nil
+}
+
+// Pick returns a kind at random by weight.
+func (m *Mix) Pick(rnd *rand.Rand) string {
+	n := rnd.Intn(m.total)
+	for i, w := range m.weights {
+		if n < w {
+			return m.kinds[i]
+		}
+		n -= w
+	}
+	return m.kinds[len(m.kinds)-1]
+}
+
+// Generator builds the payloads of a device.
+type Generator struct {
+	devId    string
+	keys     int
+	children int
+	seq      int
+	rnd      *rand.Rand
+}
+
+func NewGenerator(devId string, keys, children int, seed int64) *Generator {
+	return &Generator{devId: devId, keys: keys, children: children, rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (g *Generator) values() map[string]interface{} {
+	values := make(map[string]interface{}, g.keys+1)
+	values["seq"] = g.seq
+	for i := 0; i < g.keys; i++ {
+		values[fmt.Sprintf("key%d", i)] = float64(g.rnd.Intn(10000)) / 100
+	}
+	return values
+}
+
+func (g *Generator) telemetry() map[string]interface{} {
+	return map[string]interface{}{"ts": time.Now().UnixMilli(), "values": g.values()}
+}
+
+// Next returns the topic and payload of the next message of kind.
+func (g *Generator) Next(kind string) (string, []byte, error) {
+	g.seq++
+	var v interface{}
+	switch kind {
+	case kindTelemetry:
+		v = g.telemetry()
+	case kindAttributes:
+		v = g.values()
+	case kindGatewayTelemetry:
+		children := make(map[string]interface{}, g.children)
+		for i := 0; i < g.children; i++ {
+			children[g.child(i)] = []interface{}{g.telemetry()}
+		}
+		v = children
+	case kindGatewayAttributes:
+		children := make(map[string]interface{}, g.children)
+		for i := 0; i < g.children; i++ {
+			children[g.child(i)] = g.values()
+		}
+		v = children
+	default:
+		return "", nil, errors.Errorf("unknown payload kind %s", kind)
+	}
+	payload, err := json.Marshal(v)
+	return kindTopics[kind], payload, err
+}
+
+func (g *Generator) child(i int) string {
+	return fmt.Sprintf("%s-child%d", g.devId, i)
+}
+
+// commandResponse answers a command published to the commands topic,
+// {"name": {"id": "1", "input": {...}}}, with the outputs of each command
+// to publish to the command response topic.
+func commandResponse(payload []byte) ([]byte, error) {
+	var cmds map[string]struct {
+		ID    interface{} `json:"id"`
+		Input interface{} `json:"input"`
+	}
+	if err := json.Unmarshal(payload, &cmds); err != nil {
+		return nil, errors.Wrap(err, "decode command")
+	}
+	resp := make(map[string]interface{}, len(cmds))
+	for name, cmd := range cmds {
+		resp[name] = map[string]interface{}{
+			"id":     cmd.ID,
+			"output": map[string]interface{}{"code": 0, "input": cmd.Input},
+		}
+	}
+	return json.Marshal(resp)
+}
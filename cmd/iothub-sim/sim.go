@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tkeel-io/iothub/pkg/service"
+	"github.com/tkeel-io/kit/log"
+)
+
+// Credential authenticates a device, the device id is the MQTT username
+// and the token the password.
+type Credential struct {
+	ID    string
+	Token string
+}
+
+// GenerateCredentials returns n devices named prefix with a sequence
+// number, the token is the id prefixed with "token-".
+func GenerateCredentials(prefix string, n int) []Credential {
+	creds := make([]Credential, n)
+	for i := range creds {
+		id := fmt.Sprintf("%s%05d", prefix, i)
+		creds[i] = Credential{ID: id, Token: "token-" + id}
+	}
+	return creds
+}
+
+// LoadCredentials reads devices of a file, one "id,token" per line, blank
+// lines and lines starting with # are skipped.
+func LoadCredentials(path string) ([]Credential, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var creds []Credential
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ",", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, errors.Errorf("%s:%d: want id,token", path, n)
+		}
+		creds = append(creds, Credential{ID: strings.TrimSpace(kv[0]), Token: strings.TrimSpace(kv[1])})
+	}
+	return creds, scanner.Err()
+}
+
+// Conn is a simulated device connected to iothub.
+type Conn interface {
+	// Connect connects the device and subscribes to commands, handle is
+	// called with the payload of each command.
+	Connect(ctx context.Context, handle func(payload []byte)) error
+	Publish(ctx context.Context, topic string, payload []byte) error
+	Close(ctx context.Context) error
+}
+
+// Driver connects simulated devices.
+type Driver interface {
+	Dial(cred Credential) Conn
+	// Run runs until ctx is done, e.g. to send commands to the devices.
+	Run(ctx context.Context)
+	Close() error
+}
+
+// Options of a simulation run.
+type Options struct {
+	// Rate is the messages per second published by each device, 0 to only
+	// stay connected.
+	Rate float64
+	// ConnectRate is the devices connecting per second, 0 for all at once.
+	ConnectRate float64
+	Timeout     time.Duration
+	Mix         *Mix
+	Keys        int
+	Children    int
+}
+
+// Sim runs simulated devices through a driver.
+type Sim struct {
+	driver Driver
+	opts   Options
+	stats  *Stats
+}
+
+func NewSim(driver Driver, opts Options, stats *Stats) *Sim {
+	return &Sim{driver: driver, opts: opts, stats: stats}
+}
+
+// Run connects the devices and publishes until ctx is done, then
+// disconnects them.
+func (s *Sim) Run(ctx context.Context, creds []Credential) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.driver.Run(ctx)
+	}()
+
+	var ramp <-chan time.Time
+	if s.opts.ConnectRate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / s.opts.ConnectRate))
+		defer ticker.Stop()
+		ramp = ticker.C
+	}
+	for i, cred := range creds {
+		if ramp != nil && i > 0 {
+			select {
+			case <-ctx.Done():
+			case <-ramp:
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int, cred Credential) {
+			defer wg.Done()
+			s.runDevice(ctx, cred, int64(i))
+		}(i, cred)
+	}
+	wg.Wait()
+}
+
+func (s *Sim) runDevice(ctx context.Context, cred Credential, seed int64) {
+	conn := s.driver.Dial(cred)
+	start := time.Now()
+	connCtx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	err := conn.Connect(connCtx, func(payload []byte) { go s.answer(ctx, conn, payload) })
+	cancel()
+	if err != nil {
+		if ctx.Err() == nil {
+			s.stats.Error(opConnect, errors.Wrap(err, cred.ID))
+		}
+		return
+	}
+	s.stats.Observe(opConnect, time.Since(start))
+	s.stats.Connected(1)
+	defer func() {
+		s.stats.Connected(-1)
+		closeCtx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+		defer cancel()
+		if err := conn.Close(closeCtx); err != nil {
+			log.Warnf("close %s, %v", cred.ID, err)
+		}
+	}()
+
+	if s.opts.Rate <= 0 {
+		<-ctx.Done()
+		return
+	}
+	gen := NewGenerator(cred.ID, s.opts.Keys, s.opts.Children, seed)
+	rnd := rand.New(rand.NewSource(seed))
+	interval := time.Duration(float64(time.Second) / s.opts.Rate)
+	// spread the first messages of the devices over an interval
+	timer := time.NewTimer(time.Duration(rnd.Int63n(int64(interval) + 1)))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		timer.Reset(interval)
+		topic, payload, err := gen.Next(s.opts.Mix.Pick(rnd))
+		if err != nil {
+			s.stats.Error(opPublish, err)
+			continue
+		}
+		s.publish(ctx, conn, opPublish, topic, payload, time.Now())
+	}
+}
+
+func (s *Sim) publish(ctx context.Context, conn Conn, op, topic string, payload []byte, start time.Time) {
+	pubCtx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	defer cancel()
+	if err := conn.Publish(pubCtx, topic, payload); err != nil {
+		if ctx.Err() == nil {
+			s.stats.Error(op, err)
+		}
+		return
+	}
+	s.stats.Observe(op, time.Since(start))
+}
+
+// answer responds to a command like a device executing it.
+func (s *Sim) answer(ctx context.Context, conn Conn, payload []byte) {
+	start := time.Now()
+	resp, err := commandResponse(payload)
+	if err != nil {
+		s.stats.Error(opCommand, err)
+		return
+	}
+	s.publish(ctx, conn, opCommand, service.CommandTopicResponse, resp, start)
+}
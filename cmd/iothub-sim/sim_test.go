@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseMix(t *testing.T) {
+	m, err := ParseMix("telemetry=3, attributes ,gateway-attributes=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	picked := make(map[string]int)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 4000; i++ {
+		picked[m.Pick(rnd)]++
+	}
+	if len(picked) != 2 || picked[kindTelemetry] < 2700 || picked[kindAttributes] < 800 {
+		t.Fatalf("picked %v", picked)
+	}
+	for _, s := range []string{"", "telemetry=0", "unknown=1", "telemetry=x"} {
+		if _, err := ParseMix(s); err == nil {
+			t.Fatalf("mix %q accepted", s)
+		}
+	}
+}
+
+func TestGenerator_Next(t *testing.T) {
+	g := NewGenerator("dev1", 2, 3, 1)
+	topic, payload, err := g.Next(kindGatewayTelemetry)
+	if err != nil || topic != gatewayTelemetryTopic {
+		t.Fatal(topic, err)
+	}
+	var children map[string][]struct {
+		TS     int64                  `json:"ts"`
+		Values map[string]interface{} `json:"values"`
+	}
+	if err := json.Unmarshal(payload, &children); err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 3 || len(children["dev1-child2"]) != 1 || len(children["dev1-child2"][0].Values) != 3 {
+		t.Fatalf("payload %s", payload)
+	}
+}
+
+func TestCommandResponse(t *testing.T) {
+	resp, err := commandResponse([]byte(`{"reboot":{"id":"7","input":{"delay":1}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != `{"reboot":{"id":"7","output":{"code":0,"input":{"delay":1}}}}` {
+		t.Fatalf("response %s", resp)
+	}
+	if _, err := commandResponse([]byte(`reboot`)); err == nil {
+		t.Fatal("invalid command answered")
+	}
+}
+
+func TestOpStats_Percentiles(t *testing.T) {
+	s := &opStats{}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 1; i <= 1000; i++ {
+		s.observe(time.Duration(i)*time.Millisecond, rnd)
+	}
+	p := s.percentiles(50, 99)
+	if p[0] != 500*time.Millisecond || p[1] != 990*time.Millisecond || s.max != time.Second {
+		t.Fatalf("percentiles %v max %v", p, s.max)
+	}
+}
+
+func TestLoadCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.csv")
+	if err := os.WriteFile(path, []byte("# id,token\ndev1, token1\n\ndev2,token2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := LoadCredentials(path)
+	if err != nil || len(creds) != 2 || creds[0] != (Credential{ID: "dev1", Token: "token1"}) {
+		t.Fatalf("credentials %v, %v", creds, err)
+	}
+	if err := os.WriteFile(path, []byte("dev1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCredentials(path); err == nil {
+		t.Fatal("line without token accepted")
+	}
+}
+
+func TestSim_Local(t *testing.T) {
+	creds := GenerateCredentials("sim-", 3)
+	// an unknown device fails to connect
+	creds = append(creds, Credential{ID: "unknown", Token: "unknown"})
+	stats := NewStats()
+	driver, err := StartLocal(creds[:3], 20, time.Second, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Close()
+	mix, err := ParseMix("telemetry,attributes,gateway-attributes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	NewSim(driver, Options{Rate: 50, Timeout: time.Second, Mix: mix, Keys: 2, Children: 1}, stats).Run(ctx, creds)
+
+	if n, errs := stats.Count(opConnect); n != 3 || errs != 1 {
+		t.Fatalf("connect %d, errors %d", n, errs)
+	}
+	if n, errs := stats.Count(opPublish); n < 30 || errs != 0 {
+		t.Fatalf("publish %d, errors %d", n, errs)
+	}
+	// commands sent at the end may be answered after the run
+	if n, errs := stats.Count(opRPC); n < 3 || errs != 0 {
+		t.Fatalf("rpc %d, errors %d", n, errs)
+	}
+	if n, errs := stats.Count(opCommand); n < 3 || errs != 0 {
+		t.Fatalf("command %d, errors %d", n, errs)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// operations measured by the simulator
+const (
+	opConnect = "connect"
+	opPublish = "publish"
+	// command is the time a device takes to answer a command, from its
+	// receipt to the acknowledged response
+	opCommand = "command"
+	// rpc is the time from a command sent by core to its response reaching
+	// core, only measured against local stand-ins
+	opRPC = "rpc"
+)
+
+var operations = []string{opConnect, opPublish, opCommand, opRPC}
+
+// reservoirSize bounds the latency samples kept per operation.
+const reservoirSize = 1 << 16
+
+// opStats counts an operation and samples its latency.
+type opStats struct {
+	count   int64
+	errors  int64
+	lastErr error
+	max     time.Duration
+	seen    int64
+	samples []time.Duration
+}
+
+func (s *opStats) observe(d time.Duration, rnd *rand.Rand) {
+	s.count++
+	if d > s.max {
+		s.max = d
+	}
+	s.seen++
+	if len(s.samples) < reservoirSize {
+		s.samples = append(s.samples, d)
+		return
+	}
+	if i := rnd.Int63n(s.seen); i < reservoirSize {
+		s.samples[i] = d
+	}
+}
+
+// percentiles returns the latency at each of ps, in [0, 100].
+func (s *opStats) percentiles(ps ...float64) []time.Duration {
+	out := make([]time.Duration, len(ps))
+	if len(s.samples) == 0 {
+		return out
+	}
+	sorted := append([]time.Duration(nil), s.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, p := range ps {
+		idx := int(p / 100 * float64(len(sorted)-1))
+		out[i] = sorted[idx]
+	}
+	return out
+}
+
+// Stats collects the results of a run.
+type Stats struct {
+	lock      sync.Mutex
+	rnd       *rand.Rand
+	start     time.Time
+	ops       map[string]*opStats
+	last      map[string]int64
+	lastAt    time.Time
+	connected int64
+}
+
+func NewStats() *Stats {
+	now := time.Now()
+	s := &Stats{
+		rnd:    rand.New(rand.NewSource(now.UnixNano())),
+		start:  now,
+		lastAt: now,
+		ops:    make(map[string]*opStats),
+		last:   make(map[string]int64),
+	}
+	for _, op := range operations {
+		s.ops[op] = &opStats{}
+	}
+	return s
+}
+
+// Observe records a completed op of latency d.
+func (s *Stats) Observe(op string, d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ops[op].observe(d, s.rnd)
+}
+
+// Error records a failed op.
+func (s *Stats) Error(op string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ops[op].errors++
+	s.ops[op].lastErr = err
+}
+
+// Connected tracks the devices connected, delta is 1 or -1.
+func (s *Stats) Connected(delta int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.connected += delta
+}
+
+// Count returns the completed and failed ops.
+func (s *Stats) Count(op string) (count, errors int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ops[op].count, s.ops[op].errors
+}
+
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return fmt.Sprintf("%.2fs", d.Seconds())
+	case d >= time.Millisecond:
+		return fmt.Sprintf("%.2fms", float64(d)/float64(time.Millisecond))
+	default:
+		return fmt.Sprintf("%.0fµs", float64(d)/float64(time.Microsecond))
+	}
+}
+
+// Report writes the throughput since the previous report and the latency
+// percentiles since the start, one line.
+func (s *Stats) Report(w io.Writer, devices int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	interval := now.Sub(s.lastAt).Seconds()
+	parts := []string{fmt.Sprintf("[%s] devices %d/%d", now.Sub(s.start).Truncate(time.Second), s.connected, devices)}
+	for _, op := range operations {
+		st := s.ops[op]
+		if st.count == 0 && st.errors == 0 {
+			continue
+		}
+		rate := 0.0
+		if interval > 0 {
+			rate = float64(st.count-s.last[op]) / interval
+		}
+		s.last[op] = st.count
+		p := st.percentiles(50, 99)
+		parts = append(parts, fmt.Sprintf("%s %d %.1f/s err %d p50 %s p99 %s",
+			op, st.count, rate, st.errors, formatDuration(p[0]), formatDuration(p[1])))
+	}
+	s.lastAt = now
+	fmt.Fprintln(w, strings.Join(parts, " | "))
+}
+
+// Summary writes the results of the whole run.
+func (s *Stats) Summary(w io.Writer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	elapsed := time.Since(s.start)
+	fmt.Fprintf(w, "\nduration %s\n", elapsed.Truncate(time.Millisecond))
+	fmt.Fprintf(w, "%-8s %10s %10s %8s %10s %10s %10s %10s %10s\n", "op", "count", "rate/s", "errors", "p50", "p90", "p99", "p99.9", "max")
+	for _, op := range operations {
+		st := s.ops[op]
+		if st.count == 0 && st.errors == 0 {
+			continue
+		}
+		p := st.percentiles(50, 90, 99, 99.9)
+		fmt.Fprintf(w, "%-8s %10d %10.1f %8d %10s %10s %10s %10s %10s\n", op, st.count,
+			float64(st.count)/elapsed.Seconds(), st.errors,
+			formatDuration(p[0]), formatDuration(p[1]), formatDuration(p[2]), formatDuration(p[3]), formatDuration(st.max))
+	}
+	for _, op := range operations {
+		if err := s.ops[op].lastErr; err != nil {
+			fmt.Fprintf(w, "last %s error: %v\n", op, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/tkeel-io/iothub/pkg/archive"
+	"github.com/tkeel-io/iothub/pkg/config"
+	"github.com/tkeel-io/iothub/pkg/lorawan"
+	"github.com/tkeel-io/iothub/pkg/lwm2m"
+	"github.com/tkeel-io/iothub/pkg/service"
+	"github.com/tkeel-io/kit/log"
+)
+
+func logConf(c *config.Config) *log.Conf {
+	return &log.Conf{
+		App:   Name,
+		Level: c.Log.Level,
+		Dev:   c.Log.Dev,
+	}
+}
+
+func forwarderConfig(c *config.Config) service.ForwarderConfig {
+	return service.ForwarderConfig{
+		Brokers:        c.Kafka.Brokers,
+		Version:        c.Kafka.Version,
+		Topic:          c.Kafka.Topic,
+		PubsubName:     c.Dapr.PubsubName,
+		CloudEventMode: c.Kafka.CloudEventMode,
+	}
+}
+
+func presenceConfig(c *config.Config) service.PresenceConfig {
+	return service.PresenceConfig{
+		DeviceMetric: c.Presence.DeviceMetric,
+		OfflineTTL:   c.Presence.OfflineTTL.Duration,
+		GCInterval:   c.Presence.GCInterval.Duration,
+	}
+}
+
+func hookConfig(c *config.Config) service.Config {
+	return service.Config{
+		KeelURL:    c.Keel.BaseURL,
+		PubsubName: c.Dapr.PubsubName,
+		Emqx: service.EmqxConfig{
+			APIAddress: c.EMQX.APIAddress,
+			Username:   c.EMQX.Username,
+			Password:   c.EMQX.Password,
+		},
+		Quality: service.QualityConfig{
+			FlapThreshold: c.Quality.FlapThreshold,
+			FlapWindow:    c.Quality.FlapWindow.Duration,
+			Throttle:      c.Quality.FlapThrottle,
+		},
+		Dedup: service.DedupConfig{
+			TTL:         c.Dedup.TTL.Duration,
+			MaxEntries:  c.Dedup.MaxEntries,
+			PayloadHash: c.Dedup.PayloadHash,
+			Shared:      c.Dedup.Shared,
+		},
+		RateLimit: service.RateLimitConfig{
+			Messages: c.RateLimit.Messages,
+			Interval: c.RateLimit.Interval.Duration,
+			Burst:    c.RateLimit.Burst,
+		},
+		Hooks: service.HookConfig{
+			Hooks:  c.Exhook.Hooks,
+			Topics: c.Exhook.Topics,
+		},
+		DeviceHTTP: service.DeviceHTTPConfig{
+			PollTimeout:        c.DeviceHTTP.PollTimeout.Duration,
+			IdleTimeout:        c.DeviceHTTP.IdleTimeout.Duration,
+			MaxBodySize:        int64(c.DeviceHTTP.MaxBodyKB) << 10,
+			MaxPendingCommands: c.DeviceHTTP.MaxPendingCommands,
+			CommandTTL:         c.DeviceHTTP.CommandTTL.Duration,
+			TokenCacheTTL:      c.DeviceHTTP.TokenCacheTTL.Duration,
+		},
+		CoAP: service.CoAPConfig{
+			Addr:           c.CoAP.Addr,
+			DTLSAddr:       c.CoAP.DTLSAddr,
+			PSKSecret:      c.CoAP.PSKSecret,
+			IdleTimeout:    c.CoAP.IdleTimeout.Duration,
+			MaxMessageSize: c.CoAP.MaxMessageBytes,
+			TokenCacheTTL:  c.CoAP.TokenCacheTTL.Duration,
+		},
+		LwM2M: service.LwM2MConfig{
+			Enabled:           c.LwM2M.Enabled,
+			DownlinkTopic:     c.LwM2M.DownlinkTopic,
+			ObserveOnRegister: c.LwM2M.ObserveOnRegister,
+			RequestTTL:        c.LwM2M.RequestTTL.Duration,
+			Objects:           lwm2mObjects(c.LwM2M.Objects),
+		},
+		Sparkplug: service.SparkplugConfig{
+			Enabled:  c.Sparkplug.Enabled,
+			DeviceID: c.Sparkplug.DeviceID,
+		},
+		LoRaWAN: service.LoRaWANConfig{
+			WebhookToken:  c.LoRaWAN.WebhookToken,
+			TokenTag:      c.LoRaWAN.TokenTag,
+			Codec:         c.LoRaWAN.Codec,
+			FPort:         uint8(c.LoRaWAN.FPort),
+			IdleTimeout:   c.LoRaWAN.IdleTimeout.Duration,
+			TokenCacheTTL: c.LoRaWAN.TokenCacheTTL.Duration,
+			ChirpStack:    lorawanNetwork(c.LoRaWAN.ChirpStack),
+			TTS:           lorawanNetwork(c.LoRaWAN.TTS),
+		},
+		Live: service.LiveConfig{
+			Buffer:         c.Live.Buffer,
+			MaxConnections: c.Live.MaxConnections,
+			Heartbeat:      c.Live.Heartbeat.Duration,
+		},
+		Provision: provisionConfig(c.Provision),
+	}
+}
+
+// provisionConfig returns no products if provisioning is disabled, which
+// disables it in the hook service.
+func provisionConfig(c config.Provision) service.ProvisionConfig {
+	conf := service.ProvisionConfig{AuditSize: c.AuditSize}
+	if !c.Enabled {
+		return conf
+	}
+	for _, p := range c.Products {
+		conf.Products = append(conf.Products, service.ProvisionProduct{
+			Key:            p.Key,
+			Secret:         p.Secret,
+			Owner:          p.Owner,
+			TenantID:       p.TenantID,
+			TemplateID:     p.TemplateID,
+			DeviceIDPrefix: p.DeviceIDPrefix,
+			MaxDevices:     p.MaxDevices,
+			Serials:        p.Serials,
+		})
+	}
+	return conf
+}
+
+// validateConfig checks the settings interpreted by the domain packages,
+// see config.Flags.Validate.
+func validateConfig(c *config.Config) error {
+	var errs []string
+	if c.LwM2M.Enabled {
+		for _, o := range lwm2mObjects(c.LwM2M.Objects) {
+			if err := o.Validate(); err != nil {
+				errs = append(errs, "lwm2m.objects: "+err.Error())
+			}
+		}
+	}
+	if c.LoRaWAN.Enabled {
+		if _, err := lorawan.NewCodec(c.LoRaWAN.Codec); err != nil {
+			errs = append(errs, "lorawan.codec: "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func lwm2mObjects(objects []config.LwM2MObject) []lwm2m.Object {
+	out := make([]lwm2m.Object, 0, len(objects))
+	for _, o := range objects {
+		obj := lwm2m.Object{ID: o.ID, Name: o.Name, Multiple: o.Multiple}
+		for _, r := range o.Resources {
+			obj.Resources = append(obj.Resources, lwm2m.Resource{
+				ID:         r.ID,
+				Name:       r.Name,
+				Type:       r.Type,
+				Operations: r.Operations,
+				Multiple:   r.Multiple,
+				Telemetry:  r.Telemetry,
+			})
+		}
+		out = append(out, obj)
+	}
+	return out
+}
+
+func lorawanNetwork(n config.LoRaWANNetwork) lorawan.NetworkConfig {
+	return lorawan.NetworkConfig{APIURL: n.APIURL, APIKey: n.APIKey, WebhookID: n.WebhookID}
+}
+
+func archiveConfig(c *config.Config) archive.Config {
+	return archive.Config{
+		Type:           c.Archive.Type,
+		Dir:            c.Archive.Dir,
+		MaxFileSize:    int64(c.Archive.MaxFileSizeMB) << 20,
+		RotateInterval: c.Archive.RotateInterval.Duration,
+		Retention:      c.Archive.Retention.Duration,
+		Brokers:        c.Kafka.Brokers,
+		Version:        c.Kafka.Version,
+		Topic:          c.Archive.Topic,
+	}
+}
@@ -9,12 +9,18 @@ import (
 	"syscall"
 
 	dapr "github.com/dapr/go-sdk/client"
+	"github.com/tkeel-io/iothub/pkg/archive"
+	"github.com/tkeel-io/iothub/pkg/config"
+	"github.com/tkeel-io/iothub/pkg/metrics"
 	"github.com/tkeel-io/iothub/pkg/server"
 	"github.com/tkeel-io/iothub/pkg/service"
+	"github.com/tkeel-io/iothub/pkg/store"
+	"github.com/tkeel-io/iothub/pkg/tracing"
 	pb "github.com/tkeel-io/iothub/protobuf"
 	"github.com/tkeel-io/kit/app"
 	"github.com/tkeel-io/kit/log"
 	"github.com/tkeel-io/kit/transport"
+	"google.golang.org/grpc"
 
 	openapi "github.com/tkeel-io/iothub/api/openapi/v1"
 )
@@ -22,32 +28,51 @@ import (
 var (
 	// Name app.
 	Name string
-	// HTTPAddr string.
-	HTTPAddr string
-	// GRPCAddr string.
-	GRPCAddr string
-	//
+	// Flags overrides the config file.
+	Flags *config.Flags
 )
 
 func init() {
 	flag.StringVar(&Name, "name", "iothub", "app name.")
-	flag.StringVar(&HTTPAddr, "http_addr", ":8080", "http listen address.")
-	flag.StringVar(&GRPCAddr, "grpc_addr", ":9000", "grpc listen address.")
+	Flags = config.RegisterFlags(flag.CommandLine)
+	Flags.Validate = validateConfig
 }
 
 func main() {
 	flag.Parse()
-	httpSrv := server.NewHTTPServer(HTTPAddr)
-	grpcSrv := server.NewGRPCServer(GRPCAddr)
+	conf, err := Flags.Load()
+	if err != nil {
+		panic(err)
+	}
+	shutdownTracing, err := tracing.Init(context.Background(), Name, conf.Tracing.Exporter)
+	if err != nil {
+		panic(err)
+	}
+
+	// background jobs run until shutdown
+	bgCtx, bgCancel := context.WithCancel(context.Background())
+	defer bgCancel()
+
+	drainer := server.NewDrainer(service.DrainedHooks...)
+	httpSrv := server.NewHTTPServer(conf.Server.HTTPAddr)
+	grpcSrv := server.NewGRPCServer(conf.Server.GRPCAddr, grpc.ChainUnaryInterceptor(
+		drainer.UnaryServerInterceptor(),
+		tracing.UnaryServerInterceptor(),
+		metrics.UnaryServerInterceptor(),
+	))
 	serverList := []transport.Server{httpSrv, grpcSrv}
 
-	app := app.New(Name,
-		&log.Conf{
-			App:   Name,
-			Level: "debug",
-			Dev:   true,
-		},
-		serverList...,
+	app := app.New(Name, logConf(conf), serverList...)
+	watcher := config.NewWatcher(Flags, conf)
+	var (
+		HookServiceSrv *service.HookService
+		TopicSrv       *service.TopicService
+		DeviceSrv      *service.DeviceService
+		CoAPSrv        *service.CoAPService
+		LoRaWANSrv     *service.LoRaWANService
+		LiveSrv        *service.LiveService
+		ProvisionSrv   *service.ProvisionService
+		uplinkArchive  archive.Writer
 	)
 	{ // User service
 		OpenapiSrv := service.NewOpenapiService()
@@ -59,21 +84,93 @@ func main() {
 			panic(err)
 		}
 
+		stateStore, err := store.New(conf.Dapr.StateStore.Type, client, conf.Dapr.StateStore.Name)
+		if nil != err {
+			log.Fatal(err)
+		}
+
+		// ordered outbound channel to core
+		forwarder, err := service.NewForwarder(forwarderConfig(conf))
+		if nil != err {
+			log.Fatal(err)
+		}
+		// uplink events kept for replay
+		uplinkArchive, err = archive.NewWriter(archiveConfig(conf))
+		if nil != err {
+			log.Fatal(err)
+		}
+		forwarder.SetArchive(uplinkArchive)
+
 		// topic service
-		HookServiceSrv := service.NewHookService(client)
+		presence := service.NewPresenceTracker(presenceConfig(conf))
+		go presence.Run(bgCtx)
+		HookServiceSrv = service.NewHookService(client, stateStore, forwarder, presence, hookConfig(conf))
+		go HookServiceSrv.Run(bgCtx)
 		pb.RegisterHookProviderServer(grpcSrv.GetServe(), HookServiceSrv)
 
-		TopicSrv, err := service.NewTopicService(context.Background(), HookServiceSrv)
+		TopicSrv, err = service.NewTopicService(bgCtx, HookServiceSrv)
 		if nil != err {
 			log.Fatal(err)
 		}
 		Iothub_v1.RegisterTopicHTTPServer(httpSrv.Container, TopicSrv)
 		Iothub_v1.RegisterTopicServer(grpcSrv.GetServe(), TopicSrv)
 
+		// device http api, for devices without MQTT.
+		if conf.DeviceHTTP.Enabled {
+			DeviceSrv = service.NewDeviceService(bgCtx, HookServiceSrv)
+			go DeviceSrv.Run(bgCtx)
+			Iothub_v1.RegisterDeviceHTTPServer(httpSrv.Container, DeviceSrv)
+		}
+		// coap server, for devices not limited by the EMQX CoAP gateway.
+		if conf.CoAP.Enabled {
+			CoAPSrv = service.NewCoAPService(bgCtx, HookServiceSrv)
+			if err := CoAPSrv.Start(); err != nil {
+				log.Fatal(err)
+			}
+			go CoAPSrv.Run(bgCtx)
+		}
+
+		// network server webhooks of LoRaWAN devices.
+		if conf.LoRaWAN.Enabled {
+			LoRaWANSrv = service.NewLoRaWANService(bgCtx, HookServiceSrv)
+			go LoRaWANSrv.Run(bgCtx)
+			Iothub_v1.RegisterLoRaWANHTTPServer(httpSrv.Container, LoRaWANSrv)
+		}
+		// live device data of dashboards.
+		if conf.Live.Enabled {
+			LiveSrv = service.NewLiveService(bgCtx, HookServiceSrv)
+			Iothub_v1.RegisterLiveHTTPServer(httpSrv.Container, LiveSrv)
+		}
+		// provisioning of devices over http, MQTT goes through the hooks.
+		if conf.Provision.Enabled {
+			ProvisionSrv = service.NewProvisionService(bgCtx, HookServiceSrv)
+			Iothub_v1.RegisterProvisionHTTPServer(httpSrv.Container, ProvisionSrv)
+		}
+
 		//
-        // metrics service.
-        metricsSrv := service.NewMetricsService()
-        Iothub_v1.RegisterMetricsHTTPServer(httpSrv.Container, metricsSrv)
+		// metrics service.
+		metricsSrv := service.NewMetricsService()
+		Iothub_v1.RegisterMetricsHTTPServer(httpSrv.Container, metricsSrv)
+
+		// presence service.
+		presenceSrv := service.NewPresenceService(presence, HookServiceSrv.Quality())
+		Iothub_v1.RegisterPresenceHTTPServer(httpSrv.Container, presenceSrv)
+
+		// device registry service.
+		registrySrv := service.NewRegistryService(HookServiceSrv)
+		Iothub_v1.RegisterRegistryHTTPServer(httpSrv.Container, registrySrv)
+
+		// settings safe to change without restart.
+		watcher.OnReload(func(c *config.Config) {
+			if err := log.InitLoggerByConf(logConf(c)); err != nil {
+				log.Errorf("reload logger err, %v", err)
+			}
+			if err := forwarder.SetMode(c.Kafka.CloudEventMode); err != nil {
+				log.Errorf("reload cloudevent mode err, %v", err)
+			}
+			HookServiceSrv.Reload(hookConfig(c))
+		})
+		go watcher.Run(bgCtx)
 	}
 
 	if err := app.Run(context.TODO()); err != nil {
@@ -84,7 +181,45 @@ func main() {
 	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
 	<-stop
 
-	if err := app.Stop(context.TODO()); err != nil {
-		panic(err)
+	// stop accepting connections, core events and device requests, wait for
+	// the in-flight hooks, serve the other hooks, e.g. message.publish, until
+	// the servers stop, then flush the events to core.
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Server.ShutdownTimeout.Duration)
+	defer cancel()
+	log.Infof("shutting down, timeout %s", conf.Server.ShutdownTimeout)
+	TopicSrv.Close()
+	if DeviceSrv != nil {
+		DeviceSrv.Close()
+	}
+	if CoAPSrv != nil {
+		CoAPSrv.Close()
+	}
+	if LoRaWANSrv != nil {
+		LoRaWANSrv.Close()
+	}
+	if LiveSrv != nil {
+		LiveSrv.Close()
+	}
+	if ProvisionSrv != nil {
+		ProvisionSrv.Close()
+	}
+	if err := drainer.Drain(ctx); err != nil {
+		log.Errorf("drain hook calls err, %v", err)
+	}
+	stopErr := app.Stop(ctx)
+	if err := HookServiceSrv.Close(ctx); err != nil {
+		log.Errorf("close hook service err, %v", err)
+	}
+	if uplinkArchive != nil {
+		if err := uplinkArchive.Close(); err != nil {
+			log.Errorf("close archive err, %v", err)
+		}
+	}
+	if stopErr != nil {
+		panic(stopErr)
+	}
+	bgCancel()
+	if err := shutdownTracing(ctx); err != nil {
+		log.Error(err)
 	}
 }
@@ -0,0 +1,138 @@
+// Package archive keeps the uplink events iothub sends to core, in rotating
+// local files or a kafka topic, so that a time range can be replayed when
+// core failed to process it.
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	TypeNone  = "none"
+	TypeFile  = "file"
+	TypeKafka = "kafka"
+)
+
+// clockSkew is the tolerance between the time of an event, given by EMQX,
+// and the time it is archived at, used to skip files and offsets.
+const clockSkew = 5 * time.Minute
+
+// Record is an uplink event sent to core.
+type Record struct {
+	// Time is the time of the event.
+	Time     time.Time `json:"time"`
+	DeviceID string    `json:"device_id"`
+	TenantID string    `json:"tenant_id,omitempty"`
+	// Type is the cloudevent type, e.g. io.tkeel.iothub.telemetry.
+	Type string `json:"type"`
+	// Event is the structured cloudevent json.
+	Event json.RawMessage `json:"event"`
+}
+
+// Filter selects the records to read, zero fields match everything.
+type Filter struct {
+	// From is inclusive and To exclusive.
+	From     time.Time
+	To       time.Time
+	DeviceID string
+	TenantID string
+	Types    []string
+}
+
+// Match reports whether rec is selected by f.
+func (f Filter) Match(rec *Record) bool {
+	if !f.From.IsZero() && rec.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !rec.Time.Before(f.To) {
+		return false
+	}
+	if f.DeviceID != "" && rec.DeviceID != f.DeviceID {
+		return false
+	}
+	if f.TenantID != "" && rec.TenantID != f.TenantID {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if rec.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Writer archives records.
+type Writer interface {
+	Write(ctx context.Context, rec *Record) error
+	Close() error
+}
+
+// Reader reads archived records.
+type Reader interface {
+	// Read calls fn with the records matching filter, the records of one
+	// device in the order they were archived. It stops at the first error
+	// of fn.
+	Read(ctx context.Context, filter Filter, fn func(*Record) error) error
+	Close() error
+}
+
+// Config selects and configures the archive.
+type Config struct {
+	// Type is none, file or kafka.
+	Type string
+	// Dir keeps the files of type file.
+	Dir string
+	// MaxFileSize rotates a file above this many bytes.
+	MaxFileSize int64
+	// RotateInterval rotates a file older than this.
+	RotateInterval time.Duration
+	// Retention removes the files not written for this long, 0 keeps them.
+	Retention time.Duration
+	// Brokers, Version and Topic of type kafka.
+	Brokers []string
+	Version string
+	Topic   string
+}
+
+// NewWriter returns the writer of conf, nil for type none.
+func NewWriter(conf Config) (Writer, error) {
+	switch conf.Type {
+	case TypeNone, "":
+		return nil, nil
+	case TypeFile:
+		w, err := NewFileWriter(conf.Dir, conf.MaxFileSize, conf.RotateInterval, conf.Retention)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	case TypeKafka:
+		w, err := NewKafkaWriter(conf.Brokers, conf.Version, conf.Topic)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	return nil, errors.Errorf("unknown archive type %s", conf.Type)
+}
+
+// NewReader returns the reader of conf.
+func NewReader(conf Config) (Reader, error) {
+	switch conf.Type {
+	case TypeFile:
+		return NewFileReader(conf.Dir), nil
+	case TypeKafka:
+		r, err := NewKafkaReader(conf.Brokers, conf.Version, conf.Topic)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	return nil, errors.Errorf("no archive to read of type %q", conf.Type)
+}
@@ -0,0 +1,206 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama/mocks"
+)
+
+// events are archived about when they happen
+var t0 = time.Now().UTC().Truncate(time.Second)
+
+func record(dev, tenant, typ string, at time.Duration) *Record {
+	return &Record{
+		Time:     t0.Add(at),
+		DeviceID: dev,
+		TenantID: tenant,
+		Type:     typ,
+		Event:    json.RawMessage(`{"subject":"` + dev + `"}`),
+	}
+}
+
+func readAll(t *testing.T, r Reader, f Filter) string {
+	t.Helper()
+	var got []string
+	err := r.Read(context.Background(), f, func(rec *Record) error {
+		got = append(got, rec.DeviceID+"@"+rec.Time.Sub(t0).String())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(got, " ")
+}
+
+func TestFilter_Match(t *testing.T) {
+	rec := record("dev1", "t1", "io.tkeel.iothub.telemetry", time.Minute)
+	tests := []struct {
+		filter Filter
+		want   bool
+	}{
+		{Filter{}, true},
+		{Filter{From: t0, To: t0.Add(time.Hour)}, true},
+		{Filter{From: t0.Add(time.Minute)}, true},
+		{Filter{To: t0.Add(time.Minute)}, false},
+		{Filter{DeviceID: "dev2"}, false},
+		{Filter{TenantID: "t1", DeviceID: "dev1"}, true},
+		{Filter{TenantID: "t2"}, false},
+		{Filter{Types: []string{"io.tkeel.iothub.attributes", "io.tkeel.iothub.telemetry"}}, true},
+		{Filter{Types: []string{"io.tkeel.iothub.attributes"}}, false},
+	}
+	for i, tt := range tests {
+		if got := tt.filter.Match(rec); got != tt.want {
+			t.Errorf("%d: match %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	// a file per two records
+	w, err := NewFileWriter(dir, 200, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	records := []*Record{
+		record("dev1", "t1", "io.tkeel.iothub.telemetry", 0),
+		record("dev2", "t2", "io.tkeel.iothub.telemetry", time.Minute),
+		record("dev1", "t1", "io.tkeel.iothub.attributes", 2*time.Minute),
+		record("dev1", "t1", "io.tkeel.iothub.telemetry", 3*time.Minute),
+		record("dev2", "t2", "io.tkeel.iothub.telemetry", 4*time.Minute),
+	}
+	for _, rec := range records {
+		if err := w.Write(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+		// distinct file names
+		time.Sleep(time.Millisecond)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(ctx, records[0]); err == nil {
+		t.Fatal("write after close")
+	}
+	files, err := archiveFiles(dir)
+	if err != nil || len(files) != 3 {
+		t.Fatalf("files %v, %v", files, err)
+	}
+	// a crash in the middle of a record
+	f, err := os.OpenFile(filepath.Join(dir, files[2].name), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2022-03-01T10:0`) //nolint
+	f.Close()
+
+	r := NewFileReader(dir)
+	if got := readAll(t, r, Filter{}); got != "dev1@0s dev2@1m0s dev1@2m0s dev1@3m0s dev2@4m0s" {
+		t.Fatalf("all %s", got)
+	}
+	if got := readAll(t, r, Filter{From: t0.Add(time.Minute), To: t0.Add(4 * time.Minute), TenantID: "t1"}); got != "dev1@2m0s dev1@3m0s" {
+		t.Fatalf("range of t1 %s", got)
+	}
+	if got := readAll(t, r, Filter{DeviceID: "dev2", Types: []string{"io.tkeel.iothub.telemetry"}}); got != "dev2@1m0s dev2@4m0s" {
+		t.Fatalf("dev2 %s", got)
+	}
+	stop := context.Canceled
+	n := 0
+	err = r.Read(ctx, Filter{}, func(*Record) error {
+		if n++; n == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 2 {
+		t.Fatalf("read not stopped, %v after %d", err, n)
+	}
+}
+
+func TestFileReader_SkipFiles(t *testing.T) {
+	dir := t.TempDir()
+	// files opened two hours apart holding a record of their open time
+	for _, at := range []time.Duration{0, 2 * time.Hour} {
+		line, _ := json.Marshal(record("dev1", "t1", "io.tkeel.iothub.telemetry", at))
+		name := filepath.Join(dir, filePrefix+t0.Add(at).Format(fileTimeLayout)+fileSuffix)
+		if err := os.WriteFile(name, append(line, '\n'), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an unreadable file is never opened when out of range
+	if err := os.Mkdir(filepath.Join(dir, filePrefix+t0.Add(3*time.Hour).Format(fileTimeLayout)+fileSuffix), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	r := NewFileReader(dir)
+	if got := readAll(t, r, Filter{From: t0.Add(2 * time.Hour), To: t0.Add(150 * time.Minute)}); got != "dev1@2h0m0s" {
+		t.Fatalf("range %s", got)
+	}
+}
+
+func TestFileWriter_Retention(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, filePrefix+t0.Format(fileTimeLayout)+fileSuffix)
+	recent := filepath.Join(dir, filePrefix+t0.Add(time.Hour).Format(fileTimeLayout)+fileSuffix)
+	for _, name := range []string{old, recent} {
+		if err := os.WriteFile(name, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(old, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewFileWriter(dir, 0, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// removed when the writer starts
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatal("expired file kept")
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKafkaWriter(t *testing.T) {
+	p := mocks.NewAsyncProducer(t, nil)
+	p.ExpectInputWithCheckerFunctionAndSucceed(func(val []byte) error {
+		rec := &Record{}
+		if err := json.Unmarshal(val, rec); err != nil || rec.DeviceID != "dev1" {
+			t.Errorf("unexpected record %s, %v", val, err)
+		}
+		return nil
+	})
+	w := newKafkaWriterWithProducer(p, "iothub-archive")
+	if err := w.Write(context.Background(), record("dev1", "t1", "io.tkeel.iothub.telemetry", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	if w, err := NewWriter(Config{Type: TypeNone}); w != nil || err != nil {
+		t.Fatal("writer of type none")
+	}
+	if _, err := NewWriter(Config{Type: "s3"}); err == nil {
+		t.Fatal("unknown type accepted")
+	}
+	if _, err := NewWriter(Config{Type: TypeKafka, Version: "0.10.0.0"}); err == nil {
+		t.Fatal("kafka without timestamps accepted")
+	}
+	if _, err := NewReader(Config{Type: TypeNone}); err == nil {
+		t.Fatal("reader of type none")
+	}
+}
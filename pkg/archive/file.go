@@ -0,0 +1,273 @@
+package archive
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tkeel-io/kit/log"
+)
+
+const (
+	filePrefix = "uplink-"
+	fileSuffix = ".jsonl"
+	// the file name holds the time the file is opened at
+	fileTimeLayout = "20060102T150405.000000000Z"
+	// buffered records are written out at least this often
+	fileFlushInterval = time.Second
+	// removal interval of the files past retention
+	retentionInterval = time.Minute
+	// records above are skipped by the reader
+	maxRecordSize = 16 << 20
+)
+
+// FileWriter writes one json record per line, it starts a new file when the
+// current one is too large or too old.
+type FileWriter struct {
+	dir            string
+	maxSize        int64
+	rotateInterval time.Duration
+	retention      time.Duration
+
+	lock   sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	size   int64
+	opened time.Time
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func NewFileWriter(dir string, maxSize int64, rotateInterval, retention time.Duration) (*FileWriter, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, errors.Wrap(err, "create archive dir")
+	}
+	w := &FileWriter{
+		dir:            dir,
+		maxSize:        maxSize,
+		rotateInterval: rotateInterval,
+		retention:      retention,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *FileWriter) run() {
+	defer close(w.done)
+	flush := time.NewTicker(fileFlushInterval)
+	defer flush.Stop()
+	sweep := time.NewTicker(retentionInterval)
+	defer sweep.Stop()
+	w.removeExpired()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-flush.C:
+			w.lock.Lock()
+			if w.w != nil {
+				if err := w.w.Flush(); err != nil {
+					log.Errorf("flush archive %s err, %v", w.file.Name(), err)
+				}
+			}
+			w.lock.Unlock()
+		case <-sweep.C:
+			w.removeExpired()
+		}
+	}
+}
+
+func (w *FileWriter) Write(ctx context.Context, rec *Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "marshal archive record")
+	}
+	line = append(line, '\n')
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return errors.New("archive closed")
+	}
+	now := time.Now()
+	if w.file == nil || (w.maxSize > 0 && w.size >= w.maxSize) || (w.rotateInterval > 0 && now.Sub(w.opened) >= w.rotateInterval) {
+		if err := w.rotate(now); err != nil {
+			return err
+		}
+	}
+	n, err := w.w.Write(line)
+	w.size += int64(n)
+	return errors.Wrap(err, "write archive")
+}
+
+func (w *FileWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.w.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file, w.w = nil, nil
+	return errors.Wrap(err, "close archive file")
+}
+
+func (w *FileWriter) rotate(now time.Time) error {
+	if err := w.closeFile(); err != nil {
+		log.Errorf("rotate archive err, %v", err)
+	}
+	name := filepath.Join(w.dir, filePrefix+now.UTC().Format(fileTimeLayout)+fileSuffix)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return errors.Wrap(err, "open archive file")
+	}
+	w.file, w.w, w.size, w.opened = f, bufio.NewWriter(f), 0, now
+	return nil
+}
+
+// removeExpired removes the files not written within retention.
+func (w *FileWriter) removeExpired() {
+	if w.retention <= 0 {
+		return
+	}
+	files, err := archiveFiles(w.dir)
+	if err != nil {
+		log.Errorf("list archive err, %v", err)
+		return
+	}
+	w.lock.Lock()
+	current := ""
+	if w.file != nil {
+		current = w.file.Name()
+	}
+	w.lock.Unlock()
+	for _, f := range files {
+		path := filepath.Join(w.dir, f.name)
+		if path == current {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < w.retention {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Errorf("remove archive %s err, %v", path, err)
+		}
+	}
+}
+
+// Close flushes and closes the current file.
+func (w *FileWriter) Close() error {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return nil
+	}
+	w.closed = true
+	err := w.closeFile()
+	w.lock.Unlock()
+	close(w.stop)
+	<-w.done
+	return err
+}
+
+type archiveFile struct {
+	name   string
+	opened time.Time
+}
+
+// archiveFiles returns the archive files of dir by time opened.
+func archiveFiles(dir string) ([]archiveFile, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []archiveFile
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		t, err := time.Parse(fileTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileSuffix))
+		if err != nil {
+			continue
+		}
+		files = append(files, archiveFile{name: name, opened: t})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].opened.Before(files[j].opened) })
+	return files, nil
+}
+
+// FileReader reads the files of a FileWriter.
+type FileReader struct {
+	dir string
+}
+
+func NewFileReader(dir string) *FileReader {
+	return &FileReader{dir: dir}
+}
+
+// Read reads the files in the order they were written. A file holds the
+// records archived from its open time to the open time of the next one,
+// files out of the range of filter are skipped.
+func (r *FileReader) Read(ctx context.Context, filter Filter, fn func(*Record) error) error {
+	files, err := archiveFiles(r.dir)
+	if err != nil {
+		return errors.Wrap(err, "list archive")
+	}
+	for i, f := range files {
+		if !filter.To.IsZero() && f.opened.After(filter.To.Add(clockSkew)) {
+			break
+		}
+		if !filter.From.IsZero() && i+1 < len(files) && files[i+1].opened.Before(filter.From.Add(-clockSkew)) {
+			continue
+		}
+		if err := r.readFile(ctx, filepath.Join(r.dir, f.name), filter, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *FileReader) readFile(ctx context.Context, path string, filter Filter, fn func(*Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "open archive file")
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), maxRecordSize)
+	for n := 1; scanner.Scan(); n++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rec := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			// e.g. the last line of a file being written when iothub crashed
+			log.Warnf("skip invalid archive record %s:%d, %v", path, n, err)
+			continue
+		}
+		if !filter.Match(rec) {
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return errors.Wrapf(scanner.Err(), "read %s", path)
+}
+
+func (r *FileReader) Close() error {
+	return nil
+}
@@ -0,0 +1,175 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/tkeel-io/kit/log"
+)
+
+func newKafkaConfig(version string) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	v, err := sarama.ParseKafkaVersion(version)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse kafka version")
+	}
+	// message timestamps locate the offsets of a time range
+	if !v.IsAtLeast(sarama.V0_10_1_0) {
+		return nil, errors.New("kafka archive requires kafka version >= 0.10.1.0")
+	}
+	config.Version = v
+	return config, nil
+}
+
+// KafkaWriter produces records to a topic keyed by device id, the records
+// of a device are kept in order in one partition.
+type KafkaWriter struct {
+	producer sarama.AsyncProducer
+	topic    string
+	done     chan struct{}
+}
+
+func NewKafkaWriter(brokers []string, version, topic string) (*KafkaWriter, error) {
+	config, err := newKafkaConfig(version)
+	if err != nil {
+		return nil, err
+	}
+	config.Producer.Return.Errors = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Retry.Max = 5
+	config.Net.MaxOpenRequests = 1
+	p, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "new kafka archive producer")
+	}
+	return newKafkaWriterWithProducer(p, topic), nil
+}
+
+func newKafkaWriterWithProducer(p sarama.AsyncProducer, topic string) *KafkaWriter {
+	w := &KafkaWriter{producer: p, topic: topic, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		for rc := range p.Errors() {
+			log.Errorf("archive to %s key %v err, %v", rc.Msg.Topic, rc.Msg.Key, rc.Err)
+		}
+	}()
+	return w
+}
+
+func (w *KafkaWriter) Write(ctx context.Context, rec *Record) error {
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "marshal archive record")
+	}
+	w.producer.Input() <- &sarama.ProducerMessage{
+		Topic:     w.topic,
+		Key:       sarama.StringEncoder(rec.DeviceID),
+		Value:     sarama.ByteEncoder(value),
+		Timestamp: rec.Time,
+	}
+	return nil
+}
+
+// Close flushes the records buffered and closes the producer.
+func (w *KafkaWriter) Close() error {
+	w.producer.AsyncClose()
+	<-w.done
+	return nil
+}
+
+// KafkaReader reads the records of the topic partition by partition, from
+// the offset of the start of the range to the end of the partition when the
+// read started.
+type KafkaReader struct {
+	client   sarama.Client
+	consumer sarama.Consumer
+	topic    string
+}
+
+func NewKafkaReader(brokers []string, version, topic string) (*KafkaReader, error) {
+	config, err := newKafkaConfig(version)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "new kafka client")
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, errors.Wrap(err, "new kafka consumer")
+	}
+	return &KafkaReader{client: client, consumer: consumer, topic: topic}, nil
+}
+
+func (r *KafkaReader) Read(ctx context.Context, filter Filter, fn func(*Record) error) error {
+	partitions, err := r.client.Partitions(r.topic)
+	if err != nil {
+		return errors.Wrapf(err, "partitions of %s", r.topic)
+	}
+	for _, p := range partitions {
+		if err := r.readPartition(ctx, p, filter, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *KafkaReader) readPartition(ctx context.Context, partition int32, filter Filter, fn func(*Record) error) error {
+	start := sarama.OffsetOldest
+	if !filter.From.IsZero() {
+		start = filter.From.Add(-clockSkew).UnixNano() / 1e6
+	}
+	offset, err := r.client.GetOffset(r.topic, partition, start)
+	if err != nil {
+		return errors.Wrapf(err, "offset of partition %d", partition)
+	}
+	end, err := r.client.GetOffset(r.topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return errors.Wrapf(err, "newest offset of partition %d", partition)
+	}
+	// -1, no message after from
+	if offset < 0 || offset >= end {
+		return nil
+	}
+	pc, err := r.consumer.ConsumePartition(r.topic, partition, offset)
+	if err != nil {
+		return errors.Wrapf(err, "consume partition %d", partition)
+	}
+	defer pc.Close()
+	for {
+		var msg *sarama.ConsumerMessage
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case cerr := <-pc.Errors():
+			return errors.Wrapf(cerr, "consume partition %d", partition)
+		case msg = <-pc.Messages():
+		}
+		if !filter.To.IsZero() && msg.Timestamp.After(filter.To.Add(clockSkew)) {
+			return nil
+		}
+		rec := &Record{}
+		if err := json.Unmarshal(msg.Value, rec); err != nil {
+			log.Warnf("skip invalid archive record %d/%d, %v", partition, msg.Offset, err)
+		} else if filter.Match(rec) {
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		if msg.Offset+1 >= end {
+			return nil
+		}
+	}
+}
+
+func (r *KafkaReader) Close() error {
+	err := r.consumer.Close()
+	if cerr := r.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package coap
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/transport/v2/udp"
+	"github.com/tkeel-io/kit/log"
+)
+
+const defaultHandshakeTimeout = 10 * time.Second
+
+// DTLSConfig configures a DTLS-PSK listener.
+type DTLSConfig struct {
+	// PSK returns the pre-shared key of a client identity, an error rejects
+	// the handshake.
+	PSK func(identity []byte) ([]byte, error)
+	// HandshakeTimeout bounds the handshake of a client.
+	HandshakeTimeout time.Duration
+}
+
+// dtlsListener runs the handshakes of the clients concurrently, a slow or
+// silent client does not hold up the others.
+type dtlsListener struct {
+	inner  net.Listener
+	conf   *dtls.Config
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+	err    error
+	errSet chan struct{}
+}
+
+// ListenDTLS listens on the UDP address addr for DTLS-PSK clients with the
+// PSK cipher suites of RFC 7925, the profile for constrained devices.
+// Connections are accepted once the handshake completes.
+func ListenDTLS(addr string, conf DTLSConfig) (net.Listener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	inner, err := (&udp.ListenConfig{}).Listen("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	timeout := conf.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	l := &dtlsListener{
+		inner: inner,
+		conf: &dtls.Config{
+			PSK:             conf.PSK,
+			PSKIdentityHint: []byte("iothub"),
+			CipherSuites: []dtls.CipherSuiteID{
+				dtls.TLS_PSK_WITH_AES_128_CCM_8,
+				dtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+				dtls.TLS_PSK_WITH_AES_128_CBC_SHA256,
+			},
+			ExtendedMasterSecret: dtls.RequestExtendedMasterSecret,
+			ConnectContextMaker: func() (context.Context, func()) {
+				return context.WithTimeout(context.Background(), timeout)
+			},
+		},
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+		errSet: make(chan struct{}),
+	}
+	go l.accept()
+	return l, nil
+}
+
+func (l *dtlsListener) accept() {
+	for {
+		conn, err := l.inner.Accept()
+		if err != nil {
+			l.err = err
+			close(l.errSet)
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *dtlsListener) handshake(conn net.Conn) {
+	dc, err := dtls.Server(conn, l.conf)
+	if err != nil {
+		log.Debugf("dtls handshake of %s err, %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- dc:
+	case <-l.done:
+		dc.Close()
+	}
+}
+
+func (l *dtlsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.errSet:
+		return nil, l.err
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+func (l *dtlsListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.inner.Close()
+	})
+	return err
+}
+
+func (l *dtlsListener) Addr() net.Addr {
+	return l.inner.Addr()
+}
+
+// pskIdentity is the PSK identity of a DTLS client, empty for other conns.
+func pskIdentity(conn net.Conn) string {
+	if dc, ok := conn.(*dtls.Conn); ok {
+		return string(dc.ConnectionState().IdentityHint)
+	}
+	return ""
+}
@@ -0,0 +1,400 @@
+// Package coap is a minimal CoAP (RFC 7252) server with Observe (RFC 7641)
+// over UDP and DTLS-PSK, enough to serve iothub devices without the EMQX
+// CoAP gateway. Block-wise transfer and proxying are not supported.
+package coap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Type is the message type.
+type Type uint8
+
+const (
+	Confirmable Type = iota
+	NonConfirmable
+	Acknowledgement
+	Reset
+)
+
+func (t Type) String() string {
+	switch t {
+	case Confirmable:
+		return "CON"
+	case NonConfirmable:
+		return "NON"
+	case Acknowledgement:
+		return "ACK"
+	case Reset:
+		return "RST"
+	}
+	return fmt.Sprintf("Type(%d)", uint8(t))
+}
+
+// Code is the request method or the response code, class.detail.
+type Code uint8
+
+func code(class, detail uint8) Code {
+	return Code(class<<5 | detail)
+}
+
+const (
+	Empty  Code = 0
+	GET    Code = 1
+	POST   Code = 2
+	PUT    Code = 3
+	DELETE Code = 4
+)
+
+var (
+	Created               = code(2, 1)
+	Deleted               = code(2, 2)
+	Valid                 = code(2, 3)
+	Changed               = code(2, 4)
+	Content               = code(2, 5)
+	BadRequest            = code(4, 0)
+	Unauthorized          = code(4, 1)
+	BadOption             = code(4, 2)
+	Forbidden             = code(4, 3)
+	NotFound              = code(4, 4)
+	MethodNotAllowed      = code(4, 5)
+	RequestEntityTooLarge = code(4, 13)
+	InternalServerError   = code(5, 0)
+	ServiceUnavailable    = code(5, 3)
+)
+
+// Class is 0 for requests, 2 for success, 4 for client and 5 for server errors.
+func (c Code) Class() uint8 {
+	return uint8(c) >> 5
+}
+
+// IsRequest reports whether c is a request method.
+func (c Code) IsRequest() bool {
+	return c != Empty && c.Class() == 0
+}
+
+func (c Code) String() string {
+	switch c {
+	case Empty:
+		return "Empty"
+	case GET:
+		return "GET"
+	case POST:
+		return "POST"
+	case PUT:
+		return "PUT"
+	case DELETE:
+		return "DELETE"
+	}
+	return fmt.Sprintf("%d.%02d", c.Class(), uint8(c)&0x1f)
+}
+
+// OptionID is the number of an option.
+type OptionID uint16
+
+const (
+	IfMatch       OptionID = 1
+	URIHost       OptionID = 3
+	ETag          OptionID = 4
+	IfNoneMatch   OptionID = 5
+	Observe       OptionID = 6
+	URIPort       OptionID = 7
+	LocationPath  OptionID = 8
+	URIPath       OptionID = 11
+	ContentFormat OptionID = 12
+	MaxAge        OptionID = 14
+	URIQuery      OptionID = 15
+	Accept        OptionID = 17
+	LocationQuery OptionID = 20
+	Size1         OptionID = 60
+)
+
+// Critical options must be understood by the receiver, unknown ones are
+// rejected with BadOption.
+func (o OptionID) Critical() bool {
+	return o&1 == 1
+}
+
+// known are the options the server understands.
+func (o OptionID) known() bool {
+	switch o {
+	case IfMatch, URIHost, ETag, IfNoneMatch, Observe, URIPort, LocationPath,
+		URIPath, ContentFormat, MaxAge, URIQuery, Accept, LocationQuery, Size1:
+		return true
+	}
+	return false
+}
+
+// content formats
+const (
+	TextPlain   uint32 = 0
+	AppLinkFmt  uint32 = 40
+	AppOctets   uint32 = 42
+	AppJSON     uint32 = 50
+	AppCBOR     uint32 = 60
+	observeMask uint32 = 1<<24 - 1
+)
+
+// Observe option values of a request.
+const (
+	ObserveRegister   uint32 = 0
+	ObserveDeregister uint32 = 1
+)
+
+// Option is an option of a message, uint options are encoded big endian
+// without leading zeros.
+type Option struct {
+	ID    OptionID
+	Value []byte
+}
+
+// Message is a CoAP message.
+type Message struct {
+	Type      Type
+	Code      Code
+	MessageID uint16
+	Token     []byte
+	// Options are kept in the order of their numbers.
+	Options []Option
+	Payload []byte
+}
+
+func encodeUint(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+func decodeUint(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+// Add appends an option, keeping the options ordered.
+func (m *Message) Add(id OptionID, value []byte) {
+	i := len(m.Options)
+	for i > 0 && m.Options[i-1].ID > id {
+		i--
+	}
+	m.Options = append(m.Options, Option{})
+	copy(m.Options[i+1:], m.Options[i:])
+	m.Options[i] = Option{ID: id, Value: value}
+}
+
+// Set replaces the options id with value.
+func (m *Message) Set(id OptionID, value []byte) {
+	m.Remove(id)
+	m.Add(id, value)
+}
+
+// SetUint replaces the options id with the uint v.
+func (m *Message) SetUint(id OptionID, v uint32) {
+	m.Set(id, encodeUint(v))
+}
+
+// Remove removes the options id.
+func (m *Message) Remove(id OptionID) {
+	out := m.Options[:0]
+	for _, o := range m.Options {
+		if o.ID != id {
+			out = append(out, o)
+		}
+	}
+	m.Options = out
+}
+
+// Values returns the values of the options id.
+func (m *Message) Values(id OptionID) [][]byte {
+	var out [][]byte
+	for _, o := range m.Options {
+		if o.ID == id {
+			out = append(out, o.Value)
+		}
+	}
+	return out
+}
+
+// Uint returns the first uint option id.
+func (m *Message) Uint(id OptionID) (uint32, bool) {
+	for _, o := range m.Options {
+		if o.ID == id {
+			return decodeUint(o.Value), true
+		}
+	}
+	return 0, false
+}
+
+// Path returns the Uri-Path of m, e.g. v1/devices/me/telemetry.
+func (m *Message) Path() string {
+	segs := m.Values(URIPath)
+	parts := make([]string, len(segs))
+	for i, s := range segs {
+		parts[i] = string(s)
+	}
+	return strings.Join(parts, "/")
+}
+
+// SetPath sets the Uri-Path of m, leading and trailing slashes ignored.
+func (m *Message) SetPath(path string) {
+	m.Remove(URIPath)
+	for _, s := range strings.Split(strings.Trim(path, "/"), "/") {
+		if s != "" {
+			m.Add(URIPath, []byte(s))
+		}
+	}
+}
+
+// Query returns the value of the Uri-Query name=value of m.
+func (m *Message) Query(name string) string {
+	for _, q := range m.Values(URIQuery) {
+		if kv := strings.SplitN(string(q), "=", 2); kv[0] == name {
+			if len(kv) == 2 {
+				return kv[1]
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// unknownCritical returns an unknown critical option of m.
+func (m *Message) unknownCritical() (OptionID, bool) {
+	for _, o := range m.Options {
+		if o.ID.Critical() && !o.ID.known() {
+			return o.ID, true
+		}
+	}
+	return 0, false
+}
+
+const payloadMarker = 0xff
+
+// extended option delta and length nibbles
+func optionNibble(v int) (nibble byte, ext []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(v-269))
+		return 14, b
+	}
+}
+
+// Marshal encodes m.
+func (m *Message) Marshal() ([]byte, error) {
+	if len(m.Token) > 8 {
+		return nil, errors.Errorf("token of %d bytes, at most 8", len(m.Token))
+	}
+	b := make([]byte, 4, 4+len(m.Token)+len(m.Payload)+16)
+	b[0] = 1<<6 | byte(m.Type)<<4 | byte(len(m.Token))
+	b[1] = byte(m.Code)
+	binary.BigEndian.PutUint16(b[2:], m.MessageID)
+	b = append(b, m.Token...)
+	prev := 0
+	for _, o := range m.Options {
+		delta := int(o.ID) - prev
+		if delta < 0 {
+			return nil, errors.New("options out of order")
+		}
+		if len(o.Value) > 65535+269 {
+			return nil, errors.Errorf("option %d too long", o.ID)
+		}
+		dn, dext := optionNibble(delta)
+		ln, lext := optionNibble(len(o.Value))
+		b = append(b, dn<<4|ln)
+		b = append(b, dext...)
+		b = append(b, lext...)
+		b = append(b, o.Value...)
+		prev = int(o.ID)
+	}
+	if len(m.Payload) > 0 {
+		b = append(b, payloadMarker)
+		b = append(b, m.Payload...)
+	}
+	return b, nil
+}
+
+var errMessageFormat = errors.New("coap: message format error")
+
+func readExt(nibble byte, b []byte) (int, []byte, error) {
+	switch nibble {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, errMessageFormat
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, errMessageFormat
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case 15:
+		return 0, nil, errMessageFormat
+	}
+	return int(nibble), b, nil
+}
+
+// Unmarshal decodes a message.
+func Unmarshal(data []byte) (*Message, error) {
+	if len(data) < 4 {
+		return nil, errMessageFormat
+	}
+	if data[0]>>6 != 1 {
+		return nil, errors.Errorf("coap: version %d", data[0]>>6)
+	}
+	tkl := int(data[0] & 0xf)
+	if tkl > 8 || len(data) < 4+tkl {
+		return nil, errMessageFormat
+	}
+	m := &Message{
+		Type:      Type(data[0] >> 4 & 0x3),
+		Code:      Code(data[1]),
+		MessageID: binary.BigEndian.Uint16(data[2:]),
+	}
+	if tkl > 0 {
+		m.Token = append([]byte(nil), data[4:4+tkl]...)
+	}
+	b := data[4+tkl:]
+	id := 0
+	for len(b) > 0 {
+		if b[0] == payloadMarker {
+			if len(b) == 1 {
+				return nil, errMessageFormat
+			}
+			m.Payload = append([]byte(nil), b[1:]...)
+			break
+		}
+		dn, ln := b[0]>>4, b[0]&0xf
+		delta, rest, err := readExt(dn, b[1:])
+		if err != nil {
+			return nil, err
+		}
+		length, rest, err := readExt(ln, rest)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) < length {
+			return nil, errMessageFormat
+		}
+		id += delta
+		m.Options = append(m.Options, Option{ID: OptionID(id), Value: append([]byte(nil), rest[:length]...)})
+		b = rest[length:]
+	}
+	return m, nil
+}
@@ -0,0 +1,75 @@
+package coap
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := &Message{
+		Type:      Confirmable,
+		Code:      POST,
+		MessageID: 0x1234,
+		Token:     []byte{1, 2, 3, 4},
+		Payload:   []byte(`{"temp":20}`),
+	}
+	m.SetPath("/v1/devices/me/telemetry")
+	m.Add(URIQuery, []byte("token=abc"))
+	m.SetUint(ContentFormat, AppJSON)
+	// extended delta and length
+	m.Add(Size1, bytes.Repeat([]byte{7}, 300))
+	m.SetUint(Observe, 0)
+
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Fatalf("got %+v\nwant %+v", got, m)
+	}
+	if got.Path() != "v1/devices/me/telemetry" || got.Query("token") != "abc" || got.Query("none") != "" {
+		t.Fatalf("path %s, query %s", got.Path(), got.Query("token"))
+	}
+	if v, ok := got.Uint(ContentFormat); !ok || v != AppJSON {
+		t.Fatalf("content format %d", v)
+	}
+	if v, ok := got.Uint(Observe); !ok || v != 0 {
+		t.Fatalf("observe %d, %v", v, ok)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := map[string][]byte{
+		"short":          {0x40, 0x01},
+		"version":        {0x80, 0x01, 0, 1},
+		"token length":   {0x49, 0x01, 0, 1},
+		"marker only":    {0x40, 0x01, 0, 1, 0xff},
+		"option overrun": {0x40, 0x01, 0, 1, 0xb5, 'a'},
+		"reserved delta": {0x40, 0x01, 0, 1, 0xf0},
+	}
+	for name, data := range tests {
+		if _, err := Unmarshal(data); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestCode(t *testing.T) {
+	for c, want := range map[Code]string{GET: "GET", Content: "2.05", RequestEntityTooLarge: "4.13", ServiceUnavailable: "5.03"} {
+		if c.String() != want {
+			t.Errorf("%s, want %s", c, want)
+		}
+	}
+	if !POST.IsRequest() || Empty.IsRequest() || Content.IsRequest() {
+		t.Fatal("IsRequest")
+	}
+	if !URIPath.Critical() || ContentFormat.Critical() || !strings.HasPrefix(Type(9).String(), "Type") {
+		t.Fatal("Critical")
+	}
+}
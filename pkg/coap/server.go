@@ -0,0 +1,669 @@
+package coap
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tkeel-io/kit/log"
+)
+
+const (
+	// RFC 7252 4.6, a message fitting one IP packet without fragmentation
+	DefaultMaxMessageSize = 1152
+	DefaultIdleTimeout    = 5 * time.Minute
+	// RFC 7252 4.8 transmission parameters
+	DefaultACKTimeout    = 2 * time.Second
+	DefaultMaxRetransmit = 4
+	ackRandomFactor      = 1.5
+	// how long a message id is remembered for deduplication, EXCHANGE_LIFETIME
+	exchangeLifetime = 247 * time.Second
+
+	readBufferSize = 64 << 10
+)
+
+var (
+	// ErrClosed is returned when the session or server is closed.
+	ErrClosed = errors.New("coap: closed")
+	// ErrTimeout is returned when a confirmable message is not acknowledged.
+	ErrTimeout = errors.New("coap: no acknowledgement")
+	// ErrReset is returned when the peer rejects a confirmable message.
+	ErrReset = errors.New("coap: reset by peer")
+)
+
+// Request is a request received in a session.
+type Request struct {
+	*Message
+	Session *Session
+
+	observation *Observation
+}
+
+// Observe registers the observation of the requested resource, notifications
+// are sent with Observation.Notify. A success response to the request
+// carries the first sequence number, an error response cancels it.
+func (r *Request) Observe() *Observation {
+	if r.observation == nil {
+		r.observation = r.Session.observe(r.Message)
+	}
+	return r.observation
+}
+
+// Handler answers the requests of a server, it returns the response with
+// code, options and payload, the server fills in type, message id and token.
+type Handler interface {
+	ServeCOAP(ctx context.Context, req *Request) *Message
+}
+
+// HandlerFunc is a func used as Handler.
+type HandlerFunc func(ctx context.Context, req *Request) *Message
+
+func (f HandlerFunc) ServeCOAP(ctx context.Context, req *Request) *Message {
+	return f(ctx, req)
+}
+
+// Config configures a server, zero values are replaced by the defaults.
+type Config struct {
+	// MaxMessageSize bounds a request, larger ones are answered with 4.13.
+	MaxMessageSize int
+	// IdleTimeout closes a session without messages or observations for this long.
+	IdleTimeout time.Duration
+	// ACKTimeout is the first retransmission timeout of a confirmable
+	// notification, doubled on each of MaxRetransmit retransmissions.
+	ACKTimeout    time.Duration
+	MaxRetransmit int
+}
+
+// Server serves CoAP over UDP and over connections of a listener such as
+// DTLS. Each peer is a session, it keeps the observations of the peer.
+type Server struct {
+	handler Handler
+	conf    Config
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	lock     sync.Mutex
+	sessions map[*Session]struct{}
+	closers  []func() error
+}
+
+func NewServer(handler Handler, conf Config) *Server {
+	if conf.MaxMessageSize <= 0 {
+		conf.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if conf.IdleTimeout <= 0 {
+		conf.IdleTimeout = DefaultIdleTimeout
+	}
+	if conf.ACKTimeout <= 0 {
+		conf.ACKTimeout = DefaultACKTimeout
+	}
+	if conf.MaxRetransmit <= 0 {
+		conf.MaxRetransmit = DefaultMaxRetransmit
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		handler:  handler,
+		conf:     conf,
+		ctx:      ctx,
+		cancel:   cancel,
+		sessions: make(map[*Session]struct{}),
+	}
+	go s.sweep()
+	return s
+}
+
+// Close stops serving, it closes the connections and sessions. Requests
+// being handled see the context cancelled.
+func (s *Server) Close() error {
+	s.cancel()
+	s.lock.Lock()
+	closers := s.closers
+	s.closers = nil
+	sessions := make([]*Session, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.lock.Unlock()
+	var err error
+	for _, c := range closers {
+		if cerr := c(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for _, sess := range sessions {
+		sess.Close()
+	}
+	return err
+}
+
+// track registers closer of conn, it returns false if the server is closed.
+func (s *Server) track(closer func() error) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.closers = append(s.closers, closer)
+	return true
+}
+
+func (s *Server) addSession(sess *Session) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.sessions[sess] = struct{}{}
+	return true
+}
+
+func (s *Server) removeSession(sess *Session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, sess)
+}
+
+// ServeUDP serves the peers of conn until it or the server is closed.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	if !s.track(conn.Close) {
+		conn.Close()
+		return ErrClosed
+	}
+	// sessions by peer address, only used by this loop and session close
+	var lock sync.Mutex
+	peers := make(map[string]*Session)
+	buf := make([]byte, readBufferSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		key := addr.String()
+		lock.Lock()
+		sess, ok := peers[key]
+		if !ok {
+			sess = newSession(s, addr, "", func(b []byte) error {
+				_, err := conn.WriteTo(b, addr)
+				return err
+			})
+			sess.onClose = func() {
+				lock.Lock()
+				defer lock.Unlock()
+				if peers[key] == sess {
+					delete(peers, key)
+				}
+			}
+			if !s.addSession(sess) {
+				lock.Unlock()
+				return nil
+			}
+			peers[key] = sess
+		}
+		lock.Unlock()
+		data := append([]byte(nil), buf[:n]...)
+		go sess.handle(data)
+	}
+}
+
+// Serve serves each connection of l as a session until l or the server is
+// closed. A connection of ListenDTLS is a session of its PSK identity.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l.Close) {
+		l.Close()
+		return ErrClosed
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	sess := newSession(s, conn.RemoteAddr(), pskIdentity(conn), func(b []byte) error {
+		_, err := conn.Write(b)
+		return err
+	})
+	sess.onClose = func() { conn.Close() }
+	if !s.addSession(sess) {
+		conn.Close()
+		return
+	}
+	defer sess.Close()
+	buf := make([]byte, readBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		data := append([]byte(nil), buf[:n]...)
+		go sess.handle(data)
+	}
+}
+
+// sweep closes the idle sessions and forgets the old exchanges.
+func (s *Server) sweep() {
+	interval := s.conf.IdleTimeout / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		s.lock.Lock()
+		sessions := make([]*Session, 0, len(s.sessions))
+		for sess := range s.sessions {
+			sessions = append(sessions, sess)
+		}
+		s.lock.Unlock()
+		for _, sess := range sessions {
+			if sess.expire(now) {
+				log.Debugf("close idle coap session %s", sess.remote)
+				sess.Close()
+			}
+		}
+	}
+}
+
+// exchange is a request received, its response is resent on retransmission.
+type exchange struct {
+	response []byte
+	expires  time.Time
+}
+
+// Session is the state kept for a peer: the recent exchanges, the
+// confirmable messages waiting for acknowledgement and the observations.
+type Session struct {
+	server   *Server
+	remote   net.Addr
+	identity string
+	write    func([]byte) error
+	onClose  func()
+	done     chan struct{}
+
+	lock         sync.Mutex
+	closed       bool
+	lastActive   time.Time
+	nextID       uint16
+	exchanges    map[uint16]*exchange
+	pending      map[uint16]chan *Message
+	observations map[string]*Observation
+}
+
+func newSession(server *Server, remote net.Addr, identity string, write func([]byte) error) *Session {
+	return &Session{
+		server:       server,
+		remote:       remote,
+		identity:     identity,
+		write:        write,
+		done:         make(chan struct{}),
+		lastActive:   time.Now(),
+		nextID:       uint16(rand.Intn(1 << 16)), //nolint:gosec
+		exchanges:    make(map[uint16]*exchange),
+		pending:      make(map[uint16]chan *Message),
+		observations: make(map[string]*Observation),
+	}
+}
+
+// RemoteAddr is the address of the peer.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+// Identity is the PSK identity of a DTLS peer, empty over UDP.
+func (s *Session) Identity() string {
+	return s.identity
+}
+
+// Done is closed when the session closes.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close cancels the observations of the session and forgets it, a DTLS
+// connection is closed.
+func (s *Session) Close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	observations := s.observations
+	s.observations = make(map[string]*Observation)
+	s.lock.Unlock()
+	close(s.done)
+	for _, o := range observations {
+		o.cancel()
+	}
+	s.server.removeSession(s)
+	if s.onClose != nil {
+		s.onClose()
+	}
+}
+
+// expire forgets the exchanges older than exchangeLifetime, it reports
+// whether the session is idle.
+func (s *Session) expire(now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, ex := range s.exchanges {
+		if now.After(ex.expires) {
+			delete(s.exchanges, id)
+		}
+	}
+	return len(s.observations) == 0 && len(s.pending) == 0 &&
+		now.Sub(s.lastActive) > s.server.conf.IdleTimeout
+}
+
+func (s *Session) newMessageID() uint16 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nextID++
+	return s.nextID
+}
+
+func (s *Session) send(m *Message) error {
+	b, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.write(b)
+}
+
+// handle handles a datagram of the peer.
+func (s *Session) handle(data []byte) {
+	m, err := Unmarshal(data)
+	if err != nil {
+		// RFC 7252 4.2, a confirmable message in error is rejected
+		if len(data) >= 4 && data[0]>>6 == 1 && Type(data[0]>>4&0x3) == Confirmable {
+			s.reset(uint16(data[2])<<8 | uint16(data[3]))
+		}
+		return
+	}
+	s.lock.Lock()
+	s.lastActive = time.Now()
+	s.lock.Unlock()
+
+	switch {
+	case m.Type == Acknowledgement || m.Type == Reset:
+		s.lock.Lock()
+		ch, ok := s.pending[m.MessageID]
+		delete(s.pending, m.MessageID)
+		s.lock.Unlock()
+		if ok {
+			ch <- m
+		}
+	case m.Code == Empty:
+		// a ping is answered with a reset
+		if m.Type == Confirmable {
+			s.reset(m.MessageID)
+		}
+	case m.Code.IsRequest():
+		s.handleRequest(m, len(data))
+	default:
+		// a response the server did not ask for
+		if m.Type == Confirmable {
+			s.reset(m.MessageID)
+		}
+	}
+}
+
+func (s *Session) reset(id uint16) {
+	if err := s.send(&Message{Type: Reset, Code: Empty, MessageID: id}); err != nil {
+		log.Debugf("coap reset to %s err, %v", s.remote, err)
+	}
+}
+
+func (s *Session) handleRequest(m *Message, size int) {
+	// a retransmission is answered like the request, not handled again
+	s.lock.Lock()
+	if ex, ok := s.exchanges[m.MessageID]; ok {
+		s.lock.Unlock()
+		if ex.response != nil {
+			if err := s.write(ex.response); err != nil {
+				log.Debugf("coap response to %s err, %v", s.remote, err)
+			}
+		}
+		return
+	}
+	ex := &exchange{expires: time.Now().Add(exchangeLifetime)}
+	s.exchanges[m.MessageID] = ex
+	s.lock.Unlock()
+
+	req := &Request{Message: m, Session: s}
+	var resp *Message
+	if id, ok := m.unknownCritical(); ok {
+		resp = &Message{Code: BadOption, Payload: []byte("unknown critical option " + strconv.Itoa(int(id)))}
+	} else if size > s.server.conf.MaxMessageSize {
+		resp = &Message{Code: RequestEntityTooLarge}
+		resp.SetUint(Size1, uint32(s.server.conf.MaxMessageSize))
+	} else {
+		if v, ok := m.Uint(Observe); ok && v == ObserveDeregister {
+			s.cancelObservation(m.Token)
+		}
+		resp = s.server.handler.ServeCOAP(s.server.ctx, req)
+		if resp == nil {
+			resp = &Message{Code: InternalServerError}
+		}
+	}
+	if o := req.observation; o != nil {
+		if resp.Code.Class() == 2 {
+			resp.SetUint(Observe, o.next())
+		} else {
+			o.Cancel()
+		}
+	}
+	resp.Token = m.Token
+	if m.Type == Confirmable {
+		resp.Type = Acknowledgement
+		resp.MessageID = m.MessageID
+	} else {
+		resp.Type = NonConfirmable
+		resp.MessageID = s.newMessageID()
+	}
+	b, err := resp.Marshal()
+	if err != nil {
+		log.Errorf("marshal coap response to %s err, %v", s.remote, err)
+		return
+	}
+	s.lock.Lock()
+	ex.response = b
+	s.lock.Unlock()
+	if err := s.write(b); err != nil {
+		log.Debugf("coap response to %s err, %v", s.remote, err)
+	}
+}
+
+// Confirm sends m confirmable and waits for the acknowledgement,
+// retransmitting it with exponential back-off. It returns the ACK, which
+// may carry a piggybacked response, or ErrReset when the peer rejects m.
+func (s *Session) Confirm(ctx context.Context, m *Message) (*Message, error) {
+	m.Type = Confirmable
+	m.MessageID = s.newMessageID()
+	ch := make(chan *Message, 1)
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, ErrClosed
+	}
+	s.pending[m.MessageID] = ch
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.pending, m.MessageID)
+		s.lock.Unlock()
+	}()
+	b, err := m.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	conf := s.server.conf
+	timeout := time.Duration(float64(conf.ACKTimeout) * (1 + rand.Float64()*(ackRandomFactor-1))) //nolint:gosec
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for attempt := 0; ; attempt++ {
+		if err := s.write(b); err != nil {
+			return nil, err
+		}
+		select {
+		case reply := <-ch:
+			if reply.Type == Reset {
+				return nil, ErrReset
+			}
+			return reply, nil
+		case <-timer.C:
+			if attempt == conf.MaxRetransmit {
+				return nil, ErrTimeout
+			}
+			timeout *= 2
+			timer.Reset(timeout)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.done:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// observe registers the observation of the resource requested by m,
+// replacing the one of the same token.
+func (s *Session) observe(m *Message) *Observation {
+	o := &Observation{
+		session: s,
+		token:   m.Token,
+		path:    m.Path(),
+		done:    make(chan struct{}),
+	}
+	s.lock.Lock()
+	old := s.observations[string(m.Token)]
+	if s.closed {
+		o.cancel()
+	} else {
+		s.observations[string(m.Token)] = o
+	}
+	s.lock.Unlock()
+	if old != nil {
+		old.cancel()
+	}
+	return o
+}
+
+func (s *Session) cancelObservation(token []byte) {
+	s.lock.Lock()
+	o := s.observations[string(token)]
+	s.lock.Unlock()
+	if o != nil {
+		o.Cancel()
+	}
+}
+
+// Observations returns the observations of the session.
+func (s *Session) Observations() []*Observation {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	out := make([]*Observation, 0, len(s.observations))
+	for _, o := range s.observations {
+		out = append(out, o)
+	}
+	return out
+}
+
+// Observation is a resource observed by a peer.
+type Observation struct {
+	session *Session
+	token   []byte
+	path    string
+
+	// notifications of an observation are sent one at a time
+	notifyLock sync.Mutex
+	lock       sync.Mutex
+	seq        uint32
+	done       chan struct{}
+	once       sync.Once
+}
+
+// Session is the session of the observer.
+func (o *Observation) Session() *Session {
+	return o.session
+}
+
+// Path is the Uri-Path of the observed resource.
+func (o *Observation) Path() string {
+	return o.path
+}
+
+// Done is closed when the observation is cancelled: deregistered by the
+// peer, a notification rejected or not acknowledged, or the session closed.
+func (o *Observation) Done() <-chan struct{} {
+	return o.done
+}
+
+// Cancel ends the observation.
+func (o *Observation) Cancel() {
+	s := o.session
+	s.lock.Lock()
+	if s.observations[string(o.token)] == o {
+		delete(s.observations, string(o.token))
+	}
+	s.lock.Unlock()
+	o.cancel()
+}
+
+func (o *Observation) cancel() {
+	o.once.Do(func() { close(o.done) })
+}
+
+// next returns the next sequence number, RFC 7641 4.4.
+func (o *Observation) next() uint32 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.seq = (o.seq + 1) & observeMask
+	return o.seq
+}
+
+// Notify sends resp as a confirmable notification and waits for the
+// acknowledgement. A notification rejected or not acknowledged cancels the
+// observation.
+func (o *Observation) Notify(ctx context.Context, resp *Message) error {
+	o.notifyLock.Lock()
+	defer o.notifyLock.Unlock()
+	select {
+	case <-o.done:
+		return ErrClosed
+	default:
+	}
+	resp.Token = o.token
+	resp.SetUint(Observe, o.next())
+	_, err := o.session.Confirm(ctx, resp)
+	if errors.Is(err, ErrReset) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrClosed) {
+		o.Cancel()
+	}
+	return err
+}
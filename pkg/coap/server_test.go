@@ -0,0 +1,289 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+)
+
+// client is a peer of a test server.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (c *client) send(m *Message) {
+	c.t.Helper()
+	b, err := m.Marshal()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) recv() *Message {
+	c.t.Helper()
+	buf := make([]byte, readBufferSize)
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second)) //nolint:errcheck
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	m, err := Unmarshal(buf[:n])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+// do sends request m and returns its response, skipping notifications.
+func (c *client) do(m *Message) *Message {
+	c.t.Helper()
+	c.send(m)
+	for {
+		resp := c.recv()
+		if resp.Type != Confirmable && (resp.Type == Reset || bytes.Equal(resp.Token, m.Token)) {
+			return resp
+		}
+	}
+}
+
+func request(code Code, id uint16, path string) *Message {
+	m := &Message{Type: Confirmable, Code: code, MessageID: id, Token: []byte{byte(id)}}
+	m.SetPath(path)
+	return m
+}
+
+// testServer serves "echo" and the observable "obs", the registered
+// observations are sent to the returned channel.
+func testServer(t *testing.T, conf Config) (*Server, *int32, chan *Observation) {
+	var handled int32
+	observations := make(chan *Observation, 1)
+	s := NewServer(HandlerFunc(func(ctx context.Context, req *Request) *Message {
+		atomic.AddInt32(&handled, 1)
+		switch req.Path() {
+		case "echo":
+			return &Message{Code: Content, Payload: append([]byte(req.Session.Identity()+":"), req.Payload...)}
+		case "obs":
+			if v, ok := req.Uint(Observe); ok && v == ObserveRegister {
+				observations <- req.Observe()
+			}
+			return &Message{Code: Content, Payload: []byte("0")}
+		}
+		return &Message{Code: NotFound}
+	}), conf)
+	t.Cleanup(func() { s.Close() })
+	return s, &handled, observations
+}
+
+func udpClient(t *testing.T, s *Server) *client {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeUDP(pc) //nolint:errcheck
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &client{t: t, conn: conn}
+}
+
+func TestServerExchange(t *testing.T) {
+	s, handled, _ := testServer(t, Config{MaxMessageSize: 64})
+	c := udpClient(t, s)
+
+	// piggybacked response
+	req := request(POST, 1, "echo")
+	req.Payload = []byte("hi")
+	resp := c.do(req)
+	if resp.Type != Acknowledgement || resp.MessageID != 1 || string(resp.Token) != "\x01" || resp.Code != Content || string(resp.Payload) != ":hi" {
+		t.Fatalf("response %+v", resp)
+	}
+	// a retransmission is answered without handling it again
+	if again := c.do(req); again.Code != Content || atomic.LoadInt32(handled) != 1 {
+		t.Fatalf("retransmission %+v, handled %d", again, atomic.LoadInt32(handled))
+	}
+	// non-confirmable
+	non := request(GET, 2, "none")
+	non.Type = NonConfirmable
+	if resp := c.do(non); resp.Type != NonConfirmable || resp.Code != NotFound {
+		t.Fatalf("non-confirmable %+v", resp)
+	}
+	// ping
+	if resp := c.do(&Message{Type: Confirmable, Code: Empty, MessageID: 3}); resp.Type != Reset || resp.MessageID != 3 {
+		t.Fatalf("ping %+v", resp)
+	}
+	// unknown critical option
+	bad := request(GET, 4, "echo")
+	bad.Add(OptionID(2049), []byte("x"))
+	if resp := c.do(bad); resp.Code != BadOption {
+		t.Fatalf("critical option %+v", resp)
+	}
+	// too large
+	big := request(POST, 5, "echo")
+	big.Payload = make([]byte, 100)
+	if resp := c.do(big); resp.Code != RequestEntityTooLarge {
+		t.Fatalf("large request %+v", resp)
+	} else if v, _ := resp.Uint(Size1); v != 64 {
+		t.Fatalf("size1 %d", v)
+	}
+	// format error
+	if _, err := c.conn.Write([]byte{0x41, 0x01, 0, 6}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := c.recv(); resp.Type != Reset || resp.MessageID != 6 {
+		t.Fatalf("format error %+v", resp)
+	}
+	if n := atomic.LoadInt32(handled); n != 2 {
+		t.Fatalf("handled %d requests", n)
+	}
+}
+
+func TestServerObserve(t *testing.T) {
+	s, _, observations := testServer(t, Config{ACKTimeout: 100 * time.Millisecond, MaxRetransmit: 2})
+	c := udpClient(t, s)
+	ctx := context.Background()
+
+	req := request(GET, 1, "obs")
+	req.SetUint(Observe, ObserveRegister)
+	resp := c.do(req)
+	if seq, ok := resp.Uint(Observe); !ok || seq != 1 || resp.Code != Content {
+		t.Fatalf("register %+v", resp)
+	}
+	o := <-observations
+	if o.Path() != "obs" || len(o.Session().Observations()) != 1 {
+		t.Fatalf("observation %s", o.Path())
+	}
+
+	// confirmable notifications with increasing sequence numbers
+	errc := make(chan error, 1)
+	go func() { errc <- o.Notify(ctx, &Message{Code: Content, Payload: []byte("1")}) }()
+	n := c.recv()
+	if seq, _ := n.Uint(Observe); n.Type != Confirmable || seq != 2 || string(n.Token) != "\x01" || string(n.Payload) != "1" {
+		t.Fatalf("notification %+v", n)
+	}
+	// the notification is retransmitted until acknowledged
+	if again := c.recv(); again.MessageID != n.MessageID {
+		t.Fatalf("retransmission %+v", again)
+	}
+	c.send(&Message{Type: Acknowledgement, Code: Empty, MessageID: n.MessageID})
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// a reset cancels the observation
+	go func() { errc <- o.Notify(ctx, &Message{Code: Content, Payload: []byte("2")}) }()
+	n = c.recv()
+	c.send(&Message{Type: Reset, Code: Empty, MessageID: n.MessageID})
+	if err := <-errc; !errors.Is(err, ErrReset) {
+		t.Fatalf("notify after reset %v", err)
+	}
+	select {
+	case <-o.Done():
+	default:
+		t.Fatal("observation not cancelled")
+	}
+
+	// a notification never acknowledged cancels the observation
+	req.MessageID = 2
+	c.do(req)
+	o = <-observations
+	if err := o.Notify(ctx, &Message{Code: Content}); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("notify without ack %v", err)
+	}
+	if len(o.Session().Observations()) != 0 {
+		t.Fatal("observation kept")
+	}
+
+	// deregistration
+	req.MessageID = 3
+	c.do(req)
+	o = <-observations
+	dereg := request(GET, 4, "obs")
+	dereg.Token = req.Token
+	dereg.SetUint(Observe, ObserveDeregister)
+	if resp := c.do(dereg); resp.Code != Content {
+		t.Fatalf("deregister %+v", resp)
+	}
+	select {
+	case <-o.Done():
+	case <-time.After(time.Second):
+		t.Fatal("observation not deregistered")
+	}
+}
+
+func TestServerIdleSession(t *testing.T) {
+	s, _, observations := testServer(t, Config{IdleTimeout: 100 * time.Millisecond})
+	c := udpClient(t, s)
+	req := request(GET, 1, "obs")
+	req.SetUint(Observe, ObserveRegister)
+	c.do(req)
+	o := <-observations
+	// observed sessions are kept
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case <-o.Session().Done():
+		t.Fatal("observed session closed")
+	default:
+	}
+	o.Cancel()
+	select {
+	case <-o.Session().Done():
+	case <-time.After(time.Second):
+		t.Fatal("idle session not closed")
+	}
+}
+
+func TestServerDTLS(t *testing.T) {
+	s, _, _ := testServer(t, Config{})
+	l, err := ListenDTLS("127.0.0.1:0", DTLSConfig{
+		PSK: func(identity []byte) ([]byte, error) {
+			if string(identity) != "dev1" {
+				return nil, errors.New("unknown identity")
+			}
+			return []byte("secret"), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l) //nolint:errcheck
+	dial := func(identity, key string) (*dtls.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		return dtls.DialWithContext(ctx, "udp", l.Addr().(*net.UDPAddr), &dtls.Config{
+			PSK:             func([]byte) ([]byte, error) { return []byte(key), nil },
+			PSKIdentityHint: []byte(identity),
+			CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+		})
+	}
+
+	conn, err := dial("dev1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &client{t: t, conn: conn}
+	req := request(POST, 1, "echo")
+	req.Payload = []byte("hi")
+	if resp := c.do(req); resp.Code != Content || string(resp.Payload) != "dev1:hi" {
+		t.Fatalf("response %+v", resp)
+	}
+
+	for identity, key := range map[string]string{"dev2": "secret", "dev1": "wrong"} {
+		if conn, err := dial(identity, key); err == nil {
+			conn.Close()
+			t.Fatalf("handshake of %s with %s", identity, key)
+		}
+	}
+}
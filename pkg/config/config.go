@@ -0,0 +1,546 @@
+// Package config loads the iothub configuration from a YAML file, overridden
+// by environment variables and command line flags.
+package config
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	CloudEventModeStructured = "structured"
+	CloudEventModeBinary     = "binary"
+
+	StateStoreTypeDapr   = "dapr"
+	StateStoreTypeMemory = "memory"
+
+	ArchiveTypeNone  = "none"
+	ArchiveTypeFile  = "file"
+	ArchiveTypeKafka = "kafka"
+
+	TraceExporterNone   = "none"
+	TraceExporterOTLP   = "otlp"
+	TraceExporterStdout = "stdout"
+)
+
+// Duration is a time.Duration read from YAML strings like "30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.Wrapf(err, "parse duration %s", s)
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+type Log struct {
+	// Level is debug, info, warn or error.
+	Level string `yaml:"level"`
+	Dev   bool   `yaml:"dev"`
+}
+
+type Server struct {
+	HTTPAddr string `yaml:"http_addr"`
+	GRPCAddr string `yaml:"grpc_addr"`
+	// ShutdownTimeout bounds the graceful shutdown.
+	ShutdownTimeout Duration `yaml:"shutdown_timeout"`
+}
+
+type Tracing struct {
+	// Exporter is none, otlp or stdout.
+	Exporter string `yaml:"exporter"`
+}
+
+type StateStore struct {
+	// Type is dapr or memory.
+	Type string `yaml:"type"`
+	// Name is the dapr state store component.
+	Name string `yaml:"name"`
+}
+
+type Dapr struct {
+	// PubsubName is the pubsub component core publishes device events to.
+	PubsubName string     `yaml:"pubsub_name"`
+	StateStore StateStore `yaml:"state_store"`
+}
+
+type Keel struct {
+	// BaseURL is the keel api, invoked through the dapr sidecar.
+	BaseURL string `yaml:"base_url"`
+}
+
+type EMQX struct {
+	// APIAddress is the EMQX management api, e.g. http://emqx:8081/api.
+	APIAddress string `yaml:"api_address"`
+	Username   string `yaml:"username"`
+	Password   string `yaml:"password"`
+}
+
+type Kafka struct {
+	Brokers []string `yaml:"brokers"`
+	Version string   `yaml:"version"`
+	// Topic is the core topic device events are sent to.
+	Topic string `yaml:"topic"`
+	// CloudEventMode is the encoding of events, structured or binary.
+	CloudEventMode string `yaml:"cloudevent_mode"`
+}
+
+type Presence struct {
+	// DeviceMetric exports the per device iothub_device_status gauge.
+	DeviceMetric bool     `yaml:"device_metric"`
+	OfflineTTL   Duration `yaml:"offline_ttl"`
+	GCInterval   Duration `yaml:"gc_interval"`
+}
+
+type Quality struct {
+	// FlapThreshold is the number of reconnects within FlapWindow above
+	// which a device is flapping, 0 disables flapping detection.
+	FlapThreshold int      `yaml:"flap_threshold"`
+	FlapWindow    Duration `yaml:"flap_window"`
+	// FlapThrottle rejects the authentication of flapping devices.
+	FlapThrottle bool `yaml:"flap_throttle"`
+}
+
+type Dedup struct {
+	// TTL is how long a message key is remembered, 0 disables deduplication.
+	TTL         Duration `yaml:"ttl"`
+	MaxEntries  int      `yaml:"max_entries"`
+	PayloadHash bool     `yaml:"payload_hash"`
+	// Shared also records keys in the state store for all replicas.
+	Shared bool `yaml:"shared"`
+}
+
+type RateLimit struct {
+	// Messages is the number of uplink messages a device may send per
+	// Interval, 0 for no limit. The messages above are dropped.
+	Messages int      `yaml:"messages"`
+	Interval Duration `yaml:"interval"`
+	// Burst is the number of messages a device may send at once, Messages
+	// if 0.
+	Burst int `yaml:"burst"`
+}
+
+type Exhook struct {
+	// Hooks are the hooks registered to EMQX, all handled hooks if empty.
+	Hooks []string `yaml:"hooks"`
+	// Topics overrides the topic filters of message hooks by hook name.
+	Topics map[string][]string `yaml:"topics"`
+}
+
+type Archive struct {
+	// Type is none, file or kafka, where the uplink events are archived
+	// for replay.
+	Type string `yaml:"type"`
+	// Dir keeps the files of type file.
+	Dir string `yaml:"dir"`
+	// MaxFileSizeMB rotates a file above this size.
+	MaxFileSizeMB int `yaml:"max_file_size_mb"`
+	// RotateInterval rotates a file older than this.
+	RotateInterval Duration `yaml:"rotate_interval"`
+	// Retention removes the files not written for this long, 0 keeps them.
+	Retention Duration `yaml:"retention"`
+	// Topic of type kafka, on kafka.brokers.
+	Topic string `yaml:"topic"`
+}
+
+type DeviceHTTP struct {
+	// Enabled serves the device http api, /v1/devices/{token}/..., on
+	// server.http_addr.
+	Enabled bool `yaml:"enabled"`
+	// PollTimeout bounds a long poll of commands.
+	PollTimeout Duration `yaml:"poll_timeout"`
+	// IdleTimeout marks a device offline after no request for this long.
+	IdleTimeout Duration `yaml:"idle_timeout"`
+	MaxBodyKB   int      `yaml:"max_body_kb"`
+	// MaxPendingCommands bounds the commands kept for a device not polling.
+	MaxPendingCommands int `yaml:"max_pending_commands"`
+	// CommandTTL drops the pending commands of a device not polling for this long.
+	CommandTTL Duration `yaml:"command_ttl"`
+	// TokenCacheTTL keeps a parsed device token for this long, 0 asks keel
+	// every request.
+	TokenCacheTTL Duration `yaml:"token_cache_ttl"`
+}
+
+type CoAP struct {
+	// Enabled serves devices over CoAP without the EMQX CoAP gateway.
+	Enabled bool `yaml:"enabled"`
+	// Addr is the UDP address of plain CoAP, empty disables it.
+	Addr string `yaml:"addr"`
+	// DTLSAddr is the UDP address of CoAP over DTLS-PSK, empty disables it.
+	DTLSAddr string `yaml:"dtls_addr"`
+	// PSKSecret derives the pre-shared key of each device from its id.
+	PSKSecret string `yaml:"psk_secret"`
+	// IdleTimeout marks a device offline after no request or observation
+	// for this long.
+	IdleTimeout     Duration `yaml:"idle_timeout"`
+	MaxMessageBytes int      `yaml:"max_message_bytes"`
+	TokenCacheTTL   Duration `yaml:"token_cache_ttl"`
+}
+
+type LwM2M struct {
+	// Enabled maps the messages of the EMQX LwM2M gateway to attributes,
+	// telemetry and commands, otherwise they are forwarded as raw data.
+	Enabled bool `yaml:"enabled"`
+	// DownlinkTopic is the gateway command topic, %e is the endpoint name.
+	DownlinkTopic string `yaml:"downlink_topic"`
+	// ObserveOnRegister observes the known objects of a device registering.
+	ObserveOnRegister bool `yaml:"observe_on_register"`
+	// RequestTTL bounds the wait of a command for its response.
+	RequestTTL Duration `yaml:"request_ttl"`
+	// Objects are custom objects, in addition to Device 3, Connectivity 4,
+	// Firmware 5 and Location 6.
+	Objects []LwM2MObject `yaml:"objects"`
+}
+
+// LwM2MObject is a custom LwM2M object definition.
+type LwM2MObject struct {
+	ID   uint16 `yaml:"id"`
+	Name string `yaml:"name"`
+	// Multiple objects have instances, their keys carry the instance id.
+	Multiple  bool            `yaml:"multiple"`
+	Resources []LwM2MResource `yaml:"resources"`
+}
+
+// LwM2MResource is a resource of a custom LwM2M object.
+type LwM2MResource struct {
+	ID   uint16 `yaml:"id"`
+	Name string `yaml:"name"`
+	// Type is the data type, empty for executable resources.
+	Type string `yaml:"type"`
+	// Operations is R, W, RW or E.
+	Operations string `yaml:"operations"`
+	// Multiple resources have instances, their value is a list.
+	Multiple bool `yaml:"multiple"`
+	// Telemetry values are measurements, the others are attributes.
+	Telemetry bool `yaml:"telemetry"`
+}
+
+type LoRaWAN struct {
+	// Enabled serves the network server webhooks, /v1/lorawan/..., on
+	// server.http_addr.
+	Enabled bool `yaml:"enabled"`
+	// WebhookToken authenticates the network servers, as bearer token or
+	// ?token=.
+	WebhookToken string `yaml:"webhook_token"`
+	// TokenTag is the ChirpStack device tag holding the entity token.
+	TokenTag string `yaml:"token_tag"`
+	// Codec decodes the payloads the network server does not, none,
+	// cayennelpp or json.
+	Codec string `yaml:"codec"`
+	// FPort is the port of downlinks not setting one.
+	FPort int `yaml:"f_port"`
+	// IdleTimeout marks a device offline after no uplink for this long.
+	IdleTimeout   Duration `yaml:"idle_timeout"`
+	TokenCacheTTL Duration `yaml:"token_cache_ttl"`
+	// ChirpStack and TTS are the apis queueing downlinks.
+	ChirpStack LoRaWANNetwork `yaml:"chirpstack"`
+	TTS        LoRaWANNetwork `yaml:"tts"`
+}
+
+type LoRaWANNetwork struct {
+	APIURL string `yaml:"api_url"`
+	APIKey string `yaml:"api_key"`
+	// WebhookID is the webhook pushing downlinks, The Things Stack only.
+	WebhookID string `yaml:"webhook_id"`
+}
+
+type Live struct {
+	// Enabled serves the live data api, /v1/live/ws and /v1/live/events,
+	// on server.http_addr.
+	Enabled bool `yaml:"enabled"`
+	// Buffer is the number of events queued per connection, the following
+	// ones are dropped until the client catches up.
+	Buffer int `yaml:"buffer"`
+	// MaxConnections limits the connections of a tenant, 0 for no limit.
+	MaxConnections int `yaml:"max_connections"`
+	// Heartbeat is the interval of websocket pings and sse comments.
+	Heartbeat Duration `yaml:"heartbeat"`
+}
+
+type Provision struct {
+	// Enabled provisions devices connecting with the credentials of a
+	// product, over MQTT and POST /v1/devices/provision on server.http_addr.
+	Enabled bool `yaml:"enabled"`
+	// AuditSize is the number of attempts kept per product.
+	AuditSize int                `yaml:"audit_size"`
+	Products  []ProvisionProduct `yaml:"products"`
+}
+
+type ProvisionProduct struct {
+	// Key and Secret are the credentials shared by the devices of the
+	// product, the MQTT password of a device is <key>:<secret>.
+	Key    string `yaml:"key"`
+	Secret string `yaml:"secret"`
+	// Owner and TenantID own the devices provisioned.
+	Owner    string `yaml:"owner"`
+	TenantID string `yaml:"tenant_id"`
+	// TemplateID is the core template of the devices, optional.
+	TemplateID string `yaml:"template_id"`
+	// DeviceIDPrefix prefixes the serial number to form the device id.
+	DeviceIDPrefix string `yaml:"device_id_prefix"`
+	// MaxDevices limits the devices provisioned, 0 for no limit.
+	MaxDevices int `yaml:"max_devices"`
+	// Serials admits only these serial numbers if not empty.
+	Serials []string `yaml:"serials"`
+}
+
+type Sparkplug struct {
+	// Enabled decodes the Sparkplug B messages of edge nodes, otherwise
+	// they are forwarded as raw data.
+	Enabled bool `yaml:"enabled"`
+	// DeviceID is the entity id of a device of an edge node, %g is the
+	// group id, %n the edge node id and %d the device id.
+	DeviceID string `yaml:"device_id"`
+}
+
+// Config is the iothub configuration.
+type Config struct {
+	Log        Log        `yaml:"log"`
+	Server     Server     `yaml:"server"`
+	Tracing    Tracing    `yaml:"tracing"`
+	Dapr       Dapr       `yaml:"dapr"`
+	Keel       Keel       `yaml:"keel"`
+	EMQX       EMQX       `yaml:"emqx"`
+	Kafka      Kafka      `yaml:"kafka"`
+	Presence   Presence   `yaml:"presence"`
+	Quality    Quality    `yaml:"quality"`
+	Dedup      Dedup      `yaml:"dedup"`
+	RateLimit  RateLimit  `yaml:"rate_limit"`
+	Exhook     Exhook     `yaml:"exhook"`
+	Archive    Archive    `yaml:"archive"`
+	DeviceHTTP DeviceHTTP `yaml:"device_http"`
+	CoAP       CoAP       `yaml:"coap"`
+	LwM2M      LwM2M      `yaml:"lwm2m"`
+	Sparkplug  Sparkplug  `yaml:"sparkplug"`
+	LoRaWAN    LoRaWAN    `yaml:"lorawan"`
+	Live       Live       `yaml:"live"`
+	Provision  Provision  `yaml:"provision"`
+}
+
+// Default returns the configuration used when nothing is set.
+func Default() *Config {
+	return &Config{
+		Log: Log{Level: "debug", Dev: true},
+		Server: Server{
+			HTTPAddr:        ":8080",
+			GRPCAddr:        ":9000",
+			ShutdownTimeout: Duration{30 * time.Second},
+		},
+		Tracing: Tracing{Exporter: TraceExporterNone},
+		Dapr: Dapr{
+			PubsubName: "iothub-pubsub",
+			StateStore: StateStore{Type: StateStoreTypeDapr, Name: "iothub-private-store"},
+		},
+		Keel: Keel{BaseURL: "http://localhost:3500/v1.0/invoke/keel/method/apis"},
+		EMQX: EMQX{
+			APIAddress: "http://emqx.keel-system:8081/api",
+			Username:   "admin",
+			Password:   "public",
+		},
+		Kafka: Kafka{
+			Brokers:        []string{"kafka.keel-system.svc.cluster.local:9092"},
+			Version:        "1.0.0",
+			Topic:          "core-pub",
+			CloudEventMode: CloudEventModeStructured,
+		},
+		Presence: Presence{
+			DeviceMetric: true,
+			OfflineTTL:   Duration{24 * time.Hour},
+			GCInterval:   Duration{10 * time.Minute},
+		},
+		Quality:   Quality{FlapThreshold: 10, FlapWindow: Duration{5 * time.Minute}},
+		Dedup:     Dedup{TTL: Duration{30 * time.Second}, MaxEntries: 100000},
+		RateLimit: RateLimit{Interval: Duration{time.Second}},
+		Archive: Archive{
+			Type:           ArchiveTypeNone,
+			Dir:            "/var/lib/iothub/archive",
+			MaxFileSizeMB:  64,
+			RotateInterval: Duration{time.Hour},
+			Retention:      Duration{7 * 24 * time.Hour},
+			Topic:          "iothub-archive",
+		},
+		DeviceHTTP: DeviceHTTP{
+			PollTimeout:        Duration{30 * time.Second},
+			IdleTimeout:        Duration{5 * time.Minute},
+			MaxBodyKB:          64,
+			MaxPendingCommands: 100,
+			CommandTTL:         Duration{time.Hour},
+			TokenCacheTTL:      Duration{time.Minute},
+		},
+		CoAP: CoAP{
+			Addr:            ":5683",
+			IdleTimeout:     Duration{5 * time.Minute},
+			MaxMessageBytes: 1152,
+			TokenCacheTTL:   Duration{time.Minute},
+		},
+		LwM2M: LwM2M{
+			DownlinkTopic:     "lwm2m/%e/dn/dm",
+			ObserveOnRegister: true,
+			RequestTTL:        Duration{time.Minute},
+		},
+		Sparkplug: Sparkplug{DeviceID: "%d"},
+		LoRaWAN: LoRaWAN{
+			TokenTag:      "tkeel_token",
+			FPort:         10,
+			IdleTimeout:   Duration{2 * time.Hour},
+			TokenCacheTTL: Duration{time.Minute},
+			TTS:           LoRaWANNetwork{WebhookID: "iothub"},
+		},
+		Live:      Live{Buffer: 256, MaxConnections: 100, Heartbeat: Duration{30 * time.Second}},
+		Provision: Provision{AuditSize: 1000},
+	}
+}
+
+// Load reads the configuration file at path over the defaults, then applies
+// the environment overrides. An empty path only uses defaults and env.
+func Load(path string) (*Config, error) {
+	c := Default()
+	if path != "" {
+		bytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "read config file")
+		}
+		if err := yaml.UnmarshalStrict(bytes, c); err != nil {
+			return nil, errors.Wrapf(err, "parse config file %s", path)
+		}
+	}
+	if err := c.applyEnv(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func oneOf(v string, values ...string) bool {
+	for _, s := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the configuration and reports every invalid setting.
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, errors.Errorf(format, args...).Error())
+		}
+	}
+	check(oneOf(strings.ToLower(c.Log.Level), "debug", "info", "warn", "error"), "log.level %q is not debug, info, warn or error", c.Log.Level)
+	check(c.Server.HTTPAddr != "", "server.http_addr is empty")
+	check(c.Server.GRPCAddr != "", "server.grpc_addr is empty")
+	check(c.Server.ShutdownTimeout.Duration > 0, "server.shutdown_timeout must be positive")
+	check(oneOf(c.Tracing.Exporter, TraceExporterNone, TraceExporterOTLP, TraceExporterStdout), "tracing.exporter %q is not none, otlp or stdout", c.Tracing.Exporter)
+	check(c.Dapr.PubsubName != "", "dapr.pubsub_name is empty")
+	check(oneOf(c.Dapr.StateStore.Type, StateStoreTypeDapr, StateStoreTypeMemory), "dapr.state_store.type %q is not dapr or memory", c.Dapr.StateStore.Type)
+	check(c.Dapr.StateStore.Type != StateStoreTypeDapr || c.Dapr.StateStore.Name != "", "dapr.state_store.name is empty")
+	check(c.Keel.BaseURL != "", "keel.base_url is empty")
+	check(c.EMQX.APIAddress != "", "emqx.api_address is empty")
+	check(len(c.Kafka.Brokers) > 0, "kafka.brokers is empty")
+	check(c.Kafka.Topic != "", "kafka.topic is empty")
+	check(oneOf(c.Kafka.CloudEventMode, CloudEventModeStructured, CloudEventModeBinary), "kafka.cloudevent_mode %q is not structured or binary", c.Kafka.CloudEventMode)
+	check(c.Presence.OfflineTTL.Duration >= 0 && c.Presence.GCInterval.Duration >= 0, "presence durations must not be negative")
+	check(c.Quality.FlapThreshold >= 0, "quality.flap_threshold must not be negative")
+	check(c.Quality.FlapWindow.Duration >= 0, "quality.flap_window must not be negative")
+	check(c.Dedup.TTL.Duration >= 0, "dedup.ttl must not be negative")
+	check(c.Dedup.MaxEntries >= 0, "dedup.max_entries must not be negative")
+	check(c.RateLimit.Messages >= 0 && c.RateLimit.Burst >= 0, "rate_limit.messages and rate_limit.burst must not be negative")
+	check(c.RateLimit.Messages == 0 || c.RateLimit.Interval.Duration > 0, "rate_limit.interval must be positive")
+	check(oneOf(c.Archive.Type, ArchiveTypeNone, ArchiveTypeFile, ArchiveTypeKafka), "archive.type %q is not none, file or kafka", c.Archive.Type)
+	check(c.Archive.Type != ArchiveTypeFile || c.Archive.Dir != "", "archive.dir is empty")
+	check(c.Archive.Type != ArchiveTypeKafka || c.Archive.Topic != "", "archive.topic is empty")
+	check(c.Archive.MaxFileSizeMB >= 0, "archive.max_file_size_mb must not be negative")
+	check(c.Archive.RotateInterval.Duration >= 0 && c.Archive.Retention.Duration >= 0, "archive durations must not be negative")
+	check(c.DeviceHTTP.PollTimeout.Duration > 0, "device_http.poll_timeout must be positive")
+	check(c.DeviceHTTP.IdleTimeout.Duration > c.DeviceHTTP.PollTimeout.Duration, "device_http.idle_timeout must be longer than device_http.poll_timeout")
+	check(c.DeviceHTTP.MaxBodyKB > 0, "device_http.max_body_kb must be positive")
+	check(c.DeviceHTTP.MaxPendingCommands > 0, "device_http.max_pending_commands must be positive")
+	check(c.DeviceHTTP.CommandTTL.Duration >= 0 && c.DeviceHTTP.TokenCacheTTL.Duration >= 0, "device_http durations must not be negative")
+	if c.CoAP.Enabled {
+		check(c.CoAP.Addr != "" || c.CoAP.DTLSAddr != "", "coap.addr and coap.dtls_addr are empty")
+		check(c.CoAP.DTLSAddr == "" || c.CoAP.PSKSecret != "", "coap.psk_secret is empty")
+		check(c.CoAP.IdleTimeout.Duration > 0, "coap.idle_timeout must be positive")
+		check(c.CoAP.MaxMessageBytes > 0, "coap.max_message_bytes must be positive")
+		check(c.CoAP.TokenCacheTTL.Duration >= 0, "coap.token_cache_ttl must not be negative")
+	}
+	if c.LwM2M.Enabled {
+		check(strings.Contains(c.LwM2M.DownlinkTopic, "%e"), "lwm2m.downlink_topic %q has no %%e", c.LwM2M.DownlinkTopic)
+		check(c.LwM2M.RequestTTL.Duration > 0, "lwm2m.request_ttl must be positive")
+	}
+	if c.LoRaWAN.Enabled {
+		check(c.LoRaWAN.WebhookToken != "", "lorawan.webhook_token is empty")
+		check(c.LoRaWAN.FPort > 0 && c.LoRaWAN.FPort < 224, "lorawan.f_port %d is not 1-223", c.LoRaWAN.FPort)
+		check(c.LoRaWAN.IdleTimeout.Duration > 0, "lorawan.idle_timeout must be positive")
+		check(c.LoRaWAN.TokenCacheTTL.Duration >= 0, "lorawan.token_cache_ttl must not be negative")
+		check(c.LoRaWAN.TTS.APIURL == "" || c.LoRaWAN.TTS.WebhookID != "", "lorawan.tts.webhook_id is empty")
+	}
+	if c.Live.Enabled {
+		check(c.Live.Buffer > 0, "live.buffer must be positive")
+		check(c.Live.MaxConnections >= 0, "live.max_connections must not be negative")
+		check(c.Live.Heartbeat.Duration > 0, "live.heartbeat must be positive")
+	}
+	if c.Provision.Enabled {
+		check(c.Provision.AuditSize > 0, "provision.audit_size must be positive")
+		check(len(c.Provision.Products) > 0, "provision.products is empty")
+		keys := make(map[string]bool, len(c.Provision.Products))
+		for _, p := range c.Provision.Products {
+			check(p.Key != "" && !strings.Contains(p.Key, ":"), "provision.products key %q is empty or has a colon", p.Key)
+			check(!keys[p.Key], "provision.products key %q is duplicated", p.Key)
+			keys[p.Key] = true
+			check(p.Secret != "", "provision.products %q: secret is empty", p.Key)
+			check(p.Owner != "" && p.TenantID != "", "provision.products %q: owner or tenant_id is empty", p.Key)
+			check(p.MaxDevices >= 0, "provision.products %q: max_devices must not be negative", p.Key)
+		}
+	}
+	if c.Sparkplug.Enabled {
+		check(strings.Contains(c.Sparkplug.DeviceID, "%d"), "sparkplug.device_id %q has no %%d", c.Sparkplug.DeviceID)
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Reloadable returns a copy of c with the settings of next that are safe to
+// apply at runtime, and the names of the changed settings that need a restart.
+func (c *Config) Reloadable(next *Config) (*Config, []string) {
+	out := *c
+	out.Log.Level = next.Log.Level
+	out.Kafka.CloudEventMode = next.Kafka.CloudEventMode
+	out.Quality = next.Quality
+	out.Dedup.TTL = next.Dedup.TTL
+	out.Dedup.PayloadHash = next.Dedup.PayloadHash
+	out.RateLimit = next.RateLimit
+	// codecs and object models
+	out.LwM2M.Objects = next.LwM2M.Objects
+	out.LoRaWAN.Codec = next.LoRaWAN.Codec
+	out.Exhook = next.Exhook
+
+	var restart []string
+	// everything not copied above must be equal, compare section by section
+	cur, nxt := reflect.ValueOf(out), reflect.ValueOf(*next)
+	for i := 0; i < cur.NumField(); i++ {
+		if !reflect.DeepEqual(cur.Field(i).Interface(), nxt.Field(i).Interface()) {
+			restart = append(restart, cur.Type().Field(i).Tag.Get("yaml"))
+		}
+	}
+	return &out, restart
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "iothub.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDefault_Valid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeConfig(t, `
+log:
+  level: info
+server:
+  http_addr: ":8081"
+  shutdown_timeout: 10s
+kafka:
+  brokers: [k1:9092]
+quality:
+  flap_window: 1m
+`)
+	t.Setenv(EnvKafkaService, "k2:9092;k3:9092")
+	t.Setenv(EnvFlapThreshold, "3")
+	fs := flag.NewFlagSet("iothub", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-config", path, "-http_addr", ":8082"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := flags.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Log.Level != "info" || c.Server.ShutdownTimeout.Duration != 10*time.Second || c.Quality.FlapWindow.Duration != time.Minute {
+		t.Fatalf("file values not loaded %+v", c)
+	}
+	if strings.Join(c.Kafka.Brokers, ",") != "k2:9092,k3:9092" || c.Quality.FlapThreshold != 3 {
+		t.Fatalf("env overrides not applied %+v", c)
+	}
+	if c.Server.HTTPAddr != ":8082" || c.Server.GRPCAddr != ":9000" {
+		t.Fatalf("flag overrides not applied %+v", c.Server)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	if _, err := Load(writeConfig(t, "unknown: 1\n")); err == nil {
+		t.Fatal("unknown key accepted")
+	}
+	if _, err := Load(writeConfig(t, "dedup:\n  ttl: soon\n")); err == nil {
+		t.Fatal("invalid duration accepted")
+	}
+	c, err := Load(writeConfig(t, "kafka:\n  cloudevent_mode: xml\n  brokers: []\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "cloudevent_mode") || !strings.Contains(err.Error(), "brokers") {
+		t.Fatalf("want both errors, got %v", err)
+	}
+}
+
+func TestFlags_Validate(t *testing.T) {
+	path := writeConfig(t, "lorawan:\n  codec: xml\n")
+	fs := flag.NewFlagSet("iothub", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-config", path}); err != nil {
+		t.Fatal(err)
+	}
+	// the domain packages check their settings
+	var checked string
+	flags.Validate = func(c *Config) error {
+		checked = c.LoRaWAN.Codec
+		return errors.New("unknown codec")
+	}
+	if _, err := flags.Load(); err == nil || checked != "xml" {
+		t.Fatalf("domain settings not checked, %v", err)
+	}
+}
+
+func TestEnv_ExhookTopics(t *testing.T) {
+	t.Setenv(EnvExhookHooks, "client.connected, message.publish")
+	t.Setenv(EnvExhookTopics, "message.publish=+/v1/#, lwm2m/#")
+	c, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Exhook.Hooks) != 2 || strings.Join(c.Exhook.Topics["message.publish"], " ") != "+/v1/# lwm2m/#" {
+		t.Fatalf("unexpected config %+v", c.Exhook)
+	}
+	t.Setenv(EnvExhookTopics, "message.publish=+/v1/#;invalid")
+	if _, err := Load(""); err == nil {
+		t.Fatal("invalid topics accepted")
+	}
+}
+
+func TestWatcher_Reload(t *testing.T) {
+	path := writeConfig(t, "log:\n  level: debug\nserver:\n  http_addr: \":8081\"\n")
+	fs := flag.NewFlagSet("iothub", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-config", path}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := flags.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWatcher(flags, c)
+	var got *Config
+	w.OnReload(func(c *Config) { got = c })
+
+	// safe settings apply, the listen address waits for a restart
+	if err := ioutil.WriteFile(path, []byte("log:\n  level: warn\nserver:\n  http_addr: \":9090\"\nquality:\n  flap_threshold: 2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Log.Level != "warn" || got.Quality.FlapThreshold != 2 || got.Server.HTTPAddr != ":8081" {
+		t.Fatalf("unexpected reloaded config %+v", got)
+	}
+
+	// an invalid file keeps the current config
+	if err := ioutil.WriteFile(path, []byte("log:\n  level: loud\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Reload(); err == nil {
+		t.Fatal("invalid config reloaded")
+	}
+	if w.Current().Log.Level != "warn" {
+		t.Fatalf("current config replaced by invalid one")
+	}
+}
+
+func TestConfig_Reloadable(t *testing.T) {
+	cur, next := Default(), Default()
+	next.Dedup.TTL = Duration{time.Minute}
+	next.Dedup.Shared = true
+	next.EMQX.Password = "secret"
+	next.RateLimit.Messages = 10
+	next.LoRaWAN.Codec = "json"
+	next.LwM2M.Objects = []LwM2MObject{{ID: 3303, Name: "temperature"}}
+	out, restart := cur.Reloadable(next)
+	if out.Dedup.TTL.Duration != time.Minute || out.Dedup.Shared || out.EMQX.Password != "public" ||
+		out.RateLimit.Messages != 10 || out.LoRaWAN.Codec != "json" || len(out.LwM2M.Objects) != 1 {
+		t.Fatalf("unexpected reloadable config %+v", out)
+	}
+	if strings.Join(restart, ",") != "emqx,dedup" {
+		t.Fatalf("unexpected restart sections %v", restart)
+	}
+}
+
+func TestLoad_Example(t *testing.T) {
+	c, err := Load("../../example/iothub.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	def := Default()
+	def.Exhook = c.Exhook
+	if _, restart := def.Reloadable(c); len(restart) > 0 {
+		t.Fatalf("example differs from defaults in %v", restart)
+	}
+}
@@ -0,0 +1,212 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// environment variables overriding the configuration file
+const (
+	EnvLogLevel        = `LOG_LEVEL`
+	EnvShutdownTimeout = `SHUTDOWN_TIMEOUT`
+	EnvTraceExporter   = `OTEL_TRACES_EXPORTER`
+	EnvPubsubName      = `PUBSUB_NAME`
+	EnvStateStoreType  = `STATE_STORE_TYPE`
+	EnvStateStoreName  = `STATE_STORE_NAME`
+	EnvKeelBaseURL     = `KEEL_BASE_URL`
+	EnvEMQXAPIAddress  = `EMQX_API_ADDRESS`
+	EnvEMQXUsername    = `EMQX_API_USERNAME`
+	EnvEMQXPassword    = `EMQX_API_PASSWORD`
+	// semicolon separated brokers
+	EnvKafkaService        = `KAFKA_SERVICE`
+	EnvKafkaVersion        = `KAFKA_VERSION`
+	EnvCorePubTopic        = `CORE_PUB_TOPIC`
+	EnvCloudEventMode      = `CLOUDEVENT_MODE`
+	EnvMetricsDeviceStatus = `METRICS_DEVICE_STATUS`
+	EnvPresenceOfflineTTL  = `PRESENCE_OFFLINE_TTL`
+	EnvPresenceGCInterval  = `PRESENCE_GC_INTERVAL`
+	EnvFlapThreshold       = `FLAP_THRESHOLD`
+	EnvFlapWindow          = `FLAP_WINDOW`
+	EnvFlapThrottle        = `FLAP_THROTTLE`
+	EnvDedupTTL            = `DEDUP_TTL`
+	EnvDedupMaxEntries     = `DEDUP_MAX_ENTRIES`
+	EnvDedupPayloadHash    = `DEDUP_PAYLOAD_HASH`
+	EnvDedupShared         = `DEDUP_SHARED`
+	EnvRateLimitMessages   = `RATE_LIMIT_MESSAGES`
+	EnvRateLimitInterval   = `RATE_LIMIT_INTERVAL`
+	EnvRateLimitBurst      = `RATE_LIMIT_BURST`
+	EnvArchiveType         = `ARCHIVE_TYPE`
+	EnvArchiveDir          = `ARCHIVE_DIR`
+	EnvArchiveRetention    = `ARCHIVE_RETENTION`
+	EnvArchiveTopic        = `ARCHIVE_TOPIC`
+	EnvDeviceHTTPEnabled   = `DEVICE_HTTP_ENABLED`
+	EnvDeviceIdleTimeout   = `DEVICE_IDLE_TIMEOUT`
+	EnvCoAPEnabled         = `COAP_ENABLED`
+	EnvCoAPAddr            = `COAP_ADDR`
+	EnvCoAPDTLSAddr        = `COAP_DTLS_ADDR`
+	EnvCoAPPSKSecret       = `COAP_PSK_SECRET`
+	EnvLwM2MEnabled        = `LWM2M_ENABLED`
+	EnvLwM2MDownlinkTopic  = `LWM2M_DOWNLINK_TOPIC`
+	EnvSparkplugEnabled    = `SPARKPLUG_ENABLED`
+	EnvSparkplugDeviceID   = `SPARKPLUG_DEVICE_ID`
+	EnvLoRaWANEnabled      = `LORAWAN_ENABLED`
+	EnvLoRaWANWebhookToken = `LORAWAN_WEBHOOK_TOKEN`
+	EnvLoRaWANCodec        = `LORAWAN_CODEC`
+	EnvChirpStackAPIURL    = `CHIRPSTACK_API_URL`
+	EnvChirpStackAPIKey    = `CHIRPSTACK_API_KEY`
+	EnvTTSAPIURL           = `TTS_API_URL`
+	EnvTTSAPIKey           = `TTS_API_KEY`
+	EnvLiveEnabled         = `LIVE_ENABLED`
+	EnvLiveMaxConnections  = `LIVE_MAX_CONNECTIONS`
+	EnvProvisionEnabled    = `PROVISION_ENABLED`
+	// comma separated hooks to register, e.g. client.connected,message.publish
+	EnvExhookHooks = `EXHOOK_HOOKS`
+	// topic filters of message hooks, e.g. message.publish=+/v1/#,lwm2m/#;message.acked=+/v1/#
+	EnvExhookTopics = `EXHOOK_TOPICS`
+)
+
+// SplitList splits s by sep, dropping blank items.
+func SplitList(s, sep string) []string {
+	var out []string
+	for _, v := range strings.Split(s, sep) {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// envParser applies the set environment variables and keeps the first error.
+type envParser struct {
+	err error
+}
+
+func (p *envParser) fail(name, value string, err error) {
+	if p.err == nil {
+		p.err = errors.Wrapf(err, "invalid %s=%s", name, value)
+	}
+}
+
+func (p *envParser) string(name string, dst *string) {
+	if v := os.Getenv(name); v != "" {
+		*dst = v
+	}
+}
+
+func (p *envParser) int(name string, dst *int) {
+	if v := os.Getenv(name); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			p.fail(name, v, err)
+			return
+		}
+		*dst = n
+	}
+}
+
+func (p *envParser) bool(name string, dst *bool) {
+	if v := os.Getenv(name); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			p.fail(name, v, err)
+			return
+		}
+		*dst = b
+	}
+}
+
+func (p *envParser) duration(name string, dst *Duration) {
+	if v := os.Getenv(name); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			p.fail(name, v, err)
+			return
+		}
+		dst.Duration = d
+	}
+}
+
+func (p *envParser) list(name, sep string, dst *[]string) {
+	if v := os.Getenv(name); v != "" {
+		*dst = SplitList(v, sep)
+	}
+}
+
+func (p *envParser) hookTopics(name string, dst *map[string][]string) {
+	v := os.Getenv(name)
+	if v == "" {
+		return
+	}
+	topics := make(map[string][]string)
+	for _, item := range SplitList(v, ";") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			p.fail(name, v, errors.Errorf("item %s, want hook=filter,filter", item))
+			return
+		}
+		topics[strings.TrimSpace(kv[0])] = SplitList(kv[1], ",")
+	}
+	*dst = topics
+}
+
+func (c *Config) applyEnv() error {
+	p := &envParser{}
+	p.string(EnvLogLevel, &c.Log.Level)
+	p.duration(EnvShutdownTimeout, &c.Server.ShutdownTimeout)
+	p.string(EnvTraceExporter, &c.Tracing.Exporter)
+	p.string(EnvPubsubName, &c.Dapr.PubsubName)
+	p.string(EnvStateStoreType, &c.Dapr.StateStore.Type)
+	p.string(EnvStateStoreName, &c.Dapr.StateStore.Name)
+	p.string(EnvKeelBaseURL, &c.Keel.BaseURL)
+	p.string(EnvEMQXAPIAddress, &c.EMQX.APIAddress)
+	p.string(EnvEMQXUsername, &c.EMQX.Username)
+	p.string(EnvEMQXPassword, &c.EMQX.Password)
+	p.list(EnvKafkaService, ";", &c.Kafka.Brokers)
+	p.string(EnvKafkaVersion, &c.Kafka.Version)
+	p.string(EnvCorePubTopic, &c.Kafka.Topic)
+	p.string(EnvCloudEventMode, &c.Kafka.CloudEventMode)
+	p.bool(EnvMetricsDeviceStatus, &c.Presence.DeviceMetric)
+	p.duration(EnvPresenceOfflineTTL, &c.Presence.OfflineTTL)
+	p.duration(EnvPresenceGCInterval, &c.Presence.GCInterval)
+	p.int(EnvFlapThreshold, &c.Quality.FlapThreshold)
+	p.duration(EnvFlapWindow, &c.Quality.FlapWindow)
+	p.bool(EnvFlapThrottle, &c.Quality.FlapThrottle)
+	p.duration(EnvDedupTTL, &c.Dedup.TTL)
+	p.int(EnvDedupMaxEntries, &c.Dedup.MaxEntries)
+	p.bool(EnvDedupPayloadHash, &c.Dedup.PayloadHash)
+	p.bool(EnvDedupShared, &c.Dedup.Shared)
+	p.int(EnvRateLimitMessages, &c.RateLimit.Messages)
+	p.duration(EnvRateLimitInterval, &c.RateLimit.Interval)
+	p.int(EnvRateLimitBurst, &c.RateLimit.Burst)
+	p.list(EnvExhookHooks, ",", &c.Exhook.Hooks)
+	p.hookTopics(EnvExhookTopics, &c.Exhook.Topics)
+	p.string(EnvArchiveType, &c.Archive.Type)
+	p.string(EnvArchiveDir, &c.Archive.Dir)
+	p.duration(EnvArchiveRetention, &c.Archive.Retention)
+	p.string(EnvArchiveTopic, &c.Archive.Topic)
+	p.bool(EnvDeviceHTTPEnabled, &c.DeviceHTTP.Enabled)
+	p.duration(EnvDeviceIdleTimeout, &c.DeviceHTTP.IdleTimeout)
+	p.bool(EnvCoAPEnabled, &c.CoAP.Enabled)
+	p.string(EnvCoAPAddr, &c.CoAP.Addr)
+	p.string(EnvCoAPDTLSAddr, &c.CoAP.DTLSAddr)
+	p.string(EnvCoAPPSKSecret, &c.CoAP.PSKSecret)
+	p.bool(EnvLwM2MEnabled, &c.LwM2M.Enabled)
+	p.string(EnvLwM2MDownlinkTopic, &c.LwM2M.DownlinkTopic)
+	p.bool(EnvSparkplugEnabled, &c.Sparkplug.Enabled)
+	p.string(EnvSparkplugDeviceID, &c.Sparkplug.DeviceID)
+	p.bool(EnvLoRaWANEnabled, &c.LoRaWAN.Enabled)
+	p.string(EnvLoRaWANWebhookToken, &c.LoRaWAN.WebhookToken)
+	p.string(EnvLoRaWANCodec, &c.LoRaWAN.Codec)
+	p.string(EnvChirpStackAPIURL, &c.LoRaWAN.ChirpStack.APIURL)
+	p.string(EnvChirpStackAPIKey, &c.LoRaWAN.ChirpStack.APIKey)
+	p.string(EnvTTSAPIURL, &c.LoRaWAN.TTS.APIURL)
+	p.string(EnvTTSAPIKey, &c.LoRaWAN.TTS.APIKey)
+	p.bool(EnvLiveEnabled, &c.Live.Enabled)
+	p.int(EnvLiveMaxConnections, &c.Live.MaxConnections)
+	p.bool(EnvProvisionEnabled, &c.Provision.Enabled)
+	return p.err
+}
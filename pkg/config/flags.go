@@ -0,0 +1,83 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"time"
+)
+
+// EnvConfigFile is the configuration file used when -config is not set.
+const EnvConfigFile = `IOTHUB_CONFIG`
+
+// Flags are the command line overrides, they win over the file and env.
+type Flags struct {
+	fs *flag.FlagSet
+	// Path is the configuration file.
+	Path string
+	// Validate checks the settings interpreted by the domain packages,
+	// e.g. codecs and object models, after Config.Validate. Optional.
+	Validate func(*Config) error
+
+	logLevel        string
+	httpAddr        string
+	grpcAddr        string
+	traceExporter   string
+	stateStoreType  string
+	stateStoreName  string
+	shutdownTimeout time.Duration
+}
+
+// RegisterFlags defines the configuration flags on fs.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{fs: fs}
+	fs.StringVar(&f.Path, "config", os.Getenv(EnvConfigFile), "config file path.")
+	fs.StringVar(&f.logLevel, "log_level", "", "log level, debug, info, warn or error.")
+	fs.StringVar(&f.httpAddr, "http_addr", "", "http listen address.")
+	fs.StringVar(&f.grpcAddr, "grpc_addr", "", "grpc listen address.")
+	fs.StringVar(&f.traceExporter, "trace_exporter", "", "trace exporter, none, otlp or stdout.")
+	fs.StringVar(&f.stateStoreType, "state_store_type", "", "state store type, dapr or memory.")
+	fs.StringVar(&f.stateStoreName, "state_store", "", "dapr state store component name.")
+	fs.DurationVar(&f.shutdownTimeout, "shutdown_timeout", 0, "graceful shutdown timeout.")
+	return f
+}
+
+// Apply sets the flags given on the command line on c.
+func (f *Flags) Apply(c *Config) {
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "log_level":
+			c.Log.Level = f.logLevel
+		case "http_addr":
+			c.Server.HTTPAddr = f.httpAddr
+		case "grpc_addr":
+			c.Server.GRPCAddr = f.grpcAddr
+		case "trace_exporter":
+			c.Tracing.Exporter = f.traceExporter
+		case "state_store_type":
+			c.Dapr.StateStore.Type = f.stateStoreType
+		case "state_store":
+			c.Dapr.StateStore.Name = f.stateStoreName
+		case "shutdown_timeout":
+			c.Server.ShutdownTimeout = Duration{f.shutdownTimeout}
+		}
+	})
+}
+
+// Load loads the configuration file of the flags, applies the flags and
+// validates the result.
+func (f *Flags) Load() (*Config, error) {
+	c, err := Load(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	f.Apply(c)
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if f.Validate != nil {
+		if err := f.Validate(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
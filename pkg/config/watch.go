@@ -0,0 +1,117 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tkeel-io/kit/log"
+)
+
+// default poll interval of the configuration file
+const defaultWatchInterval = 5 * time.Second
+
+// Watcher reloads the configuration on file change or SIGHUP and passes the
+// settings safe to change at runtime to the reload callbacks. The other
+// changed settings are logged and take effect on the next restart.
+type Watcher struct {
+	flags    *Flags
+	interval time.Duration
+
+	lock     sync.Mutex
+	current  *Config
+	modTime  time.Time
+	onReload []func(*Config)
+}
+
+func NewWatcher(flags *Flags, current *Config) *Watcher {
+	w := &Watcher{
+		flags:    flags,
+		interval: defaultWatchInterval,
+		current:  current,
+	}
+	w.modTime, _ = w.stat()
+	return w
+}
+
+// OnReload registers fn, called with the new configuration after each reload.
+func (w *Watcher) OnReload(fn func(*Config)) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.onReload = append(w.onReload, fn)
+}
+
+// Current returns the configuration in effect.
+func (w *Watcher) Current() *Config {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.current
+}
+
+func (w *Watcher) stat() (time.Time, error) {
+	info, err := os.Stat(w.flags.Path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// Reload loads the configuration again, an invalid one is rejected and the
+// current one kept.
+func (w *Watcher) Reload() error {
+	next, err := w.flags.Load()
+	if err != nil {
+		return err
+	}
+	w.lock.Lock()
+	conf, restart := w.current.Reloadable(next)
+	w.current = conf
+	callbacks := append([]func(*Config){}, w.onReload...)
+	w.lock.Unlock()
+
+	if len(restart) > 0 {
+		log.Warnf("config %v changed, restart to apply", restart)
+	}
+	log.Infof("config reloaded from %s", w.flags.Path)
+	for _, fn := range callbacks {
+		fn(conf)
+	}
+	return nil
+}
+
+func (w *Watcher) reload() {
+	if err := w.Reload(); err != nil {
+		log.Errorf("reload config err, %v", err)
+	}
+}
+
+// Run reloads on SIGHUP and when the file changes until ctx is done, it
+// returns at once when there is no configuration file.
+func (w *Watcher) Run(ctx context.Context) {
+	if w.flags.Path == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			w.reload()
+		case <-ticker.C:
+			modTime, err := w.stat()
+			if err != nil || modTime.Equal(w.modTime) {
+				continue
+			}
+			w.modTime = modTime
+			w.reload()
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package exhooktest
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/tkeel-io/iothub/protobuf"
+)
+
+const emqxNode = "emqx@127.0.0.1"
+
+var msgSeq uint64
+
+// Device is an MQTT client of EMQX, its methods call the hooks in the
+// order EMQX calls them for each client action.
+type Device struct {
+	hook pb.HookProviderClient
+	Info *pb.ClientInfo
+}
+
+// Device returns an MQTT device of the harness authenticating with id as
+// username and token as password.
+func (h *Harness) Device(id, token string) *Device {
+	return NewDevice(h.Hook, id, token)
+}
+
+// NewDevice returns an MQTT device calling the hooks of any exhook server,
+// e.g. a running iothub.
+func NewDevice(hook pb.HookProviderClient, id, token string) *Device {
+	return &Device{hook: hook, Info: &pb.ClientInfo{
+		Node:       emqxNode,
+		Clientid:   id,
+		Username:   id,
+		Password:   token,
+		Peerhost:   "127.0.0.1",
+		Sockport:   1883,
+		Protocol:   "mqtt",
+		Mountpoint: id + "/",
+	}}
+}
+
+// LwM2MDevice returns a device of the EMQX LwM2M gateway, its endpoint name
+// id@token carries the credentials. Its messages are mounted on
+// lwm2m/{ep}/, publish them to up/resp and up/notify.
+func (h *Harness) LwM2MDevice(id, token string) *Device {
+	ep := id + "@" + token
+	d := NewDevice(h.Hook, ep, "")
+	d.Info.Username = ""
+	d.Info.Sockport = 5683
+	d.Info.Protocol = "lwm2m"
+	d.Info.Mountpoint = "lwm2m/" + ep + "/"
+	return d
+}
+
+func (d *Device) connInfo() *pb.ConnInfo {
+	return &pb.ConnInfo{
+		Node:      emqxNode,
+		Clientid:  d.Info.Clientid,
+		Username:  d.Info.Username,
+		Peerhost:  d.Info.Peerhost,
+		Sockport:  d.Info.Sockport,
+		ProtoName: "MQTT",
+		ProtoVer:  "4",
+		Keepalive: 60,
+	}
+}
+
+func result(resp *pb.ValuedResponse) bool {
+	if resp.GetType() == pb.ValuedResponse_IGNORE {
+		return true
+	}
+	return resp.GetBoolResult()
+}
+
+// Authenticate calls client.authenticate and returns whether it passed.
+func (d *Device) Authenticate(ctx context.Context) (bool, error) {
+	resp, err := d.hook.OnClientAuthenticate(ctx, &pb.ClientAuthenticateRequest{Clientinfo: d.Info})
+	if err != nil {
+		return false, err
+	}
+	return result(resp), nil
+}
+
+// Connect runs the hooks of an MQTT CONNECT, the session is only created
+// when authentication passes.
+func (d *Device) Connect(ctx context.Context) (bool, error) {
+	if _, err := d.hook.OnClientConnect(ctx, &pb.ClientConnectRequest{Conninfo: d.connInfo()}); err != nil {
+		return false, err
+	}
+	ok, err := d.Authenticate(ctx)
+	if err != nil {
+		return false, err
+	}
+	code := "success"
+	if !ok {
+		code = "not_authorized"
+	}
+	if _, err := d.hook.OnClientConnack(ctx, &pb.ClientConnackRequest{Conninfo: d.connInfo(), ResultCode: code}); err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, nil
+	}
+	if _, err := d.hook.OnSessionCreated(ctx, &pb.SessionCreatedRequest{Clientinfo: d.Info}); err != nil {
+		return false, err
+	}
+	if _, err := d.hook.OnClientConnected(ctx, &pb.ClientConnectedRequest{Clientinfo: d.Info}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func topicFilters(filters []string) []*pb.TopicFilter {
+	tfs := make([]*pb.TopicFilter, 0, len(filters))
+	for _, f := range filters {
+		tfs = append(tfs, &pb.TopicFilter{Name: f, Qos: 1})
+	}
+	return tfs
+}
+
+// Subscribe runs the hooks of an MQTT SUBSCRIBE and returns whether each
+// filter is granted in the SUBACK.
+func (d *Device) Subscribe(ctx context.Context, filters ...string) ([]bool, error) {
+	if _, err := d.hook.OnClientSubscribe(ctx, &pb.ClientSubscribeRequest{Clientinfo: d.Info, TopicFilters: topicFilters(filters)}); err != nil {
+		return nil, err
+	}
+	granted := make([]bool, len(filters))
+	for i, f := range filters {
+		resp, err := d.hook.OnClientCheckAcl(ctx, &pb.ClientCheckAclRequest{
+			Clientinfo: d.Info,
+			Type:       pb.ClientCheckAclRequest_SUBSCRIBE,
+			Topic:      f,
+			Result:     true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if granted[i] = result(resp); !granted[i] {
+			continue
+		}
+		if _, err := d.hook.OnSessionSubscribed(ctx, &pb.SessionSubscribedRequest{
+			Clientinfo: d.Info,
+			Topic:      f,
+			Subopts:    &pb.SubOpts{Qos: 1},
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return granted, nil
+}
+
+// Unsubscribe runs the hooks of an MQTT UNSUBSCRIBE.
+func (d *Device) Unsubscribe(ctx context.Context, filters ...string) error {
+	if _, err := d.hook.OnClientUnsubscribe(ctx, &pb.ClientUnsubscribeRequest{Clientinfo: d.Info, TopicFilters: topicFilters(filters)}); err != nil {
+		return err
+	}
+	for _, f := range filters {
+		if _, err := d.hook.OnSessionUnsubscribed(ctx, &pb.SessionUnsubscribedRequest{Clientinfo: d.Info, Topic: f}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Message returns a message of the device to topic, mounted like EMQX does.
+func (d *Device) Message(topic string, payload []byte) *pb.Message {
+	return &pb.Message{
+		Node:      emqxNode,
+		Id:        strconv.FormatUint(atomic.AddUint64(&msgSeq, 1), 16),
+		Qos:       1,
+		From:      d.Info.Clientid,
+		Topic:     d.Info.Mountpoint + topic,
+		Payload:   payload,
+		Timestamp: uint64(time.Now().UnixMilli()),
+	}
+}
+
+// Publish runs the hooks of an MQTT PUBLISH of payload to topic, it
+// returns whether the message is allowed.
+func (d *Device) Publish(ctx context.Context, topic string, payload []byte) (bool, error) {
+	return d.PublishMessage(ctx, d.Message(topic, payload))
+}
+
+// PublishMessage runs the hooks of an MQTT PUBLISH of msg, for
+// retransmissions of the same message.
+func (d *Device) PublishMessage(ctx context.Context, msg *pb.Message) (bool, error) {
+	resp, err := d.hook.OnClientCheckAcl(ctx, &pb.ClientCheckAclRequest{
+		Clientinfo: d.Info,
+		Type:       pb.ClientCheckAclRequest_PUBLISH,
+		Topic:      msg.GetTopic(),
+		Result:     true,
+	})
+	if err != nil || !result(resp) {
+		return false, err
+	}
+	pubResp, err := d.hook.OnMessagePublish(ctx, &pb.MessagePublishRequest{Message: msg})
+	if err != nil {
+		return false, err
+	}
+	return result(pubResp), nil
+}
+
+// Disconnect runs the hooks of a disconnect ending the session.
+func (d *Device) Disconnect(ctx context.Context) error {
+	if _, err := d.hook.OnClientDisconnected(ctx, &pb.ClientDisconnectedRequest{Clientinfo: d.Info, Reason: "normal"}); err != nil {
+		return err
+	}
+	_, err := d.hook.OnSessionTerminated(ctx, &pb.SessionTerminatedRequest{Clientinfo: d.Info, Reason: "normal"})
+	return err
+}
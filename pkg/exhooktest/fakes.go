@@ -0,0 +1,531 @@
+package exhooktest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/pkg/errors"
+	v1 "github.com/tkeel-io/core/api/core/v1"
+	"github.com/tkeel-io/iothub/pkg/service"
+)
+
+// Keel fakes the keel security api parsing and issuing device tokens and
+// the core entity and subscription apis, reached through the dapr sidecar.
+type Keel struct {
+	*httptest.Server
+
+	lock          sync.Mutex
+	tokens        map[string]service.TokenValidResponseData
+	subscriptions map[string]*v1.SubscriptionObject
+	entities      map[string]Entity
+	failStatus    int
+	issued        int
+}
+
+// Entity is an entity created through the core api.
+type Entity struct {
+	ID       string
+	Owner    string
+	TenantID string
+	Type     string
+	Source   string
+	// Properties is the request body.
+	Properties map[string]interface{}
+}
+
+func NewKeel() *Keel {
+	k := &Keel{
+		tokens:        make(map[string]service.TokenValidResponseData),
+		subscriptions: make(map[string]*v1.SubscriptionObject),
+		entities:      make(map[string]Entity),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/security/v1/entity/info/", k.entityInfo)
+	mux.HandleFunc("/security/v1/entity/token", k.createToken)
+	mux.HandleFunc("/core/v1/subscriptions", k.createSubscription)
+	mux.HandleFunc("/core/v1/entities", k.createEntity)
+	mux.HandleFunc("/core/v1/entities/", k.getEntity)
+	k.Server = httptest.NewServer(mux)
+	return k
+}
+
+// AddToken makes token authenticate device devId of owner and tenantId.
+func (k *Keel) AddToken(token, devId, owner, tenantId string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.tokens[token] = service.TokenValidResponseData{
+		EntityID:   devId,
+		EntityType: "device",
+		Owner:      owner,
+		TenantID:   tenantId,
+	}
+}
+
+// FailSubscriptions makes the core subscription api answer with status,
+// 0 for ok.
+func (k *Keel) FailSubscriptions(status int) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.failStatus = status
+}
+
+// Subscriptions returns the core subscriptions by id.
+func (k *Keel) Subscriptions() map[string]*v1.SubscriptionObject {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	out := make(map[string]*v1.SubscriptionObject, len(k.subscriptions))
+	for id, sub := range k.subscriptions {
+		out[id] = sub
+	}
+	return out
+}
+
+// AddEntity adds an entity to core, as if created by its owner.
+func (k *Keel) AddEntity(e Entity) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.entities[e.ID] = e
+}
+
+// Entities returns the core entities by id.
+func (k *Keel) Entities() map[string]Entity {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	out := make(map[string]Entity, len(k.entities))
+	for id, e := range k.entities {
+		out[id] = e
+	}
+	return out
+}
+
+// tenantOf returns the tenant of the keel auth header of r.
+func tenantOf(r *http.Request) string {
+	b, err := base64.StdEncoding.DecodeString(r.Header.Get("x-tKeel-auth"))
+	if err != nil {
+		return ""
+	}
+	values, err := url.ParseQuery(string(b))
+	if err != nil {
+		return ""
+	}
+	return values.Get("tenant")
+}
+
+func (k *Keel) createEntity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e := Entity{
+		ID:       r.URL.Query().Get("id"),
+		Owner:    r.URL.Query().Get("owner"),
+		TenantID: tenantOf(r),
+		Type:     r.URL.Query().Get("type"),
+		Source:   r.URL.Query().Get("source"),
+	}
+	if err := json.NewDecoder(r.Body).Decode(&e.Properties); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, ok := k.entities[e.ID]; ok {
+		http.Error(w, "entity exists", http.StatusConflict)
+		return
+	}
+	k.entities[e.ID] = e
+	writeJSON(w, map[string]interface{}{"id": e.ID})
+}
+
+// getEntity returns an entity, those of other tenants are not found.
+func (k *Keel) getEntity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	k.lock.Lock()
+	e, ok := k.entities[strings.TrimPrefix(r.URL.Path, "/core/v1/entities/")]
+	k.lock.Unlock()
+	if !ok || e.TenantID != tenantOf(r) {
+		http.Error(w, "entity not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"id":         e.ID,
+		"owner":      e.Owner,
+		"type":       e.Type,
+		"source":     e.Source,
+		"properties": e.Properties,
+	})
+}
+
+// createToken issues a token of an entity, it authenticates the entity
+// from then on.
+func (k *Keel) createToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		EntityID   string `json:"entity_id"`
+		EntityType string `json:"entity_type"`
+		Owner      string `json:"owner"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.EntityID == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	k.lock.Lock()
+	k.issued++
+	token := fmt.Sprintf("issued-%d", k.issued)
+	k.tokens[token] = service.TokenValidResponseData{
+		EntityID:   req.EntityID,
+		EntityType: req.EntityType,
+		Owner:      req.Owner,
+		TenantID:   tenantOf(r),
+	}
+	k.lock.Unlock()
+	writeJSON(w, map[string]interface{}{
+		"code": "io.tkeel.SUCCESS",
+		"msg":  "ok",
+		"data": map[string]interface{}{"token": token},
+	})
+}
+
+func (k *Keel) entityInfo(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/security/v1/entity/info/")
+	k.lock.Lock()
+	data, ok := k.tokens[token]
+	k.lock.Unlock()
+	if !ok {
+		http.Error(w, "invalid token", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, &service.TokenValidResponse{Code: "io.tkeel.SUCCESS", Msg: "ok", Data: data})
+}
+
+func (k *Keel) createSubscription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sub := &v1.SubscriptionObject{}
+	if err := json.NewDecoder(r.Body).Decode(sub); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.failStatus != 0 {
+		http.Error(w, "fail", k.failStatus)
+		return
+	}
+	if _, ok := k.subscriptions[id]; ok {
+		http.Error(w, "subscription exists", http.StatusConflict)
+		return
+	}
+	k.subscriptions[id] = sub
+	writeJSON(w, map[string]interface{}{"id": id})
+}
+
+func (k *Keel) deleteSubscription(id string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	delete(k.subscriptions, id)
+}
+
+// Published is a message published through the EMQX management api.
+type Published struct {
+	Topic    string          `json:"topic"`
+	Payload  json.RawMessage `json:"payload"`
+	QoS      int             `json:"qos"`
+	Retain   bool            `json:"retain"`
+	ClientID string          `json:"clientid"`
+	// Encoding is base64 for binary payloads, Payload is then a json string.
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Bytes returns the payload of a binary message.
+func (p Published) Bytes() ([]byte, error) {
+	var s string
+	if err := json.Unmarshal(p.Payload, &s); err != nil {
+		return nil, err
+	}
+	if p.Encoding != "base64" {
+		return []byte(s), nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// Emqx fakes the EMQX management api.
+type Emqx struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	published []Published
+	onPublish func(Published)
+	failTopic string
+	failed    []Published
+}
+
+func NewEmqx() *Emqx {
+	e := &Emqx{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v4/mqtt/publish", e.publish)
+	e.Server = httptest.NewServer(mux)
+	return e
+}
+
+// OnPublish calls fn with each message published, e.g. to deliver it to
+// simulated devices. Messages are no longer kept for Published.
+func (e *Emqx) OnPublish(fn func(Published)) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.onPublish = fn
+}
+
+// FailTopic makes the publish api fail the messages to topic, "" for none.
+func (e *Emqx) FailTopic(topic string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.failTopic = topic
+}
+
+// Failed returns the messages failed by FailTopic so far.
+func (e *Emqx) Failed() []Published {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]Published{}, e.failed...)
+}
+
+// Published returns the messages published so far.
+func (e *Emqx) Published() []Published {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]Published{}, e.published...)
+}
+
+func (e *Emqx) publish(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user == "" || pass == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var p Published
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e.lock.Lock()
+	if e.failTopic != "" && p.Topic == e.failTopic {
+		e.failed = append(e.failed, p)
+		e.lock.Unlock()
+		http.Error(w, "fail", http.StatusInternalServerError)
+		return
+	}
+	fn := e.onPublish
+	if fn == nil {
+		e.published = append(e.published, p)
+	}
+	e.lock.Unlock()
+	if fn != nil {
+		fn(p)
+	}
+	writeJSON(w, map[string]interface{}{"code": 0})
+}
+
+// Downlink is a downlink queued through a network server api.
+type Downlink struct {
+	// Network is chirpstack or tts.
+	Network string
+	Path    string
+	Body    json.RawMessage
+}
+
+// Network fakes the downlink apis of ChirpStack and The Things Stack.
+type Network struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	downlinks []Downlink
+}
+
+func NewNetwork() *Network {
+	n := &Network{}
+	n.Server = httptest.NewServer(http.HandlerFunc(n.push))
+	return n
+}
+
+// Downlinks returns the downlinks queued so far.
+func (n *Network) Downlinks() []Downlink {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]Downlink{}, n.downlinks...)
+}
+
+func (n *Network) push(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer "+NetworkAPIKey {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var network string
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/devices/") && strings.HasSuffix(r.URL.Path, "/queue"):
+		network = "chirpstack"
+	case strings.HasPrefix(r.URL.Path, "/api/v3/as/applications/") && strings.HasSuffix(r.URL.Path, "/down/push"):
+		network = "tts"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n.lock.Lock()
+	n.downlinks = append(n.downlinks, Downlink{Network: network, Path: r.URL.Path, Body: body})
+	n.lock.Unlock()
+	writeJSON(w, map[string]interface{}{})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Dapr fakes the dapr client calls of iothub, service invocation of keel
+// is served by the Keel fake. Other calls panic.
+type Dapr struct {
+	dapr.Client
+	keel *Keel
+}
+
+func (d *Dapr) InvokeMethodWithContent(ctx context.Context, appID, methodName, verb string, content *dapr.DataContent) ([]byte, error) {
+	u, err := url.Parse(methodName)
+	if err != nil {
+		return nil, err
+	}
+	const prefix = "apis/core/v1/subscriptions/"
+	if appID != "keel" || verb != http.MethodDelete || !strings.HasPrefix(u.Path, prefix) {
+		return nil, errors.Errorf("not faked: %s %s/%s", verb, appID, methodName)
+	}
+	d.keel.deleteSubscription(strings.TrimPrefix(u.Path, prefix))
+	return nil, nil
+}
+
+// Producer is a kafka producer acknowledging every message, it keeps them
+// for assertions.
+type Producer struct {
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+	closeOnce sync.Once
+	done      chan struct{}
+
+	lock      sync.Mutex
+	messages  []*sarama.ProducerMessage
+	onMessage func(*sarama.ProducerMessage)
+	fail      error
+}
+
+func NewProducer() *Producer {
+	p := &Producer{
+		input:     make(chan *sarama.ProducerMessage, 256),
+		successes: make(chan *sarama.ProducerMessage, 256),
+		errors:    make(chan *sarama.ProducerError, 256),
+		done:      make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *Producer) run() {
+	defer close(p.done)
+	defer close(p.errors)
+	defer close(p.successes)
+	for msg := range p.input {
+		p.lock.Lock()
+		fail, fn := p.fail, p.onMessage
+		if fail == nil && fn == nil {
+			p.messages = append(p.messages, msg)
+		}
+		p.lock.Unlock()
+		if fail != nil {
+			p.errors <- &sarama.ProducerError{Msg: msg, Err: fail}
+			continue
+		}
+		if fn != nil {
+			fn(msg)
+		}
+		p.successes <- msg
+	}
+}
+
+// OnMessage calls fn with each message acknowledged. Messages are no longer
+// kept for Events.
+func (p *Producer) OnMessage(fn func(*sarama.ProducerMessage)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.onMessage = fn
+}
+
+// FailWith fails the following messages with err, nil for ok.
+func (p *Producer) FailWith(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.fail = err
+}
+
+func (p *Producer) AsyncClose() {
+	p.closeOnce.Do(func() { close(p.input) })
+}
+
+func (p *Producer) Close() error {
+	p.AsyncClose()
+	<-p.done
+	return nil
+}
+
+func (p *Producer) Input() chan<- *sarama.ProducerMessage {
+	return p.input
+}
+
+func (p *Producer) Successes() <-chan *sarama.ProducerMessage {
+	return p.successes
+}
+
+func (p *Producer) Errors() <-chan *sarama.ProducerError {
+	return p.errors
+}
+
+// Events returns the structured cloudevents acknowledged so far.
+func (p *Producer) Events() ([]cloudevents.Event, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	events := make([]cloudevents.Event, 0, len(p.messages))
+	for _, msg := range p.messages {
+		value, err := msg.Value.Encode()
+		if err != nil {
+			return nil, err
+		}
+		ev := cloudevents.NewEvent()
+		if err := json.Unmarshal(value, &ev); err != nil {
+			return nil, errors.Wrap(err, "decode cloudevent")
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
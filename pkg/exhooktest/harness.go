@@ -0,0 +1,242 @@
+// Package exhooktest runs the iothub hook service in process and drives it
+// through the exhook gRPC API the way EMQX does, with fakes for dapr, keel,
+// the EMQX management api and kafka.
+package exhooktest
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	go_restful "github.com/emicklei/go-restful"
+	iothubv1 "github.com/tkeel-io/iothub/api/iothub/v1"
+	"github.com/tkeel-io/iothub/pkg/lorawan"
+	"github.com/tkeel-io/iothub/pkg/metrics"
+	"github.com/tkeel-io/iothub/pkg/service"
+	"github.com/tkeel-io/iothub/pkg/store"
+	"github.com/tkeel-io/iothub/pkg/tracing"
+	pb "github.com/tkeel-io/iothub/protobuf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	bufSize = 1 << 20
+
+	// PSKSecret derives the DTLS keys of devices, see service.DevicePSK.
+	PSKSecret = "harness-secret"
+	// WebhookToken authenticates the LoRaWAN webhooks, NetworkAPIKey the
+	// downlink apis of Network.
+	WebhookToken  = "harness-webhook"
+	NetworkAPIKey = "harness-network"
+
+	// pubsub topics of the core subscriptions, see charts/templates/subscription-iothub.yaml
+	CoreTopic        = "sub-core"
+	CoreChangedTopic = "sub-core-changed"
+)
+
+// Option changes the hook service config.
+type Option func(*service.Config)
+
+// Harness is a hook service wired to fakes, reached through gRPC, the
+// device http api, the LoRaWAN webhooks, the live data api, provisioning
+// and CoAP.
+type Harness struct {
+	// Hook and Topic are the gRPC clients EMQX and dapr use.
+	Hook  pb.HookProviderClient
+	Topic iothubv1.TopicClient
+	// HTTP serves the device http api, the LoRaWAN webhooks, the live data
+	// api, provisioning, presence and device records.
+	HTTP *httptest.Server
+	// CoAP serves CoAP on local udp ports, over DTLS with PSKSecret.
+	CoAP *service.CoAPService
+
+	// Config is the config of Service, e.g. to reload it changed.
+	Config    service.Config
+	Service   *service.HookService
+	Topics    *service.TopicService
+	Devices   *service.DeviceService
+	LoRaWAN   *service.LoRaWANService
+	Live      *service.LiveService
+	Provision *service.ProvisionService
+	Forwarder *service.Forwarder
+	Presence  *service.PresenceTracker
+	Store     *store.MemoryStore
+
+	Keel     *Keel
+	Emqx     *Emqx
+	Network  *Network
+	Dapr     *Dapr
+	Producer *Producer
+
+	srv  *grpc.Server
+	conn *grpc.ClientConn
+}
+
+// New starts a harness, it is stopped when t ends.
+func New(t testing.TB, opts ...Option) *Harness {
+	t.Helper()
+	h, err := Start(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := h.Close(); err != nil {
+			t.Errorf("close harness, %v", err)
+		}
+	})
+	return h
+}
+
+// Start starts a harness outside of tests, e.g. as local stand-ins of a
+// load test. Close stops it.
+func Start(opts ...Option) (*Harness, error) {
+	h := &Harness{
+		Store:    store.NewMemoryStore(),
+		Presence: service.NewPresenceTracker(service.PresenceConfig{}),
+		Keel:     NewKeel(),
+		Emqx:     NewEmqx(),
+		Network:  NewNetwork(),
+		Producer: NewProducer(),
+	}
+	h.Dapr = &Dapr{keel: h.Keel}
+
+	conf := service.Config{
+		KeelURL:    h.Keel.URL,
+		PubsubName: "iothub-pubsub",
+		Emqx:       service.EmqxConfig{APIAddress: h.Emqx.URL, Username: "admin", Password: "public"},
+		CoAP:       service.CoAPConfig{Addr: "127.0.0.1:0", DTLSAddr: "127.0.0.1:0", PSKSecret: PSKSecret},
+		LoRaWAN: service.LoRaWANConfig{
+			WebhookToken: WebhookToken,
+			ChirpStack:   lorawan.NetworkConfig{APIURL: h.Network.URL, APIKey: NetworkAPIKey},
+			TTS:          lorawan.NetworkConfig{APIURL: h.Network.URL, APIKey: NetworkAPIKey, WebhookID: "iothub"},
+		},
+	}
+	for _, opt := range opts {
+		opt(&conf)
+	}
+
+	forwarder, err := service.NewForwarderWithProducer(h.Producer, service.ForwarderConfig{Topic: "core-pub"})
+	if err != nil {
+		h.closeFakes()
+		return nil, err
+	}
+	h.Forwarder = forwarder
+	h.Config = conf
+	h.Service = service.NewHookService(h.Dapr, h.Store, forwarder, h.Presence, conf)
+	h.Topics, err = service.NewTopicService(context.Background(), h.Service)
+	if err != nil {
+		h.closeFakes()
+		return nil, err
+	}
+
+	h.Devices = service.NewDeviceService(context.Background(), h.Service)
+	container := go_restful.NewContainer()
+	iothubv1.RegisterDeviceHTTPServer(container, h.Devices)
+	h.LoRaWAN = service.NewLoRaWANService(context.Background(), h.Service)
+	iothubv1.RegisterLoRaWANHTTPServer(container, h.LoRaWAN)
+	h.Live = service.NewLiveService(context.Background(), h.Service)
+	iothubv1.RegisterLiveHTTPServer(container, h.Live)
+	h.Provision = service.NewProvisionService(context.Background(), h.Service)
+	iothubv1.RegisterProvisionHTTPServer(container, h.Provision)
+	iothubv1.RegisterPresenceHTTPServer(container, service.NewPresenceService(h.Presence, h.Service.Quality()))
+	iothubv1.RegisterRegistryHTTPServer(container, service.NewRegistryService(h.Service))
+	h.HTTP = httptest.NewServer(container)
+	h.CoAP = service.NewCoAPService(context.Background(), h.Service)
+	if err := h.CoAP.Start(); err != nil {
+		h.CoAP.Close()
+		h.HTTP.Close()
+		h.closeFakes()
+		return nil, err
+	}
+
+	lis := bufconn.Listen(bufSize)
+	h.srv = grpc.NewServer(grpc.ChainUnaryInterceptor(
+		tracing.UnaryServerInterceptor(),
+		metrics.UnaryServerInterceptor(),
+	))
+	pb.RegisterHookProviderServer(h.srv, h.Service)
+	iothubv1.RegisterTopicServer(h.srv, h.Topics)
+	go h.srv.Serve(lis) //nolint
+
+	h.conn, err = grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithInsecure())
+	if err != nil {
+		h.srv.Stop()
+		h.CoAP.Close()
+		h.HTTP.Close()
+		h.closeFakes()
+		return nil, err
+	}
+	h.Hook = pb.NewHookProviderClient(h.conn)
+	h.Topic = iothubv1.NewTopicClient(h.conn)
+	return h, nil
+}
+
+// Close stops the servers and flushes the forwarder.
+func (h *Harness) Close() error {
+	h.conn.Close()
+	h.srv.Stop()
+	h.Topics.Close()
+	h.Devices.Close()
+	h.LoRaWAN.Close()
+	h.Live.Close()
+	h.Provision.Close()
+	h.HTTP.Close()
+	h.CoAP.Close()
+	defer h.closeFakes()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return h.Forwarder.Close(ctx)
+}
+
+func (h *Harness) closeFakes() {
+	h.Keel.Close()
+	h.Emqx.Close()
+	h.Network.Close()
+}
+
+// Load calls provider.loaded like EMQX loading the exhook, it returns the
+// hooks iothub registers.
+func (h *Harness) Load(ctx context.Context) ([]*pb.HookSpec, error) {
+	resp, err := h.Hook.OnProviderLoaded(ctx, &pb.ProviderLoadedRequest{
+		Broker: &pb.BrokerInfo{Version: "4.3.0", Sysdescr: "EMQ X Broker"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetHooks(), nil
+}
+
+// Unload calls provider.unloaded like EMQX stopping.
+func (h *Harness) Unload(ctx context.Context) error {
+	_, err := h.Hook.OnProviderUnloaded(ctx, &pb.ProviderUnloadedRequest{})
+	return err
+}
+
+// CoreEvent delivers a core event to iothub on pubsub topic like dapr.
+func (h *Harness) CoreEvent(ctx context.Context, topic string, data map[string]interface{}) (*iothubv1.TopicEventResponse, error) {
+	v, err := structpb.NewValue(data)
+	if err != nil {
+		return nil, err
+	}
+	return h.Topic.TopicEventHandler(ctx, &iothubv1.TopicEventRequest{
+		Id:              "ev-1",
+		Specversion:     "1.0",
+		Type:            "com.dapr.event.sent",
+		Source:          "core",
+		Datacontenttype: "application/json",
+		Data:            v,
+		Topic:           topic,
+		Pubsubname:      "iothub-pubsub",
+	})
+}
+
+// Flush waits until the events sent to kafka are acknowledged.
+func (h *Harness) Flush(ctx context.Context) error {
+	return h.Forwarder.Flush(ctx)
+}
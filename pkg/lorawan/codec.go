@@ -0,0 +1,144 @@
+package lorawan
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Codecs decoding FRMPayloads not decoded by the network server.
+const (
+	// CodecNone leaves the payload undecoded, it is forwarded raw.
+	CodecNone = ""
+	// CodecCayenneLPP decodes Cayenne Low Power Payload.
+	CodecCayenneLPP = "cayennelpp"
+	// CodecJSON decodes a json object.
+	CodecJSON = "json"
+)
+
+// Codec decodes the FRMPayload of an uplink to telemetry.
+type Codec interface {
+	Decode(fPort uint8, payload []byte) (map[string]interface{}, error)
+}
+
+// NewCodec returns the codec of name, nil for CodecNone.
+func NewCodec(name string) (Codec, error) {
+	switch name {
+	case CodecNone:
+		return nil, nil
+	case CodecCayenneLPP:
+		return cayenneLPP{}, nil
+	case CodecJSON:
+		return jsonCodec{}, nil
+	}
+	return nil, errors.Errorf("unknown codec %q", name)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Decode(_ uint8, payload []byte) (map[string]interface{}, error) {
+	var v map[string]interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return nil, errors.Wrap(err, "json payload")
+	}
+	return v, nil
+}
+
+// lppType is a Cayenne LPP data type, its value is size bytes big endian,
+// divided by div.
+type lppType struct {
+	name   string
+	size   int
+	div    float64
+	signed bool
+	// values of a vector type, e.g. x, y and z of an accelerometer
+	fields []string
+}
+
+var lppTypes = map[byte]lppType{
+	0:   {name: "digital_input", size: 1, div: 1},
+	1:   {name: "digital_output", size: 1, div: 1},
+	2:   {name: "analog_input", size: 2, div: 100, signed: true},
+	3:   {name: "analog_output", size: 2, div: 100, signed: true},
+	101: {name: "illuminance", size: 2, div: 1},
+	102: {name: "presence", size: 1, div: 1},
+	103: {name: "temperature", size: 2, div: 10, signed: true},
+	104: {name: "humidity", size: 1, div: 2},
+	113: {name: "accelerometer", size: 2, div: 1000, signed: true, fields: []string{"x", "y", "z"}},
+	115: {name: "barometer", size: 2, div: 10},
+	134: {name: "gyrometer", size: 2, div: 100, signed: true, fields: []string{"x", "y", "z"}},
+}
+
+// gps is latitude and longitude in 0.0001°, altitude in 0.01 m, 3 bytes each.
+const lppGPS = 136
+
+type cayenneLPP struct{}
+
+// Decode decodes channel, type, value triplets, a value is named after its
+// type and channel, e.g. temperature_1.
+func (cayenneLPP) Decode(_ uint8, payload []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for i := 0; i < len(payload); {
+		if len(payload)-i < 2 {
+			return nil, errors.Errorf("cayenne lpp: truncated at %d", i)
+		}
+		channel, typ := payload[i], payload[i+1]
+		i += 2
+		if typ == lppGPS {
+			if len(payload)-i < 9 {
+				return nil, errors.Errorf("cayenne lpp: truncated gps of channel %d", channel)
+			}
+			values["gps_"+strconv.Itoa(int(channel))] = map[string]interface{}{
+				"latitude":  float64(lppInt(payload[i:i+3], true)) / 10000,
+				"longitude": float64(lppInt(payload[i+3:i+6], true)) / 10000,
+				"altitude":  float64(lppInt(payload[i+6:i+9], true)) / 100,
+			}
+			i += 9
+			continue
+		}
+		t, ok := lppTypes[typ]
+		if !ok {
+			return nil, errors.Errorf("cayenne lpp: unknown type %d of channel %d", typ, channel)
+		}
+		n := t.size * len(t.fields)
+		if n == 0 {
+			n = t.size
+		}
+		if len(payload)-i < n {
+			return nil, errors.Errorf("cayenne lpp: truncated %s of channel %d", t.name, channel)
+		}
+		key := t.name + "_" + strconv.Itoa(int(channel))
+		if len(t.fields) == 0 {
+			values[key] = t.value(payload[i : i+t.size])
+		} else {
+			vector := make(map[string]interface{}, len(t.fields))
+			for j, f := range t.fields {
+				vector[f] = t.value(payload[i+j*t.size : i+(j+1)*t.size])
+			}
+			values[key] = vector
+		}
+		i += n
+	}
+	return values, nil
+}
+
+func (t lppType) value(b []byte) interface{} {
+	v := lppInt(b, t.signed)
+	if t.div == 1 {
+		return v
+	}
+	return float64(v) / t.div
+}
+
+// lppInt decodes up to 4 bytes big endian.
+func lppInt(b []byte, signed bool) int64 {
+	var buf [4]byte
+	copy(buf[4-len(b):], b)
+	v := int64(binary.BigEndian.Uint32(buf[:]))
+	if bits := uint(len(b) * 8); signed && v&(1<<(bits-1)) != 0 {
+		v -= 1 << bits
+	}
+	return v
+}
@@ -0,0 +1,50 @@
+package lorawan
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCayenneLPP(t *testing.T) {
+	c, err := NewCodec(CodecCayenneLPP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte{
+		0x01, 0x67, 0xff, 0xd7, // temperature -4.1
+		0x02, 0x68, 0x50, // humidity 40
+		0x03, 0x00, 0x01, // digital input 1
+		0x04, 0x71, 0x00, 0x01, 0xff, 0xff, 0x03, 0xe8, // accelerometer
+		0x05, 0x88, 0x06, 0x76, 0x5f, 0xf2, 0x96, 0x0a, 0x00, 0x03, 0xe8, // gps
+	}
+	values, err := c.Decode(1, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"temperature_1":   -4.1,
+		"humidity_2":      40.0,
+		"digital_input_3": int64(1),
+		"accelerometer_4": map[string]interface{}{"x": 0.001, "y": -0.001, "z": 1.0},
+		"gps_5":           map[string]interface{}{"latitude": 42.3519, "longitude": -87.9094, "altitude": 10.0},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("values %v", values)
+	}
+	for _, bad := range [][]byte{{0x01}, {0x01, 0x67, 0x00}, {0x01, 0x99, 0x00}} {
+		if v, err := c.Decode(1, bad); err == nil {
+			t.Fatalf("decoded %x to %v", bad, v)
+		}
+	}
+
+	if c, err := NewCodec(CodecNone); c != nil || err != nil {
+		t.Fatalf("none %v, %v", c, err)
+	}
+	if _, err := NewCodec("js"); err == nil {
+		t.Fatal("unknown codec")
+	}
+	c, _ = NewCodec(CodecJSON)
+	if v, err := c.Decode(1, []byte(`{"on":true}`)); err != nil || v["on"] != true {
+		t.Fatalf("json %v, %v", v, err)
+	}
+}
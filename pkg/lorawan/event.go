@@ -0,0 +1,275 @@
+// Package lorawan decodes the webhooks of the ChirpStack v4 http
+// integration and The Things Stack v3 webhooks, decodes FRMPayloads with
+// a codec and queues downlinks through the network server api.
+package lorawan
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Network servers.
+const (
+	ChirpStack = "chirpstack"
+	TTS        = "tts"
+)
+
+// EventType is the kind of a webhook.
+type EventType string
+
+const (
+	Uplink EventType = "up"
+	Join   EventType = "join"
+	Status EventType = "status"
+)
+
+// ErrUnsupported is returned for the webhooks iothub does not handle, e.g.
+// acks and logs, they are to be acknowledged and dropped.
+var ErrUnsupported = errors.New("unsupported lorawan event")
+
+// Device identifies an end device at its network server.
+type Device struct {
+	Network string `json:"network"`
+	DevEUI  string `json:"dev_eui"`
+	// ApplicationID and DeviceID are the ids of The Things Stack.
+	ApplicationID string `json:"application_id,omitempty"`
+	DeviceID      string `json:"device_id,omitempty"`
+}
+
+// RxInfo is the reception of an uplink by a gateway.
+type RxInfo struct {
+	GatewayID string
+	RSSI      int
+	SNR       float64
+}
+
+// Event is a webhook of a network server.
+type Event struct {
+	Type   EventType
+	Device Device
+	// ID is unique per event, resent webhooks keep it.
+	ID      string
+	Time    time.Time
+	DevAddr string
+	// Tags are the device tags of ChirpStack.
+	Tags map[string]string
+
+	// uplink
+	FPort   uint8
+	FCnt    uint32
+	Payload []byte
+	// Object is the payload decoded by the codec of the network server.
+	Object          map[string]interface{}
+	RxInfo          []RxInfo
+	Frequency       uint64
+	SpreadingFactor int
+
+	// status, BatteryLevel is nil if unknown
+	BatteryLevel  *float64
+	Margin        int
+	ExternalPower bool
+}
+
+// Metadata returns the radio metadata of an uplink, from the gateway
+// receiving it best.
+func (e *Event) Metadata() map[string]interface{} {
+	md := map[string]interface{}{
+		"f_cnt":  e.FCnt,
+		"f_port": e.FPort,
+	}
+	if e.Frequency > 0 {
+		md["frequency"] = e.Frequency
+	}
+	if e.SpreadingFactor > 0 {
+		md["spreading_factor"] = e.SpreadingFactor
+	}
+	if len(e.RxInfo) == 0 {
+		return md
+	}
+	best := e.RxInfo[0]
+	for _, rx := range e.RxInfo[1:] {
+		if rx.RSSI > best.RSSI {
+			best = rx
+		}
+	}
+	md["rssi"] = best.RSSI
+	md["snr"] = best.SNR
+	md["gateway_id"] = best.GatewayID
+	md["gateways"] = len(e.RxInfo)
+	return md
+}
+
+// NormalizeEUI returns eui as 16 lower case hex digits.
+func NormalizeEUI(eui string) (string, error) {
+	eui = strings.ToLower(strings.ReplaceAll(eui, "-", ""))
+	if b, err := hex.DecodeString(eui); err != nil || len(b) != 8 {
+		return "", errors.Errorf("invalid EUI %q", eui)
+	}
+	return eui, nil
+}
+
+type csDeviceInfo struct {
+	ApplicationID string            `json:"applicationId"`
+	DevEUI        string            `json:"devEui"`
+	Tags          map[string]string `json:"tags"`
+}
+
+type csEvent struct {
+	DeduplicationID string                 `json:"deduplicationId"`
+	Time            time.Time              `json:"time"`
+	DeviceInfo      csDeviceInfo           `json:"deviceInfo"`
+	DevAddr         string                 `json:"devAddr"`
+	FCnt            uint32                 `json:"fCnt"`
+	FPort           uint8                  `json:"fPort"`
+	Data            []byte                 `json:"data"`
+	Object          map[string]interface{} `json:"object"`
+	RxInfo          []struct {
+		GatewayID string  `json:"gatewayId"`
+		RSSI      int     `json:"rssi"`
+		SNR       float64 `json:"snr"`
+	} `json:"rxInfo"`
+	TxInfo struct {
+		Frequency  uint64 `json:"frequency"`
+		Modulation struct {
+			LoRa struct {
+				SpreadingFactor int `json:"spreadingFactor"`
+			} `json:"lora"`
+		} `json:"modulation"`
+	} `json:"txInfo"`
+	// status
+	Margin                  int     `json:"margin"`
+	ExternalPowerSource     bool    `json:"externalPowerSource"`
+	BatteryLevelUnavailable bool    `json:"batteryLevelUnavailable"`
+	BatteryLevel            float64 `json:"batteryLevel"`
+}
+
+// ParseChirpStack parses a json event of the ChirpStack v4 http
+// integration, event is its event query parameter.
+func ParseChirpStack(event string, body []byte) (*Event, error) {
+	var typ EventType
+	switch event {
+	case "up":
+		typ = Uplink
+	case "join":
+		typ = Join
+	case "status":
+		typ = Status
+	default:
+		return nil, ErrUnsupported
+	}
+	var cs csEvent
+	if err := json.Unmarshal(body, &cs); err != nil {
+		return nil, errors.Wrap(err, "chirpstack event")
+	}
+	eui, err := NormalizeEUI(cs.DeviceInfo.DevEUI)
+	if err != nil {
+		return nil, err
+	}
+	e := &Event{
+		Type:            typ,
+		Device:          Device{Network: ChirpStack, DevEUI: eui, ApplicationID: cs.DeviceInfo.ApplicationID},
+		ID:              cs.DeduplicationID,
+		Time:            cs.Time,
+		DevAddr:         cs.DevAddr,
+		Tags:            cs.DeviceInfo.Tags,
+		FPort:           cs.FPort,
+		FCnt:            cs.FCnt,
+		Payload:         cs.Data,
+		Object:          cs.Object,
+		Frequency:       cs.TxInfo.Frequency,
+		SpreadingFactor: cs.TxInfo.Modulation.LoRa.SpreadingFactor,
+		Margin:          cs.Margin,
+		ExternalPower:   cs.ExternalPowerSource,
+	}
+	for _, rx := range cs.RxInfo {
+		e.RxInfo = append(e.RxInfo, RxInfo{GatewayID: rx.GatewayID, RSSI: rx.RSSI, SNR: rx.SNR})
+	}
+	if typ == Status && !cs.BatteryLevelUnavailable && !cs.ExternalPowerSource {
+		level := cs.BatteryLevel
+		e.BatteryLevel = &level
+	}
+	return e, nil
+}
+
+type ttsEvent struct {
+	EndDeviceIDs struct {
+		DeviceID       string `json:"device_id"`
+		ApplicationIDs struct {
+			ApplicationID string `json:"application_id"`
+		} `json:"application_ids"`
+		DevEUI  string `json:"dev_eui"`
+		DevAddr string `json:"dev_addr"`
+	} `json:"end_device_ids"`
+	CorrelationIDs []string  `json:"correlation_ids"`
+	ReceivedAt     time.Time `json:"received_at"`
+	UplinkMessage  *struct {
+		FPort          uint8                  `json:"f_port"`
+		FCnt           uint32                 `json:"f_cnt"`
+		FRMPayload     []byte                 `json:"frm_payload"`
+		DecodedPayload map[string]interface{} `json:"decoded_payload"`
+		RxMetadata     []struct {
+			GatewayIDs struct {
+				GatewayID string `json:"gateway_id"`
+			} `json:"gateway_ids"`
+			RSSI float64 `json:"rssi"`
+			SNR  float64 `json:"snr"`
+		} `json:"rx_metadata"`
+		Settings struct {
+			DataRate struct {
+				LoRa struct {
+					SpreadingFactor int `json:"spreading_factor"`
+				} `json:"lora"`
+			} `json:"data_rate"`
+			Frequency string `json:"frequency"`
+		} `json:"settings"`
+	} `json:"uplink_message"`
+	JoinAccept *struct {
+		ReceivedAt time.Time `json:"received_at"`
+	} `json:"join_accept"`
+}
+
+// ParseTTS parses a webhook of The Things Stack v3, the message type is
+// the field set in the body.
+func ParseTTS(body []byte) (*Event, error) {
+	var tts ttsEvent
+	if err := json.Unmarshal(body, &tts); err != nil {
+		return nil, errors.Wrap(err, "tts webhook")
+	}
+	ids := tts.EndDeviceIDs
+	e := &Event{
+		Time:    tts.ReceivedAt,
+		DevAddr: ids.DevAddr,
+	}
+	if len(tts.CorrelationIDs) > 0 {
+		e.ID = tts.CorrelationIDs[0]
+	}
+	switch {
+	case tts.UplinkMessage != nil:
+		up := tts.UplinkMessage
+		e.Type = Uplink
+		e.FPort, e.FCnt = up.FPort, up.FCnt
+		e.Payload, e.Object = up.FRMPayload, up.DecodedPayload
+		e.SpreadingFactor = up.Settings.DataRate.LoRa.SpreadingFactor
+		if up.Settings.Frequency != "" {
+			e.Frequency, _ = strconv.ParseUint(up.Settings.Frequency, 10, 64)
+		}
+		for _, rx := range up.RxMetadata {
+			e.RxInfo = append(e.RxInfo, RxInfo{GatewayID: rx.GatewayIDs.GatewayID, RSSI: int(rx.RSSI), SNR: rx.SNR})
+		}
+	case tts.JoinAccept != nil:
+		e.Type = Join
+	default:
+		return nil, ErrUnsupported
+	}
+	eui, err := NormalizeEUI(ids.DevEUI)
+	if err != nil {
+		return nil, err
+	}
+	e.Device = Device{Network: TTS, DevEUI: eui, ApplicationID: ids.ApplicationIDs.ApplicationID, DeviceID: ids.DeviceID}
+	return e, nil
+}
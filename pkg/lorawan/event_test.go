@@ -0,0 +1,70 @@
+package lorawan
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseChirpStack(t *testing.T) {
+	e, err := ParseChirpStack("up", fixture(t, "chirpstack_up.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != Uplink || e.Device.DevEUI != "0101010101010101" || e.Device.Network != ChirpStack ||
+		e.ID != "3ac7e3c4-4401-4b8d-9386-a5c902f9202d" || e.Tags["tkeel_token"] != "token1" ||
+		e.FPort != 1 || e.FCnt != 10 || len(e.Payload) != 7 || e.Object != nil {
+		t.Fatalf("uplink %+v", e)
+	}
+	want := map[string]interface{}{
+		"f_cnt": uint32(10), "f_port": uint8(1), "frequency": uint64(868500000), "spreading_factor": 7,
+		"rssi": -36, "snr": 10.5, "gateway_id": "0016c001f153a14d", "gateways": 2,
+	}
+	if md := e.Metadata(); !reflect.DeepEqual(md, want) {
+		t.Fatalf("metadata %v", md)
+	}
+
+	if e, err = ParseChirpStack("join", fixture(t, "chirpstack_join.json")); err != nil || e.Type != Join || e.DevAddr != "00189440" {
+		t.Fatalf("join %+v, %v", e, err)
+	}
+	if e, err = ParseChirpStack("status", fixture(t, "chirpstack_status.json")); err != nil || e.Type != Status ||
+		e.BatteryLevel == nil || *e.BatteryLevel != 87.5 || e.Margin != 7 {
+		t.Fatalf("status %+v, %v", e, err)
+	}
+	if _, err := ParseChirpStack("txack", fixture(t, "chirpstack_join.json")); err != ErrUnsupported {
+		t.Fatalf("txack %v", err)
+	}
+	if _, err := ParseChirpStack("up", []byte(`{"deviceInfo":{"devEui":"01"}}`)); err == nil {
+		t.Fatal("parsed a short DevEUI")
+	}
+}
+
+func TestParseTTS(t *testing.T) {
+	e, err := ParseTTS(fixture(t, "tts_uplink.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := Device{Network: TTS, DevEUI: "70b3d57ed0000007", ApplicationID: "metering", DeviceID: "meter-7"}
+	if e.Type != Uplink || e.Device != dev || e.ID != "as:up:01G8Y6ZC1R6Q0S8W7K2C5V9M3D" ||
+		e.FPort != 2 || e.FCnt != 42 || e.Frequency != 868100000 || e.SpreadingFactor != 9 ||
+		!reflect.DeepEqual(e.Object, map[string]interface{}{"energy": 1000.0, "valve": "open"}) ||
+		!reflect.DeepEqual(e.RxInfo, []RxInfo{{GatewayID: "gw-roof", RSSI: -71, SNR: 8.25}}) {
+		t.Fatalf("uplink %+v", e)
+	}
+	if e, err = ParseTTS(fixture(t, "tts_join_accept.json")); err != nil || e.Type != Join || e.Device != dev {
+		t.Fatalf("join %+v, %v", e, err)
+	}
+	if _, err := ParseTTS(fixture(t, "tts_downlink_ack.json")); err != ErrUnsupported {
+		t.Fatalf("downlink ack %v", err)
+	}
+}
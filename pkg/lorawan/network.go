@@ -0,0 +1,126 @@
+package lorawan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tkeel-io/iothub/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Downlink is a downlink queued for a device, its payload is Data, or
+// Object encoded by the codec of the network server.
+type Downlink struct {
+	FPort     uint8
+	Confirmed bool
+	Data      []byte
+	Object    map[string]interface{}
+}
+
+// Network queues downlinks at a network server.
+type Network interface {
+	Push(ctx context.Context, dev Device, dl Downlink) error
+}
+
+// NetworkConfig is the api of a network server.
+type NetworkConfig struct {
+	// APIURL is the base url, e.g. http://chirpstack-rest-api:8090.
+	APIURL string
+	// APIKey is the bearer token of the api.
+	APIKey string
+	// WebhookID is the webhook of the application pushing downlinks, The
+	// Things Stack only.
+	WebhookID string
+}
+
+type client struct {
+	conf NetworkConfig
+	http *http.Client
+}
+
+func (c *client) post(ctx context.Context, name, path string, body interface{}) (err error) {
+	ctx, span := tracing.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.conf.APIURL, "/")+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.conf.APIKey)
+	tracing.InjectHTTP(ctx, req)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("%s: %s %s", name, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// ChirpStackNetwork enqueues downlinks with the ChirpStack v4 rest api.
+type ChirpStackNetwork struct {
+	client
+}
+
+func NewChirpStackNetwork(conf NetworkConfig, httpClient *http.Client) *ChirpStackNetwork {
+	return &ChirpStackNetwork{client{conf: conf, http: httpClient}}
+}
+
+// Push enqueues dl with POST /api/devices/{devEui}/queue.
+func (n *ChirpStackNetwork) Push(ctx context.Context, dev Device, dl Downlink) error {
+	item := map[string]interface{}{
+		"confirmed": dl.Confirmed,
+		"fPort":     dl.FPort,
+	}
+	if dl.Data != nil {
+		item["data"] = dl.Data
+	} else {
+		item["object"] = dl.Object
+	}
+	return n.post(ctx, "chirpstack.Enqueue", "/api/devices/"+url.PathEscape(dev.DevEUI)+"/queue", map[string]interface{}{"queueItem": item})
+}
+
+// TTSNetwork pushes downlinks with the webhook api of The Things Stack v3.
+type TTSNetwork struct {
+	client
+}
+
+func NewTTSNetwork(conf NetworkConfig, httpClient *http.Client) *TTSNetwork {
+	return &TTSNetwork{client{conf: conf, http: httpClient}}
+}
+
+// Push appends dl to the queue of dev with POST
+// /api/v3/as/applications/{app}/webhooks/{webhook}/devices/{dev}/down/push.
+func (n *TTSNetwork) Push(ctx context.Context, dev Device, dl Downlink) error {
+	if dev.ApplicationID == "" || dev.DeviceID == "" {
+		return errors.Errorf("tts device %s has no application or device id", dev.DevEUI)
+	}
+	down := map[string]interface{}{
+		"f_port":    dl.FPort,
+		"confirmed": dl.Confirmed,
+		"priority":  "NORMAL",
+	}
+	if dl.Data != nil {
+		down["frm_payload"] = dl.Data
+	} else {
+		down["decoded_payload"] = dl.Object
+	}
+	path := "/api/v3/as/applications/" + url.PathEscape(dev.ApplicationID) +
+		"/webhooks/" + url.PathEscape(n.conf.WebhookID) +
+		"/devices/" + url.PathEscape(dev.DeviceID) + "/down/push"
+	return n.post(ctx, "tts.DownlinkPush", path, map[string]interface{}{"downlinks": []interface{}{down}})
+}
@@ -0,0 +1,46 @@
+package lorawan
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNetworks(t *testing.T) {
+	var path, auth, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		path, auth, body = r.URL.Path, r.Header.Get("Authorization"), string(b)
+		if r.URL.Path == "/api/devices/0202020202020202/queue" {
+			http.Error(w, `{"error":"object does not exist"}`, http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	cs := NewChirpStackNetwork(NetworkConfig{APIURL: srv.URL + "/", APIKey: "k1"}, srv.Client())
+	if err := cs.Push(ctx, Device{DevEUI: "0101010101010101"}, Downlink{FPort: 10, Data: []byte{1, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/api/devices/0101010101010101/queue" || auth != "Bearer k1" || body != `{"queueItem":{"confirmed":false,"data":"AQI=","fPort":10}}` {
+		t.Fatalf("chirpstack %s %s %s", path, auth, body)
+	}
+	if err := cs.Push(ctx, Device{DevEUI: "0202020202020202"}, Downlink{FPort: 10, Object: map[string]interface{}{"on": true}}); err == nil {
+		t.Fatal("pushed to an unknown device")
+	}
+
+	tts := NewTTSNetwork(NetworkConfig{APIURL: srv.URL, APIKey: "k2", WebhookID: "iothub"}, srv.Client())
+	dev := Device{DevEUI: "70b3d57ed0000007", ApplicationID: "metering", DeviceID: "meter-7"}
+	if err := tts.Push(ctx, dev, Downlink{FPort: 3, Confirmed: true, Object: map[string]interface{}{"valve": "close"}}); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/api/v3/as/applications/metering/webhooks/iothub/devices/meter-7/down/push" || auth != "Bearer k2" ||
+		body != `{"downlinks":[{"confirmed":true,"decoded_payload":{"valve":"close"},"f_port":3,"priority":"NORMAL"}]}` {
+		t.Fatalf("tts %s %s %s", path, auth, body)
+	}
+	if err := tts.Push(ctx, Device{DevEUI: dev.DevEUI}, Downlink{FPort: 3}); err == nil {
+		t.Fatal("pushed without device ids")
+	}
+}
@@ -0,0 +1,245 @@
+package lwm2m
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Keys of attributes and telemetry are object.resource, the instance 0 of
+// an object that is not multiple, or object.instance.resource. The values
+// of a resource of an unknown object are kept under its path, /3303/0/5700,
+// as telemetry.
+
+// Key returns the key of the resource of p, ok is false for an unknown
+// resource.
+func (r *Registry) Key(p Path) (key string, res Resource, ok bool) {
+	unknown := Path{p.Object, p.Instance, p.Resource, -1}.String()
+	if p.Resource < 0 {
+		return unknown, Resource{}, false
+	}
+	o, found := r.Object(uint16(p.Object))
+	if !found {
+		return unknown, Resource{}, false
+	}
+	if res, ok = o.Resource(uint16(p.Resource)); !ok {
+		return unknown, Resource{}, false
+	}
+	if o.Multiple || p.Instance != 0 {
+		return o.Name + "." + strconv.Itoa(p.Instance) + "." + res.Name, res, true
+	}
+	return o.Name + "." + res.Name, res, true
+}
+
+// Decode splits the content of a read response or a notification into
+// attributes and telemetry, the values of a multiple resource into a list
+// ordered by instance.
+func (r *Registry) Decode(content []Content) (attributes, telemetry map[string]interface{}) {
+	attributes = make(map[string]interface{})
+	telemetry = make(map[string]interface{})
+	type instanceValue struct {
+		instance int
+		value    interface{}
+	}
+	multiple := make(map[string][]instanceValue)
+	for _, c := range content {
+		p, err := ParsePath(c.Path)
+		if err != nil {
+			continue
+		}
+		key, res, ok := r.Key(p)
+		values := telemetry
+		if ok && !res.Telemetry {
+			values = attributes
+		}
+		if p.ResourceInstance < 0 {
+			values[key] = c.Value
+			continue
+		}
+		if _, seen := multiple[key]; !seen {
+			values[key] = nil
+		}
+		multiple[key] = append(multiple[key], instanceValue{p.ResourceInstance, c.Value})
+	}
+	for key, ivs := range multiple {
+		sort.Slice(ivs, func(i, j int) bool { return ivs[i].instance < ivs[j].instance })
+		list := make([]interface{}, len(ivs))
+		for i, iv := range ivs {
+			list[i] = iv.value
+		}
+		if _, ok := attributes[key]; ok {
+			attributes[key] = list
+		} else {
+			telemetry[key] = list
+		}
+	}
+	return attributes, telemetry
+}
+
+// Resolve returns the path and the resource of key, a key, the name of a
+// resource of one object only, or a path.
+func (r *Registry) Resolve(key string) (Path, Resource, error) {
+	if strings.HasPrefix(key, "/") {
+		p, err := ParsePath(key)
+		if err != nil {
+			return p, Resource{}, err
+		}
+		if p.Resource < 0 || p.ResourceInstance >= 0 {
+			return p, Resource{}, errors.Errorf("lwm2m path %s is not a resource", key)
+		}
+		_, res, ok := r.Key(p)
+		if !ok {
+			return p, Resource{}, errors.Errorf("unknown lwm2m resource %s", key)
+		}
+		return p, res, nil
+	}
+	parts := strings.Split(key, ".")
+	switch len(parts) {
+	case 1:
+		return r.resolveName(key)
+	case 2:
+		parts = []string{parts[0], "0", parts[1]}
+	case 3:
+	default:
+		return Path{}, Resource{}, errors.Errorf("unknown lwm2m resource %s", key)
+	}
+	instance, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return Path{}, Resource{}, errors.Errorf("unknown lwm2m resource %s", key)
+	}
+	o, ok := r.ObjectByName(parts[0])
+	if !ok {
+		return Path{}, Resource{}, errors.Errorf("unknown lwm2m object %s", parts[0])
+	}
+	res, ok := o.ResourceByName(parts[2])
+	if !ok {
+		return Path{}, Resource{}, errors.Errorf("unknown resource %s of lwm2m object %s", parts[2], o.Name)
+	}
+	return Path{int(o.ID), int(instance), int(res.ID), -1}, res, nil
+}
+
+func (r *Registry) resolveName(name string) (Path, Resource, error) {
+	var found []Path
+	var res Resource
+	for _, o := range r.Objects() {
+		if rr, ok := o.ResourceByName(name); ok {
+			found = append(found, Path{int(o.ID), 0, int(rr.ID), -1})
+			res = rr
+		}
+	}
+	switch len(found) {
+	case 0:
+		return Path{}, Resource{}, errors.Errorf("unknown lwm2m resource %s", name)
+	case 1:
+		return found[0], res, nil
+	}
+	return Path{}, Resource{}, errors.Errorf("lwm2m resource %s of several objects, name it object.%s", name, name)
+}
+
+// Write returns the request writing value to the resource of key.
+func (r *Registry) Write(key string, value interface{}) (*Request, error) {
+	p, res, err := r.Resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	if !res.Writable() {
+		return nil, errors.Errorf("lwm2m resource %s is not writable", key)
+	}
+	v, err := convert(res.Type, value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "write %s", key)
+	}
+	return &Request{MsgType: MsgWrite, Data: RequestData{Path: p.String(), Type: res.Type, Value: v}}, nil
+}
+
+// Execute returns the request executing the resource of key with args, a
+// string or a number.
+func (r *Registry) Execute(key string, args interface{}) (*Request, error) {
+	p, res, err := r.Resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	if !res.Executable() {
+		return nil, errors.Errorf("lwm2m resource %s is not executable", key)
+	}
+	var s string
+	switch v := args.(type) {
+	case nil:
+	case string:
+		s = v
+	case float64, bool, json.Number:
+		s = fmt.Sprint(v)
+	default:
+		return nil, errors.Errorf("execute %s: arguments must be a string", key)
+	}
+	return &Request{MsgType: MsgExecute, Data: RequestData{Path: p.String(), Args: s}}, nil
+}
+
+// Command returns the request of a core command named key: the execute of
+// an executable resource with input as arguments, or the write of input to
+// a writable one.
+func (r *Registry) Command(key string, input interface{}) (*Request, error) {
+	_, res, err := r.Resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	if res.Writable() {
+		return r.Write(key, input)
+	}
+	return r.Execute(key, input)
+}
+
+// Observe returns the requests observing the known objects of the object
+// instances of a registration.
+func (r *Registry) Observe(objectList []string) []*Request {
+	var out []*Request
+	for _, s := range objectList {
+		p, err := ParsePath(s)
+		if err != nil || p.Instance < 0 || p.Resource >= 0 {
+			continue
+		}
+		o, ok := r.Object(uint16(p.Object))
+		if !ok {
+			continue
+		}
+		for _, res := range o.Resources {
+			if res.Readable() {
+				out = append(out, &Request{MsgType: MsgObserve, Data: RequestData{Path: p.String()}})
+				break
+			}
+		}
+	}
+	return out
+}
+
+// convert checks value, decoded from json, against the resource type.
+func convert(typ string, value interface{}) (interface{}, error) {
+	switch typ {
+	case TypeInteger, TypeTime:
+		if f, ok := value.(float64); ok && f == math.Trunc(f) {
+			return int64(f), nil
+		}
+		return nil, errors.Errorf("%v is not an integer", value)
+	case TypeFloat:
+		if f, ok := value.(float64); ok {
+			return f, nil
+		}
+		return nil, errors.Errorf("%v is not a number", value)
+	case TypeBoolean:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		return nil, errors.Errorf("%v is not a boolean", value)
+	case TypeString, TypeOpaque, TypeObjlnk:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return nil, errors.Errorf("%v is not a string", value)
+	}
+	return nil, errors.Errorf("unsupported lwm2m type %q", typ)
+}
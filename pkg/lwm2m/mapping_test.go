@@ -0,0 +1,124 @@
+package lwm2m
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(Object{ID: 3303, Name: "temperature", Multiple: true, Resources: []Resource{
+		{ID: 5700, Name: "value", Type: TypeFloat, Operations: OpRead, Telemetry: true},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ParseResponse([]byte(`{"reqID":0,"msgType":"notify","seqNum":3,"data":{"code":"2.05","content":[
+		{"path":"/3/0/0","value":"acme"},
+		{"path":"/3/0/9","value":80},
+		{"path":"/3/0/6/1","value":5},
+		{"path":"/3/0/6/0","value":1},
+		{"path":"/3/0/7/0","value":3800},
+		{"path":"/3303/1/5700","value":21.5},
+		{"path":"/3/0/99","value":"x"},
+		{"path":"/3/1/0","value":"other"},
+		{"path":"bad","value":1}
+	]}}`))
+	if err != nil || !resp.Success() || resp.SeqNum != 3 {
+		t.Fatalf("response %+v, %v", resp, err)
+	}
+	attributes, telemetry := r.Decode(resp.Data.Content)
+	wantAttributes := map[string]interface{}{
+		"device.manufacturer":   "acme",
+		"device.power_sources":  []interface{}{1.0, 5.0},
+		"device.1.manufacturer": "other",
+	}
+	wantTelemetry := map[string]interface{}{
+		"device.battery_level":        80.0,
+		"device.power_source_voltage": []interface{}{3800.0},
+		"temperature.1.value":         21.5,
+		"/3/0/99":                     "x",
+	}
+	if !reflect.DeepEqual(attributes, wantAttributes) {
+		t.Fatalf("attributes %v", attributes)
+	}
+	if !reflect.DeepEqual(telemetry, wantTelemetry) {
+		t.Fatalf("telemetry %v", telemetry)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(Object{ID: 3303, Name: "temperature", Resources: []Resource{
+		{ID: 5518, Name: "timestamp", Type: TypeTime, Operations: OpRead},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key, path string
+	}{
+		{"device.reboot", "/3/0/4"},
+		{"device.1.reboot", "/3/1/4"},
+		{"reboot", "/3/0/4"},
+		{"latitude", "/6/0/0"},
+		{"/5/0/1", "/5/0/1"},
+		{"timestamp", ""}, // location and temperature
+		{"device.nothing", ""},
+		{"nothing.reboot", ""},
+		{"/3/0", ""},
+		{"/3/0/99", ""},
+		{"a.b.c.d", ""},
+	}
+	for _, tt := range tests {
+		p, _, err := r.Resolve(tt.key)
+		if tt.path == "" {
+			if err == nil {
+				t.Fatalf("resolved %s to %s", tt.key, p)
+			}
+			continue
+		}
+		if err != nil || p.String() != tt.path {
+			t.Fatalf("%s: %s, %v", tt.key, p, err)
+		}
+	}
+}
+
+func TestRequests(t *testing.T) {
+	r := NewRegistry()
+	encode := func(req *Request, err error) string {
+		t.Helper()
+		if err != nil {
+			return "error"
+		}
+		b, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	tests := []struct {
+		got, want string
+	}{
+		{encode(r.Write("current_time", 1.63e9)), `{"reqID":0,"msgType":"write","data":{"path":"/3/0/13","type":"Time","value":1630000000}}`},
+		{encode(r.Write("firmware.package_uri", "coap://fw")), `{"reqID":0,"msgType":"write","data":{"path":"/5/0/1","type":"String","value":"coap://fw"}}`},
+		{encode(r.Write("current_time", 1.5)), "error"},
+		{encode(r.Write("manufacturer", "x")), "error"},
+		{encode(r.Execute("reboot", nil)), `{"reqID":0,"msgType":"execute","data":{"path":"/3/0/4"}}`},
+		{encode(r.Execute("firmware.update", "0='now'")), `{"reqID":0,"msgType":"execute","data":{"path":"/5/0/2","args":"0='now'"}}`},
+		{encode(r.Execute("reboot", map[string]interface{}{"delay": 5.0})), "error"},
+		{encode(r.Execute("current_time", nil)), "error"},
+		{encode(r.Command("reboot", "")), `{"reqID":0,"msgType":"execute","data":{"path":"/3/0/4"}}`},
+		{encode(r.Command("timezone", "UTC")), `{"reqID":0,"msgType":"write","data":{"path":"/3/0/15","type":"String","value":"UTC"}}`},
+		{encode(r.Command("manufacturer", "x")), "error"},
+	}
+	for i, tt := range tests {
+		if tt.got != tt.want {
+			t.Fatalf("%d: %s, want %s", i, tt.got, tt.want)
+		}
+	}
+
+	observe := r.Observe([]string{"/1/0", "/3/0", "/6/0", "/3", "/3303/0"})
+	if len(observe) != 2 || observe[0].Data.Path != "/3/0" || observe[1].Data.Path != "/6/0" || observe[0].MsgType != MsgObserve {
+		t.Fatalf("observe %+v", observe)
+	}
+}
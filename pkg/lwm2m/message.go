@@ -0,0 +1,81 @@
+package lwm2m
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Message types of the EMQX LwM2M gateway json payloads.
+const (
+	MsgRead          = "read"
+	MsgWrite         = "write"
+	MsgExecute       = "execute"
+	MsgDiscover      = "discover"
+	MsgObserve       = "observe"
+	MsgCancelObserve = "cancel-observe"
+	MsgNotify        = "notify"
+	MsgRegister      = "register"
+	MsgUpdate        = "update"
+)
+
+// Request is a request to a device, published to the gateway command
+// topic, lwm2m/{ep}/dn/# by default.
+type Request struct {
+	ReqID   int64       `json:"reqID"`
+	MsgType string      `json:"msgType"`
+	Data    RequestData `json:"data"`
+}
+
+type RequestData struct {
+	Path string `json:"path"`
+	// Type and Value of a write.
+	Type  string      `json:"type,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+	// Args of an execute.
+	Args string `json:"args,omitempty"`
+}
+
+// Response is a message of a device, published by the gateway to
+// lwm2m/{ep}/up/resp for responses, registrations and updates, and to
+// lwm2m/{ep}/up/notify for notifications.
+type Response struct {
+	ReqID   int64        `json:"reqID"`
+	MsgType string       `json:"msgType"`
+	SeqNum  int64        `json:"seqNum,omitempty"`
+	Data    ResponseData `json:"data"`
+}
+
+type ResponseData struct {
+	ReqPath string `json:"reqPath,omitempty"`
+	// Code is the CoAP response code, 2.05 for content.
+	Code    string    `json:"code,omitempty"`
+	CodeMsg string    `json:"codeMsg,omitempty"`
+	Content []Content `json:"content,omitempty"`
+	// ObjectList is the object instances of a registration, /3/0.
+	ObjectList []string `json:"objectList,omitempty"`
+}
+
+// Content is the value of a resource.
+type Content struct {
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// ParseResponse parses a message of a device.
+func ParseResponse(payload []byte) (*Response, error) {
+	var r Response
+	if err := json.Unmarshal(payload, &r); err != nil {
+		return nil, errors.Wrap(err, "parse lwm2m message")
+	}
+	if r.MsgType == "" {
+		return nil, errors.New("lwm2m message without msgType")
+	}
+	return &r, nil
+}
+
+// Success reports whether the response code is 2.xx.
+func (r *Response) Success() bool {
+	return strings.HasPrefix(r.Data.Code, "2.")
+}
@@ -0,0 +1,225 @@
+// Package lwm2m maps the LwM2M object model to tKeel attributes, telemetry
+// and commands, for devices behind the EMQX LwM2M gateway.
+package lwm2m
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Resource operations.
+const (
+	OpRead    = "R"
+	OpWrite   = "W"
+	OpExecute = "E"
+)
+
+// Resource data types, as named by the EMQX gateway.
+const (
+	TypeString  = "String"
+	TypeInteger = "Integer"
+	TypeFloat   = "Float"
+	TypeBoolean = "Boolean"
+	TypeOpaque  = "Opaque"
+	TypeTime    = "Time"
+	TypeObjlnk  = "Objlnk"
+	TypeNone    = ""
+)
+
+// Resource is a resource of an object.
+type Resource struct {
+	ID   uint16 `yaml:"id" json:"id"`
+	Name string `yaml:"name" json:"name"`
+	// Type is the data type, empty for executable resources.
+	Type string `yaml:"type" json:"type,omitempty"`
+	// Operations is R, W, RW or E.
+	Operations string `yaml:"operations" json:"operations"`
+	// Multiple resources have instances, their value is a list.
+	Multiple bool `yaml:"multiple" json:"multiple,omitempty"`
+	// Telemetry values are measurements, the others are attributes.
+	Telemetry bool `yaml:"telemetry" json:"telemetry,omitempty"`
+}
+
+func (r Resource) can(op string) bool {
+	return strings.Contains(r.Operations, op)
+}
+
+// Readable reports whether the resource can be read and observed.
+func (r Resource) Readable() bool { return r.can(OpRead) }
+
+// Writable reports whether the resource can be written.
+func (r Resource) Writable() bool { return r.can(OpWrite) }
+
+// Executable reports whether the resource can be executed.
+func (r Resource) Executable() bool { return r.can(OpExecute) }
+
+// Object is an LwM2M object definition.
+type Object struct {
+	ID   uint16 `yaml:"id" json:"id"`
+	Name string `yaml:"name" json:"name"`
+	// Multiple objects have instances, their keys carry the instance id.
+	Multiple  bool       `yaml:"multiple" json:"multiple,omitempty"`
+	Resources []Resource `yaml:"resources" json:"resources"`
+}
+
+// Resource returns the resource id of o.
+func (o *Object) Resource(id uint16) (Resource, bool) {
+	for _, r := range o.Resources {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return Resource{}, false
+}
+
+// ResourceByName returns the resource of o named name.
+func (o *Object) ResourceByName(name string) (Resource, bool) {
+	for _, r := range o.Resources {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Resource{}, false
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks the names, ids and operations of o.
+func (o *Object) Validate() error {
+	if !validName(o.Name) {
+		return errors.Errorf("object %d: invalid name %q", o.ID, o.Name)
+	}
+	ids := make(map[uint16]bool)
+	names := make(map[string]bool)
+	for _, r := range o.Resources {
+		if !validName(r.Name) {
+			return errors.Errorf("object %s: invalid resource name %q", o.Name, r.Name)
+		}
+		if ids[r.ID] || names[r.Name] {
+			return errors.Errorf("object %s: duplicate resource %d %s", o.Name, r.ID, r.Name)
+		}
+		ids[r.ID], names[r.Name] = true, true
+		if r.Operations == "" || strings.Trim(r.Operations, "RWE") != "" {
+			return errors.Errorf("object %s: resource %s operations %q is not R, W, RW or E", o.Name, r.Name, r.Operations)
+		}
+		if r.Executable() && r.Operations != OpExecute {
+			return errors.Errorf("object %s: executable resource %s is not readable or writable", o.Name, r.Name)
+		}
+	}
+	return nil
+}
+
+// Registry is the set of known objects, the standard ones and those
+// registered by configuration.
+type Registry struct {
+	lock    sync.RWMutex
+	objects map[uint16]*Object
+	byName  map[string]*Object
+}
+
+// NewRegistry returns a registry of the standard objects.
+func NewRegistry() *Registry {
+	r := &Registry{objects: make(map[uint16]*Object), byName: make(map[string]*Object)}
+	for i := range standardObjects {
+		o := standardObjects[i]
+		r.objects[o.ID] = &o
+		r.byName[o.Name] = &o
+	}
+	return r
+}
+
+// Register adds or replaces the object of id o.ID, a name is unique.
+func (r *Registry) Register(o Object) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if other, ok := r.byName[o.Name]; ok && other.ID != o.ID {
+		return errors.Errorf("object name %s used by object %d", o.Name, other.ID)
+	}
+	if old, ok := r.objects[o.ID]; ok {
+		delete(r.byName, old.Name)
+	}
+	r.objects[o.ID] = &o
+	r.byName[o.Name] = &o
+	return nil
+}
+
+// Object returns the object id.
+func (r *Registry) Object(id uint16) (*Object, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	o, ok := r.objects[id]
+	return o, ok
+}
+
+// ObjectByName returns the object named name.
+func (r *Registry) ObjectByName(name string) (*Object, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	o, ok := r.byName[name]
+	return o, ok
+}
+
+// Objects returns the known objects by id.
+func (r *Registry) Objects() []Object {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	out := make([]Object, 0, len(r.objects))
+	for _, o := range r.objects {
+		out = append(out, *o)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Path is an LwM2M path /object/instance/resource/resource-instance, the
+// ids not given are -1.
+type Path struct {
+	Object, Instance, Resource, ResourceInstance int
+}
+
+// ParsePath parses /3, /3/0, /3/0/9 or /3/0/6/1, the leading slash is optional.
+func ParsePath(s string) (Path, error) {
+	p := Path{-1, -1, -1, -1}
+	parts := strings.Split(strings.Trim(s, "/"), "/")
+	if len(parts) > 4 || parts[0] == "" {
+		return p, errors.Errorf("invalid lwm2m path %q", s)
+	}
+	ids := []*int{&p.Object, &p.Instance, &p.Resource, &p.ResourceInstance}
+	for i, part := range parts {
+		v, err := strconv.ParseUint(part, 10, 16)
+		if err != nil {
+			return p, errors.Errorf("invalid lwm2m path %q", s)
+		}
+		*ids[i] = int(v)
+	}
+	return p, nil
+}
+
+func (p Path) String() string {
+	var b strings.Builder
+	for _, id := range []int{p.Object, p.Instance, p.Resource, p.ResourceInstance} {
+		if id < 0 {
+			break
+		}
+		b.WriteByte('/')
+		b.WriteString(strconv.Itoa(id))
+	}
+	return b.String()
+}
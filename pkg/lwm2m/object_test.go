@@ -0,0 +1,68 @@
+package lwm2m
+
+import "testing"
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		in, out string
+		ok      bool
+	}{
+		{"/3", "/3", true},
+		{"/3/0/9", "/3/0/9", true},
+		{"3/0/6/1", "/3/0/6/1", true},
+		{"/", "", false},
+		{"/3/x", "", false},
+		{"/3/0/6/1/2", "", false},
+		{"/70000", "", false},
+	}
+	for _, tt := range tests {
+		p, err := ParsePath(tt.in)
+		if (err == nil) != tt.ok || (tt.ok && p.String() != tt.out) {
+			t.Fatalf("%s: %s, %v", tt.in, p, err)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	r := NewRegistry()
+	if len(r.Objects()) != len(standardObjects) {
+		t.Fatalf("%d objects", len(r.Objects()))
+	}
+	for _, o := range standardObjects {
+		if err := o.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	temp := Object{ID: 3303, Name: "temperature", Multiple: true, Resources: []Resource{
+		{ID: 5700, Name: "value", Type: TypeFloat, Operations: OpRead, Telemetry: true},
+		{ID: 5605, Name: "reset_min_max", Operations: OpExecute},
+	}}
+	if err := r.Register(temp); err != nil {
+		t.Fatal(err)
+	}
+	if o, ok := r.ObjectByName("temperature"); !ok || o.ID != 3303 {
+		t.Fatalf("object %+v", o)
+	}
+	// renamed
+	temp.Name = "temp"
+	if err := r.Register(temp); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.ObjectByName("temperature"); ok {
+		t.Fatal("old name kept")
+	}
+
+	invalid := []Object{
+		{ID: 3304, Name: "device"},
+		{ID: 3304, Name: "bad name"},
+		{ID: 3304, Name: "h", Resources: []Resource{{ID: 1, Name: "a", Operations: "R"}, {ID: 1, Name: "b", Operations: "R"}}},
+		{ID: 3304, Name: "h", Resources: []Resource{{ID: 1, Name: "a", Operations: "X"}}},
+		{ID: 3304, Name: "h", Resources: []Resource{{ID: 1, Name: "a", Operations: "RE"}}},
+	}
+	for _, o := range invalid {
+		if err := r.Register(o); err == nil {
+			t.Fatalf("registered %+v", o)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package lwm2m
+
+// Object ids of the standard OMA objects.
+const (
+	ObjectDevice       uint16 = 3
+	ObjectConnectivity uint16 = 4
+	ObjectFirmware     uint16 = 5
+	ObjectLocation     uint16 = 6
+)
+
+// standardObjects are the OMA objects known without configuration, from
+// the LwM2M 1.0 registry, resources of no use to tKeel are left out.
+var standardObjects = []Object{
+	{
+		ID:   ObjectDevice,
+		Name: "device",
+		Resources: []Resource{
+			{ID: 0, Name: "manufacturer", Type: TypeString, Operations: OpRead},
+			{ID: 1, Name: "model_number", Type: TypeString, Operations: OpRead},
+			{ID: 2, Name: "serial_number", Type: TypeString, Operations: OpRead},
+			{ID: 3, Name: "firmware_version", Type: TypeString, Operations: OpRead},
+			{ID: 4, Name: "reboot", Operations: OpExecute},
+			{ID: 5, Name: "factory_reset", Operations: OpExecute},
+			{ID: 6, Name: "power_sources", Type: TypeInteger, Operations: OpRead, Multiple: true},
+			{ID: 7, Name: "power_source_voltage", Type: TypeInteger, Operations: OpRead, Multiple: true, Telemetry: true},
+			{ID: 8, Name: "power_source_current", Type: TypeInteger, Operations: OpRead, Multiple: true, Telemetry: true},
+			{ID: 9, Name: "battery_level", Type: TypeInteger, Operations: OpRead, Telemetry: true},
+			{ID: 10, Name: "memory_free", Type: TypeInteger, Operations: OpRead, Telemetry: true},
+			{ID: 11, Name: "error_code", Type: TypeInteger, Operations: OpRead, Multiple: true, Telemetry: true},
+			{ID: 12, Name: "reset_error_code", Operations: OpExecute},
+			{ID: 13, Name: "current_time", Type: TypeTime, Operations: OpRead + OpWrite},
+			{ID: 14, Name: "utc_offset", Type: TypeString, Operations: OpRead + OpWrite},
+			{ID: 15, Name: "timezone", Type: TypeString, Operations: OpRead + OpWrite},
+			{ID: 16, Name: "supported_binding", Type: TypeString, Operations: OpRead},
+			{ID: 17, Name: "device_type", Type: TypeString, Operations: OpRead},
+			{ID: 18, Name: "hardware_version", Type: TypeString, Operations: OpRead},
+			{ID: 19, Name: "software_version", Type: TypeString, Operations: OpRead},
+			{ID: 20, Name: "battery_status", Type: TypeInteger, Operations: OpRead, Telemetry: true},
+			{ID: 21, Name: "memory_total", Type: TypeInteger, Operations: OpRead},
+		},
+	},
+	{
+		ID:   ObjectConnectivity,
+		Name: "connectivity",
+		Resources: []Resource{
+			{ID: 0, Name: "network_bearer", Type: TypeInteger, Operations: OpRead},
+			{ID: 1, Name: "available_network_bearer", Type: TypeInteger, Operations: OpRead, Multiple: true},
+			{ID: 2, Name: "radio_signal_strength", Type: TypeInteger, Operations: OpRead, Telemetry: true},
+			{ID: 3, Name: "link_quality", Type: TypeInteger, Operations: OpRead, Telemetry: true},
+			{ID: 4, Name: "ip_addresses", Type: TypeString, Operations: OpRead, Multiple: true},
+			{ID: 5, Name: "router_ip_addresses", Type: TypeString, Operations: OpRead, Multiple: true},
+			{ID: 6, Name: "link_utilization", Type: TypeInteger, Operations: OpRead, Telemetry: true},
+			{ID: 7, Name: "apn", Type: TypeString, Operations: OpRead, Multiple: true},
+			{ID: 8, Name: "cell_id", Type: TypeInteger, Operations: OpRead},
+			{ID: 9, Name: "smnc", Type: TypeInteger, Operations: OpRead},
+			{ID: 10, Name: "smcc", Type: TypeInteger, Operations: OpRead},
+		},
+	},
+	{
+		ID:   ObjectFirmware,
+		Name: "firmware",
+		Resources: []Resource{
+			{ID: 0, Name: "package", Type: TypeOpaque, Operations: OpWrite},
+			{ID: 1, Name: "package_uri", Type: TypeString, Operations: OpRead + OpWrite},
+			{ID: 2, Name: "update", Operations: OpExecute},
+			{ID: 3, Name: "state", Type: TypeInteger, Operations: OpRead},
+			{ID: 5, Name: "update_result", Type: TypeInteger, Operations: OpRead},
+			{ID: 6, Name: "package_name", Type: TypeString, Operations: OpRead},
+			{ID: 7, Name: "package_version", Type: TypeString, Operations: OpRead},
+			{ID: 8, Name: "update_protocol_support", Type: TypeInteger, Operations: OpRead, Multiple: true},
+			{ID: 9, Name: "update_delivery_method", Type: TypeInteger, Operations: OpRead},
+		},
+	},
+	{
+		ID:   ObjectLocation,
+		Name: "location",
+		Resources: []Resource{
+			{ID: 0, Name: "latitude", Type: TypeFloat, Operations: OpRead, Telemetry: true},
+			{ID: 1, Name: "longitude", Type: TypeFloat, Operations: OpRead, Telemetry: true},
+			{ID: 2, Name: "altitude", Type: TypeFloat, Operations: OpRead, Telemetry: true},
+			{ID: 3, Name: "radius", Type: TypeFloat, Operations: OpRead, Telemetry: true},
+			{ID: 4, Name: "velocity", Type: TypeOpaque, Operations: OpRead, Telemetry: true},
+			{ID: 5, Name: "timestamp", Type: TypeTime, Operations: OpRead, Telemetry: true},
+			{ID: 6, Name: "speed", Type: TypeFloat, Operations: OpRead, Telemetry: true},
+		},
+	},
+}
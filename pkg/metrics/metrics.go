@@ -0,0 +1,313 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "iothub"
+
+// label values.
+const (
+	DirectionUpStream   = "upstream"
+	DirectionDownStream = "downstream"
+
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+
+	OpGet         = "get"
+	OpSave        = "save"
+	OpDelete      = "delete"
+	OpCreate      = "create"
+	OpTransaction = "transaction"
+)
+
+var (
+	// MsgTotal counts messages by tenant and direction.
+	MsgTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "msg_total",
+			Help:      "How many msg requests processed, partitioned by direction and tenant.",
+		},
+		[]string{"tenant_id", "direction"},
+	)
+	// MsgDuplicate counts dropped QoS 1 retransmissions.
+	MsgDuplicate = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "msg_duplicate_total",
+			Help:      "How many duplicated upstream msg dropped, partitioned by tenant.",
+		},
+		[]string{"tenant_id"},
+	)
+	// MsgRateLimited counts upstream messages dropped above the device rate.
+	MsgRateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "msg_rate_limited_total",
+			Help:      "How many upstream msg dropped above the device rate limit, partitioned by tenant.",
+		},
+		[]string{"tenant_id"},
+	)
+	// PayloadBytes counts payload bytes by tenant and direction.
+	PayloadBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "payload_bytes_total",
+			Help:      "Payload bytes processed, partitioned by direction and tenant.",
+		},
+		[]string{"tenant_id", "direction"},
+	)
+	// ConnectedTotal is the number of connected devices by tenant.
+	ConnectedTotal = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connected_total",
+			Help:      "Number of connected iothub.",
+		},
+		[]string{"tenant_id"},
+	)
+	// DevicesOnline is the number of online devices by tenant and protocol.
+	DevicesOnline = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "devices_online",
+			Help:      "Number of online devices, partitioned by tenant and protocol.",
+		},
+		[]string{"tenant_id", "protocol"},
+	)
+	// DevicesOffline is the number of known offline devices by tenant and protocol.
+	DevicesOffline = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "devices_offline",
+			Help:      "Number of known offline devices, partitioned by tenant and protocol.",
+		},
+		[]string{"tenant_id", "protocol"},
+	)
+	// DeviceStatus is 1 for online and 0 for offline devices, optional
+	// as it creates one series per device.
+	DeviceStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "device_status",
+			Help:      "device status 1-online 0-offline.",
+		},
+		[]string{"tenant_id", "device_id"},
+	)
+	// SessionDuration observes how long device sessions last.
+	SessionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "session_duration_seconds",
+			Help:      "Duration of device sessions, partitioned by tenant.",
+			// 1s to ~2d
+			Buckets: prometheus.ExponentialBuckets(1, 4, 9),
+		},
+		[]string{"tenant_id"},
+	)
+	// ReconnectTotal counts reconnects of already known devices.
+	ReconnectTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconnect_total",
+			Help:      "Device reconnects, partitioned by tenant.",
+		},
+		[]string{"tenant_id"},
+	)
+	// DevicesFlapping is the number of flapping devices by tenant.
+	DevicesFlapping = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "devices_flapping",
+			Help:      "Number of flapping devices, partitioned by tenant.",
+		},
+		[]string{"tenant_id"},
+	)
+	// HookDuration observes the handling latency of every exhook.
+	HookDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "hook_duration_seconds",
+			Help:      "Latency of exhook handling, partitioned by hook and grpc code.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"hook", "code"},
+	)
+	// AuthTotal counts device authentications by result and reason.
+	AuthTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_total",
+			Help:      "Device authentications, partitioned by result and reason.",
+		},
+		[]string{"result", "reason"},
+	)
+	// KafkaProduceDuration observes the time from enqueue to broker ack.
+	KafkaProduceDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "kafka_produce_duration_seconds",
+			Help:      "Latency of kafka produce from enqueue to ack, partitioned by topic.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"topic"},
+	)
+	// KafkaProduceErrors counts failed kafka produces.
+	KafkaProduceErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "kafka_produce_errors_total",
+			Help:      "Failed kafka produces, partitioned by topic.",
+		},
+		[]string{"topic"},
+	)
+	// ArchiveTotal counts uplink events archived for replay.
+	ArchiveTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "archive_total",
+			Help:      "Uplink events archived for replay, partitioned by result.",
+		},
+		[]string{"result"},
+	)
+	// EmqxRequestDuration observes emqx management api calls.
+	EmqxRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "emqx_request_duration_seconds",
+			Help:      "Latency of emqx api calls, partitioned by api and result.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"api", "result"},
+	)
+	// StateDuration observes state store calls.
+	StateDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "state_duration_seconds",
+			Help:      "Latency of state store calls, partitioned by operation.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"op"},
+	)
+	// StateErrors counts failed state store calls.
+	StateErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "state_errors_total",
+			Help:      "Failed state store calls, partitioned by operation.",
+		},
+		[]string{"op"},
+	)
+	// SubscriptionTotal counts core subscription creations and deletions.
+	SubscriptionTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "subscription_total",
+			Help:      "Core subscriptions created and deleted, partitioned by operation and result.",
+		},
+		[]string{"op", "result"},
+	)
+	// LiveConnections counts the open connections of the live data api.
+	LiveConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "live_connections",
+			Help:      "Open live data connections, partitioned by transport.",
+		},
+		[]string{"transport"},
+	)
+	// LiveDropped counts the live events dropped for slow clients.
+	LiveDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "live_dropped_total",
+			Help:      "Live events dropped because the queue of a connection was full, partitioned by transport.",
+		},
+		[]string{"transport"},
+	)
+	// ProvisionTotal counts device provisioning attempts by product and result.
+	ProvisionTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "provision_total",
+			Help:      "Device provisioning attempts, partitioned by product key and result.",
+		},
+		[]string{"product", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		MsgTotal,
+		MsgDuplicate,
+		MsgRateLimited,
+		PayloadBytes,
+		ConnectedTotal,
+		DevicesOnline,
+		DevicesOffline,
+		DeviceStatus,
+		SessionDuration,
+		ReconnectTotal,
+		DevicesFlapping,
+		HookDuration,
+		AuthTotal,
+		KafkaProduceDuration,
+		KafkaProduceErrors,
+		ArchiveTotal,
+		EmqxRequestDuration,
+		StateDuration,
+		StateErrors,
+		SubscriptionTotal,
+		LiveConnections,
+		LiveDropped,
+		ProvisionTotal,
+	)
+}
+
+// Result returns the result label of err.
+func Result(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
+
+// ObserveState records the latency and error of a state store call started at start.
+func ObserveState(op string, start time.Time, err error) {
+	StateDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		StateErrors.WithLabelValues(op).Inc()
+	}
+}
+
+// ObserveEmqx records the latency of an emqx api call started at start.
+func ObserveEmqx(api string, start time.Time, err error) {
+	EmqxRequestDuration.WithLabelValues(api, Result(err)).Observe(time.Since(start).Seconds())
+}
+
+// hookName returns "OnMessagePublish" of "/emqx.exhook.v1.HookProvider/OnMessagePublish".
+func hookName(fullMethod string) string {
+	if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+		return fullMethod[i+1:]
+	}
+	return fullMethod
+}
+
+// UnaryServerInterceptor observes the handling latency of every grpc call.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		HookDuration.WithLabelValues(hookName(info.FullMethod), status.Code(err).String()).
+			Observe(time.Since(start).Seconds())
+		return resp, err
+	}
+}
@@ -0,0 +1,15 @@
+package metrics
+
+import "testing"
+
+func TestHookName(t *testing.T) {
+	cases := map[string]string{
+		"/emqx.exhook.v1.HookProvider/OnMessagePublish": "OnMessagePublish",
+		"OnClientConnected":                             "OnClientConnected",
+	}
+	for in, want := range cases {
+		if got := hookName(in); got != want {
+			t.Errorf("hookName(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Drainer tracks in-flight unary calls so that shutdown can stop accepting
+// new calls and wait for the running ones.
+type Drainer struct {
+	// rejected are the full methods rejected while draining, nil for all
+	rejected map[string]bool
+
+	lock     sync.Mutex
+	draining bool
+	inflight sync.WaitGroup
+}
+
+// NewDrainer rejects the full methods given while draining, e.g.
+// /emqx.exhook.v1.HookProvider/OnClientAuthenticate, or all methods if
+// none is given. The other methods are served until the server stops.
+func NewDrainer(rejected ...string) *Drainer {
+	d := &Drainer{}
+	if len(rejected) > 0 {
+		d.rejected = make(map[string]bool, len(rejected))
+		for _, method := range rejected {
+			d.rejected[method] = true
+		}
+	}
+	return d
+}
+
+// enter reports whether a call of method is accepted, and whether it is
+// tracked as in flight.
+func (d *Drainer) enter(method string) (accepted, tracked bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.draining {
+		d.inflight.Add(1)
+		return true, true
+	}
+	return d.rejected != nil && !d.rejected[method], false
+}
+
+// UnaryServerInterceptor rejects calls with Unavailable once draining.
+func (d *Drainer) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		accepted, tracked := d.enter(info.FullMethod)
+		if !accepted {
+			return nil, status.Error(codes.Unavailable, "server is shutting down")
+		}
+		if tracked {
+			defer d.inflight.Done()
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Drain stops accepting the rejected calls and waits for the calls in
+// flight when it started until ctx is done.
+func (d *Drainer) Drain(ctx context.Context) error {
+	d.lock.Lock()
+	d.draining = true
+	d.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDrainer(t *testing.T) {
+	d := NewDrainer()
+	intercept := d.UnaryServerInterceptor()
+	started, release := make(chan struct{}), make(chan struct{})
+	go intercept(context.Background(), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) { //nolint
+		close(started)
+		<-release
+		return nil, nil
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := d.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("drain returned %v with a call in flight", err)
+	}
+	if _, err := intercept(context.Background(), nil, &grpc.UnaryServerInfo{}, nil); status.Code(err) != codes.Unavailable {
+		t.Fatalf("call accepted while draining, %v", err)
+	}
+	close(release)
+	if err := d.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDrainer_Rejected(t *testing.T) {
+	d := NewDrainer("/svc/Connect")
+	intercept := d.UnaryServerInterceptor()
+	if err := d.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+	if _, err := intercept(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/svc/Connect"}, handler); status.Code(err) != codes.Unavailable {
+		t.Fatalf("rejected call accepted while draining, %v", err)
+	}
+	// served until the server stops
+	if res, err := intercept(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/svc/Publish"}, handler); err != nil || res != "ok" {
+		t.Fatalf("call rejected while draining, %v", err)
+	}
+}
@@ -1,11 +1,63 @@
 package server
 
 import (
-	"github.com/tkeel-io/kit/transport/grpc"
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/tkeel-io/kit/log"
+	"github.com/tkeel-io/kit/transport"
+	"google.golang.org/grpc"
 )
 
-// NewHTTPServer new a GRPC server.
-func NewGRPCServer(addr string) *grpc.Server {
-	s := grpc.NewServer(addr)
-	return s
+// GRPCServer is a grpc transport server which, unlike the kit one,
+// accepts server options such as interceptors.
+type GRPCServer struct {
+	Addr string
+	srv  *grpc.Server
+}
+
+// NewGRPCServer new a GRPC server.
+func NewGRPCServer(addr string, opts ...grpc.ServerOption) *GRPCServer {
+	return &GRPCServer{
+		Addr: addr,
+		srv:  grpc.NewServer(opts...),
+	}
+}
+
+func (s *GRPCServer) GetServe() *grpc.Server {
+	return s.srv
+}
+
+func (s *GRPCServer) Type() transport.Type {
+	return transport.TypeGRPC
+}
+
+func (s *GRPCServer) Start(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("error listen addr: %w", err)
+	}
+	log.Debugf("GRPC Server listen: %s", s.Addr)
+	go func() {
+		if err := s.srv.Serve(l); err != nil {
+			log.Errorf("error grpc serve: %s", err)
+		}
+	}()
+	return nil
+}
+
+// Stop waits for pending RPCs until ctx is done, then closes them.
+func (s *GRPCServer) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.srv.Stop()
+	}
+	return nil
 }
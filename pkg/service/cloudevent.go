@@ -0,0 +1,124 @@
+package service
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "strconv"
+    "time"
+
+    "github.com/Shopify/sarama"
+    "github.com/cloudevents/sdk-go/protocol/kafka_sarama/v2"
+    cloudevents "github.com/cloudevents/sdk-go/v2"
+    "github.com/cloudevents/sdk-go/v2/binding"
+    "github.com/cloudevents/sdk-go/v2/extensions"
+    "github.com/google/uuid"
+    "github.com/pkg/errors"
+    "github.com/tkeel-io/iothub/pkg/tracing"
+)
+
+const (
+    // CloudEventModeStructured puts the whole event json in the kafka value.
+    CloudEventModeStructured = "structured"
+    // CloudEventModeBinary puts attributes in kafka headers and data in the value.
+    CloudEventModeBinary = "binary"
+
+    cloudEventSource  = "iothub"
+    defaultPubsubName = "iothub-pubsub"
+
+    // seqepoch and seq let core detect gaps and reordering of one device.
+    seqEpochExtension = "seqepoch"
+    seqExtension      = "seq"
+    // replayed is the time an archived event is sent again
+    replayedExtension = "replayed"
+)
+
+// event types sent to core
+const (
+    EventTypeConnectInfo     = "io.tkeel.iothub.connectinfo"
+    EventTypeTelemetry       = "io.tkeel.iothub.telemetry"
+    EventTypeAttributes      = "io.tkeel.iothub.attributes"
+    EventTypeCommandResponse = "io.tkeel.iothub.command.response"
+    EventTypeRaw             = "io.tkeel.iothub.raw"
+    EventTypeDownstream      = "io.tkeel.iothub.downstream"
+    EventTypeDeviceEvent     = "io.tkeel.iothub.device.event"
+)
+
+func eventTypeFromProperty(propertyType string) string {
+    switch propertyType {
+    case telemetryProperty:
+        return EventTypeTelemetry
+    case attributeProperty:
+        return EventTypeAttributes
+    case commandProperty:
+        return EventTypeCommandResponse
+    }
+    return EventTypeRaw
+}
+
+func validCloudEventMode(mode string) bool {
+    return mode == CloudEventModeStructured || mode == CloudEventModeBinary
+}
+
+// timeFromMilli converts an emqx message timestamp, falls back to now.
+func timeFromMilli(ms uint64) time.Time {
+    if ms == 0 {
+        return time.Now()
+    }
+    return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
+
+// traceparentFromContext returns the W3C trace context of the span in ctx,
+// or starts a new trace when there is none.
+func traceparentFromContext(ctx context.Context) (string, string) {
+    if tp, ts := tracing.Traceparent(ctx); tp != "" {
+        return tp, ts
+    }
+    return newTraceparent(), ""
+}
+
+func newTraceparent() string {
+    id := make([]byte, 24)
+    if _, err := rand.Read(id); err != nil {
+        return ""
+    }
+    return "00-" + hex.EncodeToString(id[:16]) + "-" + hex.EncodeToString(id[16:]) + "-01"
+}
+
+// newCloudEvent builds the event of device devId sent to core topic of pubsub.
+func newCloudEvent(ctx context.Context, topic, pubsub, devId, eventType string, evTime time.Time, data interface{}) (cloudevents.Event, error) {
+    ev := cloudevents.NewEvent()
+    ev.SetID(uuid.New().String())
+    ev.SetSource(cloudEventSource)
+    ev.SetType(eventType)
+    ev.SetSubject(devId)
+    ev.SetTime(evTime)
+    // dapr pubsub extensions, core subscribes through dapr
+    ev.SetExtension("topic", topic)
+    ev.SetExtension("pubsubname", pubsub)
+    tp, ts := traceparentFromContext(ctx)
+    extensions.DistributedTracingExtension{TraceParent: tp, TraceState: ts}.AddTracingAttributes(&ev)
+    if err := ev.SetData(cloudevents.ApplicationJSON, data); err != nil {
+        return ev, errors.Wrap(err, "set cloudevent data")
+    }
+    return ev, errors.Wrap(ev.Validate(), "validate cloudevent")
+}
+
+func setSequence(ev *cloudevents.Event, epoch int64, seq uint64) {
+    // cloudevents integers are int32, keep the full range as strings
+    ev.SetExtension(seqEpochExtension, strconv.FormatInt(epoch, 10))
+    ev.SetExtension(seqExtension, strconv.FormatUint(seq, 10))
+}
+
+// encodeCloudEvent fills the kafka message in structured or binary mode,
+// following the cloudevents kafka protocol binding.
+func encodeCloudEvent(ctx context.Context, ev cloudevents.Event, mode string, msg *sarama.ProducerMessage) error {
+    if mode == CloudEventModeBinary {
+        ctx = binding.WithForceBinary(ctx)
+    } else {
+        ctx = binding.WithForceStructured(ctx)
+    }
+    // the key is the device id, not a partitionkey extension
+    ctx = kafka_sarama.WithSkipKeyMapping(ctx)
+    return errors.Wrap(kafka_sarama.WriteProducerMessage(ctx, binding.ToMessage(&ev), msg), "encode cloudevent")
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+    "context"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/Shopify/sarama"
+    "github.com/tidwall/gjson"
+    "github.com/tkeel-io/iothub/pkg/tracing"
+)
+
+func TestNewCloudEvent_Traceparent(t *testing.T) {
+    if _, err := tracing.Init(context.Background(), "iothub", tracing.ExporterNone); err != nil {
+        t.Fatal(err)
+    }
+    tp := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+    h := http.Header{}
+    h.Set("traceparent", tp)
+    ctx := tracing.ExtractHTTP(context.Background(), h)
+    ev, err := newCloudEvent(ctx, "core-pub", defaultPubsubName, "dev1", EventTypeTelemetry, time.Now(), map[string]interface{}{"id": "dev1"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ev.Extensions()["traceparent"] != tp {
+        t.Fatalf("traceparent not propagated, got %v", ev.Extensions()["traceparent"])
+    }
+    ctx, span := tracing.Start(ctx, "test")
+    defer span.End()
+    ev, err = newCloudEvent(ctx, "core-pub", defaultPubsubName, "dev1", EventTypeTelemetry, time.Now(), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if s, _ := ev.Extensions()["traceparent"].(string); !strings.HasPrefix(s, "00-0af7651916cd43dd8448eb211c80319c-") || s == tp {
+        t.Fatalf("traceparent not continued, got %v", s)
+    }
+    ev, err = newCloudEvent(context.Background(), "core-pub", defaultPubsubName, "dev1", EventTypeTelemetry, time.Now(), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if s, _ := ev.Extensions()["traceparent"].(string); !strings.HasPrefix(s, "00-") || len(s) != 55 {
+        t.Fatalf("invalid new traceparent %v", s)
+    }
+}
+
+func TestEncodeCloudEvent(t *testing.T) {
+    ts := time.Unix(1641349927, 0)
+    ev, err := newCloudEvent(context.Background(), "core-pub", defaultPubsubName, "dev1", EventTypeTelemetry, ts, map[string]interface{}{"id": "dev1"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    setSequence(&ev, 1, 2)
+
+    msg := &sarama.ProducerMessage{}
+    if err := encodeCloudEvent(context.Background(), ev, CloudEventModeStructured, msg); err != nil {
+        t.Fatal(err)
+    }
+    v, _ := msg.Value.Encode()
+    if gjson.GetBytes(v, "subject").String() != "dev1" || gjson.GetBytes(v, "type").String() != EventTypeTelemetry {
+        t.Fatalf("unexpected structured event %s", v)
+    }
+    if gjson.GetBytes(v, "data.id").String() != "dev1" || gjson.GetBytes(v, "seq").String() != "2" {
+        t.Fatalf("unexpected structured event %s", v)
+    }
+
+    msg = &sarama.ProducerMessage{}
+    if err := encodeCloudEvent(context.Background(), ev, CloudEventModeBinary, msg); err != nil {
+        t.Fatal(err)
+    }
+    headers := make(map[string]string)
+    for _, h := range msg.Headers {
+        headers[string(h.Key)] = string(h.Value)
+    }
+    if headers["ce_subject"] != "dev1" || headers["ce_seq"] != "2" || headers["content-type"] != "application/json" {
+        t.Fatalf("unexpected binary headers %v", headers)
+    }
+    v, _ = msg.Value.Encode()
+    if gjson.GetBytes(v, "id").String() != "dev1" {
+        t.Fatalf("unexpected binary data %s", v)
+    }
+}
@@ -0,0 +1,448 @@
+package service
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "net"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pkg/errors"
+    "github.com/tkeel-io/iothub/pkg/coap"
+    "github.com/tkeel-io/iothub/pkg/tracing"
+    pb "github.com/tkeel-io/iothub/protobuf"
+    "github.com/tkeel-io/kit/log"
+    "go.opentelemetry.io/otel/trace"
+)
+
+const (
+    // ProtocolCoAP is the protocol of devices of the iothub CoAP server,
+    // "coap" is the protocol of the EMQX CoAP gateway.
+    ProtocolCoAP = "coap-native"
+
+    // query parameter of the entity token
+    coapTokenQuery = "token"
+
+    defaultCoAPIdleTimeout = 5 * time.Minute
+    // how long the notifier of a device waits on its mailbox at once
+    coapNotifyWait = time.Minute
+)
+
+// CoAPConfig configures the CoAP server of devices not going through the
+// EMQX CoAP gateway.
+type CoAPConfig struct {
+    // Addr is the UDP address of plain CoAP, empty disables it.
+    Addr string
+    // DTLSAddr is the UDP address of CoAP over DTLS-PSK, empty disables it.
+    DTLSAddr string
+    // PSKSecret derives the pre-shared keys of devices, see DevicePSK.
+    PSKSecret string
+    // IdleTimeout marks a device without request or observation offline
+    // after this long.
+    IdleTimeout time.Duration
+    // MaxMessageSize bounds a request, in bytes.
+    MaxMessageSize int
+    // TokenCacheTTL keeps a parsed token for this long, 0 asks keel every request.
+    TokenCacheTTL time.Duration
+}
+
+// DevicePSK is the DTLS pre-shared key of devId, HMAC-SHA256 of the device
+// id keyed with secret. Devices use their id as PSK identity.
+func DevicePSK(secret, devId string) []byte {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(devId)) //nolint:errcheck
+    return mac.Sum(nil)
+}
+
+// upstreamTopic reports whether devices send data to topic.
+func upstreamTopic(topic string) bool {
+    return propertyTypeFromTopic(topic) != "" || topic == RawDataTopic
+}
+
+// coversTopic reports whether the topic filter covers topic, the topic of
+// a downlink.
+func coversTopic(filter, topic string) bool {
+    for _, st := range expandFilter(filter) {
+        if st.Name() == topic {
+            return true
+        }
+        if st.Key == topicKeyWildcard && strings.HasPrefix(topic, st.withKey("").Name()+"/") {
+            return true
+        }
+    }
+    return false
+}
+
+// coapDevice are the observations of a device, by observed topic filter.
+type coapDevice struct {
+    cancel       context.CancelFunc
+    observations map[string]*coap.Observation
+    // closed and replaced when an observation is added
+    changed chan struct{}
+}
+
+// CoAPService serves devices over CoAP, the resources are the MQTT topics:
+// POST to the upstream topics goes through the upstream pipeline and GET
+// with Observe subscribes a topic, its downlinks are notified from the
+// mailbox. Requests authenticate with ?token=, the entity token. Over
+// DTLS the PSK identity is the device id, the token must be of the same
+// device.
+type CoAPService struct {
+    ctx     context.Context
+    cancel  context.CancelFunc
+    hookSvc *HookService
+    conf    CoAPConfig
+    tokens  *tokenCache
+    server  *coap.Server
+
+    lock     sync.Mutex
+    devices  map[string]*coapDevice
+    udpConn  net.PacketConn
+    dtlsList net.Listener
+}
+
+func NewCoAPService(ctx context.Context, hookSvc *HookService) *CoAPService {
+    conf := hookSvc.conf.CoAP
+    if conf.IdleTimeout <= 0 {
+        conf.IdleTimeout = defaultCoAPIdleTimeout
+    }
+    ctx, cancel := context.WithCancel(ctx)
+    s := &CoAPService{
+        ctx:     ctx,
+        cancel:  cancel,
+        hookSvc: hookSvc,
+        conf:    conf,
+        tokens:  newTokenCache(conf.TokenCacheTTL),
+        devices: make(map[string]*coapDevice),
+    }
+    s.server = coap.NewServer(s, coap.Config{
+        MaxMessageSize: conf.MaxMessageSize,
+        IdleTimeout:    conf.IdleTimeout,
+    })
+    return s
+}
+
+// Start listens on the configured addresses and serves them in the
+// background until Close.
+func (s *CoAPService) Start() error {
+    if s.conf.Addr != "" {
+        conn, err := net.ListenPacket("udp", s.conf.Addr)
+        if err != nil {
+            return errors.Wrap(err, "listen coap")
+        }
+        s.lock.Lock()
+        s.udpConn = conn
+        s.lock.Unlock()
+        go func() {
+            if err := s.server.ServeUDP(conn); err != nil {
+                log.Errorf("serve coap err, %v", err)
+            }
+        }()
+    }
+    if s.conf.DTLSAddr != "" {
+        if s.conf.PSKSecret == "" {
+            return errors.New("coap over dtls needs a psk secret")
+        }
+        l, err := coap.ListenDTLS(s.conf.DTLSAddr, coap.DTLSConfig{
+            PSK: func(identity []byte) ([]byte, error) {
+                if len(identity) == 0 {
+                    return nil, errors.New("empty psk identity")
+                }
+                return DevicePSK(s.conf.PSKSecret, string(identity)), nil
+            },
+        })
+        if err != nil {
+            return errors.Wrap(err, "listen coap over dtls")
+        }
+        s.lock.Lock()
+        s.dtlsList = l
+        s.lock.Unlock()
+        go func() {
+            if err := s.server.Serve(l); err != nil {
+                log.Errorf("serve coap over dtls err, %v", err)
+            }
+        }()
+    }
+    return nil
+}
+
+// Addr is the address of plain CoAP, nil if not listening.
+func (s *CoAPService) Addr() net.Addr {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if s.udpConn == nil {
+        return nil
+    }
+    return s.udpConn.LocalAddr()
+}
+
+// DTLSAddr is the address of CoAP over DTLS, nil if not listening.
+func (s *CoAPService) DTLSAddr() net.Addr {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if s.dtlsList == nil {
+        return nil
+    }
+    return s.dtlsList.Addr()
+}
+
+// Close stops the server and cancels the observations, the downlinks not
+// notified stay in the mailbox.
+func (s *CoAPService) Close() {
+    s.cancel()
+    if err := s.server.Close(); err != nil {
+        log.Errorf("close coap server err, %v", err)
+    }
+}
+
+// Run marks the devices idle for longer than the idle timeout offline,
+// until ctx is done.
+func (s *CoAPService) Run(ctx context.Context) {
+    interval := s.conf.IdleTimeout / 4
+    if interval < time.Second {
+        interval = time.Second
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            if n := s.ExpireIdle(ctx); n > 0 {
+                log.Infof("marked %d idle coap devices offline", n)
+            }
+            s.tokens.expire()
+        }
+    }
+}
+
+// ExpireIdle marks the CoAP devices idle for longer than the idle timeout
+// offline, observing devices are not idle. It returns how many.
+func (s *CoAPService) ExpireIdle(ctx context.Context) int {
+    return s.hookSvc.expireIdle(ctx, ProtocolCoAP, s.conf.IdleTimeout, s.observing)
+}
+
+func (s *CoAPService) observing(devId string) bool {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    _, ok := s.devices[devId]
+    return ok
+}
+
+func coapError(c coap.Code, msg string) *coap.Message {
+    return &coap.Message{Code: c, Payload: []byte(msg)}
+}
+
+func peerHostOf(addr net.Addr) string {
+    if udp, ok := addr.(*net.UDPAddr); ok {
+        return udp.IP.String()
+    }
+    host, _, err := net.SplitHostPort(addr.String())
+    if err != nil {
+        return addr.String()
+    }
+    return host
+}
+
+// ServeCOAP handles a CoAP request of a device.
+func (s *CoAPService) ServeCOAP(ctx context.Context, req *coap.Request) *coap.Message {
+    ctx, span := tracing.Start(ctx, "coap."+req.Code.String(), trace.WithSpanKind(trace.SpanKindServer))
+    var err error
+    defer func() { tracing.End(span, err) }()
+    if s.ctx.Err() != nil {
+        return coapError(coap.ServiceUnavailable, "server is shutting down")
+    }
+    devId, reason := s.hookSvc.authCached(ctx, s.tokens, req.Query(coapTokenQuery))
+    switch {
+    case reason == authReasonStateError:
+        return coapError(coap.ServiceUnavailable, "save device state failed")
+    case devId == "":
+        return coapError(coap.Unauthorized, "invalid token")
+    }
+    if id := req.Session.Identity(); id != "" && id != devId {
+        return coapError(coap.Forbidden, "token of another device")
+    }
+    rec, err := s.hookSvc.connectDevice(ctx, devId, ProtocolCoAP, peerHostOf(req.Session.RemoteAddr()))
+    if err != nil {
+        return coapError(coap.ServiceUnavailable, err.Error())
+    }
+    topic := req.Path()
+    switch req.Code {
+    case coap.POST, coap.PUT:
+        if !upstreamTopic(topic) {
+            return coapError(coap.NotFound, "no such topic")
+        }
+        if len(req.Payload) == 0 {
+            return coapError(coap.BadRequest, "empty payload")
+        }
+        msg := &pb.Message{
+            Qos:       1,
+            From:      devId,
+            Topic:     buildTopic(devId, topic),
+            Payload:   req.Payload,
+            Timestamp: uint64(time.Now().UnixMilli()),
+        }
+        if err = s.hookSvc.uplink(ctx, rec, msg); err != nil {
+            log.Errorf("coap %s of %s err, %v", topic, devId, err)
+            return coapError(coap.ServiceUnavailable, err.Error())
+        }
+        return &coap.Message{Code: coap.Changed}
+    case coap.GET:
+        if !validSubTopic(topic) {
+            return coapError(coap.NotFound, "no such topic")
+        }
+        if v, ok := req.Uint(coap.Observe); !ok || v != coap.ObserveRegister {
+            // downlinks are only sent as notifications
+            return &coap.Message{Code: coap.Content}
+        }
+        // core sends the data of subscribed topics only
+        if !rec.HasTopic(topic) {
+            if err = s.hookSvc.subscriptions.Subscribe(ctx, devId, []string{topic}); err != nil {
+                log.Errorf("subscribe %s of %s err, %v", topic, devId, err)
+                return coapError(coap.ServiceUnavailable, err.Error())
+            }
+        }
+        s.observe(devId, topic, req.Observe())
+        resp := &coap.Message{Code: coap.Content}
+        resp.SetUint(coap.ContentFormat, coap.AppJSON)
+        return resp
+    }
+    return coapError(coap.MethodNotAllowed, "")
+}
+
+// observe keeps the observation of topic by devId, replacing the previous
+// one, and notifies it of the downlinks of devId until cancelled.
+func (s *CoAPService) observe(devId, topic string, o *coap.Observation) {
+    s.lock.Lock()
+    d, ok := s.devices[devId]
+    if !ok {
+        ctx, cancel := context.WithCancel(s.ctx)
+        d = &coapDevice{cancel: cancel, observations: make(map[string]*coap.Observation), changed: make(chan struct{})}
+        s.devices[devId] = d
+        go s.notify(ctx, devId, d)
+    }
+    old := d.observations[topic]
+    d.observations[topic] = o
+    close(d.changed)
+    d.changed = make(chan struct{})
+    s.lock.Unlock()
+    if old != nil && old != o {
+        old.Cancel()
+    }
+    go func() {
+        <-o.Done()
+        s.unobserve(devId, topic, o)
+    }()
+}
+
+// unobserve forgets an observation, the notifier of a device ends with its
+// last observation.
+func (s *CoAPService) unobserve(devId, topic string, o *coap.Observation) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    d, ok := s.devices[devId]
+    if !ok || d.observations[topic] != o {
+        return
+    }
+    delete(d.observations, topic)
+    if len(d.observations) == 0 {
+        d.cancel()
+        delete(s.devices, devId)
+    }
+}
+
+// observation returns the observation of devId covering topic.
+func (s *CoAPService) observation(devId, topic string) *coap.Observation {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    d, ok := s.devices[devId]
+    if !ok {
+        return nil
+    }
+    if o, ok := d.observations[topic]; ok {
+        return o
+    }
+    for filter, o := range d.observations {
+        if coversTopic(filter, topic) {
+            return o
+        }
+    }
+    return nil
+}
+
+// notify sends the downlinks of devId to its observations until ctx is
+// done. The downlinks of topics not observed, or not acknowledged, are held
+// apart and retried once the observations change, the others keep flowing.
+// The held ones go back to the mailbox when the last observation ends.
+func (s *CoAPService) notify(ctx context.Context, devId string, d *coapDevice) {
+    mailbox := s.hookSvc.mailbox
+    var (
+        held        []PendingDownlink
+        heldChanged <-chan struct{}
+    )
+    defer func() {
+        if len(held) > 0 {
+            s.requeue(devId, held)
+        }
+    }()
+    for ctx.Err() == nil {
+        s.lock.Lock()
+        changed := d.changed
+        s.lock.Unlock()
+        wait := coapNotifyWait
+        if len(held) > 0 {
+            // polled, a new observation does not wake up the mailbox
+            wait = mailboxPollInterval
+        }
+        pending, err := mailbox.Wait(ctx, devId, wait)
+        if err != nil {
+            log.Errorf("wait downlinks of %s err, %v", devId, err)
+            select {
+            case <-ctx.Done():
+            case <-time.After(mailboxPollInterval):
+            }
+            continue
+        }
+        select {
+        case <-heldChanged:
+            pending, held = append(held, pending...), nil
+        default:
+        }
+        var kept []PendingDownlink
+        for _, dl := range pending {
+            if o := s.observation(devId, dl.Topic); o != nil {
+                msg := &coap.Message{Code: coap.Content, Payload: dl.Payload}
+                msg.SetUint(coap.ContentFormat, coap.AppJSON)
+                err := o.Notify(ctx, msg)
+                if err == nil {
+                    // an acknowledged notification is a sign of life
+                    s.hookSvc.presence.Seen(devId)
+                    continue
+                }
+                log.Warnf("notify %s of %s err, %v", dl.Topic, devId, err)
+            }
+            kept = append(kept, dl)
+        }
+        if len(kept) > 0 {
+            held, heldChanged = append(held, kept...), changed
+            if n := len(held) - mailbox.maxPending; n > 0 {
+                log.Warnf("undelivered downlinks of %s full, drop %d oldest", devId, n)
+                held = held[n:]
+            }
+        }
+    }
+}
+
+func (s *CoAPService) requeue(devId string, pending []PendingDownlink) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    for _, dl := range pending {
+        if err := s.hookSvc.mailbox.Push(ctx, devId, dl); err != nil {
+            log.Errorf("requeue downlink %s of %s err, %v", dl.Topic, devId, err)
+            return
+        }
+    }
+}
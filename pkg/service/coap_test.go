@@ -0,0 +1,257 @@
+package service_test
+
+import (
+    "context"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/pion/dtls/v2"
+    "github.com/tkeel-io/iothub/pkg/coap"
+    "github.com/tkeel-io/iothub/pkg/exhooktest"
+    "github.com/tkeel-io/iothub/pkg/service"
+)
+
+// coapClient is a CoAP device of a harness, notifications received while
+// waiting for a response are kept for notification.
+type coapClient struct {
+    t     *testing.T
+    conn  net.Conn
+    id    uint16
+    notes []*coap.Message
+}
+
+func dialCoAP(t *testing.T, h *exhooktest.Harness) *coapClient {
+    conn, err := net.Dial("udp", h.CoAP.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    return &coapClient{t: t, conn: conn}
+}
+
+func dialCoAPDTLS(h *exhooktest.Harness, identity string, key []byte) (*dtls.Conn, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+    defer cancel()
+    return dtls.DialWithContext(ctx, "udp", h.CoAP.DTLSAddr().(*net.UDPAddr), &dtls.Config{
+        PSK:             func([]byte) ([]byte, error) { return key, nil },
+        PSKIdentityHint: []byte(identity),
+        CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+    })
+}
+
+func (c *coapClient) send(m *coap.Message) {
+    c.t.Helper()
+    b, err := m.Marshal()
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    if _, err := c.conn.Write(b); err != nil {
+        c.t.Fatal(err)
+    }
+}
+
+func (c *coapClient) recv() *coap.Message {
+    c.t.Helper()
+    buf := make([]byte, 2048)
+    c.conn.SetReadDeadline(time.Now().Add(3 * time.Second)) //nolint:errcheck
+    n, err := c.conn.Read(buf)
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    m, err := coap.Unmarshal(buf[:n])
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    return m
+}
+
+// do sends a confirmable request of path?token= and returns the response.
+func (c *coapClient) do(code coap.Code, path, token, payload string, observe uint32, withObserve bool) *coap.Message {
+    c.t.Helper()
+    c.id++
+    req := &coap.Message{Type: coap.Confirmable, Code: code, MessageID: c.id, Token: []byte(path), Payload: []byte(payload)}
+    if len(req.Token) > 8 {
+        req.Token = req.Token[len(req.Token)-8:]
+    }
+    req.SetPath(path)
+    req.Add(coap.URIQuery, []byte("token="+token))
+    if withObserve {
+        req.SetUint(coap.Observe, observe)
+    }
+    c.send(req)
+    for {
+        m := c.recv()
+        if m.Type == coap.Acknowledgement && m.MessageID == req.MessageID {
+            return m
+        }
+        if m.Type == coap.Confirmable {
+            c.notes = append(c.notes, m)
+        }
+    }
+}
+
+// notification returns the next notification, acknowledged or reset.
+func (c *coapClient) notification(reset bool) *coap.Message {
+    c.t.Helper()
+    var m *coap.Message
+    if len(c.notes) > 0 {
+        m, c.notes = c.notes[0], c.notes[1:]
+    } else {
+        m = c.recv()
+    }
+    if m.Type != coap.Confirmable {
+        c.t.Fatalf("notification %+v", m)
+    }
+    reply := &coap.Message{Type: coap.Acknowledgement, Code: coap.Empty, MessageID: m.MessageID}
+    if reset {
+        reply.Type = coap.Reset
+    }
+    c.send(reply)
+    return m
+}
+
+func TestCoAP_Upstream(t *testing.T) {
+    h := exhooktest.New(t)
+    h.Keel.AddToken("token1", "dev1", "u1", "t1")
+    c := dialCoAP(t, h)
+
+    tests := []struct {
+        path, token, payload string
+        code                 coap.Code
+    }{
+        {service.TelemetryTopic, "wrong", `{"temp":20}`, coap.Unauthorized},
+        {service.TelemetryTopic, "token1", `{"temp":20}`, coap.Changed},
+        {service.AttributesTopic, "token1", `{"fw":"1.2"}`, coap.Changed},
+        {service.CommandTopicResponse, "token1", `{"reboot":{"output":0}}`, coap.Changed},
+        {service.TelemetryTopic, "token1", ``, coap.BadRequest},
+        {"v1/devices/me/unknown", "token1", `{}`, coap.NotFound},
+    }
+    for _, tt := range tests {
+        if resp := c.do(coap.POST, tt.path, tt.token, tt.payload, 0, false); resp.Code != tt.code {
+            t.Fatalf("%s %s: %s %s, want %s", tt.path, tt.payload, resp.Code, resp.Payload, tt.code)
+        }
+    }
+    if got := eventTypes(t, h); got != "connectinfo telemetry attributes command.response" {
+        t.Fatalf("events %s", got)
+    }
+    rec, err := h.Service.Registry().Get(context.Background(), "dev1")
+    if err != nil || rec == nil || rec.Protocol != service.ProtocolCoAP || rec.ConnectInfo == nil || rec.ConnectInfo.PeerHost != "127.0.0.1" {
+        t.Fatalf("record %+v, %v", rec, err)
+    }
+    if got := lastEvent(t, h).Get("data.rawData.path").String(); got != "dev1/v1/devices/me/command/response" {
+        t.Fatalf("path %s", got)
+    }
+}
+
+func TestCoAP_Observe(t *testing.T) {
+    h := exhooktest.New(t, func(c *service.Config) {
+        c.CoAP.IdleTimeout = 100 * time.Millisecond
+    })
+    h.Keel.AddToken("token1", "dev1", "u1", "t1")
+    ctx := context.Background()
+    c := dialCoAP(t, h)
+
+    resp := c.do(coap.GET, service.CommandTopic, "token1", "", coap.ObserveRegister, true)
+    if _, ok := resp.Uint(coap.Observe); resp.Code != coap.Content || !ok {
+        t.Fatalf("observe %+v", resp)
+    }
+    if got := subscriptionTopics(h); got != "realtime:sub-core" {
+        t.Fatalf("subscriptions %s", got)
+    }
+
+    // notified instead of published to emqx
+    want := `{"reboot":{"id":"c1","input":{"delay":5}}}`
+    if resp, err := h.CoreEvent(ctx, exhooktest.CoreTopic, commandEvent()); err != nil || resp.GetStatus() != service.SubscriptionResponseStatusDrop {
+        t.Fatalf("core event %v, %v", resp, err)
+    }
+    if n := c.notification(false); string(n.Payload) != want {
+        t.Fatalf("notification %s", n.Payload)
+    }
+    if published := h.Emqx.Published(); len(published) != 0 {
+        t.Fatalf("published to emqx %+v", published)
+    }
+    // an observing device is not idle
+    time.Sleep(150 * time.Millisecond)
+    if n := h.CoAP.ExpireIdle(ctx); n != 0 {
+        t.Fatalf("%d observing devices expired", n)
+    }
+
+    // a rejected notification waits for the next observation
+    if _, err := h.CoreEvent(ctx, exhooktest.CoreTopic, commandEvent()); err != nil {
+        t.Fatal(err)
+    }
+    c.notification(true)
+    time.Sleep(50 * time.Millisecond)
+    c.do(coap.GET, service.CommandTopic, "token1", "", coap.ObserveRegister, true)
+    if n := c.notification(false); string(n.Payload) != want {
+        t.Fatalf("notification after reset %s", n.Payload)
+    }
+
+    // deregistered, the device goes idle
+    c.do(coap.GET, service.CommandTopic, "token1", "", coap.ObserveDeregister, true)
+    time.Sleep(150 * time.Millisecond)
+    if n := h.CoAP.ExpireIdle(ctx); n != 1 {
+        t.Fatalf("%d devices expired", n)
+    }
+    if got := eventTypes(t, h); !strings.HasPrefix(got, "connectinfo downstream downstream") || !strings.HasSuffix(got, "connectinfo") {
+        t.Fatalf("events %s", got)
+    }
+}
+
+func TestCoAP_DTLS(t *testing.T) {
+    h := exhooktest.New(t)
+    h.Keel.AddToken("token1", "dev1", "u1", "t1")
+    h.Keel.AddToken("token2", "dev2", "u1", "t1")
+
+    conn, err := dialCoAPDTLS(h, "dev1", service.DevicePSK(exhooktest.PSKSecret, "dev1"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    c := &coapClient{t: t, conn: conn}
+    if resp := c.do(coap.POST, service.TelemetryTopic, "token1", `{"temp":20}`, 0, false); resp.Code != coap.Changed {
+        t.Fatalf("post %s %s", resp.Code, resp.Payload)
+    }
+    // the token of another device
+    if resp := c.do(coap.POST, service.TelemetryTopic, "token2", `{"temp":20}`, 0, false); resp.Code != coap.Forbidden {
+        t.Fatalf("post of dev2 %s", resp.Code)
+    }
+    // the key of another device
+    if conn, err := dialCoAPDTLS(h, "dev1", service.DevicePSK(exhooktest.PSKSecret, "dev2")); err == nil {
+        conn.Close()
+        t.Fatal("handshake with the key of dev2")
+    }
+}
+
+func TestCoAP_ObserveHeld(t *testing.T) {
+    h := exhooktest.New(t)
+    h.Keel.AddToken("token1", "dev1", "u1", "t1")
+    ctx := context.Background()
+    c := dialCoAP(t, h)
+
+    c.do(coap.GET, service.CommandTopic, "token1", "", coap.ObserveRegister, true)
+    c.do(coap.GET, service.AttributesTopic, "token1", "", coap.ObserveRegister, true)
+    c.do(coap.GET, service.AttributesTopic, "token1", "", coap.ObserveDeregister, true)
+    time.Sleep(50 * time.Millisecond)
+
+    // the attributes wait for an observation, the command does not
+    attributes := map[string]interface{}{
+        "id":         "dev1",
+        "owner":      "u1",
+        "properties": map[string]interface{}{"attributes": map[string]interface{}{"mode": "eco"}},
+    }
+    for _, event := range []map[string]interface{}{attributes, commandEvent()} {
+        if _, err := h.CoreEvent(ctx, exhooktest.CoreTopic, event); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if n := c.notification(false); string(n.Payload) != `{"reboot":{"id":"c1","input":{"delay":5}}}` {
+        t.Fatalf("notification %s", n.Payload)
+    }
+    c.do(coap.GET, service.AttributesTopic, "token1", "", coap.ObserveRegister, true)
+    if n := c.notification(false); string(n.Payload) != `{"mode":"eco"}` {
+        t.Fatalf("held notification %s", n.Payload)
+    }
+}
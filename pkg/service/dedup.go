@@ -0,0 +1,176 @@
+package service
+
+import (
+    "container/list"
+    "context"
+    "crypto/sha1"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/pkg/errors"
+    "github.com/tkeel-io/iothub/pkg/store"
+    "github.com/tkeel-io/iothub/pkg/tracing"
+    pb "github.com/tkeel-io/iothub/protobuf"
+    "github.com/tkeel-io/kit/log"
+    "go.opentelemetry.io/otel/trace"
+)
+
+const (
+    dedupPrefixKey = `dedup_`
+
+    defaultDedupMaxEntries = 100000
+)
+
+// DedupConfig configures the deduplication window of uplink messages.
+type DedupConfig struct {
+    // TTL is how long a message key is remembered, 0 disables deduplication.
+    TTL time.Duration
+    // MaxEntries bounds the number of keys kept in memory.
+    MaxEntries int
+    // PayloadHash adds a hash of the payload to the key, for devices reusing message ids.
+    PayloadHash bool
+    // Shared also records keys in the state store so all replicas see them.
+    Shared bool
+}
+
+type dedupEntry struct {
+    key     string
+    expires time.Time
+}
+
+// Deduplicator remembers recently seen (device, message id) pairs so that
+// QoS 1 retransmissions are not forwarded to core twice.
+type Deduplicator struct {
+    confLock sync.RWMutex
+    conf     DedupConfig
+    store    store.StateStore
+
+    lock    sync.Mutex
+    entries map[string]*list.Element
+    order   *list.List
+}
+
+func NewDeduplicator(conf DedupConfig, stateStore store.StateStore) *Deduplicator {
+    if conf.MaxEntries <= 0 {
+        conf.MaxEntries = defaultDedupMaxEntries
+    }
+    return &Deduplicator{
+        conf:    conf,
+        store:   stateStore,
+        entries: make(map[string]*list.Element),
+        order:   list.New(),
+    }
+}
+
+// SetConfig changes the window and the payload hash of the following
+// messages, the entry bound and sharing are fixed at start.
+func (d *Deduplicator) SetConfig(conf DedupConfig) {
+    d.confLock.Lock()
+    defer d.confLock.Unlock()
+    d.conf.TTL, d.conf.PayloadHash = conf.TTL, conf.PayloadHash
+}
+
+func (d *Deduplicator) config() DedupConfig {
+    d.confLock.RLock()
+    defer d.confLock.RUnlock()
+    return d.conf
+}
+
+// Enabled reports whether the deduplication window is active.
+func (d *Deduplicator) Enabled() bool {
+    return d != nil && d.config().TTL > 0
+}
+
+func (d *Deduplicator) key(conf DedupConfig, username string, msg *pb.Message) string {
+    key := username + "/" + msg.GetId()
+    if conf.PayloadHash {
+        key = fmt.Sprintf("%s/%x", key, sha1.Sum(msg.GetPayload()))
+    }
+    return key
+}
+
+// Duplicate reports whether msg from username was already seen within the
+// window, and records it otherwise.
+func (d *Deduplicator) Duplicate(ctx context.Context, username string, msg *pb.Message) bool {
+    if d == nil || msg.GetId() == "" {
+        return false
+    }
+    conf := d.config()
+    if conf.TTL <= 0 {
+        return false
+    }
+    key := d.key(conf, username, msg)
+    now := time.Now()
+    if d.seenLocal(conf, key, now) {
+        return true
+    }
+    if conf.Shared && d.store != nil {
+        return d.seenShared(ctx, key, conf.TTL)
+    }
+    return false
+}
+
+// Forget drops the key of msg from username recorded by Duplicate, e.g.
+// after failing to forward it, so that its retransmission is forwarded.
+func (d *Deduplicator) Forget(ctx context.Context, username string, msg *pb.Message) {
+    if d == nil || msg.GetId() == "" {
+        return
+    }
+    conf := d.config()
+    if conf.TTL <= 0 {
+        return
+    }
+    key := d.key(conf, username, msg)
+    d.lock.Lock()
+    if e, ok := d.entries[key]; ok {
+        d.order.Remove(e)
+        delete(d.entries, key)
+    }
+    d.lock.Unlock()
+    if conf.Shared && d.store != nil {
+        if err := d.store.Delete(ctx, dedupPrefixKey+key, ""); err != nil {
+            log.Errorf("dedup delete state err, %v", err)
+        }
+    }
+}
+
+func (d *Deduplicator) seenLocal(conf DedupConfig, key string, now time.Time) bool {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+    // drop expired entries, oldest first
+    for e := d.order.Front(); e != nil; e = d.order.Front() {
+        ent := e.Value.(*dedupEntry)
+        if ent.expires.After(now) {
+            break
+        }
+        d.order.Remove(e)
+        delete(d.entries, ent.key)
+    }
+    if _, ok := d.entries[key]; ok {
+        return true
+    }
+    for d.order.Len() >= conf.MaxEntries {
+        e := d.order.Front()
+        d.order.Remove(e)
+        delete(d.entries, e.Value.(*dedupEntry).key)
+    }
+    d.entries[key] = d.order.PushBack(&dedupEntry{key: key, expires: now.Add(conf.TTL)})
+    return false
+}
+
+func (d *Deduplicator) seenShared(ctx context.Context, key string, ttl time.Duration) bool {
+    storeKey := dedupPrefixKey + key
+    ctx, span := tracing.Start(ctx, "dedup.Shared", trace.WithSpanKind(trace.SpanKindInternal))
+    defer span.End()
+    // only the first replica creates the key, the others see a duplicate
+    err := d.store.Save(ctx, &store.Item{Key: storeKey, Value: []byte("T"), TTL: ttl, FirstWrite: true})
+    if errors.Is(err, store.ErrEtagMismatch) {
+        return true
+    }
+    if err != nil {
+        // fail open, a duplicate is better than a lost message
+        log.Errorf("dedup save state err, %v", err)
+    }
+    return false
+}
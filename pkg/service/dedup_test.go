@@ -0,0 +1,88 @@
+package service
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    "github.com/tkeel-io/iothub/pkg/store"
+    pb "github.com/tkeel-io/iothub/protobuf"
+)
+
+func TestDeduplicator_Duplicate(t *testing.T) {
+    d := NewDeduplicator(DedupConfig{TTL: time.Minute, MaxEntries: 2}, nil)
+    ctx := context.Background()
+    msg := &pb.Message{Id: "m1", Payload: []byte("a")}
+    if d.Duplicate(ctx, "dev1", msg) {
+        t.Fatal("first message reported as duplicate")
+    }
+    if !d.Duplicate(ctx, "dev1", msg) {
+        t.Fatal("retransmission not detected")
+    }
+    if d.Duplicate(ctx, "dev2", msg) {
+        t.Fatal("same id of another device reported as duplicate")
+    }
+    // m1 of dev1 is evicted once the window is full
+    d.Duplicate(ctx, "dev3", msg)
+    if d.Duplicate(ctx, "dev1", msg) {
+        t.Fatal("evicted key still reported as duplicate")
+    }
+}
+
+func TestDeduplicator_PayloadHash(t *testing.T) {
+    d := NewDeduplicator(DedupConfig{TTL: time.Minute, PayloadHash: true}, nil)
+    ctx := context.Background()
+    d.Duplicate(ctx, "dev1", &pb.Message{Id: "m1", Payload: []byte("a")})
+    if d.Duplicate(ctx, "dev1", &pb.Message{Id: "m1", Payload: []byte("b")}) {
+        t.Fatal("reused id with new payload reported as duplicate")
+    }
+    if !d.Duplicate(ctx, "dev1", &pb.Message{Id: "m1", Payload: []byte("a")}) {
+        t.Fatal("retransmission not detected")
+    }
+}
+
+func TestDeduplicator_Expired(t *testing.T) {
+    d := NewDeduplicator(DedupConfig{TTL: time.Millisecond}, nil)
+    ctx := context.Background()
+    msg := &pb.Message{Id: "m1"}
+    d.Duplicate(ctx, "dev1", msg)
+    time.Sleep(5 * time.Millisecond)
+    if d.Duplicate(ctx, "dev1", msg) {
+        t.Fatal("expired key reported as duplicate")
+    }
+}
+
+func TestDeduplicator_Shared(t *testing.T) {
+    // two replicas receiving the same retransmission
+    stateStore := store.NewMemoryStore()
+    conf := DedupConfig{TTL: time.Minute, Shared: true}
+    r1, r2 := NewDeduplicator(conf, stateStore), NewDeduplicator(conf, stateStore)
+    ctx := context.Background()
+    msg := &pb.Message{Id: "m1"}
+    if r1.Duplicate(ctx, "dev1", msg) {
+        t.Fatal("first message reported as duplicate")
+    }
+    if !r2.Duplicate(ctx, "dev1", msg) {
+        t.Fatal("retransmission on another replica not detected")
+    }
+}
+
+func TestDeduplicator_Forget(t *testing.T) {
+    // a message not forwarded, its retransmission is forwarded
+    stateStore := store.NewMemoryStore()
+    conf := DedupConfig{TTL: time.Minute, Shared: true}
+    r1, r2 := NewDeduplicator(conf, stateStore), NewDeduplicator(conf, stateStore)
+    ctx := context.Background()
+    msg := &pb.Message{Id: "m1"}
+    if r1.Duplicate(ctx, "dev1", msg) {
+        t.Fatal("first message reported as duplicate")
+    }
+    r1.Forget(ctx, "dev1", msg)
+    if r1.Duplicate(ctx, "dev1", msg) {
+        t.Fatal("forgotten message reported as duplicate")
+    }
+    r1.Forget(ctx, "dev1", msg)
+    if r2.Duplicate(ctx, "dev1", msg) {
+        t.Fatal("forgotten message reported as duplicate on another replica")
+    }
+}
@@ -0,0 +1,264 @@
+package service
+
+import (
+    "context"
+    "encoding/json"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "strconv"
+    "time"
+
+    go_restful "github.com/emicklei/go-restful"
+    "github.com/tkeel-io/iothub/pkg/tracing"
+    pb "github.com/tkeel-io/iothub/protobuf"
+    "github.com/tkeel-io/kit/log"
+    "go.opentelemetry.io/otel/trace"
+)
+
+const (
+    // ProtocolHTTP is the protocol of devices using the device http api.
+    ProtocolHTTP = "http"
+
+    // optional id of a device request, a retried request of the same id is
+    // dropped like a QoS 1 retransmission
+    deviceMessageIDHeader = "X-Message-Id"
+
+    defaultDevicePollTimeout = 30 * time.Second
+    defaultDeviceIdleTimeout = 5 * time.Minute
+    defaultDeviceMaxBodySize = 64 << 10
+)
+
+// DeviceHTTPConfig configures the http api of devices unable to keep an
+// MQTT connection.
+type DeviceHTTPConfig struct {
+    // PollTimeout bounds a long poll of commands.
+    PollTimeout time.Duration
+    // IdleTimeout marks a device offline after no request for this long.
+    IdleTimeout time.Duration
+    // MaxBodySize bounds the payload of a request, in bytes.
+    MaxBodySize int64
+    // MaxPendingCommands bounds the commands kept for a device not polling,
+    // the oldest are dropped.
+    MaxPendingCommands int
+    // CommandTTL drops the pending commands of a device not polling for this long.
+    CommandTTL time.Duration
+    // TokenCacheTTL keeps a parsed token for this long, 0 asks keel every request.
+    TokenCacheTTL time.Duration
+}
+
+// DeviceService is the device facing http api. Requests authenticate with
+// the entity token of MQTT devices and go through the same upstream
+// pipeline, commands wait in the mailbox until the device polls them.
+type DeviceService struct {
+    ctx     context.Context
+    cancel  context.CancelFunc
+    hookSvc *HookService
+    conf    DeviceHTTPConfig
+    tokens  *tokenCache
+}
+
+func NewDeviceService(ctx context.Context, hookSvc *HookService) *DeviceService {
+    conf := hookSvc.conf.DeviceHTTP
+    if conf.PollTimeout <= 0 {
+        conf.PollTimeout = defaultDevicePollTimeout
+    }
+    if conf.IdleTimeout <= 0 {
+        conf.IdleTimeout = defaultDeviceIdleTimeout
+    }
+    if conf.MaxBodySize <= 0 {
+        conf.MaxBodySize = defaultDeviceMaxBodySize
+    }
+    ctx, cancel := context.WithCancel(ctx)
+    return &DeviceService{
+        ctx:     ctx,
+        cancel:  cancel,
+        hookSvc: hookSvc,
+        conf:    conf,
+        tokens:  newTokenCache(conf.TokenCacheTTL),
+    }
+}
+
+// Close rejects the following requests and ends the waiting polls.
+func (s *DeviceService) Close() {
+    s.cancel()
+}
+
+// Run marks the devices idle for longer than the idle timeout offline,
+// until ctx is done.
+func (s *DeviceService) Run(ctx context.Context) {
+    interval := s.conf.IdleTimeout / 4
+    if interval < time.Second {
+        interval = time.Second
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            if n := s.ExpireIdle(ctx); n > 0 {
+                log.Infof("marked %d idle http devices offline", n)
+            }
+            s.tokens.expire()
+        }
+    }
+}
+
+// ExpireIdle marks the http devices idle for longer than the idle timeout
+// offline, it returns how many.
+func (s *DeviceService) ExpireIdle(ctx context.Context) int {
+    return s.hookSvc.expireIdle(ctx, ProtocolHTTP, s.conf.IdleTimeout, nil)
+}
+
+func peerHost(req *http.Request) string {
+    host, _, err := net.SplitHostPort(req.RemoteAddr)
+    if err != nil {
+        return req.RemoteAddr
+    }
+    return host
+}
+
+// device authenticates the token of req and returns the record of its
+// device, marked online. It writes the error response and returns nil if
+// the request is rejected.
+func (s *DeviceService) device(ctx context.Context, req *go_restful.Request, resp *go_restful.Response) *DeviceRecord {
+    if s.ctx.Err() != nil {
+        resp.WriteErrorString(http.StatusServiceUnavailable, "server is shutting down")
+        return nil
+    }
+    devId, reason := s.hookSvc.authCached(ctx, s.tokens, req.PathParameter("token"))
+    switch {
+    case reason == authReasonStateError:
+        resp.WriteErrorString(http.StatusServiceUnavailable, "save device state failed")
+        return nil
+    case devId == "":
+        resp.WriteErrorString(http.StatusUnauthorized, "invalid token")
+        return nil
+    }
+    rec, err := s.hookSvc.connectDevice(ctx, devId, ProtocolHTTP, peerHost(req.Request))
+    if err != nil {
+        resp.WriteErrorString(http.StatusServiceUnavailable, err.Error())
+        return nil
+    }
+    return rec
+}
+
+// post sends the payload of req to core as published by the device on topic.
+func (s *DeviceService) post(req *go_restful.Request, resp *go_restful.Response, name, topic string) {
+    ctx := tracing.ExtractHTTP(req.Request.Context(), req.Request.Header)
+    ctx, span := tracing.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+    var err error
+    defer func() { tracing.End(span, err) }()
+    rec := s.device(ctx, req, resp)
+    if rec == nil {
+        return
+    }
+    payload, err := ioutil.ReadAll(io.LimitReader(req.Request.Body, s.conf.MaxBodySize+1))
+    if err != nil {
+        resp.WriteErrorString(http.StatusBadRequest, err.Error())
+        return
+    }
+    if int64(len(payload)) > s.conf.MaxBodySize {
+        resp.WriteErrorString(http.StatusRequestEntityTooLarge, "payload larger than "+strconv.FormatInt(s.conf.MaxBodySize, 10)+" bytes")
+        return
+    }
+    if len(payload) == 0 {
+        resp.WriteErrorString(http.StatusBadRequest, "empty payload")
+        return
+    }
+    msg := &pb.Message{
+        Id:        req.HeaderParameter(deviceMessageIDHeader),
+        Qos:       1,
+        From:      rec.DeviceID,
+        Topic:     buildTopic(rec.DeviceID, topic),
+        Payload:   payload,
+        Timestamp: uint64(time.Now().UnixMilli()),
+    }
+    if err = s.hookSvc.uplink(ctx, rec, msg); err != nil {
+        log.Errorf("%s of %s err, %v", name, rec.DeviceID, err)
+        resp.WriteErrorString(http.StatusServiceUnavailable, err.Error())
+        return
+    }
+    resp.WriteHeader(http.StatusOK)
+}
+
+// PostTelemetry handles POST /v1/devices/{token}/telemetry.
+func (s *DeviceService) PostTelemetry(req *go_restful.Request, resp *go_restful.Response) {
+    s.post(req, resp, "device.PostTelemetry", TelemetryTopic)
+}
+
+// PostAttributes handles POST /v1/devices/{token}/attributes.
+func (s *DeviceService) PostAttributes(req *go_restful.Request, resp *go_restful.Response) {
+    s.post(req, resp, "device.PostAttributes", AttributesTopic)
+}
+
+// PostCommandResponse handles POST /v1/devices/{token}/commands/response.
+func (s *DeviceService) PostCommandResponse(req *go_restful.Request, resp *go_restful.Response) {
+    s.post(req, resp, "device.PostCommandResponse", CommandTopicResponse)
+}
+
+type PendingCommandsResponse struct {
+    Commands []PendingDownlink `json:"commands"`
+}
+
+// GetCommands handles GET /v1/devices/{token}/commands?timeout=, a long poll
+// of the pending commands, 204 if none came within timeout seconds. Taken
+// commands are not kept, a device losing the response loses them.
+func (s *DeviceService) GetCommands(req *go_restful.Request, resp *go_restful.Response) {
+    ctx := tracing.ExtractHTTP(req.Request.Context(), req.Request.Header)
+    ctx, span := tracing.Start(ctx, "device.GetCommands", trace.WithSpanKind(trace.SpanKindServer))
+    var err error
+    defer func() { tracing.End(span, err) }()
+    rec := s.device(ctx, req, resp)
+    if rec == nil {
+        return
+    }
+    devId := rec.DeviceID
+    // core sends the commands of subscribed devices only
+    if !rec.HasTopic(CommandTopic) {
+        if err = s.hookSvc.subscriptions.Subscribe(ctx, devId, []string{CommandTopic}); err != nil {
+            log.Errorf("subscribe commands of %s err, %v", devId, err)
+            resp.WriteErrorString(http.StatusServiceUnavailable, err.Error())
+            return
+        }
+    }
+    timeout := s.conf.PollTimeout
+    if v, perr := strconv.Atoi(req.QueryParameter("timeout")); perr == nil && v >= 0 && time.Duration(v)*time.Second < timeout {
+        timeout = time.Duration(v) * time.Second
+    }
+    // closing ends the poll
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    go func() {
+        select {
+        case <-s.ctx.Done():
+            cancel()
+        case <-ctx.Done():
+        }
+    }()
+    var pending []PendingDownlink
+    pending, err = s.hookSvc.mailbox.Wait(ctx, devId, timeout)
+    // a device waiting is not idle
+    s.hookSvc.presence.Seen(devId)
+    if err != nil {
+        log.Errorf("poll commands of %s err, %v", devId, err)
+        resp.WriteErrorString(http.StatusServiceUnavailable, err.Error())
+        return
+    }
+    if len(pending) == 0 {
+        resp.WriteHeader(http.StatusNoContent)
+        return
+    }
+    result, err := json.Marshal(&PendingCommandsResponse{Commands: pending})
+    if err != nil {
+        resp.WriteErrorString(http.StatusInternalServerError, err.Error())
+        return
+    }
+    resp.Header().Set(go_restful.HEADER_ContentType, go_restful.MIME_JSON)
+    if _, err := resp.Write(result); err != nil {
+        log.Errorf("write %d commands of %s err, %v", len(pending), devId, err)
+    }
+}
@@ -0,0 +1,187 @@
+package service_test
+
+import (
+    "context"
+    "io/ioutil"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/tkeel-io/iothub/pkg/exhooktest"
+    "github.com/tkeel-io/iothub/pkg/service"
+)
+
+// deviceRequest calls the device http api of h, it returns the status and body.
+func deviceRequest(t *testing.T, h *exhooktest.Harness, method, path, msgId, body string) (int, string) {
+    t.Helper()
+    req, err := http.NewRequest(method, h.HTTP.URL+path, strings.NewReader(body))
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if msgId != "" {
+        req.Header.Set("X-Message-Id", msgId)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    b, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return resp.StatusCode, string(b)
+}
+
+func commandEvent() map[string]interface{} {
+    return map[string]interface{}{
+        "id":    "dev1",
+        "owner": "u1",
+        "properties": map[string]interface{}{
+            "commands": map[string]interface{}{"reboot": map[string]interface{}{"id": "c1", "input": map[string]interface{}{"delay": 5}}},
+        },
+    }
+}
+
+func TestDeviceHTTP_Upstream(t *testing.T) {
+    h := exhooktest.New(t, func(c *service.Config) {
+        c.Dedup = service.DedupConfig{TTL: time.Minute}
+        c.DeviceHTTP.MaxBodySize = 32
+    })
+    h.Keel.AddToken("token1", "dev1", "u1", "t1")
+
+    tests := []struct {
+        path, msgId, body string
+        status            int
+    }{
+        {"/v1/devices/wrong/telemetry", "", `{"temp":20}`, http.StatusUnauthorized},
+        {"/v1/devices/token1/telemetry", "m1", `{"temp":20}`, http.StatusOK},
+        // retried request
+        {"/v1/devices/token1/telemetry", "m1", `{"temp":20}`, http.StatusOK},
+        {"/v1/devices/token1/attributes", "", `{"fw":"1.2"}`, http.StatusOK},
+        {"/v1/devices/token1/commands/response", "", `{"reboot":{"output":0}}`, http.StatusOK},
+        {"/v1/devices/token1/telemetry", "", ``, http.StatusBadRequest},
+        {"/v1/devices/token1/telemetry", "", `{"temp":20,"humidity":40,"co2":400}`, http.StatusRequestEntityTooLarge},
+    }
+    for _, tt := range tests {
+        if status, body := deviceRequest(t, h, http.MethodPost, tt.path, tt.msgId, tt.body); status != tt.status {
+            t.Fatalf("%s %s: %d %s, want %d", tt.path, tt.body, status, body, tt.status)
+        }
+    }
+    if got := eventTypes(t, h); got != "connectinfo telemetry attributes command.response" {
+        t.Fatalf("events %s", got)
+    }
+    rec, err := h.Service.Registry().Get(context.Background(), "dev1")
+    if err != nil || rec == nil || rec.Protocol != service.ProtocolHTTP || rec.ConnectInfo == nil {
+        t.Fatalf("record %+v, %v", rec, err)
+    }
+    if ci := rec.ConnectInfo; !ci.Online || ci.PeerHost != "127.0.0.1" {
+        t.Fatalf("connect info %+v", ci)
+    }
+    if p, _ := h.Presence.Get("dev1"); !p.Online || p.Protocol != service.ProtocolHTTP || p.TenantID != "t1" {
+        t.Fatalf("presence %+v", p)
+    }
+    if got := lastEvent(t, h).Get("data.rawData.path").String(); got != "dev1/v1/devices/me/command/response" {
+        t.Fatalf("path %s", got)
+    }
+}
+
+func TestDeviceHTTP_Commands(t *testing.T) {
+    h := exhooktest.New(t)
+    h.Keel.AddToken("token1", "dev1", "u1", "t1")
+    ctx := context.Background()
+
+    // the first poll subscribes the commands
+    if status, body := deviceRequest(t, h, http.MethodGet, "/v1/devices/token1/commands?timeout=0", "", ""); status != http.StatusNoContent {
+        t.Fatalf("empty poll %d %s", status, body)
+    }
+    if got := subscriptionTopics(h); got != "realtime:sub-core" {
+        t.Fatalf("subscriptions %s", got)
+    }
+
+    // pending until polled
+    resp, err := h.CoreEvent(ctx, exhooktest.CoreTopic, commandEvent())
+    if err != nil || resp.GetStatus() != service.SubscriptionResponseStatusDrop {
+        t.Fatalf("core event %v, %v", resp, err)
+    }
+    if published := h.Emqx.Published(); len(published) != 0 {
+        t.Fatalf("published to emqx %+v", published)
+    }
+    status, body := deviceRequest(t, h, http.MethodGet, "/v1/devices/token1/commands", "", "")
+    want := `{"commands":[{"topic":"v1/devices/me/commands","payload":{"reboot":{"id":"c1","input":{"delay":5}}},"ts":`
+    if status != http.StatusOK || !strings.HasPrefix(body, want) {
+        t.Fatalf("poll %d %s", status, body)
+    }
+
+    // a waiting poll is answered on arrival
+    done := make(chan string)
+    start := time.Now()
+    go func() {
+        _, body := deviceRequest(t, h, http.MethodGet, "/v1/devices/token1/commands?timeout=10", "", "")
+        done <- body
+    }()
+    time.Sleep(50 * time.Millisecond)
+    if _, err := h.CoreEvent(ctx, exhooktest.CoreTopic, commandEvent()); err != nil {
+        t.Fatal(err)
+    }
+    if body := <-done; !strings.HasPrefix(body, want) || time.Since(start) > 5*time.Second {
+        t.Fatalf("long poll %s after %s", body, time.Since(start))
+    }
+    if got := eventTypes(t, h); got != "connectinfo downstream downstream" {
+        t.Fatalf("events %s", got)
+    }
+
+    // closing ends the waiting polls
+    go func() {
+        status, _ := deviceRequest(t, h, http.MethodGet, "/v1/devices/token1/commands?timeout=10", "", "")
+        done <- http.StatusText(status)
+    }()
+    time.Sleep(50 * time.Millisecond)
+    h.Devices.Close()
+    if got := <-done; got != http.StatusText(http.StatusNoContent) {
+        t.Fatalf("poll on close %s", got)
+    }
+    if status, _ := deviceRequest(t, h, http.MethodGet, "/v1/devices/token1/commands", "", ""); status != http.StatusServiceUnavailable {
+        t.Fatalf("poll after close %d", status)
+    }
+}
+
+func TestDeviceHTTP_ExpireIdle(t *testing.T) {
+    h := exhooktest.New(t, func(c *service.Config) {
+        c.DeviceHTTP.IdleTimeout = 200 * time.Millisecond
+    })
+    h.Keel.AddToken("token1", "dev1", "u1", "t1")
+    h.Keel.AddToken("token2", "dev2", "u1", "t1")
+    // an MQTT device is never idle
+    if _, err := h.Device("dev2", "token2").Connect(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if status, body := deviceRequest(t, h, http.MethodPost, "/v1/devices/token1/telemetry", "", `{"temp":20}`); status != http.StatusOK {
+        t.Fatalf("post %d %s", status, body)
+    }
+    if n := h.Devices.ExpireIdle(context.Background()); n != 0 {
+        t.Fatalf("%d devices expired right away", n)
+    }
+    time.Sleep(250 * time.Millisecond)
+    if n := h.Devices.ExpireIdle(context.Background()); n != 1 {
+        t.Fatalf("%d devices expired", n)
+    }
+    if p, _ := h.Presence.Get("dev1"); p.Online {
+        t.Fatal("idle device online")
+    }
+    if p, _ := h.Presence.Get("dev2"); !p.Online {
+        t.Fatal("mqtt device offline")
+    }
+    if got := eventTypes(t, h); got != "connectinfo connectinfo telemetry connectinfo" {
+        t.Fatalf("events %s", got)
+    }
+    // online again with the next request
+    if status, _ := deviceRequest(t, h, http.MethodPost, "/v1/devices/token1/telemetry", "", `{"temp":21}`); status != http.StatusOK {
+        t.Fatal("post after idle")
+    }
+    if p, _ := h.Presence.Get("dev1"); !p.Online {
+        t.Fatal("device offline after request")
+    }
+}
@@ -2,41 +2,66 @@ package service
 
 import (
     "bytes"
+    "context"
+    "encoding/base64"
     json "encoding/json"
     "errors"
-    "github.com/tkeel-io/kit/log"
     "io/ioutil"
     "net/http"
+    "time"
+
+    "github.com/tkeel-io/iothub/pkg/metrics"
+    "github.com/tkeel-io/iothub/pkg/tracing"
+    "github.com/tkeel-io/kit/log"
+    "go.opentelemetry.io/otel/trace"
 )
 
-// emq deployed address
-//const ServerAddress string = "http://192.168.123.9:30855/api"
-const ServerAddress string = "http://emqx.keel-system:8081/api"
+// EmqxConfig is the EMQX management api.
+type EmqxConfig struct {
+    // APIAddress is the api base url, e.g. http://emqx.keel-system:8081/api
+    APIAddress string
+    Username   string
+    Password   string
+}
 
-// base64 encode: admin:public --> YWRtaW46cHVibGlj
-const AuthorizationValue string = "Basic YWRtaW46cHVibGlj"
+// EmqxClient calls the EMQX management api.
+type EmqxClient struct {
+    conf EmqxConfig
+}
+
+func NewEmqxClient(conf EmqxConfig) *EmqxClient {
+    return &EmqxClient{conf: conf}
+}
+
+func (c *EmqxClient) setAuth(req *http.Request) {
+    req.SetBasicAuth(c.conf.Username, c.conf.Password)
+}
 
 // emq info type
 const ClientsInfo string = "client"
 const SubscribeTopicsInfo string = "subscribe"
 
 // get emq info
-func GetEmqInfo(infoType string) ([]map[string]interface{}, error) {
+func (c *EmqxClient) GetEmqInfo(ctx context.Context, infoType string) (_ []map[string]interface{}, err error) {
+    defer func(start time.Time) { metrics.ObserveEmqx("info", start, err) }(time.Now())
     var url string
     if infoType == ClientsInfo {
-        url = ServerAddress + "/v4/clients?_page=1&_limit=100000"
+        url = c.conf.APIAddress + "/v4/clients?_page=1&_limit=100000"
     } else if infoType == SubscribeTopicsInfo {
-        url = ServerAddress + "/v4/subscriptions?_page=1&_limit=100000"
+        url = c.conf.APIAddress + "/v4/subscriptions?_page=1&_limit=100000"
     } else {
         return nil, errors.New("invalid infoType")
     }
 
-    req, err := http.NewRequest(http.MethodGet, url, nil)
+    ctx, span := tracing.Start(ctx, "emqx.GetInfo", trace.WithSpanKind(trace.SpanKindClient))
+    defer span.End()
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
     if nil != err {
         return nil, err
     }
 
-    req.Header.Add("Authorization", AuthorizationValue)
+    c.setAuth(req)
+    tracing.InjectHTTP(ctx, req)
     resp, err := http.DefaultClient.Do(req)
     if err != nil {
         log.Error("error ", err)
@@ -72,28 +97,49 @@ func GetEmqInfo(infoType string) ([]map[string]interface{}, error) {
     return data, nil
 }
 
-func Publish(username, topic, clientId string, qos int, retain bool, payload interface{}) error {
+func (c *EmqxClient) Publish(ctx context.Context, username, topic, clientId string, qos int, retain bool, payload interface{}) (err error) {
     log.Debugf("send data to client, username: %s, topic:%s, payload: %v", username, topic, payload)
-    url := ServerAddress + "/v4/mqtt/publish"
-    pubData := map[string]interface{}{
+    return c.publish(ctx, map[string]interface{}{
         "topic":    topic,
         "payload":  payload,
         "qos":      qos,
         "retain":   retain,
         "clientid": clientId,
-    }
+    })
+}
+
+// PublishBinary publishes a binary payload, e.g. protobuf, base64 encoded
+// in the api request.
+func (c *EmqxClient) PublishBinary(ctx context.Context, username, topic, clientId string, qos int, retain bool, payload []byte) (err error) {
+    log.Debugf("send binary data to client, username: %s, topic:%s, %d bytes", username, topic, len(payload))
+    return c.publish(ctx, map[string]interface{}{
+        "topic":    topic,
+        "payload":  base64.StdEncoding.EncodeToString(payload),
+        "encoding": "base64",
+        "qos":      qos,
+        "retain":   retain,
+        "clientid": clientId,
+    })
+}
+
+func (c *EmqxClient) publish(ctx context.Context, pubData map[string]interface{}) (err error) {
+    defer func(start time.Time) { metrics.ObserveEmqx("publish", start, err) }(time.Now())
+    url := c.conf.APIAddress + "/v4/mqtt/publish"
     data, err := json.Marshal(pubData)
     if nil != err {
         log.Error("error ", err)
         return err
     }
-    req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(data))
+    ctx, span := tracing.Start(ctx, "emqx.Publish", trace.WithSpanKind(trace.SpanKindClient))
+    defer span.End()
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(data))
     if nil != err {
         return err
     }
 
     req.Header.Add("Content-Type", "application/json")
-    req.Header.Add("Authorization", AuthorizationValue)
+    c.setAuth(req)
+    tracing.InjectHTTP(ctx, req)
     resp, err := http.DefaultClient.Do(req)
     if err != nil {
         log.Errorf("Publish.DefaultClient.Do data=%s error=%s", string(data), err.Error())
@@ -0,0 +1,342 @@
+package service_test
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/tidwall/gjson"
+    "github.com/tkeel-io/iothub/pkg/exhooktest"
+    "github.com/tkeel-io/iothub/pkg/service"
+)
+
+func eventTypes(t *testing.T, h *exhooktest.Harness) string {
+    t.Helper()
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    if err := h.Flush(ctx); err != nil {
+        t.Fatal(err)
+    }
+    events, err := h.Producer.Events()
+    if err != nil {
+        t.Fatal(err)
+    }
+    types := make([]string, 0, len(events))
+    for _, ev := range events {
+        types = append(types, strings.TrimPrefix(ev.Type(), "io.tkeel.iothub."))
+    }
+    return strings.Join(types, " ")
+}
+
+func lastEvent(t *testing.T, h *exhooktest.Harness) gjson.Result {
+    t.Helper()
+    events, err := h.Producer.Events()
+    if err != nil || len(events) == 0 {
+        t.Fatalf("no event, %v", err)
+    }
+    return gjson.ParseBytes(events[len(events)-1].Data())
+}
+
+func subscriptionTopics(h *exhooktest.Harness) string {
+    var topics []string
+    for _, sub := range h.Keel.Subscriptions() {
+        topics = append(topics, sub.Mode+":"+sub.Topic)
+    }
+    return strings.Join(topics, " ")
+}
+
+func TestExhook(t *testing.T) {
+    tests := []struct {
+        name string
+        opts []exhooktest.Option
+        run  func(ctx context.Context, h *exhooktest.Harness, d *exhooktest.Device) error
+        // check runs after the events are flushed
+        check func(t *testing.T, h *exhooktest.Harness)
+    }{
+        {
+            name: "provider loaded registers handled hooks",
+            run: func(ctx context.Context, h *exhooktest.Harness, d *exhooktest.Device) error {
+                specs, err := h.Load(ctx)
+                if err == nil && len(specs) != 8 {
+                    err = errors.New("unexpected hooks")
+                }
+                return err
+            },
+        },
+        {
+            name: "connect with invalid token is rejected",
+            run: func(ctx context.Context, h *exhooktest.Harness, d *exhooktest.Device) error {
+                d.Info.Password = "wrong"
+                if ok, err := d.Connect(ctx); err != nil || ok {
+                    return errors.New("invalid token accepted")
+                }
+                return nil
+            },
+            check: func(t *testing.T, h *exhooktest.Harness) {
+                if _, ok := h.Presence.Get("dev1"); ok {
+                    t.Fatal("rejected device tracked")
+                }
+            },
+        },
+        {
+            name: "connect with token of another device is rejected",
+            run: func(ctx context.Context, h *exhooktest.Harness, d *exhooktest.Device) error {
+                h.Keel.AddToken("token2", "dev2", "u1", "t1")
+                d.Info.Password = "token2"
+                if ok, err := d.Authenticate(ctx); err != nil || ok {
+                    return errors.New("username mismatch accepted")
+                }
+                d.Info.Password = ""
+                if ok, err := d.Authenticate(ctx); err != nil || ok {
+                    return errors.New("empty password accepted")
+                }
+                return nil
+            },
+        },
+        {
+            name: "connect records owner and reports online",
+            run: func(ctx context.Context, h *exhooktest.Harness, d *exhooktest.Device) error {
+                _, err := d.Connect(ctx)
+                return err
+            },
+            check: func(t *testing.T, h *exhooktest.Harness) {
+                if got := eventTypes(t, h); got != "connectinfo" {
+                    t.Fatalf("events %s", got)
+                }
+                ev := lastEvent(t, h)
+                if ev.Get("owner").String() != "u1" || ev.Get("id").String() != "dev1" {
+                    t.Fatalf("unexpected connect event %s", ev.Raw)
+                }
+                rec, err := h.Service.Registry().Get(context.Background(), "dev1")
+                if err != nil || rec.TenantID != "t1" || rec.ConnectInfo == nil || !rec.ConnectInfo.Online {
+                    t.Fatalf("unexpected record %+v, %v", rec, err)
+                }
+                if p, _ := h.Presence.Get("dev1"); !p.Online {
+                    t.Fatal("dev1 not online")
+                }
+            },
+        },
+        {
+            name: "subscribe creates core subscriptions per mode",
+            run: func(ctx context.Context, h *exhooktest.Harness, d *exhooktest.Device) error {
+                if _, err := d.Connect(ctx); err != nil {
+                    return err
+                }
+                granted, err := d.Subscribe(ctx, "v1/devices/me/attributes", "v1/devices/me/onchange/attributes", "v1/other")
+                if err == nil && (!granted[0] || !granted[1] || granted[2]) {
+                    err = errors.New("unexpected suback")
+                }
+                return err
+            },
+            check: func(t *testing.T, h *exhooktest.Harness) {
+                got := subscriptionTopics(h)
+                if !strings.Contains(got, "realtime:sub-core") || !strings.Contains(got, "changed:sub-core-changed") || len(h.Keel.Subscriptions()) != 2 {
+                    t.Fatalf("subscriptions %s", got)
+                }
+            },
+        },
+        {
+            name: "subscribe fails when core rejects the subscription",
+            run: func(ctx context.Context, h *exhooktest.Harness, d *exhooktest.Device) error {
+                if _, err := d.Connect(ctx); err != nil {
+                    return err
+                }
+                h.Keel.FailSubscriptions(500)
+                if _, err := d.Subscribe(ctx, "v1/devices/me/attributes"); err == nil {
+                    return errors.New("subscribe succeeded")
+                }
+                return nil
+            },
+        },
+        {
+            name: "unsubscribe and session end delete core subscriptions",
+            run: func(ctx context.Context, h *exhooktest.Harness, d *exhooktest.Device) error {
+                if _, err := d.Connect(ctx); err != nil {
+                    return err
+                }
+                if _, err := d.Subscribe(ctx, "v1/devices/me/attributes", "v1/devices/me/onchange/commands"); err != nil {
+                    return err
+                }
+                if err := d.Unsubscribe(ctx, "v1/devices/me/attributes"); err != nil {
+                    return err
+                }
+                if got := subscriptionTopics(h); got != "changed:sub-core-changed" {
+                    return errors.New("subscriptions after unsubscribe " + got)
+                }
+                return d.Disconnect(ctx)
+            },
+            check: func(t *testing.T, h *exhooktest.Harness) {
+                if n := len(h.Keel.Subscriptions()); n != 0 {
+                    t.Fatalf("%d subscriptions left", n)
+                }
+                if got := eventTypes(t, h); got != "connectinfo connectinfo" {
+                    t.Fatalf("events %s", got)
+                }
+                if p, _ := h.Presence.Get("dev1"); p.Online {
+                    t.Fatal("dev1 still online")
+                }
+            },
+        },
+        {
+            name: "publish forwards device data to core",
+            run: func(ctx context.Context, h *exhooktest.Harness, d *exhooktest.Device) error {
+                if _, err := d.Connect(ctx); err != nil {
+                    return err
+                }
+                for _, topic := range []string{"v1/devices/me/telemetry", "v1/devices/me/attributes", "v1/devices/me/command/response", "v1/devices/me/raw"} {
+                    if ok, err := d.Publish(ctx, topic, []byte(`{"temperature":20}`)); err != nil || !ok {
+                        return errors.New("publish rejected " + topic)
+                    }
+                }
+                return nil
+            },
+            check: func(t *testing.T, h *exhooktest.Harness) {
+                if got := eventTypes(t, h); got != "connectinfo telemetry attributes command.response raw" {
+                    t.Fatalf("events %s", got)
+                }
+                ev := lastEvent(t, h)
+                if ev.Get("owner").String() != "u1" || ev.Get("data.rawData.path").String() != "dev1/v1/devices/me/raw" {
+                    t.Fatalf("unexpected publish event %s", ev.Raw)
+                }
+            },
+        },
+        {
+            name: "publish of a retransmission is forwarded once",
+            opts: []exhooktest.Option{func(c *service.Config) { c.Dedup.TTL = time.Minute }},
+            run: func(ctx context.Context, h *exhooktest.Harness, d *exhooktest.Device) error {
+                msg := d.Message("v1/devices/me/telemetry", []byte(`{"temperature":20}`))
+                for i := 0; i < 2; i++ {
+                    if ok, err := d.PublishMessage(ctx, msg); err != nil || !ok {
+                        return errors.New("retransmission rejected")
+                    }
+                }
+                return nil
+            },
+            check: func(t *testing.T, h *exhooktest.Harness) {
+                if got := eventTypes(t, h); got != "telemetry" {
+                    t.Fatalf("events %s", got)
+                }
+            },
+        },
+        {
+            name: "publish to a topic without device is not forwarded",
+            run: func(ctx context.Context, h *exhooktest.Harness, d *exhooktest.Device) error {
+                msg := d.Message("", []byte(`{}`))
+                msg.Topic = "nodevice"
+                _, err := d.PublishMessage(ctx, msg)
+                return err
+            },
+            check: func(t *testing.T, h *exhooktest.Harness) {
+                if got := eventTypes(t, h); got != "" {
+                    t.Fatalf("events %s", got)
+                }
+            },
+        },
+        {
+            name: "core event is published to the subscribed topic and echoed",
+            run: func(ctx context.Context, h *exhooktest.Harness, d *exhooktest.Device) error {
+                if _, err := d.Connect(ctx); err != nil {
+                    return err
+                }
+                if _, err := d.Subscribe(ctx, "v1/devices/me/attributes"); err != nil {
+                    return err
+                }
+                resp, err := h.CoreEvent(ctx, exhooktest.CoreTopic, map[string]interface{}{
+                    "id":         "dev1",
+                    "owner":      "u1",
+                    "properties": map[string]interface{}{"attributes": map[string]interface{}{"mode": "eco"}},
+                })
+                if err == nil && resp.GetStatus() == service.SubscriptionResponseStatusRetry {
+                    err = errors.New("core event retried")
+                }
+                return err
+            },
+            check: func(t *testing.T, h *exhooktest.Harness) {
+                published := h.Emqx.Published()
+                if len(published) != 1 || published[0].Topic != "dev1/v1/devices/me/attributes" || string(published[0].Payload) != `{"mode":"eco"}` {
+                    t.Fatalf("published %+v", published)
+                }
+                if got := eventTypes(t, h); got != "connectinfo downstream" {
+                    t.Fatalf("events %s", got)
+                }
+            },
+        },
+        {
+            name: "failed downlink does not stop the others and is not redelivered",
+            run: func(ctx context.Context, h *exhooktest.Harness, d *exhooktest.Device) error {
+                if _, err := d.Connect(ctx); err != nil {
+                    return err
+                }
+                if _, err := d.Subscribe(ctx, "v1/devices/me/attributes", "v1/devices/me/commands"); err != nil {
+                    return err
+                }
+                h.Emqx.FailTopic("dev1/v1/devices/me/attributes")
+                resp, err := h.CoreEvent(ctx, exhooktest.CoreTopic, map[string]interface{}{
+                    "id":    "dev1",
+                    "owner": "u1",
+                    "properties": map[string]interface{}{
+                        "attributes": map[string]interface{}{"mode": "eco"},
+                        "commands":   map[string]interface{}{"reboot": map[string]interface{}{"id": "c1", "input": ""}},
+                    },
+                })
+                if err == nil && resp.GetStatus() != service.SubscriptionResponseStatusDrop {
+                    err = errors.New("core event not dropped")
+                }
+                return err
+            },
+            check: func(t *testing.T, h *exhooktest.Harness) {
+                published := h.Emqx.Published()
+                if len(published) != 1 || published[0].Topic != "dev1/v1/devices/me/commands" {
+                    t.Fatalf("published %+v", published)
+                }
+                if got := eventTypes(t, h); got != "connectinfo downstream" {
+                    t.Fatalf("events %s", got)
+                }
+            },
+        },
+        {
+            name: "provider unloaded reports the devices of its node offline and flushes events",
+            run: func(ctx context.Context, h *exhooktest.Harness, d *exhooktest.Device) error {
+                if _, err := d.Connect(ctx); err != nil {
+                    return err
+                }
+                return h.Unload(ctx)
+            },
+            check: func(t *testing.T, h *exhooktest.Harness) {
+                if got := eventTypes(t, h); got != "connectinfo connectinfo" {
+                    t.Fatalf("events %s", got)
+                }
+                if p, _ := h.Presence.Get("dev1"); p.Online {
+                    t.Fatal("dev1 online")
+                }
+            },
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+            defer cancel()
+            h := exhooktest.New(t, tt.opts...)
+            h.Keel.AddToken("token1", "dev1", "u1", "t1")
+            d := h.Device("dev1", "token1")
+            if err := tt.run(ctx, h, d); err != nil {
+                t.Fatal(err)
+            }
+            if tt.check != nil {
+                tt.check(t, h)
+            }
+        })
+    }
+}
+
+// closing iothub lets dapr redeliver core events to another instance
+func TestExhook_TopicServiceClosed(t *testing.T) {
+    h := exhooktest.New(t)
+    h.Topics.Close()
+    resp, err := h.CoreEvent(context.Background(), exhooktest.CoreTopic, map[string]interface{}{"id": "dev1"})
+    if err != nil || resp.GetStatus() != service.SubscriptionResponseStatusRetry {
+        t.Fatalf("unexpected response %v, %v", resp, err)
+    }
+}
@@ -0,0 +1,368 @@
+package service
+
+import (
+    "context"
+    "hash/fnv"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/Shopify/sarama"
+    cloudevents "github.com/cloudevents/sdk-go/v2"
+    "github.com/pkg/errors"
+    "github.com/tkeel-io/iothub/pkg/archive"
+    "github.com/tkeel-io/iothub/pkg/metrics"
+    "github.com/tkeel-io/iothub/pkg/tracing"
+    "github.com/tkeel-io/kit/log"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/trace"
+)
+
+const (
+    // number of device lock stripes
+    forwarderStripes = 64
+    // poll interval of Flush
+    flushInterval = 10 * time.Millisecond
+)
+
+// ErrForwarderClosed is returned by Send after Close.
+var ErrForwarderClosed = errors.New("forwarder closed")
+
+// Forwarder is the single outbound channel from iothub to core.
+//
+// Every event of a device (connect info, uplink data and downstream echo)
+// goes through it, keyed by device id so that all of them land in the same
+// partition in the order they were produced. Each event carries a per
+// device sequence number and the epoch of its counter, core can detect
+// gaps and reordering by comparing seq within the same epoch. Counters of
+// disconnected devices are forgotten, the next one starts a newer epoch.
+type Forwarder struct {
+    producer sarama.AsyncProducer
+    // the topic pub to core
+    topic string
+    // dapr pubsub of the events
+    pubsubName string
+    version    sarama.KafkaVersion
+    // cloudevent kafka encoding, structured or binary, changed by SetMode
+    mode atomic.Value
+    // *archive.Writer of the uplink events, set by SetArchive
+    archiver atomic.Value
+    // epoch of new counters, unix milliseconds, advanced by Forget
+    epoch int64
+    // map[devId]*seqCounter, guarded by the stripe of the device
+    seqs  sync.Map
+    locks [forwarderStripes]sync.Mutex
+    done  chan struct{}
+    // messages sent and not yet acknowledged by kafka
+    pending int64
+    // closed guards the producer input against sends after Close
+    closeLock sync.RWMutex
+    closed    bool
+}
+
+// ForwarderConfig configures the kafka producer of the forwarder.
+type ForwarderConfig struct {
+    Brokers []string
+    // Version is the kafka version, e.g. 1.0.0.
+    Version string
+    // Topic is the core topic events are sent to.
+    Topic string
+    // PubsubName is the dapr pubsub core reads the events from.
+    PubsubName string
+    // CloudEventMode is structured or binary.
+    CloudEventMode string
+}
+
+func newProducerConfig(conf ForwarderConfig) (*sarama.Config, error) {
+    config := sarama.NewConfig()
+    config.Producer.Return.Successes = true
+    config.Producer.Return.Errors = true
+    // keep per partition ordering even on retries
+    config.Producer.RequiredAcks = sarama.WaitForAll
+    config.Producer.Retry.Max = 5
+    config.Net.MaxOpenRequests = 1
+    version, err := sarama.ParseKafkaVersion(conf.Version)
+    if err != nil {
+        return nil, errors.Wrap(err, "parse kafka version")
+    }
+    config.Version = version
+    config.Producer.Idempotent = version.IsAtLeast(sarama.V0_11_0_0)
+    return config, nil
+}
+
+func NewForwarder(conf ForwarderConfig) (*Forwarder, error) {
+    config, err := newProducerConfig(conf)
+    if err != nil {
+        return nil, err
+    }
+    p, err := sarama.NewAsyncProducer(conf.Brokers, config)
+    if err != nil {
+        return nil, errors.Wrap(err, "new kafka producer")
+    }
+    f, err := NewForwarderWithProducer(p, conf)
+    if err != nil {
+        p.AsyncClose()
+        return nil, err
+    }
+    return f, nil
+}
+
+// NewForwarderWithProducer forwards through a producer owned by the caller,
+// conf.Brokers is not used.
+func NewForwarderWithProducer(p sarama.AsyncProducer, conf ForwarderConfig) (*Forwarder, error) {
+    f := newForwarderWithProducer(p, conf.Topic, CloudEventModeStructured)
+    if conf.Version != "" {
+        version, err := sarama.ParseKafkaVersion(conf.Version)
+        if err != nil {
+            return nil, errors.Wrap(err, "parse kafka version")
+        }
+        f.version = version
+    }
+    if conf.PubsubName != "" {
+        f.pubsubName = conf.PubsubName
+    }
+    if conf.CloudEventMode != "" {
+        if err := f.SetMode(conf.CloudEventMode); err != nil {
+            return nil, err
+        }
+    }
+    return f, nil
+}
+
+// SetMode changes the cloudevent encoding of the following events.
+func (f *Forwarder) SetMode(mode string) error {
+    if !validCloudEventMode(mode) {
+        return errors.Errorf("invalid cloudevent mode %s", mode)
+    }
+    if mode == CloudEventModeBinary && !f.version.IsAtLeast(sarama.V0_11_0_0) {
+        return errors.New("cloudevent binary mode requires kafka version >= 0.11.0.0")
+    }
+    f.mode.Store(mode)
+    return nil
+}
+
+func newForwarderWithProducer(p sarama.AsyncProducer, topic, mode string) *Forwarder {
+    f := &Forwarder{
+        producer:   p,
+        topic:      topic,
+        pubsubName: defaultPubsubName,
+        version:    sarama.V0_11_0_0,
+        epoch:      time.Now().UnixMilli(),
+        done:       make(chan struct{}),
+    }
+    f.mode.Store(mode)
+    go f.drain()
+    return f
+}
+
+func (f *Forwarder) drain() {
+    defer close(f.done)
+    errs := f.producer.Errors()
+    success := f.producer.Successes()
+    for errs != nil || success != nil {
+        select {
+        case rc, ok := <-errs:
+            if !ok {
+                errs = nil
+                continue
+            }
+            atomic.AddInt64(&f.pending, -1)
+            metrics.KafkaProduceErrors.WithLabelValues(rc.Msg.Topic).Inc()
+            log.Errorf("produce to %s key %v err, %v", rc.Msg.Topic, rc.Msg.Key, rc.Err)
+        case msg, ok := <-success:
+            if !ok {
+                success = nil
+                continue
+            }
+            atomic.AddInt64(&f.pending, -1)
+            if start, ok := msg.Metadata.(time.Time); ok {
+                metrics.KafkaProduceDuration.WithLabelValues(msg.Topic).Observe(time.Since(start).Seconds())
+            }
+        }
+    }
+}
+
+// seqCounter numbers the events of a device.
+type seqCounter struct {
+    epoch int64
+    seq   uint64
+}
+
+// nextSeq returns the epoch and the next sequence number of devId, the
+// stripe of devId must be held.
+func (f *Forwarder) nextSeq(devId string) (int64, uint64) {
+    v, ok := f.seqs.Load(devId)
+    if !ok {
+        v = &seqCounter{epoch: atomic.LoadInt64(&f.epoch)}
+        f.seqs.Store(devId, v)
+    }
+    c := v.(*seqCounter)
+    c.seq++
+    return c.epoch, c.seq
+}
+
+// Forget drops the sequence counter of devId, e.g. once it disconnected.
+// Its next event starts a counter in an epoch newer than the dropped one.
+func (f *Forwarder) Forget(devId string) {
+    lock := f.stripe(devId)
+    lock.Lock()
+    defer lock.Unlock()
+    if _, ok := f.seqs.LoadAndDelete(devId); !ok {
+        return
+    }
+    for {
+        epoch, next := atomic.LoadInt64(&f.epoch), time.Now().UnixMilli()
+        if next <= epoch {
+            next = epoch + 1
+        }
+        if atomic.CompareAndSwapInt64(&f.epoch, epoch, next) {
+            return
+        }
+    }
+}
+
+func (f *Forwarder) stripe(devId string) *sync.Mutex {
+    h := fnv.New32a()
+    h.Write([]byte(devId)) //nolint
+    return &f.locks[h.Sum32()%forwarderStripes]
+}
+
+// Send forwards data of devId to core as a cloudevent of eventType.
+// data is the event body, {"id","owner","type","source","data"}.
+func (f *Forwarder) Send(ctx context.Context, devId, eventType string, ts time.Time, data map[string]interface{}) error {
+    _, err := f.send(ctx, devId, eventType, ts, data)
+    return err
+}
+
+// SendUplink sends data published by devId of tenantId like Send, and
+// archives the event for replay.
+func (f *Forwarder) SendUplink(ctx context.Context, devId, tenantId, eventType string, ts time.Time, data map[string]interface{}) error {
+    ev, err := f.send(ctx, devId, eventType, ts, data)
+    if err != nil {
+        return err
+    }
+    w, _ := f.archiver.Load().(*archive.Writer)
+    if w == nil || *w == nil {
+        return nil
+    }
+    // the archive is best effort, it never fails the uplink
+    err = f.archiveEvent(ctx, *w, tenantId, ev)
+    metrics.ArchiveTotal.WithLabelValues(metrics.Result(err)).Inc()
+    if err != nil {
+        log.Errorf("archive event %s of %s err, %v", ev.ID(), devId, err)
+    }
+    return nil
+}
+
+func (f *Forwarder) archiveEvent(ctx context.Context, w archive.Writer, tenantId string, ev cloudevents.Event) error {
+    bytes, err := ev.MarshalJSON()
+    if err != nil {
+        return errors.Wrap(err, "marshal cloudevent")
+    }
+    return w.Write(ctx, &archive.Record{
+        Time:     ev.Time(),
+        DeviceID: ev.Subject(),
+        TenantID: tenantId,
+        Type:     ev.Type(),
+        Event:    bytes,
+    })
+}
+
+// SetArchive archives the uplink events to w, nil disables archiving. The
+// writer is owned by the caller.
+func (f *Forwarder) SetArchive(w archive.Writer) {
+    f.archiver.Store(&w)
+}
+
+func (f *Forwarder) send(ctx context.Context, devId, eventType string, ts time.Time, data map[string]interface{}) (ev cloudevents.Event, err error) {
+    ctx, span := tracing.Start(ctx, "kafka.Produce", trace.WithSpanKind(trace.SpanKindProducer),
+        trace.WithAttributes(attribute.String("messaging.destination", f.topic), attribute.String("iothub.device_id", devId)))
+    defer func() { tracing.End(span, err) }()
+
+    ev, err = newCloudEvent(ctx, f.topic, f.pubsubName, devId, eventType, ts, data)
+    if err != nil {
+        log.Errorf("build cloudevent %s", err.Error())
+        return ev, err
+    }
+
+    // sequence assignment and enqueue must not interleave for one device
+    lock := f.stripe(devId)
+    lock.Lock()
+    defer lock.Unlock()
+
+    epoch, seq := f.nextSeq(devId)
+    setSequence(&ev, epoch, seq)
+    return ev, f.enqueue(ctx, devId, ev)
+}
+
+// Resend sends an event archived before to core again. It keeps the id and
+// sequence of the event so core can tell a replay, and marks it replayed.
+func (f *Forwarder) Resend(ctx context.Context, ev cloudevents.Event) (err error) {
+    ctx, span := tracing.Start(ctx, "kafka.Produce", trace.WithSpanKind(trace.SpanKindProducer),
+        trace.WithAttributes(attribute.String("messaging.destination", f.topic), attribute.String("iothub.device_id", ev.Subject())))
+    defer func() { tracing.End(span, err) }()
+
+    ev.SetExtension("topic", f.topic)
+    ev.SetExtension("pubsubname", f.pubsubName)
+    ev.SetExtension(replayedExtension, time.Now())
+    return f.enqueue(ctx, ev.Subject(), ev)
+}
+
+func (f *Forwarder) enqueue(ctx context.Context, devId string, ev cloudevents.Event) error {
+    msg := &sarama.ProducerMessage{
+        Topic:    f.topic,
+        Key:      sarama.StringEncoder(devId),
+        Metadata: time.Now(),
+    }
+    if err := encodeCloudEvent(ctx, ev, f.mode.Load().(string), msg); err != nil {
+        log.Errorf("encode cloudevent %s", err.Error())
+        return err
+    }
+    tracing.InjectKafka(ctx, msg)
+
+    f.closeLock.RLock()
+    defer f.closeLock.RUnlock()
+    if f.closed {
+        return ErrForwarderClosed
+    }
+    atomic.AddInt64(&f.pending, 1)
+    f.producer.Input() <- msg
+    return nil
+}
+
+// Flush waits until kafka acknowledged every message sent so far, or ctx is done.
+func (f *Forwarder) Flush(ctx context.Context) error {
+    ticker := time.NewTicker(flushInterval)
+    defer ticker.Stop()
+    for atomic.LoadInt64(&f.pending) > 0 {
+        select {
+        case <-ctx.Done():
+            return errors.Wrapf(ctx.Err(), "flush forwarder, %d messages pending", atomic.LoadInt64(&f.pending))
+        case <-ticker.C:
+        }
+    }
+    return nil
+}
+
+// Close flushes the pending messages and closes the producer, Send fails
+// afterwards.
+func (f *Forwarder) Close(ctx context.Context) error {
+    f.closeLock.Lock()
+    if f.closed {
+        f.closeLock.Unlock()
+        return nil
+    }
+    f.closed = true
+    f.closeLock.Unlock()
+
+    err := f.Flush(ctx)
+    f.producer.AsyncClose()
+    select {
+    case <-f.done:
+    case <-ctx.Done():
+        if err == nil {
+            err = errors.Wrap(ctx.Err(), "close kafka producer")
+        }
+    }
+    return err
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/Shopify/sarama"
+    "github.com/Shopify/sarama/mocks"
+    cloudevents "github.com/cloudevents/sdk-go/v2"
+    "github.com/tidwall/gjson"
+    "github.com/tkeel-io/iothub/pkg/archive"
+)
+
+// mockProducerConfig returns acks like the forwarder producer config.
+func mockProducerConfig() *sarama.Config {
+    config := sarama.NewConfig()
+    config.Producer.Return.Successes = true
+    config.Producer.Return.Errors = true
+    return config
+}
+
+func TestForwarder_Send(t *testing.T) {
+    p := mocks.NewAsyncProducer(t, mockProducerConfig())
+    var seqs []int64
+    for i := 0; i < 3; i++ {
+        p.ExpectInputWithCheckerFunctionAndSucceed(func(val []byte) error {
+            seqs = append(seqs, gjson.GetBytes(val, "seq").Int())
+            return nil
+        })
+    }
+    f := newForwarderWithProducer(p, "core-pub", CloudEventModeStructured)
+    for _, dev := range []string{"dev1", "dev1", "dev2"} {
+        if err := f.Send(context.Background(), dev, EventTypeTelemetry, time.Now(), map[string]interface{}{"id": dev}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := p.Close(); err != nil {
+        t.Fatal(err)
+    }
+    <-f.done
+    if len(seqs) != 3 || seqs[0] != 1 || seqs[1] != 2 || seqs[2] != 1 {
+        t.Fatalf("unexpected sequence numbers %v", seqs)
+    }
+}
+
+func TestForwarder_Forget(t *testing.T) {
+    p := mocks.NewAsyncProducer(t, mockProducerConfig())
+    var seqs, epochs []int64
+    for i := 0; i < 3; i++ {
+        p.ExpectInputWithCheckerFunctionAndSucceed(func(val []byte) error {
+            seqs = append(seqs, gjson.GetBytes(val, "seq").Int())
+            epochs = append(epochs, gjson.GetBytes(val, "seqepoch").Int())
+            return nil
+        })
+    }
+    f := newForwarderWithProducer(p, "core-pub", CloudEventModeStructured)
+    send := func() {
+        if err := f.Send(context.Background(), "dev1", EventTypeTelemetry, time.Now(), map[string]interface{}{"id": "dev1"}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    send()
+    send()
+    f.Forget("dev1")
+    // a reconnect starts over in a newer epoch
+    send()
+    if err := p.Close(); err != nil {
+        t.Fatal(err)
+    }
+    <-f.done
+    if len(seqs) != 3 || seqs[1] != 2 || seqs[2] != 1 || epochs[0] != epochs[1] || epochs[2] <= epochs[1] {
+        t.Fatalf("unexpected sequence numbers %v in epochs %v", seqs, epochs)
+    }
+}
+
+func TestForwarder_Close(t *testing.T) {
+    p := mocks.NewAsyncProducer(t, mockProducerConfig())
+    p.ExpectInputAndSucceed()
+    p.ExpectInputAndSucceed()
+    f := newForwarderWithProducer(p, "core-pub", CloudEventModeStructured)
+    for _, dev := range []string{"dev1", "dev2"} {
+        if err := f.Send(context.Background(), dev, EventTypeTelemetry, time.Now(), map[string]interface{}{"id": dev}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    if err := f.Close(ctx); err != nil {
+        t.Fatal(err)
+    }
+    if n := atomic.LoadInt64(&f.pending); n != 0 {
+        t.Fatalf("%d messages pending after close", n)
+    }
+    if err := f.Send(context.Background(), "dev1", EventTypeTelemetry, time.Now(), nil); !errors.Is(err, ErrForwarderClosed) {
+        t.Fatalf("send after close, got %v", err)
+    }
+    // closing twice is a no-op
+    if err := f.Close(ctx); err != nil {
+        t.Fatal(err)
+    }
+}
+
+type memArchive struct {
+    records []*archive.Record
+}
+
+func (a *memArchive) Write(ctx context.Context, rec *archive.Record) error {
+    a.records = append(a.records, rec)
+    return nil
+}
+
+func (a *memArchive) Close() error {
+    return nil
+}
+
+func TestForwarder_SendUplinkResend(t *testing.T) {
+    p := mocks.NewAsyncProducer(t, mockProducerConfig())
+    var values [][]byte
+    for i := 0; i < 3; i++ {
+        p.ExpectInputWithCheckerFunctionAndSucceed(func(val []byte) error {
+            values = append(values, val)
+            return nil
+        })
+    }
+    f := newForwarderWithProducer(p, "core-pub", CloudEventModeStructured)
+    a := &memArchive{}
+    f.SetArchive(a)
+    ctx := context.Background()
+    if err := f.SendUplink(ctx, "dev1", "t1", EventTypeTelemetry, time.Now(), map[string]interface{}{"id": "dev1"}); err != nil {
+        t.Fatal(err)
+    }
+    // other events are not archived
+    if err := f.Send(ctx, "dev1", EventTypeConnectInfo, time.Now(), map[string]interface{}{"id": "dev1"}); err != nil {
+        t.Fatal(err)
+    }
+    if len(a.records) != 1 || a.records[0].TenantID != "t1" || a.records[0].DeviceID != "dev1" || a.records[0].Type != EventTypeTelemetry {
+        t.Fatalf("unexpected archive %+v", a.records)
+    }
+
+    ev := cloudevents.NewEvent()
+    if err := json.Unmarshal(a.records[0].Event, &ev); err != nil {
+        t.Fatal(err)
+    }
+    if err := f.Resend(ctx, ev); err != nil {
+        t.Fatal(err)
+    }
+    if len(a.records) != 1 {
+        t.Fatal("replayed event archived again")
+    }
+    if err := p.Close(); err != nil {
+        t.Fatal(err)
+    }
+    <-f.done
+    original, replayed := gjson.ParseBytes(values[0]), gjson.ParseBytes(values[2])
+    if replayed.Get("id").String() != original.Get("id").String() || replayed.Get("seq").String() != "1" ||
+        replayed.Get(replayedExtension).String() == "" || original.Get(replayedExtension).Exists() {
+        t.Fatalf("unexpected replayed event %s", values[2])
+    }
+}
@@ -1,35 +1,36 @@
 package service
 
 import (
+    "bytes"
     "context"
-    "crypto/md5"
     "encoding/base64"
     "encoding/json"
     "fmt"
+    "io"
     "io/ioutil"
+    "net"
     "net/http"
-    "os"
-    "reflect"
+    "net/url"
     "strconv"
     "strings"
     "sync"
     "time"
 
-    "github.com/Shopify/sarama"
-    cloudevents "github.com/cloudevents/sdk-go/v2"
     dapr "github.com/dapr/go-sdk/client"
-    "github.com/google/uuid"
-    jsoniter "github.com/json-iterator/go"
     "github.com/pkg/errors"
-    "github.com/prometheus/client_golang/prometheus"
     v1 "github.com/tkeel-io/core/api/core/v1"
+    "github.com/tkeel-io/iothub/pkg/metrics"
+    "github.com/tkeel-io/iothub/pkg/sparkplug"
+    "github.com/tkeel-io/iothub/pkg/store"
+    "github.com/tkeel-io/iothub/pkg/tracing"
     pb "github.com/tkeel-io/iothub/protobuf"
     "github.com/tkeel-io/kit/log"
+    "go.opentelemetry.io/otel/trace"
+    "google.golang.org/grpc/peer"
 )
 
 const (
     //state store
-    iothubPrivateStatesStoreName = `iothub-private-store`
     connectInfoSuffixKey         = `_ci`
     devEntitySuffixKey           = `_de`
     subEntitySuffixKey           = `_sub`
@@ -49,8 +50,8 @@ const (
     MarkDownStream = "downstream"
     MarkConnecting = "connecting"
 
-    // subscription mode
-    onChangeMode = "onChange"
+    // subscription mode of core
+    onChangeMode = "changed"
     realtimeMode = "realtime"
 
     // default client id for cloud
@@ -61,20 +62,6 @@ const (
     defaultTenant   = `_tKeel_system`
     defaultUser     = `_tKeel_admin`
     defultRole      = `admin`
-
-    // default base url
-    BaseUrl = `http://localhost:3500/v1.0/invoke/keel/method/apis`
-)
-const (
-    _envCorePubTopic = `CORE_PUB_TOPIC`
-    _envKafkaService = `KAFKA_SERVICE`
-)
-
-type DeviceStatus int
-
-const (
-    DeviceStatusOffline DeviceStatus = iota + 1
-    DeviceStatusOnline
 )
 
 func propertyTypeFromTopic(topic string) string {
@@ -89,134 +76,191 @@ func propertyTypeFromTopic(topic string) string {
     return ""
 }
 
+// Config configures the hook service.
+type Config struct {
+    // KeelURL is the keel api base url, invoked through the dapr sidecar.
+    KeelURL string
+    // PubsubName is the dapr pubsub core subscriptions publish to.
+    PubsubName string
+    Emqx       EmqxConfig
+    Quality    QualityConfig
+    Dedup      DedupConfig
+    RateLimit  RateLimitConfig
+    Hooks      HookConfig
+    DeviceHTTP DeviceHTTPConfig
+    CoAP       CoAPConfig
+    LwM2M      LwM2MConfig
+    Sparkplug  SparkplugConfig
+    LoRaWAN    LoRaWANConfig
+    Live       LiveConfig
+    Provision  ProvisionConfig
+}
+
 // HookService is used to implement emqx_exhook_v1.s *HookService.
 type HookService struct {
     pb.UnimplementedHookProviderServer
+    conf       Config
     daprClient dapr.Client
+    emqx       *EmqxClient
+    // 设备 owner, tenant, connect info 与订阅
+    store         store.StateStore
+    registry      *DeviceRegistry
+    subscriptions *SubscriptionManager
+    // hooks registered to EMQX, replaced on reload
+    hookLock  sync.RWMutex
+    hookSpecs []*pb.HookSpec
     //clients map[string]*ConnectInfo
     //entities map[string]*DeviceEntityInfo
 
     // map["clientid"][{"topic": "xxx/xxx", "qos": 0, "node": "XXX"},]
     subscribeTopics map[string][]map[string]interface{}
-    producer        sarama.AsyncProducer
-    // the topic pub to core
-    corePubTopic string
-    // metrics
-    collector *Collector
-    // 记录设备的状态 1 在线 0 离线
-    deviceStatus sync.Map
-}
-
-type Collector struct {
-    msgTotal       *prometheus.CounterVec
-    connectedTotal *prometheus.GaugeVec
-    deviceStatus   *prometheus.GaugeVec
-}
-
-func NewHookService(client dapr.Client) *HookService {
-    config := sarama.NewConfig()
-    config.Producer.Return.Successes = true
-    config.Producer.Return.Errors = true
-    ad := envWithDefault(_envKafkaService, `kafka.keel-system.svc.cluster.local:9092`)
-    ads := strings.Split(ad, ";")
-    p, err := sarama.NewAsyncProducer(ads, config)
-    // TODO: error
-    if err != nil {
-        panic("error")
-    }
-    go func(p sarama.AsyncProducer) {
-        errs := p.Errors()
-        success := p.Successes()
-        for {
-            select {
-            case rc := <-errs:
-                if rc != nil {
-                    // TODO:
-                }
-                return
-            case _ = <-success:
-            }
-        }
-    }(p)
-    //
-    msgReq := prometheus.NewCounterVec(
-        prometheus.CounterOpts{
-            Name: "iothub_msg_total",
-            Help: "How many msg requests processed, partitioned by direction and tenant.",
-        },
-        []string{"tenant_id", "direction"},
-    )
-    //
-    prometheus.MustRegister(msgReq)
-    //
-    connectedTotal := prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name: "iothub_connected_total",
-            Help: "Number of connected iothub.",
-        },
-        []string{"tenant_id"},
-    )
-    prometheus.MustRegister(connectedTotal)
-    // 在线设置为1，离线设置0
-    deviceStatus := prometheus.NewGaugeVec(
-        prometheus.GaugeOpts{
-            Name: "iothub_device_status",
-            Help: "device status 1-online 0-offline.",
-        },
-        []string{"tenant_id", "device_id"},
-    )
-    prometheus.MustRegister(deviceStatus)
-    // create metrics
-    mc := &Collector{
-        msgTotal:       msgReq,
-        connectedTotal: connectedTotal,
-        deviceStatus:   deviceStatus,
-    }
-    //
-    return &HookService{
-        daprClient:   client,
-        producer:     p,
-        corePubTopic: envWithDefault(_envCorePubTopic, "core-pub"),
-        collector:    mc,
-    }
+    // ordered outbound channel to core
+    forwarder *Forwarder
+    // 记录设备的在线状态
+    presence *PresenceTracker
+    // 连接质量, 重连次数与抖动
+    quality *ConnectionQuality
+    // drop QoS 1 retransmissions
+    dedup *Deduplicator
+    // drop the uplinks of devices above their rate
+    rateLimit *RateLimiter
+    // downlinks of devices over http and CoAP
+    mailbox *Mailbox
+    // object model of devices of the LwM2M gateway
+    lwm2m *lwm2mMapper
+    // births and rebirth requests of Sparkplug B edge nodes
+    sparkplug *sparkplugMapper
+    // codec and network servers of LoRaWAN devices
+    lorawan *lorawanMapper
+    // live connections of dashboards
+    live *LiveHub
+    // products of devices provisioning themselves
+    provision *provisioner
+}
+
+func NewHookService(client dapr.Client, stateStore store.StateStore, forwarder *Forwarder, presence *PresenceTracker, conf Config) *HookService {
+    s := &HookService{
+        conf:       conf,
+        daprClient: client,
+        emqx:       NewEmqxClient(conf.Emqx),
+        store:      stateStore,
+        registry:   NewDeviceRegistry(stateStore),
+        forwarder:  forwarder,
+        presence:   presence,
+        dedup:      NewDeduplicator(conf.Dedup, stateStore),
+        rateLimit:  NewRateLimiter(conf.RateLimit),
+        mailbox:    NewMailbox(stateStore, conf.DeviceHTTP.MaxPendingCommands, conf.DeviceHTTP.CommandTTL),
+        hookSpecs:  conf.Hooks.HookSpecs(),
+        lwm2m:      newLwM2MMapper(conf.LwM2M),
+        sparkplug:  newSparkplugMapper(conf.Sparkplug),
+        lorawan:    newLoRaWANMapper(conf.LoRaWAN),
+        live:       NewLiveHub(conf.Live),
+        provision:  newProvisioner(conf.Provision),
+    }
+    s.quality = NewConnectionQuality(conf.Quality, s.reportFlapping)
+    s.subscriptions = NewSubscriptionManager(s.registry, s)
+    return s
+}
+
+// Run runs the background jobs of the hook service until ctx is done.
+func (s *HookService) Run(ctx context.Context) {
+    s.quality.Run(ctx)
+}
+
+// Reload applies the settings safe to change at runtime: flapping
+// detection, the deduplication window, the rate limit, the LoRaWAN codec,
+// the LwM2M objects and the hooks, which EMQX picks up the next time it
+// loads the provider.
+func (s *HookService) Reload(conf Config) {
+    s.quality.SetConfig(conf.Quality)
+    s.dedup.SetConfig(conf.Dedup)
+    s.rateLimit.SetConfig(conf.RateLimit)
+    s.lorawan.setCodec(conf.LoRaWAN.Codec)
+    s.lwm2m.setObjects(conf.LwM2M.Objects)
+    specs := conf.Hooks.HookSpecs()
+    s.hookLock.Lock()
+    s.hookSpecs = specs
+    s.hookLock.Unlock()
+}
+
+// Close flushes and closes the forwarder, the hook server must be stopped
+// before. Devices stay online in core: iothub stopping does not disconnect
+// them from EMQX, another replica takes over their hooks.
+func (s *HookService) Close(ctx context.Context) error {
+    return s.forwarder.Close(ctx)
 }
 
-//
-func envWithDefault(envVal, defaultVal string) string {
-    if s := os.Getenv(envVal); s != "" {
-        return s
+// RemoveDevice forgets devId once it is deleted: its record, its presence
+// and per device series, and its event sequence.
+func (s *HookService) RemoveDevice(ctx context.Context, devId string) error {
+    if err := s.registry.Delete(ctx, devId); err != nil {
+        return err
     }
-    return defaultVal
+    s.presence.Remove(devId)
+    s.forwarder.Forget(devId)
+    s.rateLimit.Forget(devId)
+    return nil
+}
+
+// Registry returns the device registry.
+func (s *HookService) Registry() *DeviceRegistry {
+    return s.registry
+}
+
+// Quality returns the connection quality tracker.
+func (s *HookService) Quality() *ConnectionQuality {
+    return s.quality
 }
 
 // HookProviderServer callbacks
 
 func (s *HookService) OnProviderLoaded(ctx context.Context, in *pb.ProviderLoadedRequest) (*pb.LoadedResponse, error) {
-    hooks := []*pb.HookSpec{
-        {Name: "client.connect"},
-        {Name: "client.connack"},
-        {Name: "client.connected"},
-        {Name: "client.disconnected"},
-        {Name: "client.authenticate"},
-        {Name: "client.check_acl"},
-        {Name: "client.subscribe"},
-        {Name: "client.unsubscribe"},
-        {Name: "session.created"},
-        {Name: "session.subscribed"},
-        {Name: "session.unsubscribed"},
-        {Name: "session.resumed"},
-        {Name: "session.discarded"},
-        {Name: "session.takeovered"},
-        {Name: "session.terminated"},
-        {Name: "message.publish"},
-        {Name: "message.delivered"},
-        {Name: "message.acked"},
-        {Name: "message.dropped"},
-    }
-    return &pb.LoadedResponse{Hooks: hooks}, nil
+    log.Infof("exhook provider loaded by %s", in.GetBroker().GetSysdescr())
+    s.hookLock.RLock()
+    defer s.hookLock.RUnlock()
+    return &pb.LoadedResponse{Hooks: s.hookSpecs}, nil
 }
 
+// DrainedHooks are the hooks rejected on shutdown, the devices connecting
+// retry and reach another instance. EMQX does not retry the other hooks,
+// e.g. message.publish and client.disconnected, they are served until the
+// gRPC server stops.
+var DrainedHooks = []string{
+    "/emqx.exhook.v1.HookProvider/OnClientConnect",
+    "/emqx.exhook.v1.HookProvider/OnClientAuthenticate",
+}
+
+// exhookNode identifies the emqx node calling a hook by the host of its
+// gRPC connection, shared by its pool of connections.
+func exhookNode(ctx context.Context) string {
+    p, ok := peer.FromContext(ctx)
+    if !ok || p.Addr == nil {
+        return ""
+    }
+    addr := p.Addr.String()
+    if host, _, err := net.SplitHostPort(addr); err == nil {
+        return host
+    }
+    return addr
+}
+
+// OnProviderUnloaded is called when an emqx node stops or unloads the
+// exhook. The devices connected through it are reported offline, their
+// disconnect hooks will not come, and the pending events are flushed. The
+// devices of the other nodes are still connected and stay online.
 func (s *HookService) OnProviderUnloaded(ctx context.Context, in *pb.ProviderUnloadedRequest) (*pb.EmptySuccess, error) {
+    node := exhookNode(ctx)
+    log.Infof("exhook provider unloaded by %s", node)
+    if node != "" {
+        for _, devId := range s.presence.OnlineOn(node) {
+            if err := s.disconnected(ctx, devId); err != nil {
+                log.Errorf("mark %s offline on unload err, %v", devId, err)
+            }
+        }
+    }
+    if err := s.forwarder.Flush(ctx); err != nil {
+        log.Errorf("flush forwarder on unload err, %v", err)
+    }
     return &pb.EmptySuccess{}, nil
 }
 
@@ -230,7 +274,10 @@ func (s *HookService) OnClientConnack(ctx context.Context, in *pb.ClientConnackR
 
 func (s *HookService) OnClientConnected(ctx context.Context, in *pb.ClientConnectedRequest) (*pb.EmptySuccess, error) {
     log.Debugf("clientInfo %v", in.GetClientinfo())
-    ts := time.Now().UnixMilli()
+    // not a device yet
+    if s.provisionClient(in.Clientinfo) {
+        return &pb.EmptySuccess{}, nil
+    }
     username := GetUsername(in.Clientinfo)
     ci := &ConnectInfo{
         ClientID:   in.Clientinfo.Clientid,
@@ -241,6 +288,19 @@ func (s *HookService) OnClientConnected(ctx context.Context, in *pb.ClientConnec
         Online:     true,
         Timestamp:  time.Now().UnixMilli(),
     }
+    rec, err := s.markOnline(ctx, ci)
+    if err != nil {
+        return nil, err
+    }
+    s.presence.SetNode(username, exhookNode(ctx))
+    s.quality.Connected(rec.TenantID, rec.Owner, username)
+    return &pb.EmptySuccess{}, nil
+}
+
+// markOnline saves the connect info of a device and reports it online to core.
+func (s *HookService) markOnline(ctx context.Context, ci *ConnectInfo) (*DeviceRecord, error) {
+    username := ci.UserName
+    ts := ci.Timestamp
     v, err := EncodeData(*ci)
     if err != nil {
         return nil, err
@@ -256,26 +316,22 @@ func (s *HookService) OnClientConnected(ctx context.Context, in *pb.ClientConnec
             "mark":   MarkConnecting,
         },
     }
-    // get owner
-    owner, err := s.GetState(username + devEntitySuffixKey)
+    // get owner, save ConnectInfo
+    rec, err := s.registry.Update(ctx, username, func(rec *DeviceRecord) error {
+        rec.Protocol = ci.Protocol
+        rec.ConnectInfo = ci
+        rec.LastSeen = ts
+        return nil
+    })
     if err != nil {
+        log.Errorf("save connect info of %s err, %v", username, err)
         return nil, err
     }
-    sw := string(owner)
-    tenant, err := s.GetState(username + tenantSuffixKey)
-    if err != nil {
-        return nil, err
-    }
-    tenantId := string(tenant)
-    st, ok := s.deviceStatus.Load(username)
-    // 有并发问题
-    if !ok || (ok && st == DeviceStatusOffline) {
-        // metrics
-        s.collector.connectedTotal.WithLabelValues(tenantId).Add(1)
-        s.deviceStatus.Store(username, DeviceStatusOnline)
-    }
+    sw := rec.Owner
+    tenantId := rec.TenantID
     // 记录设备状态 Online
-    s.collector.deviceStatus.WithLabelValues(tenantId, username).Set(1)
+    s.presence.Connected(tenantId, username, ci.Protocol)
+    s.live.presence(rec, true)
 
     data := map[string]interface{}{
         "id":     username,
@@ -285,25 +341,38 @@ func (s *HookService) OnClientConnected(ctx context.Context, in *pb.ClientConnec
         "data":   infoMap,
     }
     log.Debugf("iothub->core %s", data)
-    if err := s.daprClient.PublishEvent(context.Background(), "iothub-pubsub", s.corePubTopic, data); err != nil {
-        log.Error(err)
+    if err := s.forwarder.Send(ctx, username, EventTypeConnectInfo, time.UnixMilli(ts), data); err != nil {
         return nil, err
     }
-    //save ConnectInfo
-    ciByte, err := json.Marshal(ci)
-    if nil != err {
-        log.Error(err)
-        return nil, err
+    return rec, nil
+}
+
+func (s *HookService) OnClientDisconnected(ctx context.Context, in *pb.ClientDisconnectedRequest) (*pb.EmptySuccess, error) {
+    if s.provisionClient(in.Clientinfo) {
+        return &pb.EmptySuccess{}, nil
     }
-    if err := s.SaveState(username+connectInfoSuffixKey, ciByte); err != nil {
+    if err := s.disconnected(ctx, GetUsername(in.Clientinfo)); err != nil {
         return nil, err
     }
-
     return &pb.EmptySuccess{}, nil
 }
 
-func (s *HookService) OnClientDisconnected(ctx context.Context, in *pb.ClientDisconnectedRequest) (*pb.EmptySuccess, error) {
-    username := GetUsername(in.Clientinfo)
+// disconnected reports the MQTT client username offline, and the devices
+// of a Sparkplug edge node.
+func (s *HookService) disconnected(ctx context.Context, username string) error {
+    if err := s.markOffline(ctx, username); err != nil {
+        return err
+    }
+    if s.conf.Sparkplug.Enabled {
+        if err := s.sparkplugDisconnected(ctx, username); err != nil {
+            log.Errorf("end sparkplug devices of %s err, %v", username, err)
+        }
+    }
+    return nil
+}
+
+// markOffline clears the connect info of username and reports it offline to core.
+func (s *HookService) markOffline(ctx context.Context, username string) error {
     ts := time.Now().UnixMilli()
     ci := &ConnectInfo{
         ClientID:   "",
@@ -316,7 +385,7 @@ func (s *HookService) OnClientDisconnected(ctx context.Context, in *pb.ClientDis
     }
     v, err := EncodeData(*ci)
     if err != nil {
-        return nil, err
+        return err
     }
     infoMap := map[string]interface{}{
         //connectInfoProperty: *ci,
@@ -329,31 +398,23 @@ func (s *HookService) OnClientDisconnected(ctx context.Context, in *pb.ClientDis
             "mark":   MarkConnecting,
         },
     }
-    // get owner
-    dv, ok := s.deviceStatus.Load(username)
-    tenant, err := s.GetState(username + tenantSuffixKey)
-    if err != nil {
-        return nil, err
-    }
-    //
-    tenantId := string(tenant)
-    // online
-    if ok && dv == DeviceStatusOnline { //
-
-        s.collector.connectedTotal.WithLabelValues(tenantId).Add(-1)
-        // 设置成 offline
-        s.deviceStatus.Store(username, DeviceStatusOffline)
-    }
-    // add device status -- offline
-    s.collector.deviceStatus.WithLabelValues(tenantId, username).Set(0)
-    owner, err := s.GetState(username + devEntitySuffixKey)
+    // get owner, delete connect info
+    rec, err := s.registry.Update(ctx, username, func(rec *DeviceRecord) error {
+        rec.ConnectInfo = nil
+        rec.LastSeen = ts
+        return nil
+    })
     if err != nil {
-        return nil, err
+        log.Errorf("delete connect info of %s err, %v", username, err)
+        return err
     }
-    //
+    // 设置成 offline
+    s.presence.Disconnected(username)
+    s.quality.Disconnected(username)
+    s.live.presence(rec, false)
 
     // add metrics
-    sw := string(owner)
+    sw := rec.Owner
 
     data := map[string]interface{}{
         "id":     username,
@@ -363,48 +424,10 @@ func (s *HookService) OnClientDisconnected(ctx context.Context, in *pb.ClientDis
         "data":   infoMap,
     }
     log.Debugf("iothub->core %s", data)
-    if err := s.daprClient.PublishEvent(context.Background(), "iothub-pubsub", s.corePubTopic, data); err != nil {
-        log.Error(err)
-        return nil, err
-    }
-
-    //delete connect info from state store
-    if err := s.DeleteState(username + connectInfoSuffixKey); err != nil {
-        log.Errorf("Failed to delete state store: %v", err)
-        return nil, err
-    }
-
-    //delete subId
-    if err := s.DeleteState(username + subEntitySuffixKey); nil != err {
-        log.Errorf("delete subscription id err, %v", err)
-        // get all subscription id
-        subIds, err := s.GetState(username)
-        if err != nil {
-            return nil, err
-        }
-        // delete topic id and subscription id
-        for _, subId := range subIds {
-            id := string(subId)
-            topic, err := s.GetState(id)
-            if err != nil {
-                return nil, err
-            }
-            if err := s.DeleteState(string(topic)); nil != err {
-                log.Errorf("delete topic err, %v", err)
-                return nil, err
-            }
-            if err := s.DeleteState(id); nil != err {
-                log.Errorf("delete subscription id err, %v", err)
-                return nil, err
-            }
-        }
-        // delete device id
-        if err := s.DeleteState(username); nil != err {
-            log.Errorf("delete device id err, %v", err)
-            return nil, err
-        }
-    }
-    return &pb.EmptySuccess{}, nil
+    err = s.forwarder.Send(ctx, username, EventTypeConnectInfo, time.UnixMilli(ts), data)
+    // the sequence of a reconnect starts over in a new epoch
+    s.forwarder.Forget(username)
+    return err
 }
 
 type TokenValidRequest struct {
@@ -426,15 +449,18 @@ type TokenValidResponse struct {
     Data TokenValidResponseData `json:"data"`
 }
 
-func (s *HookService) parseToken(password string) (*TokenValidResponse, error) {
-    url := BaseUrl + "/security/v1/entity/info/" + password
-    req, err := http.NewRequest(http.MethodGet, url, nil)
+func (s *HookService) parseToken(ctx context.Context, password string) (*TokenValidResponse, error) {
+    ctx, span := tracing.Start(ctx, "keel.ParseToken", trace.WithSpanKind(trace.SpanKindClient))
+    defer span.End()
+    url := s.conf.KeelURL + "/security/v1/entity/info/" + password
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
     if err != nil {
         return nil, err
     }
 
     req.Header.Add("Content-Type", "application/json")
     AddDefaultAuthHeader(req)
+    tracing.InjectHTTP(ctx, req)
 
     resp, err := http.DefaultClient.Do(req)
     if err != nil {
@@ -459,27 +485,58 @@ func (s *HookService) parseToken(password string) (*TokenValidResponse, error) {
     return tokenResp, nil
 }
 
-func (s *HookService) auth(password, username string) bool {
-    tokenResp, err := s.parseToken(password)
+// auth failure reasons
+const (
+    authReasonOK               = "ok"
+    authReasonEmptyCredentials = "empty_credentials"
+    authReasonInvalidToken     = "invalid_token"
+    authReasonUsernameMismatch = "username_mismatch"
+    authReasonStateError       = "state_error"
+    authReasonFlapping         = "flapping"
+)
+
+func (s *HookService) auth(ctx context.Context, password, username string) bool {
+    devId, _ := s.authToken(ctx, password, username)
+    return devId != ""
+}
+
+// authToken parses an entity token with keel and saves the owner and tenant
+// of its device. The token must belong to expect if not empty. It returns
+// the device id, empty with the failure reason if the token is rejected.
+func (s *HookService) authToken(ctx context.Context, token, expect string) (devId string, reason string) {
+    reason = authReasonOK
+    defer func() {
+        result := metrics.ResultSuccess
+        if reason != authReasonOK {
+            result = metrics.ResultFailure
+        }
+        metrics.AuthTotal.WithLabelValues(result, reason).Inc()
+    }()
+    tokenResp, err := s.parseToken(ctx, token)
     if nil != err {
         log.Error(err)
-        return false
+        reason = authReasonInvalidToken
+        return "", reason
     }
-    log.Debug(tokenResp, username)
-    if tokenResp.Data.EntityID != username {
-        log.Errorf("invalid username %s", username)
-        return false
+    log.Debug(tokenResp, expect)
+    devId = tokenResp.Data.EntityID
+    if devId == "" || (expect != "" && devId != expect) {
+        log.Errorf("invalid username %s", expect)
+        reason = authReasonUsernameMismatch
+        return "", reason
     }
     // TODO: 目前 owner 为用户 Id，是否带上租户 Id
-    //save owner
-    if err := s.SaveState(username+devEntitySuffixKey, []byte(tokenResp.Data.Owner)); err != nil {
-        return false
-    }
-    // save owner and tenant map
-    if err := s.SaveState(username+tenantSuffixKey, []byte(tokenResp.Data.TenantID)); err != nil {
-        return false
-    }
-    return true
+    // save owner and tenant
+    if _, err := s.registry.Update(ctx, devId, func(rec *DeviceRecord) error {
+        rec.Owner = tokenResp.Data.Owner
+        rec.TenantID = tokenResp.Data.TenantID
+        return nil
+    }); err != nil {
+        log.Errorf("save device record of %s err, %v", devId, err)
+        reason = authReasonStateError
+        return "", reason
+    }
+    return devId, reason
 }
 
 func GetUsername(Clientinfo *pb.ClientInfo) string {
@@ -488,7 +545,7 @@ func GetUsername(Clientinfo *pb.ClientInfo) string {
     var username string
     if protocol == "coap" {
         username = Clientinfo.GetClientid()
-    } else if protocol == "lwm2m" {
+    } else if protocol == ProtocolLwM2M {
         username = SplitLwm2mClientID(Clientinfo.GetClientid(), 0)
     } else {
         username = Clientinfo.GetUsername()
@@ -508,7 +565,7 @@ func SplitLwm2mClientID(lwm2mClientID string, index int) string {
 func GetPassword(Clientinfo *pb.ClientInfo) string {
     protocol := Clientinfo.GetProtocol()
     var pw string
-    if protocol == "lwm2m" {
+    if protocol == ProtocolLwM2M {
         pw = SplitLwm2mClientID(Clientinfo.GetClientid(), 1)
     } else {
         pw = Clientinfo.GetPassword()
@@ -524,65 +581,91 @@ func (s *HookService) OnClientAuthenticate(ctx context.Context, in *pb.ClientAut
     pw := GetPassword(in.Clientinfo)
     if username == "" || pw == "" {
         log.Warnf("invalid username %s or password %s", username, pw)
+        metrics.AuthTotal.WithLabelValues(metrics.ResultFailure, authReasonEmptyCredentials).Inc()
+        return res, nil
+    }
+    if s.quality.Throttled(username) {
+        log.Warnf("reject flapping device %s", username)
+        metrics.AuthTotal.WithLabelValues(metrics.ResultFailure, authReasonFlapping).Inc()
+        res.Value = &pb.ValuedResponse_BoolResult{BoolResult: false}
         return res, nil
     }
-    authRes := s.auth(pw, username)
+    if product, ok := s.provision.credentials(pw); product != nil {
+        res.Value = &pb.ValuedResponse_BoolResult{BoolResult: s.authProvision(ctx, in.Clientinfo, product, ok)}
+        return res, nil
+    }
+    authRes := s.auth(ctx, pw, username)
     res.Value = &pb.ValuedResponse_BoolResult{BoolResult: authRes}
     return res, nil
 }
 
+// OnClientCheckAcl rejects subscriptions of topic filters covering no
+// iothub topic, EMQX fails only these filters in the SUBACK. Sparkplug
+// edge nodes, when enabled, subscribe to their NCMD and DCMD topics.
+// Provisioning clients only use the provision topics.
 func (s *HookService) OnClientCheckAcl(ctx context.Context, in *pb.ClientCheckAclRequest) (*pb.ValuedResponse, error) { //nolint
-    return &pb.ValuedResponse{}, nil
+    res := &pb.ValuedResponse{Type: pb.ValuedResponse_IGNORE}
+    if product := s.provisionProduct(in.GetClientinfo()); product != nil {
+        res.Type = pb.ValuedResponse_STOP_AND_RETURN
+        res.Value = &pb.ValuedResponse_BoolResult{BoolResult: provisionACL(in, product)}
+        return res, nil
+    }
+    if in.GetType() != pb.ClientCheckAclRequest_SUBSCRIBE || validSubTopic(in.GetTopic()) ||
+        s.conf.Sparkplug.Enabled && sparkplug.IsTopic(in.GetTopic()) {
+        return res, nil
+    }
+    log.Warnf("deny subscription of %s to %s", in.GetClientinfo().GetUsername(), in.GetTopic())
+    res.Type = pb.ValuedResponse_STOP_AND_RETURN
+    res.Value = &pb.ValuedResponse_BoolResult{BoolResult: false}
+    return res, nil
 }
 
 func (s *HookService) OnClientSubscribe(ctx context.Context, in *pb.ClientSubscribeRequest) (*pb.EmptySuccess, error) {
-    topics := in.GetTopicFilters()
+    if s.provisionClient(in.Clientinfo) {
+        return &pb.EmptySuccess{}, nil
+    }
     username := in.Clientinfo.GetUsername()
-    for _, tf := range topics {
+    topics := make([]string, 0, len(in.GetTopicFilters()))
+    for _, tf := range in.GetTopicFilters() {
         topic := tf.GetName()
-        // 获取设备token(mqtt 的 pwd)
-        value, err := s.GetState(username + devEntitySuffixKey)
-        if err != nil {
-            return nil, err
-        }
-        owner := string(value)
-
+        // 非法的 topic 由 OnClientCheckAcl 拒绝, 不影响其他 topic
         if !validSubTopic(topic) {
-            log.Errorf("invalid topic:%s username:%s", topic, username)
-            return nil, errors.New("invalid topic")
-        }
-
-        itemType := "*"
-        log.Debugf("client subscribe:%s itemType:%", owner, itemType)
-        // TODO: 优化逻辑
-        if err := s.CreateSubscribeEntity(owner, username, itemType, topic, realtimeMode); err != nil {
-            return nil, err
+            // sparkplug commands are published by iothub, not subscribed in core
+            if !s.conf.Sparkplug.Enabled || !sparkplug.IsTopic(topic) {
+                log.Warnf("skip invalid topic:%s username:%s", topic, username)
+            }
+            continue
         }
+        topics = append(topics, topic)
+    }
+    if len(topics) == 0 {
+        return &pb.EmptySuccess{}, nil
+    }
+    log.Debugf("client %s subscribe %v", username, topics)
+    if err := s.subscriptions.Subscribe(ctx, username, topics); err != nil {
+        log.Errorf("subscribe %v of %s err, %v", topics, username, err)
+        return nil, err
     }
     return &pb.EmptySuccess{}, nil
 }
 
 func (s *HookService) OnClientUnsubscribe(ctx context.Context, in *pb.ClientUnsubscribeRequest) (*pb.EmptySuccess, error) {
-    var (
-        err error
-    )
-    // TODO: 1. 删除对应的 topic
-    topics := in.GetTopicFilters()
+    if s.provisionClient(in.Clientinfo) {
+        return &pb.EmptySuccess{}, nil
+    }
     // tips: username == devId
     username := in.Clientinfo.GetUsername()
-    for _, tf := range topics {
-        topic := tf.GetName()
-        topic = buildTopic(username, topic)
-        log.Debug("unSubscribe topic ", topic)
-        if e := s.DeleteState(topic); nil != e {
-            log.Errorf("delete subscription id err, %v", e)
-            if err != nil {
-                err = e
-            }
-        }
+    topics := make([]string, 0, len(in.GetTopicFilters()))
+    for _, tf := range in.GetTopicFilters() {
+        topics = append(topics, tf.GetName())
+    }
+    log.Debugf("client %s unsubscribe %v", username, topics)
+    // 所有的 topic 都取消完了则删除设备在 core 里面的订阅
+    if err := s.subscriptions.Unsubscribe(ctx, username, topics); err != nil {
+        log.Errorf("unsubscribe %v of %s err, %v", topics, username, err)
+        return nil, err
     }
-    // TODO: 2. 如果所有的 topic 都取消完了则删除设备在 core 里面的订阅
-    return &pb.EmptySuccess{}, err
+    return &pb.EmptySuccess{}, nil
 }
 
 func (s *HookService) OnSessionCreated(ctx context.Context, in *pb.SessionCreatedRequest) (*pb.EmptySuccess, error) {
@@ -610,6 +693,15 @@ func (s *HookService) OnSessionTakeovered(ctx context.Context, in *pb.SessionTak
 }
 
 func (s *HookService) OnSessionTerminated(ctx context.Context, in *pb.SessionTerminatedRequest) (*pb.EmptySuccess, error) {
+    if s.provisionClient(in.Clientinfo) {
+        return &pb.EmptySuccess{}, nil
+    }
+    // 会话结束, 删除设备在 core 里面的订阅
+    username := GetUsername(in.Clientinfo)
+    if err := s.subscriptions.Terminate(ctx, username); err != nil {
+        log.Errorf("terminate subscriptions of %s err, %v", username, err)
+        return nil, err
+    }
     return &pb.EmptySuccess{}, nil
 }
 
@@ -636,27 +728,9 @@ func getUserNameFromTopic(topic string) (user string) {
     return items[0]
 }
 
-type Event struct {
-    cloudevents.Event
-}
-
-func toCloudEventData(data interface{}) ([]byte, error) {
-    m := make(map[string]interface{})
-    m["traceid"] = uuid.New().String()
-    m["id"] = uuid.New().String()
-    m["topic"] = "core-pub"
-    m["pubsubname"] = "iothub-pubsub"
-    m["source"] = "iothub"
-    m["type"] = "com.dapr.event.sent"
-    m["specversion"] = "1.0"
-    m["data"] = data
-    //
-    return jsoniter.Marshal(m)
-}
-
 func topicFromUserNameTopic(userNameTopic string) string {
     vv := strings.SplitN(userNameTopic, "/", 2)
-    if len(vv) > 0 {
+    if len(vv) == 2 {
         return vv[1]
     }
     return ""
@@ -668,34 +742,76 @@ func (s *HookService) OnMessagePublish(ctx context.Context, in *pb.MessagePublis
     res.Value = &pb.ValuedResponse_BoolResult{BoolResult: false}
     username := getUserNameFromTopic(in.Message.Topic)
     //get owner
-    owner, err := s.GetState(username + tenantSuffixKey)
-    log.Infof("find username: %s owner: %s", username, owner)
+    rec, err := s.registry.Get(ctx, username)
     if err != nil {
         return nil, err
     }
-    tenantId := string(owner)
+    if rec == nil {
+        rec = &DeviceRecord{DeviceID: username}
+    }
+    log.Infof("find username: %s owner: %s", username, rec.Owner)
     //do nothing when receive tkeel attribute/telemetry/command event.
     // 下行数据直接返回
     // add metrics
     if in.Message.From == defaultDownStreamClientId {
-        s.collector.msgTotal.WithLabelValues(tenantId, MarkDownStream).Add(1)
+        metrics.MsgTotal.WithLabelValues(rec.TenantID, metrics.DirectionDownStream).Inc()
+        metrics.PayloadBytes.WithLabelValues(rec.TenantID, metrics.DirectionDownStream).Add(float64(len(in.GetMessage().GetPayload())))
         log.Debugf("downstream data: %v", in.GetMessage())
         res.Value = &pb.ValuedResponse_BoolResult{BoolResult: true}
         return res, nil
     }
+    uplink := s.uplink
+    switch {
+    case isLwM2MTopic(in.Message.Topic) && s.conf.LwM2M.Enabled:
+        uplink = s.lwm2mUplink
+    case isSparkplugTopic(in.Message.Topic) && s.conf.Sparkplug.Enabled:
+        uplink = s.sparkplugUplink
+    case s.provision.enabled() && isProvisionTopic(in.Message.Topic):
+        uplink = s.provisionUplink
+    }
+    if err := uplink(ctx, rec, in.GetMessage()); err != nil {
+        return res, err
+    }
+    res.Value = &pb.ValuedResponse_BoolResult{BoolResult: true}
+    return res, nil
+}
+
+// uplink sends a message of the device of rec to core, the message topic is
+// <devId>/<topic>. It is the upstream pipeline of every device protocol:
+// deduplication, presence, metrics, then the ordered forwarder.
+func (s *HookService) uplink(ctx context.Context, rec *DeviceRecord, msg *pb.Message) error {
+    username := rec.DeviceID
+    owner, tenantId := rec.Owner, rec.TenantID
+    // checked first, the key of a dropped message is not recorded
+    if !s.rateLimit.Allow(username) {
+        metrics.MsgRateLimited.WithLabelValues(tenantId).Inc()
+        log.Debugf("rate limited message %s from %s", msg.GetId(), username)
+        return nil
+    }
+    // QoS 1 retransmission, count it but do not forward to core again
+    if s.dedup.Duplicate(ctx, username, msg) {
+        metrics.MsgDuplicate.WithLabelValues(tenantId).Add(1)
+        log.Debugf("duplicate message %s from %s", msg.GetId(), username)
+        return nil
+    }
     //
-    s.collector.msgTotal.WithLabelValues(tenantId, MarkUpStream).Add(1)
+    // unknown after a restart, the device is connected since it publishes
+    if !s.presence.Seen(username) && rec.TenantID != "" {
+        s.presence.Connected(rec.TenantID, username, rec.Protocol)
+    }
+    metrics.MsgTotal.WithLabelValues(tenantId, metrics.DirectionUpStream).Inc()
+    metrics.PayloadBytes.WithLabelValues(tenantId, metrics.DirectionUpStream).Add(float64(len(msg.GetPayload())))
     //
     data := make(map[string]interface{})
     data["id"] = username
-    data["owner"] = string(owner)
+    data["owner"] = owner
     data["type"] = "device"
     data["source"] = "iothub"
     // username = deviceId
     // 此处topic为 user/topic
-    userNameTopic := in.GetMessage().Topic
+    userNameTopic := msg.GetTopic()
 
-    payloadBytes := in.GetMessage().GetPayload()
+    payloadBytes := msg.GetPayload()
     log.Infof("receive topic: %s payload: %s", userNameTopic, string(payloadBytes))
 
     /*
@@ -714,12 +830,13 @@ func (s *HookService) OnMessagePublish(ctx context.Context, in *pb.MessagePublis
 
     topic := topicFromUserNameTopic(userNameTopic)
     if topic == "" {
-        res.Value = &pb.ValuedResponse_BoolResult{BoolResult: true}
+        return nil
     }
 
     propertyType := propertyTypeFromTopic(topic)
     // TODO: propertyType check
     ts := time.Now().UnixMilli()
+    msgTime := timeFromMilli(msg.GetTimestamp())
     md := map[string]interface{}{
         rawDataProperty: map[string]interface{}{
             "id":     username,
@@ -731,23 +848,14 @@ func (s *HookService) OnMessagePublish(ctx context.Context, in *pb.MessagePublis
         },
     }
     data["data"] = md
-    dd, err := toCloudEventData(data)
-    if err != nil {
-        log.Errorf("toCloudEventData %s", err.Error())
-        return res, err
-    }
-    s.producer.Input() <- &sarama.ProducerMessage{
-        Topic: s.corePubTopic,
-        Value: sarama.ByteEncoder(dd),
-        Key:   sarama.StringEncoder(username),
+    if err := s.forwarder.SendUplink(ctx, username, tenantId, eventTypeFromProperty(propertyType), msgTime, data); err != nil {
+        // not forwarded, let the retransmission through
+        s.dedup.Forget(ctx, username, msg)
+        return err
     }
+    s.live.uplink(rec, topic, payloadBytes)
     log.Debug("OnMessagePublish", data)
-    //if err := s.daprClient.PublishEvent(context.Background(), "iothub-pubsub", s.corePubTopic, data); err != nil {
-    //	log.Error(err)
-    //	return res, nil
-    //}
-    res.Value = &pb.ValuedResponse_BoolResult{BoolResult: true}
-    return res, nil
+    return nil
 }
 
 func (s *HookService) OnMessageDelivered(ctx context.Context, in *pb.MessageDeliveredRequest) (*pb.EmptySuccess, error) {
@@ -768,20 +876,13 @@ func AddDefaultAuthHeader(req *http.Request) {
 }
 
 // create SubscribeEntity
-func (s *HookService) CreateSubscribeEntity(owner, devId, itemType, subscriptionTopic, subscriptionMode string) error {
-    // md5(devId+itemType)
-    // IoTHub 订阅 “*”
-    //
-    if itemType != "*" {
-        itemType = "*"
-    }
-    subId := fmt.Sprintf("sub-%x", md5.Sum([]byte(devId+itemType)))
-    //subId := fmt.Sprintf("%s%s", "sub-", GetUUID())
+// selects is the comma separated list of selected properties, "*" for all.
+func (s *HookService) CreateSubscribeEntity(ctx context.Context, owner, devId, subId, selects, subscriptionMode string) error {
     subReq := &v1.SubscriptionObject{
-        PubsubName: "iothub-pubsub",
-        Topic:      "sub-core",
+        PubsubName: s.conf.PubsubName,
+        Topic:      pubsubTopicOfMode(subscriptionMode),
         Mode:       subscriptionMode,
-        Filter:     fmt.Sprintf("insert into %s select %s.%s", subId, devId, itemType),
+        Filter:     coreFilter(subId, devId, selects),
         Source:     "tkeel-device",
         Target:     "iothub",
     }
@@ -793,76 +894,98 @@ func (s *HookService) CreateSubscribeEntity(owner, devId, itemType, subscription
         return err
     }
 
-    url := fmt.Sprintf(BaseUrl+"/core/v1/subscriptions?id=%s&source=%s&owner=%s&type=%s", subId, "iothub", owner, "SUBSCRIPTION")
+    ctx, span := tracing.Start(ctx, "core.CreateSubscription", trace.WithSpanKind(trace.SpanKindClient))
+    defer span.End()
+    url := fmt.Sprintf(s.conf.KeelURL+"/core/v1/subscriptions?id=%s&source=%s&owner=%s&type=%s", subId, "iothub", owner, "SUBSCRIPTION")
     payload := strings.NewReader(string(data))
-    req, err := http.NewRequest(http.MethodPost, url, payload)
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, payload)
     if err != nil {
         return err
     }
     req.Header.Add("Content-Type", "application/json")
     AddDefaultAuthHeader(req)
+    tracing.InjectHTTP(ctx, req)
 
     resp, err := http.DefaultClient.Do(req)
     if err != nil {
+        metrics.SubscriptionTotal.WithLabelValues(metrics.OpCreate, metrics.ResultFailure).Inc()
         return err
     }
     defer resp.Body.Close()
+    // an existing subscription of the same id is fine, creation is idempotent
+    ok := resp.StatusCode < http.StatusMultipleChoices || resp.StatusCode == http.StatusConflict
+    if ok {
+        metrics.SubscriptionTotal.WithLabelValues(metrics.OpCreate, metrics.ResultSuccess).Inc()
+    } else {
+        metrics.SubscriptionTotal.WithLabelValues(metrics.OpCreate, metrics.ResultFailure).Inc()
+    }
 
     res, err := ioutil.ReadAll(resp.Body)
     if err != nil {
         log.Errorf("create subscription err, %v", err)
         return err
     }
-
-    // TODO: 保存订阅 subid 一个设备只会有一个 subId 然后由 iothub 区分同的 topic
-    if err := s.SaveState(subId, []byte(devId)); err != nil {
-        return err
+    if !ok {
+        log.Errorf("create subscription %s err, %s: %s", subId, resp.Status, res)
+        return errors.New("create subscription: " + resp.Status)
     }
 
-    // TODO: 关联deviceId 与 subId
-    if err := s.SaveState(devId, []byte(subId)); err != nil {
-        return err
-    }
-    // TODO: 保存订阅的 topic = deviceId/subscriptionTopic 取消订阅即是删除对应的 topic
-    // TODO: 保存设备订阅的 topic 一个设备可能会订阅多个 topic 所以这里使用 deviceId + topic 作为唯一key
-
-    tp := buildTopic(devId, subscriptionTopic)
     log.Debugf("create subscription ok, %v", res)
-    if err := s.SaveState(tp, []byte("T")); err != nil {
-        return err
-    }
-
     return nil
 }
 
-// 保存每一个设备的 subIds
-func (s *HookService) SaveSubscriptionId(devId, subId string) error {
-    subscriptionIds, err := s.GetState(devId)
+// coreEntity is the part of a core entity iothub checks.
+type coreEntity struct {
+    ID         string `json:"id"`
+    Owner      string `json:"owner"`
+    Source     string `json:"source"`
+    Type       string `json:"type"`
+    Properties struct {
+        BasicInfo map[string]interface{} `json:"basicInfo"`
+    } `json:"properties"`
+}
+
+// getEntity returns the core entity devId as seen by owner of tenantId,
+// nil if it does not exist.
+func (s *HookService) getEntity(ctx context.Context, tenantId, owner, devId string) (_ *coreEntity, err error) {
+    ctx, span := tracing.Start(ctx, "core.GetEntity", trace.WithSpanKind(trace.SpanKindClient))
+    defer func() { tracing.End(span, err) }()
+    query := url.Values{"owner": {owner}, "type": {"device"}}
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.conf.KeelURL+"/core/v1/entities/"+url.PathEscape(devId)+"?"+query.Encode(), nil)
     if err != nil {
-        return err
+        return nil, err
     }
-    var subIds interface{}
-
-    if err := json.Unmarshal(subscriptionIds, &subIds); nil != err {
-        return err
+    addTenantAuthHeader(req, tenantId, owner)
+    tracing.InjectHTTP(ctx, req)
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, nil
     }
-    idArray := reflect.ValueOf(subIds)
-    idArray.Field(idArray.Len()).SetString(subId)
-    newSubIds, err := json.Marshal(idArray.Interface())
+    res, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
     if err != nil {
-        return err
+        return nil, err
     }
-    if err := s.SaveState(devId, newSubIds); err != nil {
-        return err
+    if resp.StatusCode/100 != 2 {
+        return nil, errors.Errorf("core.GetEntity: %s %s", resp.Status, bytes.TrimSpace(res))
     }
-    return nil
+    entity := &coreEntity{}
+    if err := json.Unmarshal(res, entity); err != nil {
+        return nil, err
+    }
+    return entity, nil
 }
 
 // delete SubscribeEntity
-func (s *HookService) DeleteSubscribeEntity(owner, devId, subId string) error {
+func (s *HookService) DeleteSubscribeEntity(ctx context.Context, owner, devId, subId string) error {
+    ctx, span := tracing.Start(ctx, "core.DeleteSubscription", trace.WithSpanKind(trace.SpanKindClient))
+    defer span.End()
     url := fmt.Sprintf("apis/core/v1/subscriptions/%s?source=%s&owner=%s&type=%s", subId, "iothub", owner, "SUBSCRIPTION")
     res, err := s.daprClient.InvokeMethodWithContent(
-        context.Background(),
+        tracing.OutgoingGRPC(ctx),
         "keel",
         url,
         http.MethodDelete,
@@ -870,6 +993,7 @@ func (s *HookService) DeleteSubscribeEntity(owner, devId, subId string) error {
             ContentType: "application/json",
         },
     )
+    metrics.SubscriptionTotal.WithLabelValues(metrics.OpDelete, metrics.Result(err)).Inc()
     if err != nil {
         log.Errorf("delete subscription entity err %v", err)
         return err
@@ -879,8 +1003,8 @@ func (s *HookService) DeleteSubscribeEntity(owner, devId, subId string) error {
 }
 
 // get state store
-func (s *HookService) GetState(key string) ([]byte, error) {
-    item, err := s.daprClient.GetState(context.Background(), iothubPrivateStatesStoreName, key)
+func (s *HookService) GetState(ctx context.Context, key string) ([]byte, error) {
+    item, err := s.store.Get(ctx, key)
     if err != nil {
         log.Errorf("Failed to get state: %v", err)
         return nil, err
@@ -889,8 +1013,8 @@ func (s *HookService) GetState(key string) ([]byte, error) {
 }
 
 // save state store
-func (s *HookService) SaveState(key string, data []byte) error {
-    if err := s.daprClient.SaveState(context.Background(), iothubPrivateStatesStoreName, key, data); err != nil {
+func (s *HookService) SaveState(ctx context.Context, key string, data []byte) error {
+    if err := s.store.Save(ctx, &store.Item{Key: key, Value: data}); err != nil {
         log.Errorf("Failed to persist state: %v\n", err)
         return err
     }
@@ -898,8 +1022,8 @@ func (s *HookService) SaveState(key string, data []byte) error {
 }
 
 // delete state store
-func (s *HookService) DeleteState(key string) error {
-    if err := s.daprClient.DeleteState(context.Background(), iothubPrivateStatesStoreName, key); err != nil {
+func (s *HookService) DeleteState(ctx context.Context, key string) error {
+    if err := s.store.Delete(ctx, key, ""); err != nil {
         log.Errorf("Failed to delete state store: %v", err)
         return err
     }
@@ -0,0 +1,99 @@
+package service
+
+import (
+    "strings"
+
+    pb "github.com/tkeel-io/iothub/protobuf"
+    "github.com/tkeel-io/kit/log"
+)
+
+// hookDef describes one exhook hook of EMQX and what iothub does with it.
+type hookDef struct {
+    Name string
+    // Reason is why iothub registers the hook, empty for no-op hooks
+    Reason string
+    // Topics are the default topic filters of message hooks
+    Topics []string
+}
+
+// _hookDefs are all exhook hooks, in the order EMQX documents them.
+var _hookDefs = []hookDef{
+    {Name: "client.connect"},
+    {Name: "client.connack"},
+    {Name: "client.connected", Reason: "device online status and connect info"},
+    {Name: "client.disconnected", Reason: "device offline status"},
+    {Name: "client.authenticate", Reason: "device token authentication"},
+    {Name: "client.check_acl", Reason: "reject subscriptions outside the iothub topics"},
+    {Name: "client.subscribe", Reason: "create core subscriptions"},
+    {Name: "client.unsubscribe", Reason: "delete core subscriptions"},
+    {Name: "session.created"},
+    {Name: "session.subscribed"},
+    {Name: "session.unsubscribed"},
+    {Name: "session.resumed"},
+    {Name: "session.discarded"},
+    {Name: "session.takeovered"},
+    {Name: "session.terminated", Reason: "delete core subscriptions of ended sessions"},
+    // device topics, sparkplug ones too, are mounted under the username,
+    // lwm2m under lwm2m/
+    {Name: "message.publish", Reason: "forward device data to core", Topics: []string{"+/v1/#", "+/spBv1.0/#", "lwm2m/#"}},
+    {Name: "message.delivered"},
+    {Name: "message.acked"},
+    {Name: "message.dropped"},
+}
+
+func findHookDef(name string) (hookDef, bool) {
+    for _, def := range _hookDefs {
+        if def.Name == name {
+            return def, true
+        }
+    }
+    return hookDef{}, false
+}
+
+// HookConfig selects the hooks registered to EMQX.
+type HookConfig struct {
+    // Hooks are the hooks to register, all hooks iothub handles if empty.
+    Hooks []string
+    // Topics overrides the topic filters of message hooks by hook name,
+    // an empty list registers the hook for all topics.
+    Topics map[string][]string
+}
+
+// HookSpecs returns the hooks to register to EMQX. Each line of the log
+// lists a hook, its topic filters and why it is registered or skipped.
+func (c HookConfig) HookSpecs() []*pb.HookSpec {
+    selected := make(map[string]bool, len(c.Hooks))
+    for _, name := range c.Hooks {
+        if _, ok := findHookDef(name); !ok {
+            log.Warnf("ignore unknown exhook %s", name)
+            continue
+        }
+        selected[name] = true
+    }
+
+    var specs []*pb.HookSpec
+    for _, def := range _hookDefs {
+        reason := def.Reason
+        switch {
+        case len(selected) > 0 && !selected[def.Name]:
+            log.Infof("exhook %s skipped, not configured", def.Name)
+            continue
+        case len(selected) == 0 && reason == "":
+            log.Infof("exhook %s skipped, no-op", def.Name)
+            continue
+        case reason == "":
+            reason = "configured"
+        }
+        topics := def.Topics
+        if t, ok := c.Topics[def.Name]; ok {
+            topics = t
+        }
+        if !strings.HasPrefix(def.Name, "message.") {
+            // EMQX filters topics of message hooks only
+            topics = nil
+        }
+        log.Infof("exhook %s registered, topics %v: %s", def.Name, topics, reason)
+        specs = append(specs, &pb.HookSpec{Name: def.Name, Topics: topics})
+    }
+    return specs
+}
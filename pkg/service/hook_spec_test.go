@@ -0,0 +1,29 @@
+package service
+
+import (
+    "strings"
+    "testing"
+)
+
+func hookNames(c HookConfig) string {
+    var names []string
+    for _, spec := range c.HookSpecs() {
+        names = append(names, spec.Name+strings.Join(spec.Topics, ","))
+    }
+    return strings.Join(names, " ")
+}
+
+func TestHookConfig_HookSpecs(t *testing.T) {
+    want := "client.connected client.disconnected client.authenticate client.check_acl client.subscribe " +
+        "client.unsubscribe session.terminated message.publish+/v1/#,+/spBv1.0/#,lwm2m/#"
+    if got := hookNames(HookConfig{}); got != want {
+        t.Fatalf("default hooks %s", got)
+    }
+    c := HookConfig{
+        Hooks:  []string{"message.publish", "message.acked", "client.connected", "unknown"},
+        Topics: map[string][]string{"message.publish": {"+/v1/devices/me/telemetry"}, "client.connected": {"#"}},
+    }
+    if got := hookNames(c); got != "client.connected message.publish+/v1/devices/me/telemetry message.acked" {
+        t.Fatalf("configured hooks %s", got)
+    }
+}
@@ -1,15 +1,101 @@
 package service
 
-import "testing"
+import (
+    "context"
+    "net"
+    "sync/atomic"
+    "testing"
+    "time"
 
-func TestHookService_OnMessagePublish(t *testing.T) {
+    "github.com/Shopify/sarama/mocks"
+    "github.com/tkeel-io/iothub/pkg/store"
+    pb "github.com/tkeel-io/iothub/protobuf"
+    "google.golang.org/grpc/peer"
+)
 
-}
+// publish and subscription hooks are covered through the harness, see
+// exhook_test.go.
 
-func TestHookService_CreateSubscribeEntity(t *testing.T) {
+func TestTopicFromUserNameTopic(t *testing.T) {
+    tests := map[string]string{
+        "dev1/v1/devices/me/telemetry": "v1/devices/me/telemetry",
+        "dev1/":                        "",
+        "dev1":                         "",
+    }
+    for in, want := range tests {
+        if got := topicFromUserNameTopic(in); got != want {
+            t.Fatalf("topic of %q is %q, want %q", in, got, want)
+        }
+    }
+}
 
+func TestHookService_State(t *testing.T) {
+    ctx := context.Background()
+    s := &HookService{store: store.NewMemoryStore()}
+    if err := s.SaveState(ctx, "dev1"+tenantSuffixKey, []byte("t1")); err != nil {
+        t.Fatal(err)
+    }
+    v, err := s.GetState(ctx, "dev1"+tenantSuffixKey)
+    if err != nil || string(v) != "t1" {
+        t.Fatalf("unexpected state %s, %v", v, err)
+    }
+    if err := s.DeleteState(ctx, "dev1"+tenantSuffixKey); err != nil {
+        t.Fatal(err)
+    }
+    if v, _ := s.GetState(ctx, "dev1"+tenantSuffixKey); v != nil {
+        t.Fatalf("deleted state %s returned", v)
+    }
 }
 
-func TestTopicFromUserNameTopic(t *testing.T) {
-    t.Log(topicFromUserNameTopic("aa/v1/bb"))
-}
\ No newline at end of file
+func TestHookService_OnProviderUnloaded(t *testing.T) {
+    ctx := context.Background()
+    // the event sent before the unload and dev1 offline
+    p := mocks.NewAsyncProducer(t, mockProducerConfig())
+    p.ExpectInputAndSucceed()
+    p.ExpectInputAndSucceed()
+    stateStore := store.NewMemoryStore()
+    s := NewHookService(nil, stateStore, newForwarderWithProducer(p, "core-pub", CloudEventModeStructured),
+        NewPresenceTracker(PresenceConfig{}), Config{})
+    // dev1 and dev2 connected through two emqx nodes
+    nodes := map[string]string{"dev1": "10.0.0.1", "dev2": "10.0.0.2"}
+    for devId, node := range nodes {
+        devId := devId
+        if _, err := s.registry.Update(ctx, devId, func(rec *DeviceRecord) error {
+            rec.TenantID, rec.Owner = "t1", "u1"
+            rec.ConnectInfo = &ConnectInfo{UserName: devId, Online: true}
+            return nil
+        }); err != nil {
+            t.Fatal(err)
+        }
+        s.presence.Connected("t1", devId, "mqtt")
+        s.presence.SetNode(devId, node)
+    }
+    if err := s.forwarder.Send(ctx, "dev1", EventTypeTelemetry, time.Now(), map[string]interface{}{"id": "dev1"}); err != nil {
+        t.Fatal(err)
+    }
+
+    unloadCtx := peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}})
+    if _, err := s.OnProviderUnloaded(unloadCtx, &pb.ProviderUnloadedRequest{}); err != nil {
+        t.Fatal(err)
+    }
+    if n := atomic.LoadInt64(&s.forwarder.pending); n != 0 {
+        t.Fatalf("%d events not flushed on unload", n)
+    }
+    // its disconnect hooks do not come
+    if d, _ := s.presence.Get("dev1"); d.Online {
+        t.Fatal("dev1 online after the unload of its node")
+    }
+    if rec, err := s.registry.Get(ctx, "dev1"); err != nil || rec.ConnectInfo != nil {
+        t.Fatalf("connect info of dev1 kept, %+v %v", rec, err)
+    }
+    // still connected through another node
+    if d, _ := s.presence.Get("dev2"); !d.Online {
+        t.Fatal("dev2 offline after unload")
+    }
+    if err := s.Close(ctx); err != nil {
+        t.Fatal(err)
+    }
+    if d, _ := s.presence.Get("dev2"); !d.Online {
+        t.Fatal("dev2 offline after close")
+    }
+}
@@ -0,0 +1,607 @@
+package service
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "path"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    go_restful "github.com/emicklei/go-restful"
+    "github.com/gorilla/websocket"
+    "github.com/pkg/errors"
+    "github.com/tkeel-io/iothub/pkg/metrics"
+    "github.com/tkeel-io/kit/log"
+)
+
+// Dashboards follow devices live without going through core: a tenant
+// user subscribes to device ids or patterns over a websocket or a
+// server-sent events stream and receives the uplinks, downlinks and
+// presence changes iothub handles. Every connection has a bounded queue,
+// a slow client misses events instead of holding the hooks up and is told
+// how many with a dropped event. Users only see the devices of their
+// tenant, the system tenant sees every device.
+
+// live event types.
+const (
+    LiveUplink   = "uplink"
+    LiveDownlink = "downlink"
+    LivePresence = "presence"
+    // liveDropped counts the events a slow client missed
+    liveDropped = "dropped"
+    // liveSubscriptions answers a websocket request with the devices and
+    // patterns of the connection
+    liveSubscriptions = "subscriptions"
+
+    liveTransportWebSocket = "websocket"
+    liveTransportSSE       = "sse"
+
+    defaultLiveBuffer    = 256
+    defaultLiveHeartbeat = 30 * time.Second
+    // devices and patterns of a connection
+    maxLiveSubscriptions = 1000
+    liveWriteTimeout     = 10 * time.Second
+    liveMaxRequestSize   = 64 << 10
+)
+
+var errLiveConnections = errors.New("too many live connections")
+
+// LiveConfig configures the live data api.
+type LiveConfig struct {
+    // Buffer is the number of events queued per connection, the following
+    // ones are dropped until the client catches up.
+    Buffer int
+    // MaxConnections limits the connections of a tenant, 0 for no limit.
+    MaxConnections int
+    // Heartbeat is the interval of websocket pings and sse comments.
+    Heartbeat time.Duration
+}
+
+// LiveEvent is an event of the live data api.
+type LiveEvent struct {
+    Type     string `json:"type"`
+    DeviceID string `json:"device_id,omitempty"`
+    TenantID string `json:"tenant_id,omitempty"`
+    Protocol string `json:"protocol,omitempty"`
+    // Topic is the device topic, e.g. v1/devices/me/telemetry.
+    Topic string `json:"topic,omitempty"`
+    // Payload is a json payload, Data a binary one.
+    Payload json.RawMessage `json:"payload,omitempty"`
+    Data    []byte          `json:"data,omitempty"`
+    // presence
+    Online *bool `json:"online,omitempty"`
+    // dropped
+    Dropped uint64 `json:"dropped,omitempty"`
+    // subscriptions
+    Devices []string `json:"devices,omitempty"`
+    Error   string   `json:"error,omitempty"`
+    // unix milliseconds
+    Ts int64 `json:"ts"`
+}
+
+func (ev *LiveEvent) setPayload(b []byte) {
+    if json.Valid(b) {
+        ev.Payload = b
+    } else {
+        ev.Data = b
+    }
+}
+
+type liveMessage struct {
+    typ  string
+    data []byte
+}
+
+func newLiveMessage(ev *LiveEvent) liveMessage {
+    data, err := json.Marshal(ev)
+    if err != nil {
+        log.Errorf("encode live %s event err, %v", ev.Type, err)
+    }
+    return liveMessage{typ: ev.Type, data: data}
+}
+
+// liveFilter selects the events of a connection by device id or pattern,
+// and by type.
+type liveFilter struct {
+    devices  map[string]struct{}
+    patterns []string
+    // nil selects every type
+    types map[string]bool
+}
+
+func newLiveFilter() *liveFilter {
+    return &liveFilter{devices: make(map[string]struct{})}
+}
+
+// liveFilterOf returns the filter of the devices and types query
+// parameters, comma separated or repeated.
+func liveFilterOf(req *go_restful.Request) (*liveFilter, error) {
+    f := newLiveFilter()
+    if err := f.add(queryList(req, "devices")); err != nil {
+        return nil, err
+    }
+    for _, typ := range queryList(req, "types") {
+        if typ != LiveUplink && typ != LiveDownlink && typ != LivePresence {
+            return nil, errors.Errorf("invalid type %q", typ)
+        }
+        if f.types == nil {
+            f.types = make(map[string]bool)
+        }
+        f.types[typ] = true
+    }
+    return f, nil
+}
+
+func queryList(req *go_restful.Request, name string) []string {
+    var items []string
+    for _, v := range req.Request.URL.Query()[name] {
+        for _, item := range strings.Split(v, ",") {
+            if item = strings.TrimSpace(item); item != "" {
+                items = append(items, item)
+            }
+        }
+    }
+    return items
+}
+
+// add subscribes to ids, an id with a wildcard, * ? or [, is a pattern of
+// device ids, see path.Match.
+func (f *liveFilter) add(ids []string) error {
+    for _, id := range ids {
+        if _, err := path.Match(id, ""); err != nil || id == "" {
+            return errors.Errorf("invalid device or pattern %q", id)
+        }
+    }
+    if len(f.devices)+len(f.patterns)+len(ids) > maxLiveSubscriptions {
+        return errors.Errorf("more than %d devices and patterns", maxLiveSubscriptions)
+    }
+    for _, id := range ids {
+        if !strings.ContainsAny(id, "*?[") {
+            f.devices[id] = struct{}{}
+        } else if !contains(f.patterns, id) {
+            f.patterns = append(f.patterns, id)
+        }
+    }
+    return nil
+}
+
+func (f *liveFilter) remove(ids []string) {
+    for _, id := range ids {
+        delete(f.devices, id)
+        for i, p := range f.patterns {
+            if p == id {
+                f.patterns = append(f.patterns[:i], f.patterns[i+1:]...)
+                break
+            }
+        }
+    }
+}
+
+func (f *liveFilter) empty() bool {
+    return len(f.devices) == 0 && len(f.patterns) == 0
+}
+
+func (f *liveFilter) list() []string {
+    items := make([]string, 0, len(f.devices)+len(f.patterns))
+    for id := range f.devices {
+        items = append(items, id)
+    }
+    items = append(items, f.patterns...)
+    sort.Strings(items)
+    return items
+}
+
+func (f *liveFilter) match(ev *LiveEvent) bool {
+    if f.types != nil && !f.types[ev.Type] {
+        return false
+    }
+    if _, ok := f.devices[ev.DeviceID]; ok {
+        return true
+    }
+    for _, p := range f.patterns {
+        if ok, _ := path.Match(p, ev.DeviceID); ok {
+            return true
+        }
+    }
+    return false
+}
+
+func contains(items []string, v string) bool {
+    for _, item := range items {
+        if item == v {
+            return true
+        }
+    }
+    return false
+}
+
+// liveSubscriber is a live connection, tenantId is empty for the system
+// tenant.
+type liveSubscriber struct {
+    tenantId  string
+    transport string
+    events    chan liveMessage
+    // events dropped since the last dropped event
+    dropped uint64
+
+    lock   sync.RWMutex
+    filter *liveFilter
+}
+
+func (sub *liveSubscriber) match(ev *LiveEvent) bool {
+    if sub.tenantId != "" && ev.TenantID != sub.tenantId {
+        return false
+    }
+    sub.lock.RLock()
+    defer sub.lock.RUnlock()
+    return sub.filter.match(ev)
+}
+
+// update applies a websocket request and returns the subscriptions.
+func (sub *liveSubscriber) update(subscribe, unsubscribe []string) (liveMessage, error) {
+    sub.lock.Lock()
+    defer sub.lock.Unlock()
+    sub.filter.remove(unsubscribe)
+    err := sub.filter.add(subscribe)
+    ev := &LiveEvent{Type: liveSubscriptions, Devices: sub.filter.list(), Ts: time.Now().UnixMilli()}
+    if err != nil {
+        ev.Error = err.Error()
+    }
+    return newLiveMessage(ev), err
+}
+
+// droppedMessage returns the dropped event if events were dropped since
+// the last one.
+func (sub *liveSubscriber) droppedMessage() (liveMessage, bool) {
+    n := atomic.SwapUint64(&sub.dropped, 0)
+    if n == 0 {
+        return liveMessage{}, false
+    }
+    return newLiveMessage(&LiveEvent{Type: liveDropped, Dropped: n, Ts: time.Now().UnixMilli()}), true
+}
+
+// LiveHub fans the events of devices out to the live connections.
+type LiveHub struct {
+    conf LiveConfig
+    // number of connections, publishing is free without any
+    active int32
+
+    lock    sync.RWMutex
+    subs    map[*liveSubscriber]struct{}
+    tenants map[string]int
+}
+
+func NewLiveHub(conf LiveConfig) *LiveHub {
+    if conf.Buffer <= 0 {
+        conf.Buffer = defaultLiveBuffer
+    }
+    if conf.Heartbeat <= 0 {
+        conf.Heartbeat = defaultLiveHeartbeat
+    }
+    return &LiveHub{
+        conf:    conf,
+        subs:    make(map[*liveSubscriber]struct{}),
+        tenants: make(map[string]int),
+    }
+}
+
+func (h *LiveHub) subscribe(tenantId, transport string, filter *liveFilter) (*liveSubscriber, error) {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+    if h.conf.MaxConnections > 0 && h.tenants[tenantId] >= h.conf.MaxConnections {
+        return nil, errLiveConnections
+    }
+    sub := &liveSubscriber{
+        tenantId:  tenantId,
+        transport: transport,
+        events:    make(chan liveMessage, h.conf.Buffer),
+        filter:    filter,
+    }
+    h.subs[sub] = struct{}{}
+    h.tenants[tenantId]++
+    atomic.AddInt32(&h.active, 1)
+    metrics.LiveConnections.WithLabelValues(transport).Inc()
+    return sub, nil
+}
+
+func (h *LiveHub) unsubscribe(sub *liveSubscriber) {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+    if _, ok := h.subs[sub]; !ok {
+        return
+    }
+    delete(h.subs, sub)
+    if h.tenants[sub.tenantId]--; h.tenants[sub.tenantId] <= 0 {
+        delete(h.tenants, sub.tenantId)
+    }
+    atomic.AddInt32(&h.active, -1)
+    metrics.LiveConnections.WithLabelValues(sub.transport).Dec()
+}
+
+func (h *LiveHub) idle() bool {
+    return atomic.LoadInt32(&h.active) == 0
+}
+
+// publish queues ev to the connections selecting it, without blocking.
+func (h *LiveHub) publish(ev *LiveEvent) {
+    var msg liveMessage
+    h.lock.RLock()
+    defer h.lock.RUnlock()
+    for sub := range h.subs {
+        if !sub.match(ev) {
+            continue
+        }
+        // encoded once for every connection
+        if msg.data == nil {
+            if msg = newLiveMessage(ev); msg.data == nil {
+                return
+            }
+        }
+        select {
+        case sub.events <- msg:
+        default:
+            atomic.AddUint64(&sub.dropped, 1)
+            metrics.LiveDropped.WithLabelValues(sub.transport).Inc()
+        }
+    }
+}
+
+// uplink publishes a message of the device of rec to topic.
+func (h *LiveHub) uplink(rec *DeviceRecord, topic string, payload []byte) {
+    if h.idle() {
+        return
+    }
+    ev := &LiveEvent{
+        Type:     LiveUplink,
+        DeviceID: rec.DeviceID,
+        TenantID: rec.TenantID,
+        Protocol: rec.Protocol,
+        Topic:    topic,
+        Ts:       time.Now().UnixMilli(),
+    }
+    ev.setPayload(payload)
+    h.publish(ev)
+}
+
+// downlink publishes the value sent to devId on topic, rec is nil for an
+// unknown device.
+func (h *LiveHub) downlink(rec *DeviceRecord, devId, topic string, value interface{}) {
+    if h.idle() {
+        return
+    }
+    payload, err := json.Marshal(value)
+    if err != nil {
+        return
+    }
+    ev := &LiveEvent{Type: LiveDownlink, DeviceID: devId, Topic: topic, Payload: payload, Ts: time.Now().UnixMilli()}
+    if rec != nil {
+        ev.TenantID, ev.Protocol = rec.TenantID, rec.Protocol
+    }
+    h.publish(ev)
+}
+
+// presence publishes the device of rec going online or offline.
+func (h *LiveHub) presence(rec *DeviceRecord, online bool) {
+    if h.idle() {
+        return
+    }
+    h.publish(&LiveEvent{
+        Type:     LivePresence,
+        DeviceID: rec.DeviceID,
+        TenantID: rec.TenantID,
+        Protocol: rec.Protocol,
+        Online:   &online,
+        Ts:       time.Now().UnixMilli(),
+    })
+}
+
+// LiveService serves the live data api, /v1/live/ws and /v1/live/events.
+type LiveService struct {
+    ctx      context.Context
+    cancel   context.CancelFunc
+    hub      *LiveHub
+    upgrader websocket.Upgrader
+}
+
+func NewLiveService(ctx context.Context, hookSvc *HookService) *LiveService {
+    ctx, cancel := context.WithCancel(ctx)
+    return &LiveService{
+        ctx:    ctx,
+        cancel: cancel,
+        hub:    hookSvc.live,
+        upgrader: websocket.Upgrader{
+            // users are authenticated by the keel header of the gateway,
+            // not by cookies
+            CheckOrigin: func(*http.Request) bool { return true },
+        },
+    }
+}
+
+// Close ends the live connections.
+func (s *LiveService) Close() {
+    s.cancel()
+}
+
+// liveTenant returns the tenant of the user of req, empty for the system
+// tenant, false if the request has no tenant user.
+func liveTenant(req *go_restful.Request) (string, bool) {
+    tenantId := tenantFromAuthHeader(req.Request.Header)
+    if tenantId == "" {
+        return "", false
+    }
+    if tenantId == defaultTenant {
+        return "", true
+    }
+    return tenantId, true
+}
+
+// open subscribes the connection of req, or writes the error. The devices
+// of a sse stream cannot change, it needs at least one.
+func (s *LiveService) open(req *go_restful.Request, resp *go_restful.Response, transport string) *liveSubscriber {
+    tenantId, ok := liveTenant(req)
+    if !ok {
+        resp.WriteErrorString(http.StatusUnauthorized, "no tenant user")
+        return nil
+    }
+    filter, err := liveFilterOf(req)
+    if err != nil {
+        resp.WriteErrorString(http.StatusBadRequest, err.Error())
+        return nil
+    }
+    if transport == liveTransportSSE && filter.empty() {
+        resp.WriteErrorString(http.StatusBadRequest, "no devices")
+        return nil
+    }
+    sub, err := s.hub.subscribe(tenantId, transport, filter)
+    if err != nil {
+        resp.WriteErrorString(http.StatusTooManyRequests, err.Error())
+        return nil
+    }
+    return sub
+}
+
+type liveRequest struct {
+    Subscribe   []string `json:"subscribe"`
+    Unsubscribe []string `json:"unsubscribe"`
+}
+
+// WebSocket handles GET /v1/live/ws?devices=&types=, every event is a text
+// message. The client changes its devices with
+// {"subscribe": [...], "unsubscribe": [...]}, answered with the
+// subscriptions of the connection.
+func (s *LiveService) WebSocket(req *go_restful.Request, resp *go_restful.Response) {
+    sub := s.open(req, resp, liveTransportWebSocket)
+    if sub == nil {
+        return
+    }
+    defer s.hub.unsubscribe(sub)
+    // the upgrader writes the http error
+    conn, err := s.upgrader.Upgrade(resp.ResponseWriter, req.Request, nil)
+    if err != nil {
+        log.Debugf("upgrade live websocket err, %v", err)
+        return
+    }
+    defer conn.Close()
+
+    replies := make(chan liveMessage, 1)
+    done := make(chan struct{})
+    go s.readWebSocket(conn, sub, replies, done)
+    write := func(msg liveMessage) error {
+        if err := conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout)); err != nil {
+            return err
+        }
+        return conn.WriteMessage(websocket.TextMessage, msg.data)
+    }
+    ping := time.NewTicker(s.hub.conf.Heartbeat)
+    defer ping.Stop()
+    for {
+        var err error
+        select {
+        case <-s.ctx.Done():
+            conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), time.Now().Add(liveWriteTimeout)) //nolint
+            return
+        case <-done:
+            return
+        case <-ping.C:
+            err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteTimeout))
+        case msg := <-replies:
+            err = write(msg)
+        case msg := <-sub.events:
+            if err = write(msg); err == nil {
+                if msg, ok := sub.droppedMessage(); ok {
+                    err = write(msg)
+                }
+            }
+        }
+        if err != nil {
+            log.Debugf("write live websocket err, %v", err)
+            return
+        }
+    }
+}
+
+// readWebSocket applies the requests of the client until the connection
+// fails or misses two heartbeats.
+func (s *LiveService) readWebSocket(conn *websocket.Conn, sub *liveSubscriber, replies chan<- liveMessage, done chan<- struct{}) {
+    defer close(done)
+    timeout := 2 * s.hub.conf.Heartbeat
+    conn.SetReadLimit(liveMaxRequestSize)
+    conn.SetReadDeadline(time.Now().Add(timeout)) //nolint
+    conn.SetPongHandler(func(string) error { return conn.SetReadDeadline(time.Now().Add(timeout)) })
+    for {
+        _, b, err := conn.ReadMessage()
+        if err != nil {
+            return
+        }
+        conn.SetReadDeadline(time.Now().Add(timeout)) //nolint
+        var r liveRequest
+        var reply liveMessage
+        if err := json.Unmarshal(b, &r); err != nil {
+            reply = newLiveMessage(&LiveEvent{Type: liveSubscriptions, Error: "invalid request", Ts: time.Now().UnixMilli()})
+        } else {
+            reply, _ = sub.update(r.Subscribe, r.Unsubscribe)
+        }
+        select {
+        case replies <- reply:
+        case <-s.ctx.Done():
+            return
+        }
+    }
+}
+
+// Events handles GET /v1/live/events?devices=&types=, a server-sent events
+// stream named by event type.
+func (s *LiveService) Events(req *go_restful.Request, resp *go_restful.Response) {
+    flusher, ok := resp.ResponseWriter.(http.Flusher)
+    if !ok {
+        resp.WriteErrorString(http.StatusInternalServerError, "streaming unsupported")
+        return
+    }
+    sub := s.open(req, resp, liveTransportSSE)
+    if sub == nil {
+        return
+    }
+    defer s.hub.unsubscribe(sub)
+    header := resp.Header()
+    header.Set(go_restful.HEADER_ContentType, "text/event-stream")
+    header.Set("Cache-Control", "no-cache")
+    // no buffering by nginx ingresses
+    header.Set("X-Accel-Buffering", "no")
+    resp.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    write := func(msg liveMessage) error {
+        _, err := fmt.Fprintf(resp, "event: %s\ndata: %s\n\n", msg.typ, msg.data)
+        return err
+    }
+    heartbeat := time.NewTicker(s.hub.conf.Heartbeat)
+    defer heartbeat.Stop()
+    for {
+        var err error
+        select {
+        case <-s.ctx.Done():
+            return
+        case <-req.Request.Context().Done():
+            return
+        case <-heartbeat.C:
+            _, err = io.WriteString(resp, ": heartbeat\n\n")
+        case msg := <-sub.events:
+            if err = write(msg); err == nil {
+                if msg, ok := sub.droppedMessage(); ok {
+                    err = write(msg)
+                }
+            }
+        }
+        if err != nil {
+            log.Debugf("write live events err, %v", err)
+            return
+        }
+        flusher.Flush()
+    }
+}
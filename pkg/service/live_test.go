@@ -0,0 +1,206 @@
+package service_test
+
+import (
+    "bufio"
+    "context"
+    "encoding/base64"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "github.com/tidwall/gjson"
+    "github.com/tkeel-io/iothub/pkg/exhooktest"
+)
+
+const systemTenant = "_tKeel_system"
+
+// liveHeader is the keel auth header of a user of tenantId, set by the gateway.
+func liveHeader(tenantId string) http.Header {
+    header := make(http.Header)
+    if tenantId != "" {
+        header.Set("x-tKeel-auth", base64.StdEncoding.EncodeToString([]byte("tenant="+tenantId+"&user=u1&role=admin")))
+    }
+    return header
+}
+
+func dialLive(t *testing.T, h *exhooktest.Harness, tenantId, query string) (*websocket.Conn, int) {
+    t.Helper()
+    url := "ws" + strings.TrimPrefix(h.HTTP.URL, "http") + "/v1/live/ws?" + query
+    conn, resp, err := websocket.DefaultDialer.Dial(url, liveHeader(tenantId))
+    if err != nil {
+        if resp == nil {
+            t.Fatal(err)
+        }
+        return nil, resp.StatusCode
+    }
+    t.Cleanup(func() { conn.Close() })
+    return conn, resp.StatusCode
+}
+
+func readLive(t *testing.T, conn *websocket.Conn) gjson.Result {
+    t.Helper()
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    _, b, err := conn.ReadMessage()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return gjson.ParseBytes(b)
+}
+
+func liveSummary(ev gjson.Result) string {
+    return ev.Get("type").String() + " " + ev.Get("device_id").String()
+}
+
+func TestLive_WebSocket(t *testing.T) {
+    h := exhooktest.New(t)
+    ctx := context.Background()
+    h.Keel.AddToken("token1", "dev1", "u1", "t1")
+    h.Keel.AddToken("token2", "dev2", "u2", "t2")
+
+    if _, status := dialLive(t, h, "", "devices=dev1"); status != http.StatusUnauthorized {
+        t.Fatalf("no tenant user %d", status)
+    }
+    if _, status := dialLive(t, h, "t1", "devices=dev1&types=attributes"); status != http.StatusBadRequest {
+        t.Fatalf("invalid type %d", status)
+    }
+    tenant, _ := dialLive(t, h, "t1", "devices=dev*")
+    admin, _ := dialLive(t, h, systemTenant, "devices=dev2&types=uplink")
+
+    d1 := h.Device("dev1", "token1")
+    d2 := h.Device("dev2", "token2")
+    for _, d := range []*exhooktest.Device{d1, d2} {
+        if ok, err := d.Connect(ctx); !ok || err != nil {
+            t.Fatalf("connect %s, %v", d.Info.Username, err)
+        }
+    }
+    if ok, err := d1.Publish(ctx, "v1/devices/me/telemetry", []byte(`{"temp":21}`)); !ok || err != nil {
+        t.Fatalf("publish, %v", err)
+    }
+    if ok, err := d2.Publish(ctx, "v1/devices/me/raw", []byte{0xca, 0xfe}); !ok || err != nil {
+        t.Fatalf("publish, %v", err)
+    }
+    event := map[string]interface{}{
+        "id":         "dev1",
+        "owner":      "u1",
+        "properties": map[string]interface{}{"attributes": map[string]interface{}{"interval": 5}},
+    }
+    if _, err := h.CoreEvent(ctx, exhooktest.CoreTopic, event); err != nil {
+        t.Fatal(err)
+    }
+    if err := d1.Disconnect(ctx); err != nil {
+        t.Fatal(err)
+    }
+
+    // dev2 is of another tenant
+    var got []string
+    events := make([]gjson.Result, 0, 4)
+    for i := 0; i < 4; i++ {
+        ev := readLive(t, tenant)
+        got = append(got, liveSummary(ev))
+        events = append(events, ev)
+    }
+    if strings.Join(got, ", ") != "presence dev1, uplink dev1, downlink dev1, presence dev1" {
+        t.Fatalf("tenant events %v", got)
+    }
+    if events[0].Get("online").Bool() != true || events[3].Get("online").Bool() != false || events[3].Get("tenant_id").String() != "t1" {
+        t.Fatalf("presence %s %s", events[0].Raw, events[3].Raw)
+    }
+    if events[1].Get("topic").String() != "v1/devices/me/telemetry" || events[1].Get("payload").Raw != `{"temp":21}` {
+        t.Fatalf("uplink %s", events[1].Raw)
+    }
+    if events[2].Get("topic").String() != "v1/devices/me/attributes" || events[2].Get("payload").Raw != `{"interval":5}` {
+        t.Fatalf("downlink %s", events[2].Raw)
+    }
+    // binary payloads in base64
+    if ev := readLive(t, admin); liveSummary(ev) != "uplink dev2" || ev.Get("tenant_id").String() != "t2" || ev.Get("data").String() != "yv4=" {
+        t.Fatalf("admin event %s", ev.Raw)
+    }
+
+    // subscriptions change over the connection
+    if err := tenant.WriteJSON(map[string]interface{}{"subscribe": []string{"[dev"}}); err != nil {
+        t.Fatal(err)
+    }
+    if ev := readLive(t, tenant); ev.Get("type").String() != "subscriptions" || ev.Get("error").String() == "" {
+        t.Fatalf("invalid pattern %s", ev.Raw)
+    }
+    if err := tenant.WriteJSON(map[string]interface{}{"subscribe": []string{"meter1", "dev1"}, "unsubscribe": []string{"dev*"}}); err != nil {
+        t.Fatal(err)
+    }
+    if ev := readLive(t, tenant); ev.Get("devices").Raw != `["dev1","meter1"]` {
+        t.Fatalf("subscriptions %s", ev.Raw)
+    }
+}
+
+func TestLive_Events(t *testing.T) {
+    h := exhooktest.New(t)
+    ctx := context.Background()
+    h.Keel.AddToken("token1", "dev1", "u1", "t1")
+
+    get := func(tenantId, query string) *http.Response {
+        req, err := http.NewRequest(http.MethodGet, h.HTTP.URL+"/v1/live/events?"+query, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        req.Header = liveHeader(tenantId)
+        req.Header.Set("Accept", "text/event-stream")
+        req.Header.Set("Accept-Encoding", "gzip")
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return resp
+    }
+    for _, tt := range []struct {
+        tenantId, query string
+        status          int
+    }{
+        {"", "devices=dev1", http.StatusUnauthorized},
+        {"t1", "", http.StatusBadRequest},
+        {"t1", "devices=[dev", http.StatusBadRequest},
+    } {
+        resp := get(tt.tenantId, tt.query)
+        resp.Body.Close()
+        if resp.StatusCode != tt.status {
+            t.Fatalf("%q %q: %d", tt.tenantId, tt.query, resp.StatusCode)
+        }
+    }
+
+    resp := get("t1", "devices=dev1&types=uplink")
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+        t.Fatalf("stream %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+    }
+    d := h.Device("dev1", "token1")
+    if ok, err := d.Connect(ctx); !ok || err != nil {
+        t.Fatalf("connect, %v", err)
+    }
+    if ok, err := d.Publish(ctx, "v1/devices/me/attributes", []byte(`{"fw":"1.0"}`)); !ok || err != nil {
+        t.Fatalf("publish, %v", err)
+    }
+
+    lines := make(chan string)
+    go func() {
+        defer close(lines)
+        scanner := bufio.NewScanner(resp.Body)
+        for scanner.Scan() {
+            lines <- scanner.Text()
+        }
+    }()
+    var got []string
+    for len(got) < 2 {
+        select {
+        case line := <-lines:
+            if line != "" {
+                got = append(got, line)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatalf("events %v", got)
+        }
+    }
+    data := gjson.Parse(strings.TrimPrefix(got[1], "data: "))
+    if got[0] != "event: uplink" || data.Get("device_id").String() != "dev1" || data.Get("payload.fw").String() != "1.0" {
+        t.Fatalf("events %v", got)
+    }
+}
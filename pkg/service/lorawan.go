@@ -0,0 +1,511 @@
+package service
+
+import (
+    "context"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    go_restful "github.com/emicklei/go-restful"
+    "github.com/pkg/errors"
+    "github.com/tkeel-io/iothub/pkg/lorawan"
+    "github.com/tkeel-io/iothub/pkg/store"
+    "github.com/tkeel-io/iothub/pkg/tracing"
+    pb "github.com/tkeel-io/iothub/protobuf"
+    "github.com/tkeel-io/kit/log"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// LoRaWAN devices are reached through their network server, ChirpStack or
+// The Things Stack, which posts the uplinks, joins and status of devices
+// to the webhooks of iothub. A DevEUI maps to the entity of the token in
+// the device tags, or bound once with the entity token. FRMPayloads not
+// decoded by the network server go through the codec, or are forwarded
+// raw. Core commands and attributes are queued as downlinks with the
+// network server api, there is no command response.
+
+const (
+    ProtocolLoRaWAN = "lorawan"
+
+    // entity of a DevEUI, lorawan_eui_<devEui>
+    lorawanEUIPrefixKey = `lorawan_eui_`
+    // network server ids of an entity, lorawan_dev_<devId>
+    lorawanDevicePrefixKey = `lorawan_dev_`
+
+    // telemetry key of the radio metadata of an uplink
+    lorawanMetadataKey = "lorawan"
+
+    defaultLoRaWANTokenTag    = "tkeel_token"
+    defaultLoRaWANFPort       = 10
+    defaultLoRaWANIdleTimeout = 2 * time.Hour
+    lorawanMaxBodySize        = 256 << 10
+)
+
+// LoRaWANConfig configures the network server webhooks and apis.
+type LoRaWANConfig struct {
+    // WebhookToken authenticates the network servers, as bearer token or
+    // ?token=.
+    WebhookToken string
+    // TokenTag is the device tag holding the entity token, ChirpStack only.
+    TokenTag string
+    // Codec decodes the payloads not decoded by the network server, see
+    // lorawan.NewCodec.
+    Codec string
+    // FPort is the port of downlinks not setting one.
+    FPort uint8
+    // IdleTimeout marks a device offline after no uplink for this long.
+    IdleTimeout time.Duration
+    // TokenCacheTTL keeps a parsed token for this long, 0 asks keel every webhook.
+    TokenCacheTTL time.Duration
+    // ChirpStack and TTS are the apis queueing downlinks, a network
+    // without APIURL receives none.
+    ChirpStack lorawan.NetworkConfig
+    TTS        lorawan.NetworkConfig
+}
+
+// lorawanMapper decodes the uplinks and queues the downlinks of LoRaWAN
+// devices.
+type lorawanMapper struct {
+    conf     LoRaWANConfig
+    networks map[string]lorawan.Network
+    // replaced on reload
+    codecLock sync.RWMutex
+    codec     lorawan.Codec
+}
+
+func newLoRaWANMapper(conf LoRaWANConfig) *lorawanMapper {
+    if conf.TokenTag == "" {
+        conf.TokenTag = defaultLoRaWANTokenTag
+    }
+    if conf.FPort == 0 {
+        conf.FPort = defaultLoRaWANFPort
+    }
+    m := &lorawanMapper{conf: conf, networks: make(map[string]lorawan.Network)}
+    m.setCodec(conf.Codec)
+    client := &http.Client{Timeout: 10 * time.Second}
+    if conf.ChirpStack.APIURL != "" {
+        m.networks[lorawan.ChirpStack] = lorawan.NewChirpStackNetwork(conf.ChirpStack, client)
+    }
+    if conf.TTS.APIURL != "" {
+        m.networks[lorawan.TTS] = lorawan.NewTTSNetwork(conf.TTS, client)
+    }
+    return m
+}
+
+// setCodec replaces the codec decoding the payloads of the following
+// uplinks, an invalid one keeps the current codec.
+func (m *lorawanMapper) setCodec(name string) {
+    codec, err := lorawan.NewCodec(name)
+    if err != nil {
+        log.Errorf("lorawan codec err, %v", err)
+        return
+    }
+    m.codecLock.Lock()
+    m.codec = codec
+    m.codecLock.Unlock()
+}
+
+func (m *lorawanMapper) decoder() lorawan.Codec {
+    m.codecLock.RLock()
+    defer m.codecLock.RUnlock()
+    return m.codec
+}
+
+// lorawanDevice is an entity and its ids at the network server.
+type lorawanDevice struct {
+    Entity string `json:"entity"`
+    lorawan.Device
+}
+
+func (s *HookService) loadLoRaWANDevice(ctx context.Context, key string) (*lorawanDevice, error) {
+    item, err := s.store.Get(ctx, key)
+    if err != nil || len(item.Value) == 0 {
+        return nil, err
+    }
+    var d lorawanDevice
+    if err := json.Unmarshal(item.Value, &d); err != nil {
+        return nil, err
+    }
+    return &d, nil
+}
+
+// bindLoRaWAN maps the DevEUI of dev to entity, it saves nothing unchanged.
+func (s *HookService) bindLoRaWAN(ctx context.Context, entity string, dev lorawan.Device) error {
+    d := &lorawanDevice{Entity: entity, Device: dev}
+    prev, err := s.loadLoRaWANDevice(ctx, lorawanDevicePrefixKey+entity)
+    if err != nil {
+        return err
+    }
+    if prev != nil && *prev == *d {
+        return nil
+    }
+    b, err := json.Marshal(d)
+    if err != nil {
+        return err
+    }
+    if err := s.store.Save(ctx, &store.Item{Key: lorawanEUIPrefixKey + dev.DevEUI, Value: b}); err != nil {
+        return err
+    }
+    return s.store.Save(ctx, &store.Item{Key: lorawanDevicePrefixKey + entity, Value: b})
+}
+
+// lorawanUplink sends an event of the device of rec to core.
+func (s *HookService) lorawanUplink(ctx context.Context, rec *DeviceRecord, e *lorawan.Event) error {
+    msg := &pb.Message{
+        Id:        e.ID,
+        Qos:       1,
+        From:      e.Device.DevEUI,
+        Timestamp: uint64(time.Now().UnixMilli()),
+    }
+    if !e.Time.IsZero() {
+        msg.Timestamp = uint64(e.Time.UnixMilli())
+    }
+    switch e.Type {
+    case lorawan.Join:
+        return s.lorawanSend(ctx, rec, msg, AttributesTopic, map[string]interface{}{
+            "dev_eui":  e.Device.DevEUI,
+            "dev_addr": e.DevAddr,
+        })
+    case lorawan.Status:
+        status := map[string]interface{}{
+            "margin":                e.Margin,
+            "external_power_source": e.ExternalPower,
+        }
+        if e.BatteryLevel != nil {
+            status["battery_level"] = *e.BatteryLevel
+        }
+        return s.lorawanSend(ctx, rec, msg, AttributesTopic, status)
+    }
+
+    values := e.Object
+    if codec := s.lorawan.decoder(); values == nil && codec != nil && len(e.Payload) > 0 {
+        var err error
+        if values, err = codec.Decode(e.FPort, e.Payload); err != nil {
+            log.Warnf("decode lorawan payload of %s, %v", rec.DeviceID, err)
+        }
+    }
+    if values == nil {
+        values = make(map[string]interface{})
+        // undecoded, for the scripts of core
+        if len(e.Payload) > 0 {
+            raw := &pb.Message{
+                Id:        msg.Id,
+                Qos:       msg.Qos,
+                From:      msg.From,
+                Topic:     buildTopic(rec.DeviceID, RawDataTopic),
+                Payload:   e.Payload,
+                Timestamp: msg.Timestamp,
+            }
+            if err := s.uplink(ctx, rec, raw); err != nil {
+                return err
+            }
+            if msg.Id != "" {
+                msg.Id += "/metadata"
+            }
+        }
+    }
+    values[lorawanMetadataKey] = e.Metadata()
+    return s.lorawanSend(ctx, rec, msg, TelemetryTopic, values)
+}
+
+func (s *HookService) lorawanSend(ctx context.Context, rec *DeviceRecord, msg *pb.Message, topic string, values map[string]interface{}) error {
+    payload, err := json.Marshal(values)
+    if err != nil {
+        return err
+    }
+    msg.Topic, msg.Payload = buildTopic(rec.DeviceID, topic), payload
+    return s.uplink(ctx, rec, msg)
+}
+
+// lorawanDownlink queues the commands and attributes of dl for the device
+// of rec at its network server. The input of a command with data, base64,
+// or hex is sent as is, with its f_port and confirmed, any other command
+// or attribute is encoded by the codec of the network server.
+func (s *HookService) lorawanDownlink(ctx context.Context, rec *DeviceRecord, dl downlink) error {
+    d, err := s.loadLoRaWANDevice(ctx, lorawanDevicePrefixKey+rec.DeviceID)
+    if err != nil {
+        return err
+    }
+    if d == nil {
+        return errors.Errorf("lorawan device %s has no DevEUI", rec.DeviceID)
+    }
+    network, ok := s.lorawan.networks[d.Network]
+    if !ok {
+        return errors.Errorf("no api of network server %s", d.Network)
+    }
+
+    var downlinks []lorawan.Downlink
+    switch {
+    case dl.Topic == CommandTopic:
+        commands, _ := dl.Value.(map[string]interface{})
+        for name, v := range commands {
+            invocation, _ := v.(map[string]interface{})
+            downlinks = append(downlinks, s.lorawanCommand(name, invocation["input"]))
+        }
+    case strings.HasPrefix(dl.Topic, CommandTopic+"/"):
+        invocation, _ := dl.Value.(map[string]interface{})
+        downlinks = append(downlinks, s.lorawanCommand(strings.TrimPrefix(dl.Topic, CommandTopic+"/"), invocation["input"]))
+    case dl.Topic == AttributesTopic:
+        attributes, _ := dl.Value.(map[string]interface{})
+        downlinks = append(downlinks, lorawan.Downlink{FPort: s.lorawan.conf.FPort, Object: attributes})
+    case strings.HasPrefix(dl.Topic, AttributesTopic+"/"):
+        key := strings.TrimPrefix(dl.Topic, AttributesTopic+"/")
+        downlinks = append(downlinks, lorawan.Downlink{FPort: s.lorawan.conf.FPort, Object: map[string]interface{}{key: dl.Value}})
+    default:
+        log.Warnf("drop %s of lorawan %s", dl.Topic, rec.DeviceID)
+        return nil
+    }
+    for _, down := range downlinks {
+        if err := network.Push(ctx, d.Device, down); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *HookService) lorawanCommand(name string, input interface{}) lorawan.Downlink {
+    down := lorawan.Downlink{FPort: s.lorawan.conf.FPort}
+    in, _ := input.(map[string]interface{})
+    if port, ok := in["f_port"].(float64); ok && port > 0 && port < 224 {
+        down.FPort = uint8(port)
+    }
+    down.Confirmed, _ = in["confirmed"].(bool)
+    if data, ok := in["data"].(string); ok {
+        if b, err := base64.StdEncoding.DecodeString(data); err == nil {
+            down.Data = b
+            return down
+        }
+    }
+    if data, ok := in["hex"].(string); ok {
+        if b, err := hex.DecodeString(data); err == nil {
+            down.Data = b
+            return down
+        }
+    }
+    down.Object = map[string]interface{}{name: input}
+    return down
+}
+
+// LoRaWANService serves the webhooks of the network servers.
+type LoRaWANService struct {
+    ctx     context.Context
+    cancel  context.CancelFunc
+    hookSvc *HookService
+    conf    LoRaWANConfig
+    tokens  *tokenCache
+}
+
+func NewLoRaWANService(ctx context.Context, hookSvc *HookService) *LoRaWANService {
+    conf := hookSvc.lorawan.conf
+    if conf.IdleTimeout <= 0 {
+        conf.IdleTimeout = defaultLoRaWANIdleTimeout
+    }
+    ctx, cancel := context.WithCancel(ctx)
+    return &LoRaWANService{
+        ctx:     ctx,
+        cancel:  cancel,
+        hookSvc: hookSvc,
+        conf:    conf,
+        tokens:  newTokenCache(conf.TokenCacheTTL),
+    }
+}
+
+// Close rejects the following webhooks.
+func (s *LoRaWANService) Close() {
+    s.cancel()
+}
+
+// Run marks the devices without uplink for longer than the idle timeout
+// offline, until ctx is done.
+func (s *LoRaWANService) Run(ctx context.Context) {
+    ticker := time.NewTicker(s.conf.IdleTimeout / 4)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            if n := s.hookSvc.expireIdle(ctx, ProtocolLoRaWAN, s.conf.IdleTimeout, nil); n > 0 {
+                log.Infof("marked %d idle lorawan devices offline", n)
+            }
+            s.tokens.expire()
+        }
+    }
+}
+
+// authorized checks the webhook token of req, it writes the error response
+// if not.
+func (s *LoRaWANService) authorized(req *go_restful.Request, resp *go_restful.Response) bool {
+    if s.ctx.Err() != nil {
+        resp.WriteErrorString(http.StatusServiceUnavailable, "server is shutting down")
+        return false
+    }
+    token := strings.TrimPrefix(req.HeaderParameter("Authorization"), "Bearer ")
+    if token == "" {
+        token = req.QueryParameter("token")
+    }
+    if s.conf.WebhookToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.WebhookToken)) != 1 {
+        resp.WriteErrorString(http.StatusUnauthorized, "invalid webhook token")
+        return false
+    }
+    return true
+}
+
+func (s *LoRaWANService) body(req *go_restful.Request, resp *go_restful.Response) []byte {
+    body, err := ioutil.ReadAll(io.LimitReader(req.Request.Body, lorawanMaxBodySize+1))
+    if err != nil {
+        resp.WriteErrorString(http.StatusBadRequest, err.Error())
+        return nil
+    }
+    if len(body) > lorawanMaxBodySize {
+        resp.WriteErrorString(http.StatusRequestEntityTooLarge, "webhook too large")
+        return nil
+    }
+    return body
+}
+
+// entity returns the entity of the device of e, from the token in its tags
+// or its binding. It writes the error response and returns "" if unknown.
+func (s *LoRaWANService) entity(ctx context.Context, e *lorawan.Event, resp *go_restful.Response) string {
+    if token := e.Tags[s.conf.TokenTag]; token != "" {
+        devId, reason := s.hookSvc.authCached(ctx, s.tokens, token)
+        switch {
+        case reason == authReasonStateError:
+            resp.WriteErrorString(http.StatusServiceUnavailable, "save device state failed")
+            return ""
+        case devId == "":
+            resp.WriteErrorString(http.StatusForbidden, "invalid token of "+e.Device.DevEUI)
+            return ""
+        }
+        return devId
+    }
+    d, err := s.hookSvc.loadLoRaWANDevice(ctx, lorawanEUIPrefixKey+e.Device.DevEUI)
+    if err != nil {
+        resp.WriteErrorString(http.StatusServiceUnavailable, err.Error())
+        return ""
+    }
+    if d == nil {
+        resp.WriteErrorString(http.StatusNotFound, "unknown DevEUI "+e.Device.DevEUI)
+        return ""
+    }
+    return d.Entity
+}
+
+func (s *LoRaWANService) handle(req *go_restful.Request, resp *go_restful.Response, name string, parse func(body []byte) (*lorawan.Event, error)) {
+    ctx := tracing.ExtractHTTP(req.Request.Context(), req.Request.Header)
+    ctx, span := tracing.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+    var err error
+    defer func() { tracing.End(span, err) }()
+    if !s.authorized(req, resp) {
+        return
+    }
+    body := s.body(req, resp)
+    if body == nil {
+        return
+    }
+    e, err := parse(body)
+    if errors.Is(err, lorawan.ErrUnsupported) {
+        err = nil
+        resp.WriteHeader(http.StatusNoContent)
+        return
+    }
+    if err != nil {
+        resp.WriteErrorString(http.StatusBadRequest, err.Error())
+        return
+    }
+    devId := s.entity(ctx, e, resp)
+    if devId == "" {
+        return
+    }
+    if err = s.hookSvc.bindLoRaWAN(ctx, devId, e.Device); err != nil {
+        resp.WriteErrorString(http.StatusServiceUnavailable, err.Error())
+        return
+    }
+    // the gateway receiving an uplink best
+    peer, _ := e.Metadata()["gateway_id"].(string)
+    rec, err := s.hookSvc.connectDevice(ctx, devId, ProtocolLoRaWAN, peer)
+    if err != nil {
+        resp.WriteErrorString(http.StatusServiceUnavailable, err.Error())
+        return
+    }
+    // core sends the commands of subscribed devices only
+    if !rec.HasTopic(CommandTopic) {
+        if err = s.hookSvc.subscriptions.Subscribe(ctx, devId, []string{CommandTopic}); err != nil {
+            log.Errorf("subscribe commands of %s err, %v", devId, err)
+        }
+    }
+    if err = s.hookSvc.lorawanUplink(ctx, rec, e); err != nil {
+        log.Errorf("%s of %s err, %v", name, devId, err)
+        resp.WriteErrorString(http.StatusServiceUnavailable, err.Error())
+        return
+    }
+    resp.WriteHeader(http.StatusOK)
+}
+
+// ChirpStackWebhook handles POST /v1/lorawan/chirpstack?event=, the
+// ChirpStack v4 http integration with json encoding.
+func (s *LoRaWANService) ChirpStackWebhook(req *go_restful.Request, resp *go_restful.Response) {
+    event := req.QueryParameter("event")
+    s.handle(req, resp, "lorawan.ChirpStackWebhook", func(body []byte) (*lorawan.Event, error) {
+        return lorawan.ParseChirpStack(event, body)
+    })
+}
+
+// TTSWebhook handles POST /v1/lorawan/tts, the webhooks of The Things Stack.
+func (s *LoRaWANService) TTSWebhook(req *go_restful.Request, resp *go_restful.Response) {
+    s.handle(req, resp, "lorawan.TTSWebhook", lorawan.ParseTTS)
+}
+
+type BindLoRaWANRequest struct {
+    // Token is the entity token of the device.
+    Token   string `json:"token"`
+    Network string `json:"network"`
+    // ApplicationID and DeviceID are the ids of The Things Stack.
+    ApplicationID string `json:"application_id"`
+    DeviceID      string `json:"device_id"`
+}
+
+// BindDevice handles PUT /v1/lorawan/devices/{dev_eui}, it maps a DevEUI
+// without token tag to the entity of the token in the body.
+func (s *LoRaWANService) BindDevice(req *go_restful.Request, resp *go_restful.Response) {
+    ctx := req.Request.Context()
+    if !s.authorized(req, resp) {
+        return
+    }
+    eui, err := lorawan.NormalizeEUI(req.PathParameter("dev_eui"))
+    if err != nil {
+        resp.WriteErrorString(http.StatusBadRequest, err.Error())
+        return
+    }
+    var bind BindLoRaWANRequest
+    if err := req.ReadEntity(&bind); err != nil {
+        resp.WriteErrorString(http.StatusBadRequest, err.Error())
+        return
+    }
+    if bind.Network != lorawan.ChirpStack && bind.Network != lorawan.TTS {
+        resp.WriteErrorString(http.StatusBadRequest, "network is not chirpstack or tts")
+        return
+    }
+    devId, reason := s.hookSvc.authToken(ctx, bind.Token, "")
+    switch {
+    case reason == authReasonStateError:
+        resp.WriteErrorString(http.StatusServiceUnavailable, "save device state failed")
+        return
+    case devId == "":
+        resp.WriteErrorString(http.StatusForbidden, "invalid token")
+        return
+    }
+    dev := lorawan.Device{Network: bind.Network, DevEUI: eui, ApplicationID: bind.ApplicationID, DeviceID: bind.DeviceID}
+    if err := s.hookSvc.bindLoRaWAN(ctx, devId, dev); err != nil {
+        resp.WriteErrorString(http.StatusServiceUnavailable, err.Error())
+        return
+    }
+    resp.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,182 @@
+package service_test
+
+import (
+    "context"
+    "io/ioutil"
+    "net/http"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/tidwall/gjson"
+    "github.com/tkeel-io/iothub/pkg/exhooktest"
+    "github.com/tkeel-io/iothub/pkg/service"
+)
+
+// webhook posts the recorded webhook fixture to path of the LoRaWAN api.
+func webhook(t *testing.T, h *exhooktest.Harness, path, fixture string) (int, string) {
+    t.Helper()
+    b, err := ioutil.ReadFile(filepath.Join("..", "lorawan", "testdata", fixture))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return deviceRequest(t, h, http.MethodPost, path+"token="+exhooktest.WebhookToken, "", string(b))
+}
+
+func TestLoRaWAN_ChirpStack(t *testing.T) {
+    h := exhooktest.New(t, func(c *service.Config) {
+        c.Dedup = service.DedupConfig{TTL: time.Minute}
+        c.LoRaWAN.Codec = "cayennelpp"
+    })
+    ctx := context.Background()
+    h.Keel.AddToken("token1", "dev1", "u1", "t1")
+
+    if status, _ := deviceRequest(t, h, http.MethodPost, "/v1/lorawan/chirpstack?event=up&token=wrong", "", "{}"); status != http.StatusUnauthorized {
+        t.Fatalf("wrong webhook token %d", status)
+    }
+    tests := []struct {
+        path, fixture string
+        status        int
+    }{
+        {"/v1/lorawan/chirpstack?event=join&", "chirpstack_join.json", http.StatusOK},
+        {"/v1/lorawan/chirpstack?event=up&", "chirpstack_up.json", http.StatusOK},
+        // resent by the network server
+        {"/v1/lorawan/chirpstack?event=up&", "chirpstack_up.json", http.StatusOK},
+        {"/v1/lorawan/chirpstack?event=status&", "chirpstack_status.json", http.StatusOK},
+        {"/v1/lorawan/chirpstack?event=txack&", "chirpstack_join.json", http.StatusNoContent},
+    }
+    for _, tt := range tests {
+        if status, body := webhook(t, h, tt.path, tt.fixture); status != tt.status {
+            t.Fatalf("%s %s: %d %s", tt.path, tt.fixture, status, body)
+        }
+    }
+    if got := eventTypes(t, h); got != "connectinfo attributes telemetry attributes" {
+        t.Fatalf("events %s", got)
+    }
+    if got := subscriptionTopics(h); got != "realtime:sub-core" {
+        t.Fatalf("subscriptions %s", got)
+    }
+    rec, err := h.Service.Registry().Get(ctx, "dev1")
+    if err != nil || rec == nil || rec.Protocol != service.ProtocolLoRaWAN || rec.ConnectInfo == nil {
+        t.Fatalf("record %+v, %v", rec, err)
+    }
+
+    events, err := h.Producer.Events()
+    if err != nil {
+        t.Fatal(err)
+    }
+    telemetry := gjson.ParseBytes(events[2].Data())
+    values := gjson.Parse(rawValues(t, telemetry))
+    if values.Get("temperature_1").Float() != 22.5 || values.Get("humidity_2").Float() != 40 ||
+        values.Get("lorawan.rssi").Int() != -36 || values.Get("lorawan.snr").Float() != 10.5 ||
+        values.Get("lorawan.gateway_id").String() != "0016c001f153a14d" || values.Get("lorawan.f_cnt").Int() != 10 {
+        t.Fatalf("telemetry %s", values.Raw)
+    }
+    if status := gjson.Parse(rawValues(t, lastEvent(t, h))); status.Get("battery_level").Float() != 87.5 || status.Get("margin").Int() != 7 {
+        t.Fatalf("status %s", status.Raw)
+    }
+
+    // raw bytes, or encoded by the network server
+    event := map[string]interface{}{
+        "id":    "dev1",
+        "owner": "u1",
+        "properties": map[string]interface{}{
+            "commands": map[string]interface{}{
+                "open":  map[string]interface{}{"id": "c1", "input": map[string]interface{}{"f_port": 2, "hex": "0101", "confirmed": true}},
+                "blink": map[string]interface{}{"id": "c2", "input": 3},
+            },
+        },
+    }
+    if _, err := h.CoreEvent(ctx, exhooktest.CoreTopic, event); err != nil {
+        t.Fatal(err)
+    }
+    items := make(map[string]string)
+    for _, dl := range h.Network.Downlinks() {
+        if dl.Network != "chirpstack" || dl.Path != "/api/devices/0101010101010101/queue" {
+            t.Fatalf("downlink %+v", dl)
+        }
+        item := gjson.GetBytes(dl.Body, "queueItem")
+        items[item.Get("fPort").String()] = item.Raw
+    }
+    if len(items) != 2 || items["2"] != `{"confirmed":true,"data":"AQE=","fPort":2}` || items["10"] != `{"confirmed":false,"fPort":10,"object":{"blink":3}}` {
+        t.Fatalf("downlinks %v", items)
+    }
+}
+
+func TestLoRaWAN_Reload(t *testing.T) {
+    h := exhooktest.New(t)
+    h.Keel.AddToken("token1", "dev1", "u1", "t1")
+
+    // undecoded, then decoded by the reloaded codec and rate limited
+    conf := h.Config
+    conf.LoRaWAN.Codec = "cayennelpp"
+    conf.RateLimit = service.RateLimitConfig{Messages: 1, Interval: time.Hour}
+    for i, reload := range []bool{false, true, false} {
+        if reload {
+            h.Service.Reload(conf)
+        }
+        if status, body := webhook(t, h, "/v1/lorawan/chirpstack?event=up&", "chirpstack_up.json"); status != http.StatusOK {
+            t.Fatalf("uplink %d: %d %s", i, status, body)
+        }
+    }
+    if got := eventTypes(t, h); got != "connectinfo raw telemetry telemetry" {
+        t.Fatalf("events %s", got)
+    }
+    if values := gjson.Parse(rawValues(t, lastEvent(t, h))); values.Get("temperature_1").Float() != 22.5 {
+        t.Fatalf("telemetry %s", values.Raw)
+    }
+}
+
+func TestLoRaWAN_TTS(t *testing.T) {
+    h := exhooktest.New(t)
+    ctx := context.Background()
+    h.Keel.AddToken("token7", "meter7", "u1", "t1")
+
+    // no token tag, bound once
+    if status, _ := webhook(t, h, "/v1/lorawan/tts?", "tts_uplink.json"); status != http.StatusNotFound {
+        t.Fatalf("unbound DevEUI %d", status)
+    }
+    bind := `{"token":"token7","network":"tts"}`
+    if status, body := deviceRequest(t, h, http.MethodPut, "/v1/lorawan/devices/70-B3-D5-7E-D0-00-00-07?token="+exhooktest.WebhookToken, "", bind); status != http.StatusNoContent {
+        t.Fatalf("bind %d %s", status, body)
+    }
+    if status, body := deviceRequest(t, h, http.MethodPut, "/v1/lorawan/devices/70B3D57ED0000008?token="+exhooktest.WebhookToken, "", `{"token":"wrong","network":"tts"}`); status != http.StatusForbidden {
+        t.Fatalf("bind with a wrong token %d %s", status, body)
+    }
+    for _, fixture := range []string{"tts_join_accept.json", "tts_uplink.json", "tts_downlink_ack.json"} {
+        if status, body := webhook(t, h, "/v1/lorawan/tts?", fixture); status/100 != 2 {
+            t.Fatalf("%s: %d %s", fixture, status, body)
+        }
+    }
+    if got := eventTypes(t, h); got != "connectinfo attributes telemetry" {
+        t.Fatalf("events %s", got)
+    }
+    values := gjson.Parse(rawValues(t, lastEvent(t, h)))
+    if values.Get("energy").Int() != 1000 || values.Get("valve").String() != "open" || values.Get("lorawan.rssi").Int() != -71 {
+        t.Fatalf("telemetry %s", values.Raw)
+    }
+
+    // the webhook filled in the ids of the downlink api
+    event := map[string]interface{}{
+        "id":    "meter7",
+        "owner": "u1",
+        "properties": map[string]interface{}{
+            "attributes": map[string]interface{}{"interval": 600},
+        },
+    }
+    // subscribed to commands only
+    if _, err := h.CoreEvent(ctx, exhooktest.CoreTopic, event); err != nil || len(h.Network.Downlinks()) != 0 {
+        t.Fatalf("attributes %+v, %v", h.Network.Downlinks(), err)
+    }
+    event["properties"] = map[string]interface{}{
+        "commands": map[string]interface{}{"close": map[string]interface{}{"id": "c1", "input": map[string]interface{}{"valve": "close"}}},
+    }
+    if _, err := h.CoreEvent(ctx, exhooktest.CoreTopic, event); err != nil {
+        t.Fatal(err)
+    }
+    downlinks := h.Network.Downlinks()
+    if len(downlinks) != 1 || downlinks[0].Path != "/api/v3/as/applications/metering/webhooks/iothub/devices/meter-7/down/push" ||
+        gjson.GetBytes(downlinks[0].Body, "downlinks.0.decoded_payload").Raw != `{"close":{"valve":"close"}}` {
+        t.Fatalf("downlinks %+v", downlinks)
+    }
+}
@@ -0,0 +1,315 @@
+package service
+
+import (
+    "context"
+    "encoding/json"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/pkg/errors"
+    "github.com/tkeel-io/iothub/pkg/lwm2m"
+    "github.com/tkeel-io/iothub/pkg/store"
+    pb "github.com/tkeel-io/iothub/protobuf"
+    "github.com/tkeel-io/kit/log"
+)
+
+// Devices of the EMQX LwM2M gateway publish json messages of their object
+// model to lwm2m/{ep}/up/..., ep is their endpoint name devId@token. Read
+// responses and notifications are mapped to attributes and telemetry, core
+// commands and attributes to write and execute requests published to the
+// gateway command topic.
+
+const (
+    ProtocolLwM2M = "lwm2m"
+
+    lwm2mTopicPrefix = `lwm2m/`
+    // command of a pending request, lwm2m_req_<devId>_<reqID>
+    lwm2mRequestPrefixKey = `lwm2m_req_`
+
+    defaultLwM2MDownlinkTopic = "lwm2m/%e/dn/dm"
+    defaultLwM2MRequestTTL    = time.Minute
+)
+
+// LwM2MConfig configures the mapping of the EMQX LwM2M gateway messages.
+type LwM2MConfig struct {
+    // Enabled maps the messages, otherwise they are forwarded as raw data.
+    Enabled bool
+    // DownlinkTopic is the gateway command topic, %e is the endpoint name.
+    DownlinkTopic string
+    // ObserveOnRegister observes the known objects of a device registering.
+    ObserveOnRegister bool
+    // RequestTTL bounds the wait of a command for its response.
+    RequestTTL time.Duration
+    // Objects are the custom objects, in addition to the standard ones.
+    Objects []lwm2m.Object
+}
+
+// lwm2mMapper maps the messages of LwM2M devices with the object registry.
+type lwm2mMapper struct {
+    conf  LwM2MConfig
+    reqID uint32
+    // replaced on reload
+    objectsLock sync.RWMutex
+    objects     *lwm2m.Registry
+}
+
+func newLwM2MMapper(conf LwM2MConfig) *lwm2mMapper {
+    if conf.DownlinkTopic == "" {
+        conf.DownlinkTopic = defaultLwM2MDownlinkTopic
+    }
+    if conf.RequestTTL <= 0 {
+        conf.RequestTTL = defaultLwM2MRequestTTL
+    }
+    m := &lwm2mMapper{
+        conf: conf,
+        // request ids of replicas rarely collide
+        reqID: uint32(time.Now().UnixNano()),
+    }
+    m.setObjects(conf.Objects)
+    return m
+}
+
+// setObjects replaces the custom objects mapping the following messages.
+func (m *lwm2mMapper) setObjects(objects []lwm2m.Object) {
+    registry := lwm2m.NewRegistry()
+    for _, o := range objects {
+        if err := registry.Register(o); err != nil {
+            log.Errorf("register lwm2m object %d err, %v", o.ID, err)
+        }
+    }
+    m.objectsLock.Lock()
+    m.objects = registry
+    m.objectsLock.Unlock()
+}
+
+func (m *lwm2mMapper) registry() *lwm2m.Registry {
+    m.objectsLock.RLock()
+    defer m.objectsLock.RUnlock()
+    return m.objects
+}
+
+func (m *lwm2mMapper) nextReqID() int64 {
+    return int64(atomic.AddUint32(&m.reqID, 1) & 0x7fffffff)
+}
+
+func (m *lwm2mMapper) downlinkTopic(ep string) string {
+    return strings.ReplaceAll(m.conf.DownlinkTopic, "%e", ep)
+}
+
+func isLwM2MTopic(topic string) bool {
+    return strings.HasPrefix(topic, lwm2mTopicPrefix)
+}
+
+// lwm2mEndpoint returns the endpoint name of a topic lwm2m/{ep}/...
+func lwm2mEndpoint(topic string) string {
+    items := strings.SplitN(strings.TrimPrefix(topic, lwm2mTopicPrefix), "/", 2)
+    return items[0]
+}
+
+func lwm2mRequestKey(devId string, reqID int64) string {
+    return lwm2mRequestPrefixKey + devId + "_" + strconv.FormatInt(reqID, 10)
+}
+
+// lwm2mCommand is a core command waiting for the response of its request.
+type lwm2mCommand struct {
+    Name string `json:"name"`
+    ID   string `json:"id"`
+}
+
+// lwm2mUplink maps a message of an LwM2M device to the iothub topics, the
+// messages it does not map are forwarded raw.
+func (s *HookService) lwm2mUplink(ctx context.Context, rec *DeviceRecord, msg *pb.Message) error {
+    resp, err := lwm2m.ParseResponse(msg.GetPayload())
+    if err != nil {
+        log.Warnf("lwm2m message of %s, %v", rec.DeviceID, err)
+        return s.uplink(ctx, rec, msg)
+    }
+    switch resp.MsgType {
+    case lwm2m.MsgRegister:
+        s.lwm2mRegistered(ctx, rec, lwm2mEndpoint(msg.GetTopic()), resp)
+    case lwm2m.MsgRead, lwm2m.MsgObserve, lwm2m.MsgNotify:
+        if !resp.Success() || len(resp.Data.Content) == 0 {
+            break
+        }
+        attributes, telemetry := s.lwm2m.registry().Decode(resp.Data.Content)
+        if err := s.lwm2mSend(ctx, rec, msg, AttributesTopic, attributes); err != nil {
+            return err
+        }
+        return s.lwm2mSend(ctx, rec, msg, TelemetryTopic, telemetry)
+    case lwm2m.MsgWrite, lwm2m.MsgExecute:
+        cmd, err := s.takeLwM2MCommand(ctx, rec.DeviceID, resp.ReqID)
+        if err != nil {
+            return err
+        }
+        if cmd == nil {
+            break
+        }
+        output := map[string]interface{}{
+            cmd.Name: map[string]interface{}{
+                "id":     cmd.ID,
+                "output": map[string]interface{}{"code": resp.Data.Code, "message": resp.Data.CodeMsg},
+            },
+        }
+        return s.lwm2mSend(ctx, rec, msg, CommandTopicResponse, output)
+    }
+    return s.uplink(ctx, rec, msg)
+}
+
+// lwm2mSend sends values mapped from msg as a message to topic.
+func (s *HookService) lwm2mSend(ctx context.Context, rec *DeviceRecord, msg *pb.Message, topic string, values map[string]interface{}) error {
+    if len(values) == 0 {
+        return nil
+    }
+    payload, err := json.Marshal(values)
+    if err != nil {
+        return err
+    }
+    id := msg.GetId()
+    // both mapped messages of a notification are deduplicated
+    if id != "" {
+        id += "/" + topic
+    }
+    return s.uplink(ctx, rec, &pb.Message{
+        Node:      msg.GetNode(),
+        Id:        id,
+        Qos:       msg.GetQos(),
+        From:      msg.GetFrom(),
+        Topic:     buildTopic(rec.DeviceID, topic),
+        Payload:   payload,
+        Timestamp: msg.GetTimestamp(),
+    })
+}
+
+// lwm2mRegistered subscribes a registered device to its commands and
+// attributes, and observes its known objects. The registration is
+// forwarded anyway, failures are only logged.
+func (s *HookService) lwm2mRegistered(ctx context.Context, rec *DeviceRecord, ep string, resp *lwm2m.Response) {
+    devId := rec.DeviceID
+    if !rec.HasTopic(CommandTopic) || !rec.HasTopic(AttributesTopic) {
+        if err := s.subscriptions.Subscribe(ctx, devId, []string{CommandTopic, AttributesTopic}); err != nil {
+            log.Errorf("subscribe lwm2m device %s err, %v", devId, err)
+        }
+    }
+    if !s.lwm2m.conf.ObserveOnRegister {
+        return
+    }
+    for _, req := range s.lwm2m.registry().Observe(resp.Data.ObjectList) {
+        req.ReqID = s.lwm2m.nextReqID()
+        if err := s.emqx.Publish(ctx, devId, s.lwm2m.downlinkTopic(ep), defaultDownStreamClientId, 0, false, req); err != nil {
+            log.Errorf("observe %s of %s err, %v", req.Data.Path, devId, err)
+        }
+    }
+}
+
+// takeLwM2MCommand returns and forgets the command of request reqID of
+// devId, nil if there is none.
+func (s *HookService) takeLwM2MCommand(ctx context.Context, devId string, reqID int64) (*lwm2mCommand, error) {
+    key := lwm2mRequestKey(devId, reqID)
+    item, err := s.store.Get(ctx, key)
+    if err != nil {
+        return nil, err
+    }
+    if len(item.Value) == 0 {
+        return nil, nil
+    }
+    var cmd lwm2mCommand
+    if err := json.Unmarshal(item.Value, &cmd); err != nil {
+        log.Warnf("drop invalid lwm2m request %s, %v", key, err)
+        return nil, nil
+    }
+    if err := s.store.Delete(ctx, key, item.Etag); err != nil {
+        // answered through another replica
+        if errors.Is(err, store.ErrEtagMismatch) {
+            return nil, nil
+        }
+        return nil, err
+    }
+    return &cmd, nil
+}
+
+// lwm2mDownlink publishes dl to the LwM2M device of rec as write and
+// execute requests, data of other topics is published as it is.
+func (s *HookService) lwm2mDownlink(ctx context.Context, rec *DeviceRecord, dl downlink) error {
+    devId := rec.DeviceID
+    if rec.ConnectInfo == nil {
+        return errors.Errorf("lwm2m device %s is offline", devId)
+    }
+    topic := s.lwm2m.downlinkTopic(rec.ConnectInfo.ClientID)
+    switch {
+    case dl.Topic == CommandTopic:
+        commands, _ := dl.Value.(map[string]interface{})
+        var errs []error
+        for name, v := range commands {
+            if err := s.lwm2mExecute(ctx, devId, topic, name, v); err != nil {
+                errs = append(errs, errors.Wrapf(err, "command %s", name))
+            }
+        }
+        return combineErrors(errs)
+    case strings.HasPrefix(dl.Topic, CommandTopic+"/"):
+        return s.lwm2mExecute(ctx, devId, topic, strings.TrimPrefix(dl.Topic, CommandTopic+"/"), dl.Value)
+    case dl.Topic == AttributesTopic:
+        attributes, _ := dl.Value.(map[string]interface{})
+        var errs []error
+        for key, v := range attributes {
+            if err := s.lwm2mWrite(ctx, devId, topic, key, v); err != nil {
+                errs = append(errs, errors.Wrapf(err, "attribute %s", key))
+            }
+        }
+        return combineErrors(errs)
+    case strings.HasPrefix(dl.Topic, AttributesTopic+"/"):
+        return s.lwm2mWrite(ctx, devId, topic, strings.TrimPrefix(dl.Topic, AttributesTopic+"/"), dl.Value)
+    }
+    return s.emqx.Publish(ctx, devId, topic, defaultDownStreamClientId, 0, false, dl.Value)
+}
+
+// combineErrors returns the errors of the requests of a downlink as one,
+// nil if there are none.
+func combineErrors(errs []error) error {
+    switch len(errs) {
+    case 0:
+        return nil
+    case 1:
+        return errs[0]
+    }
+    msgs := make([]string, 0, len(errs))
+    for _, err := range errs {
+        msgs = append(msgs, err.Error())
+    }
+    return errors.New(strings.Join(msgs, "; "))
+}
+
+// lwm2mExecute publishes the request of command name, its response is
+// sent back as the command output.
+func (s *HookService) lwm2mExecute(ctx context.Context, devId, topic, name string, v interface{}) error {
+    invocation, _ := v.(map[string]interface{})
+    req, err := s.lwm2m.registry().Command(name, invocation["input"])
+    if err != nil {
+        // the device cannot run it, as an MQTT device without a handler
+        log.Warnf("lwm2m command %s of %s, %v", name, devId, err)
+        return nil
+    }
+    req.ReqID = s.lwm2m.nextReqID()
+    id, _ := invocation["id"].(string)
+    b, err := json.Marshal(lwm2mCommand{Name: name, ID: id})
+    if err != nil {
+        return err
+    }
+    if err := s.store.Save(ctx, &store.Item{Key: lwm2mRequestKey(devId, req.ReqID), Value: b, TTL: s.lwm2m.conf.RequestTTL}); err != nil {
+        return err
+    }
+    return s.emqx.Publish(ctx, devId, topic, defaultDownStreamClientId, 0, false, req)
+}
+
+// lwm2mWrite publishes the write request of attribute key.
+func (s *HookService) lwm2mWrite(ctx context.Context, devId, topic, key string, v interface{}) error {
+    req, err := s.lwm2m.registry().Write(key, v)
+    if err != nil {
+        log.Warnf("lwm2m attribute %s of %s, %v", key, devId, err)
+        return nil
+    }
+    req.ReqID = s.lwm2m.nextReqID()
+    return s.emqx.Publish(ctx, devId, topic, defaultDownStreamClientId, 0, false, req)
+}
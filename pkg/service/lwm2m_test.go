@@ -0,0 +1,189 @@
+package service_test
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "testing"
+
+    "github.com/tidwall/gjson"
+    "github.com/tkeel-io/iothub/pkg/exhooktest"
+    "github.com/tkeel-io/iothub/pkg/service"
+)
+
+const lwm2mDownlinkTopic = "lwm2m/dev1@token1/dn/dm"
+
+func lwm2mEnabled(c *service.Config) {
+    c.LwM2M.Enabled = true
+}
+
+func connectLwM2M(t *testing.T, h *exhooktest.Harness) *exhooktest.Device {
+    t.Helper()
+    ctx := context.Background()
+    h.Keel.AddToken("token1", "dev1", "u1", "t1")
+    d := h.LwM2MDevice("dev1", "token1")
+    if ok, err := d.Connect(ctx); err != nil || !ok {
+        t.Fatalf("connect %v, %v", ok, err)
+    }
+    register := `{"msgType":"register","data":{"ep":"dev1@token1","lt":300,"objectList":["/1/0","/3/0","/6/0","/3303/0"]}}`
+    if ok, err := d.Publish(ctx, "up/resp", []byte(register)); err != nil || !ok {
+        t.Fatalf("register %v, %v", ok, err)
+    }
+    return d
+}
+
+// rawValues returns the values of the rawData of ev.
+func rawValues(t *testing.T, ev gjson.Result) string {
+    t.Helper()
+    var b []byte
+    if err := json.Unmarshal([]byte(ev.Get("data.rawData.values").Raw), &b); err != nil {
+        t.Fatal(err)
+    }
+    return string(b)
+}
+
+func TestLwM2M_Uplink(t *testing.T) {
+    h := exhooktest.New(t, lwm2mEnabled, func(c *service.Config) {
+        c.LwM2M.ObserveOnRegister = true
+    })
+    ctx := context.Background()
+    d := connectLwM2M(t, h)
+
+    // subscribed and observed on registration
+    if got := subscriptionTopics(h); got != "realtime:sub-core" {
+        t.Fatalf("subscriptions %s", got)
+    }
+    published := h.Emqx.Published()
+    if len(published) != 2 || published[0].Topic != lwm2mDownlinkTopic ||
+        gjson.GetBytes(published[0].Payload, "data.path").String() != "/3/0" ||
+        gjson.GetBytes(published[1].Payload, "data.path").String() != "/6/0" {
+        t.Fatalf("published %+v", published)
+    }
+
+    notify := `{"reqID":0,"msgType":"notify","seqNum":1,"data":{"reqPath":"/3/0","code":"2.05","codeMsg":"content","content":[
+        {"path":"/3/0/0","value":"acme"},{"path":"/3/0/9","value":80}]}}`
+    if ok, err := d.Publish(ctx, "up/notify", []byte(notify)); err != nil || !ok {
+        t.Fatalf("notify %v, %v", ok, err)
+    }
+    if got := eventTypes(t, h); got != "connectinfo raw attributes telemetry" {
+        t.Fatalf("events %s", got)
+    }
+    ev := lastEvent(t, h)
+    if path, values := ev.Get("data.rawData.path").String(), rawValues(t, ev); path != "dev1/v1/devices/me/telemetry" || values != `{"device.battery_level":80}` {
+        t.Fatalf("telemetry %s %s", path, values)
+    }
+
+    // an error response is forwarded raw
+    if _, err := d.Publish(ctx, "up/resp", []byte(`{"reqID":5,"msgType":"read","data":{"reqPath":"/3/0/9","code":"4.04","codeMsg":"not_found"}}`)); err != nil {
+        t.Fatal(err)
+    }
+    if ev := lastEvent(t, h); ev.Get("data.rawData.path").String() != "lwm2m/dev1@token1/up/resp" {
+        t.Fatalf("error response %s", ev.Raw)
+    }
+}
+
+func TestLwM2M_Raw(t *testing.T) {
+    h := exhooktest.New(t)
+    ctx := context.Background()
+    d := connectLwM2M(t, h)
+
+    // not mapped unless enabled
+    notify := `{"reqID":0,"msgType":"notify","seqNum":1,"data":{"reqPath":"/3/0","code":"2.05","codeMsg":"content","content":[{"path":"/3/0/9","value":80}]}}`
+    if ok, err := d.Publish(ctx, "up/notify", []byte(notify)); err != nil || !ok {
+        t.Fatalf("notify %v, %v", ok, err)
+    }
+    if got := eventTypes(t, h); got != "connectinfo raw raw" {
+        t.Fatalf("events %s", got)
+    }
+    if ev := lastEvent(t, h); ev.Get("data.rawData.path").String() != "lwm2m/dev1@token1/up/notify" {
+        t.Fatalf("notify %s", ev.Raw)
+    }
+    if got := subscriptionTopics(h); got != "" {
+        t.Fatalf("subscriptions %s", got)
+    }
+}
+
+func TestLwM2M_Downlink(t *testing.T) {
+    h := exhooktest.New(t, lwm2mEnabled)
+    ctx := context.Background()
+    d := connectLwM2M(t, h)
+
+    event := map[string]interface{}{
+        "id":    "dev1",
+        "owner": "u1",
+        "properties": map[string]interface{}{
+            "commands":   map[string]interface{}{"reboot": map[string]interface{}{"id": "c1", "input": ""}},
+            "attributes": map[string]interface{}{"device.timezone": "UTC", "device.manufacturer": "acme"},
+        },
+    }
+    if _, err := h.CoreEvent(ctx, exhooktest.CoreTopic, event); err != nil {
+        t.Fatal(err)
+    }
+    var reboot, write string
+    var reqID int64
+    for _, p := range h.Emqx.Published() {
+        if p.Topic != lwm2mDownlinkTopic {
+            t.Fatalf("published to %s", p.Topic)
+        }
+        switch gjson.GetBytes(p.Payload, "msgType").String() {
+        case "execute":
+            reboot = gjson.GetBytes(p.Payload, "data").Raw
+            reqID = gjson.GetBytes(p.Payload, "reqID").Int()
+        case "write":
+            write = gjson.GetBytes(p.Payload, "data").Raw
+        }
+    }
+    // manufacturer is read only
+    if reboot != `{"path":"/3/0/4"}` || write != `{"path":"/3/0/15","type":"String","value":"UTC"}` || len(h.Emqx.Published()) != 2 {
+        t.Fatalf("published %+v", h.Emqx.Published())
+    }
+
+    resp := fmt.Sprintf(`{"reqID":%d,"msgType":"execute","data":{"reqPath":"/3/0/4","code":"2.04","codeMsg":"changed"}}`, reqID)
+    if _, err := d.Publish(ctx, "up/resp", []byte(resp)); err != nil {
+        t.Fatal(err)
+    }
+    ev := lastEvent(t, h)
+    if got := rawValues(t, ev); ev.Get("data.rawData.type").String() != "commands" || got != `{"reboot":{"id":"c1","output":{"code":"2.04","message":"changed"}}}` {
+        t.Fatalf("command response %s", got)
+    }
+    // answered once
+    if _, err := d.Publish(ctx, "up/resp", []byte(resp)); err != nil {
+        t.Fatal(err)
+    }
+    if ev := lastEvent(t, h); ev.Get("data.rawData.type").String() == "commands" {
+        t.Fatal("command answered twice")
+    }
+
+    // the core subscriptions end with the session
+    if err := d.Disconnect(ctx); err != nil {
+        t.Fatal(err)
+    }
+    if got := subscriptionTopics(h); got != "" {
+        t.Fatalf("subscriptions %s", got)
+    }
+}
+
+func TestLwM2M_DownlinkFailed(t *testing.T) {
+    h := exhooktest.New(t, lwm2mEnabled)
+    ctx := context.Background()
+    connectLwM2M(t, h)
+    h.Emqx.FailTopic(lwm2mDownlinkTopic)
+
+    // a failed request does not stop the others
+    event := map[string]interface{}{
+        "id":    "dev1",
+        "owner": "u1",
+        "properties": map[string]interface{}{
+            "commands": map[string]interface{}{
+                "reboot":        map[string]interface{}{"id": "c1", "input": ""},
+                "factory_reset": map[string]interface{}{"id": "c2", "input": ""},
+            },
+        },
+    }
+    if _, err := h.CoreEvent(ctx, exhooktest.CoreTopic, event); err != nil {
+        t.Fatal(err)
+    }
+    if failed := h.Emqx.Failed(); len(failed) != 2 {
+        t.Fatalf("failed %+v", failed)
+    }
+}
@@ -0,0 +1,176 @@
+package service
+
+import (
+    "context"
+    "encoding/json"
+    "sync"
+    "time"
+
+    "github.com/pkg/errors"
+    "github.com/tkeel-io/iothub/pkg/store"
+    "github.com/tkeel-io/kit/log"
+)
+
+const (
+    // pending downlinks of a device, mailbox_<devId>
+    mailboxPrefixKey = `mailbox_`
+    // optimistic concurrency retries of one push or take
+    mailboxRetries = 5
+    // how often a waiting poll re-reads the store, for downlinks pushed by
+    // another replica
+    mailboxPollInterval = time.Second
+
+    defaultMailboxMaxPending = 100
+)
+
+// PendingDownlink is data of a core event waiting for a device polling
+// over http or observing over CoAP, the same payload an MQTT device gets
+// on Topic.
+type PendingDownlink struct {
+    Topic   string          `json:"topic"`
+    Payload json.RawMessage `json:"payload"`
+    // unix milliseconds of the core event
+    Ts int64 `json:"ts"`
+}
+
+// Mailbox keeps the downlinks of devices without a connection in the state
+// store until they poll them, so that any replica can serve the poll.
+// Waiting polls of this replica are woken up on push, the others re-read the
+// store every mailboxPollInterval.
+type Mailbox struct {
+    store store.StateStore
+    // maxPending bounds the downlinks kept per device, the oldest are dropped
+    maxPending int
+    // ttl expires the mailbox of a device not pushed to for this long
+    ttl time.Duration
+
+    lock    sync.Mutex
+    waiters map[string]chan struct{}
+}
+
+func NewMailbox(stateStore store.StateStore, maxPending int, ttl time.Duration) *Mailbox {
+    if maxPending <= 0 {
+        maxPending = defaultMailboxMaxPending
+    }
+    return &Mailbox{
+        store:      stateStore,
+        maxPending: maxPending,
+        ttl:        ttl,
+        waiters:    make(map[string]chan struct{}),
+    }
+}
+
+func mailboxKey(devId string) string {
+    return mailboxPrefixKey + devId
+}
+
+// load returns the pending downlinks of devId and their etag.
+func (m *Mailbox) load(ctx context.Context, devId string) ([]PendingDownlink, string, error) {
+    item, err := m.store.Get(ctx, mailboxKey(devId))
+    if err != nil {
+        return nil, "", err
+    }
+    if len(item.Value) == 0 {
+        return nil, item.Etag, nil
+    }
+    var pending []PendingDownlink
+    if err := json.Unmarshal(item.Value, &pending); err != nil {
+        // a broken mailbox would block the device forever
+        log.Warnf("drop invalid mailbox of %s, %v", devId, err)
+        return nil, item.Etag, nil
+    }
+    return pending, item.Etag, nil
+}
+
+// Push adds a downlink of devId and wakes up its waiting poll.
+func (m *Mailbox) Push(ctx context.Context, devId string, dl PendingDownlink) error {
+    for i := 0; i < mailboxRetries; i++ {
+        pending, etag, err := m.load(ctx, devId)
+        if err != nil {
+            return err
+        }
+        pending = append(pending, dl)
+        if n := len(pending) - m.maxPending; n > 0 {
+            log.Warnf("mailbox of %s full, drop %d oldest downlinks", devId, n)
+            pending = pending[n:]
+        }
+        value, err := json.Marshal(pending)
+        if err != nil {
+            return err
+        }
+        err = m.store.Save(ctx, &store.Item{Key: mailboxKey(devId), Value: value, Etag: etag, FirstWrite: etag == "", TTL: m.ttl})
+        if errors.Is(err, store.ErrEtagMismatch) {
+            continue
+        }
+        if err != nil {
+            return err
+        }
+        m.wake(devId)
+        return nil
+    }
+    return errors.Errorf("push to mailbox of %s: too many concurrent writes", devId)
+}
+
+// Take removes and returns the pending downlinks of devId, oldest first.
+func (m *Mailbox) Take(ctx context.Context, devId string) ([]PendingDownlink, error) {
+    for i := 0; i < mailboxRetries; i++ {
+        pending, etag, err := m.load(ctx, devId)
+        if err != nil || etag == "" {
+            return nil, err
+        }
+        err = m.store.Delete(ctx, mailboxKey(devId), etag)
+        if errors.Is(err, store.ErrEtagMismatch) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        return pending, nil
+    }
+    return nil, errors.Errorf("take mailbox of %s: too many concurrent writes", devId)
+}
+
+// Wait takes the pending downlinks of devId, waiting for one until timeout
+// or ctx is done. It returns none on timeout.
+func (m *Mailbox) Wait(ctx context.Context, devId string, timeout time.Duration) ([]PendingDownlink, error) {
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    ticker := time.NewTicker(mailboxPollInterval)
+    defer ticker.Stop()
+    for {
+        // watch before reading, a push in between is not missed
+        woken := m.watch(devId)
+        pending, err := m.Take(ctx, devId)
+        if err != nil || len(pending) > 0 {
+            return pending, err
+        }
+        select {
+        case <-ctx.Done():
+            return nil, nil
+        case <-timer.C:
+            return nil, nil
+        case <-woken:
+        case <-ticker.C:
+        }
+    }
+}
+
+func (m *Mailbox) watch(devId string) <-chan struct{} {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    ch, ok := m.waiters[devId]
+    if !ok {
+        ch = make(chan struct{})
+        m.waiters[devId] = ch
+    }
+    return ch
+}
+
+func (m *Mailbox) wake(devId string) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    if ch, ok := m.waiters[devId]; ok {
+        close(ch)
+        delete(m.waiters, devId)
+    }
+}
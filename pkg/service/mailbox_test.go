@@ -0,0 +1,45 @@
+package service
+
+import (
+    "context"
+    "encoding/json"
+    "testing"
+    "time"
+
+    "github.com/tkeel-io/iothub/pkg/store"
+)
+
+func TestMailbox(t *testing.T) {
+    m := NewMailbox(store.NewMemoryStore(), 2, time.Hour)
+    ctx := context.Background()
+    if pending, err := m.Take(ctx, "dev1"); err != nil || len(pending) != 0 {
+        t.Fatalf("empty mailbox %v, %v", pending, err)
+    }
+    // the oldest is dropped when full
+    for _, v := range []string{"1", "2", "3"} {
+        if err := m.Push(ctx, "dev1", PendingDownlink{Topic: CommandTopic, Payload: json.RawMessage(v)}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    pending, err := m.Take(ctx, "dev1")
+    if err != nil || len(pending) != 2 || string(pending[0].Payload) != "2" || string(pending[1].Payload) != "3" {
+        t.Fatalf("pending %+v, %v", pending, err)
+    }
+    if pending, _ := m.Take(ctx, "dev1"); len(pending) != 0 {
+        t.Fatalf("taken twice %+v", pending)
+    }
+
+    // timeout
+    start := time.Now()
+    if pending, err := m.Wait(ctx, "dev1", 10*time.Millisecond); err != nil || len(pending) != 0 || time.Since(start) > time.Second {
+        t.Fatalf("wait %+v, %v after %s", pending, err, time.Since(start))
+    }
+    // woken up by a push
+    go func() {
+        time.Sleep(10 * time.Millisecond)
+        m.Push(ctx, "dev1", PendingDownlink{Topic: CommandTopic, Payload: json.RawMessage("4")}) //nolint
+    }()
+    if pending, err := m.Wait(ctx, "dev1", 10*time.Second); err != nil || len(pending) != 1 || time.Since(start) > 5*time.Second {
+        t.Fatalf("wait %+v, %v after %s", pending, err, time.Since(start))
+    }
+}
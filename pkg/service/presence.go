@@ -0,0 +1,342 @@
+package service
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    go_restful "github.com/emicklei/go-restful"
+    "github.com/tkeel-io/iothub/pkg/metrics"
+    "github.com/tkeel-io/kit/log"
+)
+
+const (
+    presenceStatusOnline  = "online"
+    presenceStatusOffline = "offline"
+
+    defaultPresencePageSize = 100
+    maxPresencePageSize     = 1000
+)
+
+// PresenceConfig configures device presence tracking.
+type PresenceConfig struct {
+    // DeviceMetric exports the per device iothub_device_status gauge.
+    DeviceMetric bool
+    // OfflineTTL is how long an offline device is kept before it is forgotten.
+    OfflineTTL time.Duration
+    // GCInterval is how often offline devices are collected.
+    GCInterval time.Duration
+}
+
+// DevicePresence is the presence of one device.
+type DevicePresence struct {
+    DeviceID string `json:"device_id"`
+    TenantID string `json:"tenant_id"`
+    Protocol string `json:"protocol"`
+    Online   bool   `json:"online"`
+    // unix milliseconds
+    LastSeen       int64 `json:"last_seen"`
+    ConnectedAt    int64 `json:"connected_at,omitempty"`
+    DisconnectedAt int64 `json:"disconnected_at,omitempty"`
+    // connection quality, reconnects within the flap window
+    Reconnects int  `json:"reconnects"`
+    Flapping   bool `json:"flapping"`
+    // node is the emqx node of an MQTT connection, see exhookNode
+    node string
+}
+
+// PresenceTracker keeps the presence of devices and the presence metrics.
+// Only aggregate gauges are unbounded by tenant and protocol, per device
+// series are optional and collected once a device is offline for too long.
+type PresenceTracker struct {
+    conf PresenceConfig
+
+    lock    sync.RWMutex
+    devices map[string]*DevicePresence
+}
+
+func NewPresenceTracker(conf PresenceConfig) *PresenceTracker {
+    return &PresenceTracker{
+        conf:    conf,
+        devices: make(map[string]*DevicePresence),
+    }
+}
+
+// Connected marks devId online, it returns false if it already was.
+func (p *PresenceTracker) Connected(tenantId, devId, protocol string) bool {
+    now := time.Now().UnixMilli()
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    d, ok := p.devices[devId]
+    if ok && d.Online {
+        d.LastSeen = now
+        return false
+    }
+    if ok {
+        metrics.DevicesOffline.WithLabelValues(d.TenantID, d.Protocol).Dec()
+    } else {
+        d = &DevicePresence{DeviceID: devId}
+        p.devices[devId] = d
+    }
+    d.TenantID, d.Protocol, d.Online, d.node = tenantId, protocol, true, ""
+    d.LastSeen, d.ConnectedAt = now, now
+    metrics.DevicesOnline.WithLabelValues(tenantId, protocol).Inc()
+    metrics.ConnectedTotal.WithLabelValues(tenantId).Inc()
+    if p.conf.DeviceMetric {
+        metrics.DeviceStatus.WithLabelValues(tenantId, devId).Set(1)
+    }
+    return true
+}
+
+// Disconnected marks devId offline, it returns false if it was not online.
+// A device not tracked, e.g. connected before a restart, stays untracked.
+func (p *PresenceTracker) Disconnected(devId string) bool {
+    now := time.Now().UnixMilli()
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    d, ok := p.devices[devId]
+    if !ok || !d.Online {
+        return false
+    }
+    metrics.DevicesOnline.WithLabelValues(d.TenantID, d.Protocol).Dec()
+    metrics.ConnectedTotal.WithLabelValues(d.TenantID).Dec()
+    d.Online = false
+    d.LastSeen, d.DisconnectedAt = now, now
+    metrics.DevicesOffline.WithLabelValues(d.TenantID, d.Protocol).Inc()
+    if p.conf.DeviceMetric {
+        metrics.DeviceStatus.WithLabelValues(d.TenantID, devId).Set(0)
+    }
+    return true
+}
+
+// SetNode records the emqx node devId is connected through.
+func (p *PresenceTracker) SetNode(devId, node string) {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    if d, ok := p.devices[devId]; ok {
+        d.node = node
+    }
+}
+
+// OnlineOn returns the ids of the devices tracked online through node.
+func (p *PresenceTracker) OnlineOn(node string) []string {
+    p.lock.RLock()
+    defer p.lock.RUnlock()
+    var ids []string
+    for _, d := range p.devices {
+        if d.Online && d.node == node {
+            ids = append(ids, d.DeviceID)
+        }
+    }
+    return ids
+}
+
+// Seen refreshes the last seen time of devId, it returns false if devId
+// is not tracked online.
+func (p *PresenceTracker) Seen(devId string) bool {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    d, ok := p.devices[devId]
+    if !ok {
+        return false
+    }
+    d.LastSeen = time.Now().UnixMilli()
+    return d.Online
+}
+
+// Online returns the devices tracked online.
+func (p *PresenceTracker) Online() []DevicePresence {
+    p.lock.RLock()
+    defer p.lock.RUnlock()
+    items := make([]DevicePresence, 0)
+    for _, d := range p.devices {
+        if d.Online {
+            items = append(items, *d)
+        }
+    }
+    return items
+}
+
+// Get returns the presence of devId.
+func (p *PresenceTracker) Get(devId string) (DevicePresence, bool) {
+    p.lock.RLock()
+    defer p.lock.RUnlock()
+    if d, ok := p.devices[devId]; ok {
+        return *d, true
+    }
+    return DevicePresence{}, false
+}
+
+// Remove forgets devId and drops its series.
+func (p *PresenceTracker) Remove(devId string) {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    p.remove(devId)
+}
+
+func (p *PresenceTracker) remove(devId string) {
+    d, ok := p.devices[devId]
+    if !ok {
+        return
+    }
+    if d.Online {
+        metrics.DevicesOnline.WithLabelValues(d.TenantID, d.Protocol).Dec()
+        metrics.ConnectedTotal.WithLabelValues(d.TenantID).Dec()
+    } else {
+        metrics.DevicesOffline.WithLabelValues(d.TenantID, d.Protocol).Dec()
+    }
+    metrics.DeviceStatus.DeleteLabelValues(d.TenantID, devId)
+    delete(p.devices, devId)
+}
+
+// GC forgets the devices offline for longer than the offline ttl.
+func (p *PresenceTracker) GC() int {
+    deadline := time.Now().Add(-p.conf.OfflineTTL).UnixMilli()
+    p.lock.Lock()
+    defer p.lock.Unlock()
+    n := 0
+    for id, d := range p.devices {
+        if !d.Online && d.LastSeen < deadline {
+            p.remove(id)
+            n++
+        }
+    }
+    return n
+}
+
+// Run collects offline devices until ctx is done.
+func (p *PresenceTracker) Run(ctx context.Context) {
+    if p.conf.GCInterval <= 0 || p.conf.OfflineTTL <= 0 {
+        return
+    }
+    ticker := time.NewTicker(p.conf.GCInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            if n := p.GC(); n > 0 {
+                log.Infof("presence gc removed %d offline devices", n)
+            }
+        }
+    }
+}
+
+// List returns one page of devices of tenantId (all tenants if empty),
+// filtered by status (online, offline or all if empty), ordered by device id.
+func (p *PresenceTracker) List(tenantId, status string, pageNum, pageSize int) ([]DevicePresence, int) {
+    p.lock.RLock()
+    items := make([]DevicePresence, 0)
+    for _, d := range p.devices {
+        if tenantId != "" && d.TenantID != tenantId {
+            continue
+        }
+        if (status == presenceStatusOnline && !d.Online) || (status == presenceStatusOffline && d.Online) {
+            continue
+        }
+        items = append(items, *d)
+    }
+    p.lock.RUnlock()
+
+    sort.Slice(items, func(i, j int) bool { return items[i].DeviceID < items[j].DeviceID })
+    total := len(items)
+    start := (pageNum - 1) * pageSize
+    if start >= total {
+        return []DevicePresence{}, total
+    }
+    end := start + pageSize
+    if end > total {
+        end = total
+    }
+    return items[start:end], total
+}
+
+// PresenceService exports device presence over http for per device dashboards.
+type PresenceService struct {
+    tracker *PresenceTracker
+    quality *ConnectionQuality
+}
+
+func NewPresenceService(tracker *PresenceTracker, quality *ConnectionQuality) *PresenceService {
+    return &PresenceService{tracker: tracker, quality: quality}
+}
+
+type PresenceListResponse struct {
+    Total    int              `json:"total"`
+    PageNum  int              `json:"page_num"`
+    PageSize int              `json:"page_size"`
+    Items    []DevicePresence `json:"items"`
+}
+
+func queryInt(req *go_restful.Request, name string, defaultVal int) int {
+    if v, err := strconv.Atoi(req.QueryParameter(name)); err == nil && v > 0 {
+        return v
+    }
+    return defaultVal
+}
+
+// tenantFromAuthHeader returns the tenant of the keel auth header,
+// "tenant=xx&user=xx&role=xx" in base64, see AddDefaultAuthHeader.
+func tenantFromAuthHeader(header http.Header) string {
+    raw, err := base64.StdEncoding.DecodeString(header.Get(tkeelAuthHeader))
+    if err != nil {
+        return ""
+    }
+    values, err := url.ParseQuery(string(raw))
+    if err != nil {
+        return ""
+    }
+    return values.Get("tenant")
+}
+
+// ListPresence handles GET /v1/presence?tenant_id=&status=&page_num=&page_size=.
+func (s *PresenceService) ListPresence(req *go_restful.Request, resp *go_restful.Response) {
+    tenantId := req.QueryParameter("tenant_id")
+    // tenant users only see their own devices
+    t := tenantFromAuthHeader(req.Request.Header)
+    if t == "" {
+        resp.WriteErrorString(http.StatusUnauthorized, "no tenant user")
+        return
+    }
+    if t != defaultTenant {
+        tenantId = t
+    }
+    status := req.QueryParameter("status")
+    if status != "" && status != presenceStatusOnline && status != presenceStatusOffline {
+        resp.WriteErrorString(http.StatusBadRequest, "invalid status "+status)
+        return
+    }
+    pageNum := queryInt(req, "page_num", 1)
+    pageSize := queryInt(req, "page_size", defaultPresencePageSize)
+    if pageSize > maxPresencePageSize {
+        pageSize = maxPresencePageSize
+    }
+    items, total := s.tracker.List(tenantId, status, pageNum, pageSize)
+    if s.quality != nil {
+        for i := range items {
+            items[i].Reconnects = s.quality.Reconnects(items[i].DeviceID)
+            items[i].Flapping = s.quality.Flapping(items[i].DeviceID)
+        }
+    }
+    result, err := json.Marshal(&PresenceListResponse{
+        Total:    total,
+        PageNum:  pageNum,
+        PageSize: pageSize,
+        Items:    items,
+    })
+    if err != nil {
+        resp.WriteErrorString(http.StatusInternalServerError, err.Error())
+        return
+    }
+    resp.Header().Set(go_restful.HEADER_ContentType, go_restful.MIME_JSON)
+    if _, err := resp.Write(result); err != nil {
+        log.Errorf("write presence response err, %v", err)
+    }
+}
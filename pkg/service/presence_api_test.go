@@ -0,0 +1,87 @@
+package service_test
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "testing"
+
+    "github.com/tidwall/gjson"
+    "github.com/tkeel-io/iothub/pkg/exhooktest"
+)
+
+// apiRequest calls the http api of h as a user of tenantId, none if empty.
+func apiRequest(t *testing.T, h *exhooktest.Harness, method, path, tenantId string) (int, gjson.Result) {
+    t.Helper()
+    req, err := http.NewRequest(method, h.HTTP.URL+path, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header = liveHeader(tenantId)
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    var v json.RawMessage
+    json.NewDecoder(resp.Body).Decode(&v) //nolint
+    return resp.StatusCode, gjson.ParseBytes(v)
+}
+
+func TestPresence_API(t *testing.T) {
+    h := exhooktest.New(t)
+    ctx := context.Background()
+    h.Keel.AddToken("token1", "dev1", "u1", "t1")
+    h.Keel.AddToken("token2", "dev2", "u2", "t2")
+    for _, d := range []*exhooktest.Device{h.Device("dev1", "token1"), h.Device("dev2", "token2")} {
+        if ok, err := d.Connect(ctx); !ok || err != nil {
+            t.Fatalf("connect %s, %v", d.Info.Username, err)
+        }
+    }
+
+    if status, _ := apiRequest(t, h, http.MethodGet, "/v1/presence", ""); status != http.StatusUnauthorized {
+        t.Fatalf("presence without tenant user %d", status)
+    }
+    // tenant users only see their own devices
+    if status, list := apiRequest(t, h, http.MethodGet, "/v1/presence?tenant_id=t2", "t1"); status != http.StatusOK ||
+        list.Get("total").Int() != 1 || list.Get("items.0.device_id").String() != "dev1" {
+        t.Fatalf("presence of t1 %d %s", status, list.Raw)
+    }
+    if status, list := apiRequest(t, h, http.MethodGet, "/v1/presence", systemTenant); status != http.StatusOK || list.Get("total").Int() != 2 {
+        t.Fatalf("presence of the system tenant %d %s", status, list.Raw)
+    }
+
+    if status, _ := apiRequest(t, h, http.MethodGet, "/v1/devices/dev1/record", ""); status != http.StatusUnauthorized {
+        t.Fatalf("record without tenant user %d", status)
+    }
+    if status, _ := apiRequest(t, h, http.MethodGet, "/v1/devices/dev1/record", "t2"); status != http.StatusNotFound {
+        t.Fatalf("record of another tenant %d", status)
+    }
+    if status, rec := apiRequest(t, h, http.MethodGet, "/v1/devices/dev1/record", "t1"); status != http.StatusOK || rec.Get("tenant_id").String() != "t1" {
+        t.Fatalf("record %d %s", status, rec.Raw)
+    }
+
+    // deleted in core
+    for _, tt := range []struct {
+        tenantId string
+        status   int
+    }{
+        {"", http.StatusUnauthorized},
+        {"t2", http.StatusNotFound},
+        {"t1", http.StatusNoContent},
+        {"t1", http.StatusNotFound},
+    } {
+        if status, _ := apiRequest(t, h, http.MethodDelete, "/v1/devices/dev1/record", tt.tenantId); status != tt.status {
+            t.Fatalf("delete as %q: %d", tt.tenantId, status)
+        }
+    }
+    if _, ok := h.Presence.Get("dev1"); ok {
+        t.Fatal("presence of a deleted device")
+    }
+    if rec, err := h.Service.Registry().Get(ctx, "dev1"); err != nil || rec != nil {
+        t.Fatalf("record of a deleted device %+v, %v", rec, err)
+    }
+    if _, ok := h.Presence.Get("dev2"); !ok {
+        t.Fatal("presence of another device removed")
+    }
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+    "testing"
+    "time"
+)
+
+func TestPresenceTracker(t *testing.T) {
+    p := NewPresenceTracker(PresenceConfig{OfflineTTL: time.Hour})
+    if !p.Connected("t1", "dev1", "mqtt") {
+        t.Fatal("first connect not reported")
+    }
+    if p.Connected("t1", "dev1", "mqtt") {
+        t.Fatal("duplicated connect reported")
+    }
+    p.Connected("t1", "dev2", "coap")
+    p.Connected("t2", "dev3", "mqtt")
+    if !p.Disconnected("dev2") {
+        t.Fatal("disconnect of online device not reported")
+    }
+    // untracked after a restart
+    if p.Disconnected("dev4") {
+        t.Fatal("disconnect of untracked device reported")
+    }
+    if _, ok := p.Get("dev4"); ok {
+        t.Fatal("untracked device tracked on disconnect")
+    }
+
+    items, total := p.List("t1", presenceStatusOnline, 1, 10)
+    if total != 1 || items[0].DeviceID != "dev1" {
+        t.Fatalf("unexpected online devices %v", items)
+    }
+    items, total = p.List("", "", 2, 2)
+    if total != 3 || len(items) != 1 || items[0].DeviceID != "dev3" {
+        t.Fatalf("unexpected second page %v", items)
+    }
+
+    // offline for longer than the ttl
+    p.devices["dev2"].LastSeen = time.Now().Add(-2 * time.Hour).UnixMilli()
+    if n := p.GC(); n != 1 {
+        t.Fatalf("gc removed %d devices", n)
+    }
+    if _, ok := p.Get("dev2"); ok {
+        t.Fatal("collected device still tracked")
+    }
+}
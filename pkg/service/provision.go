@@ -0,0 +1,741 @@
+package service
+
+import (
+    "bytes"
+    "context"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "regexp"
+    "strings"
+    "time"
+
+    go_restful "github.com/emicklei/go-restful"
+    "github.com/pkg/errors"
+    "github.com/tkeel-io/iothub/pkg/metrics"
+    "github.com/tkeel-io/iothub/pkg/store"
+    "github.com/tkeel-io/iothub/pkg/tracing"
+    pb "github.com/tkeel-io/iothub/protobuf"
+    "github.com/tkeel-io/kit/log"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// Devices without an entity token provision themselves on first connect
+// with the provision key and secret of their product and their serial
+// number: iothub creates the entity in core, issues its token with keel
+// and returns both. Over MQTT a device connects with its serial number as
+// username and <key>:<secret> as password, subscribes to
+// v1/devices/provision/response/<key> and publishes the request to
+// v1/devices/provision, over http it posts the request to
+// /v1/devices/provision. The product key in the response topic keeps the
+// devices of products sharing a serial number apart. A product limits its
+// devices and may admit only allowlisted serial numbers, a serial number
+// is provisioned once and no longer connects to provision. Every attempt
+// is logged, counted and kept in the audit trail of its product.
+
+const (
+    ProvisionTopic = "v1/devices/provision"
+    // ProvisionResponseTopic is followed by /<product key>.
+    ProvisionResponseTopic = "v1/devices/provision/response"
+
+    // provisioned devices of a product, provision_product_<key>
+    provisionProductPrefixKey = `provision_product_`
+    // device of a serial number, provision_sn_<key>_<serial>
+    provisionSerialPrefixKey = `provision_sn_`
+    // recent attempts of a product, provision_audit_<key>
+    provisionAuditPrefixKey = `provision_audit_`
+
+    defaultProvisionAuditSize = 1000
+    // a reservation older than this is of a failed attempt, a new one
+    // takes it over
+    provisionPendingTimeout = time.Minute
+    provisionRetries        = 3
+    provisionMaxBodySize    = 4 << 10
+
+    provisionStatusPending     = "pending"
+    provisionStatusProvisioned = "provisioned"
+
+    // metrics label of attempts with an unknown product key
+    provisionUnknownProduct = "unknown"
+    // protocol of requests published over MQTT, as reported by EMQX
+    protocolMQTT = "mqtt"
+)
+
+// provision results
+const (
+    provisionResultOK                 = "ok"
+    provisionResultInvalidRequest     = "invalid_request"
+    provisionResultInvalidCredentials = "invalid_credentials"
+    provisionResultNotAllowed         = "not_allowed"
+    provisionResultLimitReached       = "limit_reached"
+    provisionResultProvisioned        = "already_provisioned"
+    provisionResultInProgress         = "in_progress"
+    provisionResultDeviceExists       = "device_exists"
+    provisionResultError              = "error"
+)
+
+// errDeviceExists is returned when the entity of a provisioned device
+// exists in core and is not of the product.
+var errDeviceExists = errors.New("device exists")
+
+var provisionSerialPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// ProvisionProduct is a product whose devices provision themselves.
+type ProvisionProduct struct {
+    // Key and Secret are the provision credentials shared by the devices
+    // of the product.
+    Key    string
+    Secret string
+    // Owner and TenantID own the entities created.
+    Owner    string
+    TenantID string
+    // TemplateID is the core template of the entities, optional.
+    TemplateID string
+    // DeviceIDPrefix prefixes the serial number to form the entity id.
+    DeviceIDPrefix string
+    // MaxDevices limits the devices provisioned, 0 for no limit.
+    MaxDevices int
+    // Serials admits only these serial numbers if not empty.
+    Serials []string
+}
+
+// ProvisionConfig configures device provisioning, it is disabled without
+// products.
+type ProvisionConfig struct {
+    Products []ProvisionProduct
+    // AuditSize is the number of attempts kept per product.
+    AuditSize int
+}
+
+// ProvisionRequest is the request of a device, over MQTT SerialNumber
+// defaults to the username.
+type ProvisionRequest struct {
+    ProductKey    string `json:"product_key"`
+    ProductSecret string `json:"product_secret"`
+    SerialNumber  string `json:"serial_number"`
+}
+
+// ProvisionResponse returns the credentials of a provisioned device, it
+// connects with DeviceID as username and Token as password.
+type ProvisionResponse struct {
+    Status   string `json:"status"`
+    DeviceID string `json:"device_id,omitempty"`
+    Token    string `json:"token,omitempty"`
+    Error    string `json:"error,omitempty"`
+}
+
+// ProvisionAttempt is an entry of the audit trail of a product.
+type ProvisionAttempt struct {
+    // unix milliseconds
+    Time         int64  `json:"time"`
+    SerialNumber string `json:"serial_number"`
+    DeviceID     string `json:"device_id,omitempty"`
+    Protocol     string `json:"protocol"`
+    Peer         string `json:"peer,omitempty"`
+    Result       string `json:"result"`
+}
+
+// provisionedDevice is the device of a serial number.
+type provisionedDevice struct {
+    DeviceID  string `json:"device_id"`
+    Status    string `json:"status"`
+    UpdatedAt int64  `json:"updated_at"`
+}
+
+type provisionCount struct {
+    Devices int `json:"devices"`
+}
+
+// provisioner checks the provision credentials and serial numbers of the
+// configured products.
+type provisioner struct {
+    conf     ProvisionConfig
+    products map[string]*ProvisionProduct
+    // allowlists by product key
+    serials map[string]map[string]struct{}
+}
+
+func newProvisioner(conf ProvisionConfig) *provisioner {
+    if conf.AuditSize <= 0 {
+        conf.AuditSize = defaultProvisionAuditSize
+    }
+    p := &provisioner{
+        conf:     conf,
+        products: make(map[string]*ProvisionProduct),
+        serials:  make(map[string]map[string]struct{}),
+    }
+    for i := range conf.Products {
+        product := &conf.Products[i]
+        p.products[product.Key] = product
+        if len(product.Serials) == 0 {
+            continue
+        }
+        allow := make(map[string]struct{}, len(product.Serials))
+        for _, sn := range product.Serials {
+            allow[sn] = struct{}{}
+        }
+        p.serials[product.Key] = allow
+    }
+    return p
+}
+
+func (p *provisioner) enabled() bool {
+    return len(p.products) > 0
+}
+
+// product returns the product of key, and whether secret is its secret.
+func (p *provisioner) product(key, secret string) (*ProvisionProduct, bool) {
+    product, ok := p.products[key]
+    if !ok {
+        return nil, false
+    }
+    return product, subtle.ConstantTimeCompare([]byte(secret), []byte(product.Secret)) == 1
+}
+
+// credentials returns the product of the MQTT password <key>:<secret>, nil
+// if it is not a provision credential.
+func (p *provisioner) credentials(password string) (*ProvisionProduct, bool) {
+    if !p.enabled() {
+        return nil, false
+    }
+    i := strings.Index(password, ":")
+    if i < 0 {
+        return nil, false
+    }
+    return p.product(password[:i], password[i+1:])
+}
+
+// check returns why serial may not provision a device of product, ok if
+// it may.
+func (p *provisioner) check(product *ProvisionProduct, serial string) string {
+    if !provisionSerialPattern.MatchString(serial) {
+        return provisionResultInvalidRequest
+    }
+    if allow, ok := p.serials[product.Key]; ok {
+        if _, ok := allow[serial]; !ok {
+            return provisionResultNotAllowed
+        }
+    }
+    return provisionResultOK
+}
+
+func provisionSerialKey(productKey, serial string) string {
+    return provisionSerialPrefixKey + productKey + "_" + serial
+}
+
+func provisionResponseTopic(productKey string) string {
+    return ProvisionResponseTopic + "/" + productKey
+}
+
+// provisionClient reports whether the MQTT client of ci connects with
+// provision credentials, it only requests its own credentials.
+func (s *HookService) provisionClient(ci *pb.ClientInfo) bool {
+    return s.provisionProduct(ci) != nil
+}
+
+// provisionProduct returns the product of the provision credentials of the
+// MQTT client of ci, nil if it connects with other credentials.
+func (s *HookService) provisionProduct(ci *pb.ClientInfo) *ProvisionProduct {
+    product, _ := s.provision.credentials(GetPassword(ci))
+    return product
+}
+
+// authProvision authenticates an MQTT client connecting with the provision
+// credentials of product, its username is the serial number. A serial
+// number already provisioned connects with the credentials of its device.
+func (s *HookService) authProvision(ctx context.Context, ci *pb.ClientInfo, product *ProvisionProduct, ok bool) bool {
+    serial := GetUsername(ci)
+    result := provisionResultInvalidCredentials
+    if ok {
+        result = s.provision.check(product, serial)
+    }
+    if result == provisionResultOK {
+        provisioned, err := s.provisioned(ctx, product, serial)
+        if err != nil {
+            log.Errorf("get provisioning of %s err, %v", serial, err)
+            return false
+        }
+        if !provisioned {
+            return true
+        }
+        result = provisionResultProvisioned
+    }
+    s.auditProvision(ctx, product, &ProvisionAttempt{
+        SerialNumber: serial,
+        Protocol:     ci.GetProtocol(),
+        Peer:         ci.GetPeerhost(),
+        Result:       result,
+    })
+    return false
+}
+
+// provisioned reports whether serial provisioned a device of product.
+func (s *HookService) provisioned(ctx context.Context, product *ProvisionProduct, serial string) (bool, error) {
+    item, err := s.store.Get(ctx, provisionSerialKey(product.Key, serial))
+    if err != nil || item.Value == nil {
+        return false, err
+    }
+    var dev provisionedDevice
+    if err := json.Unmarshal(item.Value, &dev); err != nil {
+        return false, err
+    }
+    return dev.Status == provisionStatusProvisioned, nil
+}
+
+// provisionACL reports whether a provisioning client of product may
+// publish or subscribe to topic, only its provision topics.
+func provisionACL(in *pb.ClientCheckAclRequest, product *ProvisionProduct) bool {
+    topic := strings.TrimPrefix(in.GetTopic(), in.GetClientinfo().GetMountpoint())
+    if in.GetType() == pb.ClientCheckAclRequest_PUBLISH {
+        return topic == ProvisionTopic
+    }
+    return topic == provisionResponseTopic(product.Key)
+}
+
+// isProvisionTopic reports whether topic, <username>/<topic>, is a
+// provision request.
+func isProvisionTopic(topic string) bool {
+    return topicFromUserNameTopic(topic) == ProvisionTopic
+}
+
+// provisionUplink answers the provision request msg of the client of rec,
+// the device id of rec is its username. The response goes to the topic of
+// the product key of the request, only the clients of the product
+// subscribe to it.
+func (s *HookService) provisionUplink(ctx context.Context, rec *DeviceRecord, msg *pb.Message) error {
+    serial := rec.DeviceID
+    var req ProvisionRequest
+    if err := json.Unmarshal(msg.GetPayload(), &req); err != nil || req.ProductKey == "" {
+        log.Warnf("drop provision request of %s without a product key", serial)
+        return nil
+    }
+    var resp *ProvisionResponse
+    switch {
+    case req.SerialNumber != "" && req.SerialNumber != serial:
+        // the response goes to the topics of the username
+        resp = &ProvisionResponse{Status: metrics.ResultFailure, Error: provisionResultInvalidRequest}
+    default:
+        req.SerialNumber = serial
+        resp = s.provisionDevice(ctx, &req, protocolMQTT, "")
+    }
+    return s.emqx.Publish(ctx, serial, buildTopic(serial, provisionResponseTopic(req.ProductKey)), defaultDownStreamClientId, 1, false, resp)
+}
+
+// provisionDevice provisions the device of req, protocol and peer are
+// audited.
+func (s *HookService) provisionDevice(ctx context.Context, req *ProvisionRequest, protocol, peer string) (resp *ProvisionResponse) {
+    ctx, span := tracing.Start(ctx, "provision.Device")
+    attempt := &ProvisionAttempt{SerialNumber: req.SerialNumber, Protocol: protocol, Peer: peer}
+    product, ok := s.provision.product(req.ProductKey, req.ProductSecret)
+    defer func() {
+        if resp.Status != metrics.ResultSuccess {
+            attempt.Result = resp.Error
+        } else {
+            attempt.Result = provisionResultOK
+        }
+        s.auditProvision(ctx, product, attempt)
+        span.End()
+    }()
+    if !ok {
+        return &ProvisionResponse{Status: metrics.ResultFailure, Error: provisionResultInvalidCredentials}
+    }
+    if result := s.provision.check(product, req.SerialNumber); result != provisionResultOK {
+        return &ProvisionResponse{Status: metrics.ResultFailure, Error: result}
+    }
+    devId := product.DeviceIDPrefix + req.SerialNumber
+    attempt.DeviceID = devId
+    result, retried, err := s.reserveProvision(ctx, product, req.SerialNumber, devId)
+    if err != nil {
+        log.Errorf("reserve provisioning of %s err, %v", devId, err)
+        return &ProvisionResponse{Status: metrics.ResultFailure, Error: provisionResultError}
+    }
+    if result != provisionResultOK {
+        return &ProvisionResponse{Status: metrics.ResultFailure, Error: result}
+    }
+    token, err := s.createDevice(ctx, product, req.SerialNumber, devId, retried)
+    if err != nil {
+        log.Errorf("provision %s err, %v", devId, err)
+        if err := s.releaseProvision(ctx, product, req.SerialNumber); err != nil {
+            log.Errorf("release provisioning of %s err, %v", devId, err)
+        }
+        if errors.Is(err, errDeviceExists) {
+            return &ProvisionResponse{Status: metrics.ResultFailure, Error: provisionResultDeviceExists}
+        }
+        return &ProvisionResponse{Status: metrics.ResultFailure, Error: provisionResultError}
+    }
+    if err := s.saveProvisioned(ctx, product, req.SerialNumber, devId, provisionStatusProvisioned, ""); err != nil {
+        // the device has its credentials, a retry is rejected once the
+        // reservation is taken over
+        log.Errorf("save provisioned %s err, %v", devId, err)
+    }
+    return &ProvisionResponse{Status: metrics.ResultSuccess, DeviceID: devId, Token: token}
+}
+
+// reserveProvision counts the device of serial against the limit of
+// product and reserves serial, it returns why it cannot. retried reports
+// that the reservation is taken over from an unfinished attempt for devId.
+func (s *HookService) reserveProvision(ctx context.Context, product *ProvisionProduct, serial, devId string) (result string, retried bool, err error) {
+    countKey := provisionProductPrefixKey + product.Key
+    serialKey := provisionSerialKey(product.Key, serial)
+    for i := 0; i < provisionRetries; i++ {
+        items, err := s.store.BulkGet(ctx, []string{countKey, serialKey})
+        if err != nil {
+            return "", false, err
+        }
+        countItem, serialItem := items[0], items[1]
+        now := time.Now().UnixMilli()
+        if serialItem.Value != nil {
+            var dev provisionedDevice
+            if err := json.Unmarshal(serialItem.Value, &dev); err != nil {
+                return "", false, err
+            }
+            if dev.Status == provisionStatusProvisioned {
+                return provisionResultProvisioned, false, nil
+            }
+            if now-dev.UpdatedAt < provisionPendingTimeout.Milliseconds() {
+                return provisionResultInProgress, false, nil
+            }
+            // reserved by a failed attempt, already counted
+            err = s.saveProvisioned(ctx, product, serial, devId, provisionStatusPending, serialItem.Etag)
+            if errors.Is(err, store.ErrEtagMismatch) {
+                continue
+            }
+            return provisionResultOK, dev.DeviceID == devId, err
+        }
+        var count provisionCount
+        if countItem.Value != nil {
+            if err := json.Unmarshal(countItem.Value, &count); err != nil {
+                return "", false, err
+            }
+        }
+        if product.MaxDevices > 0 && count.Devices >= product.MaxDevices {
+            return provisionResultLimitReached, false, nil
+        }
+        count.Devices++
+        countValue, err := json.Marshal(&count)
+        if err != nil {
+            return "", false, err
+        }
+        devValue, err := json.Marshal(&provisionedDevice{DeviceID: devId, Status: provisionStatusPending, UpdatedAt: now})
+        if err != nil {
+            return "", false, err
+        }
+        err = s.store.Transaction(ctx,
+            store.Upsert(&store.Item{Key: countKey, Value: countValue, Etag: countItem.Etag, FirstWrite: countItem.Etag == ""}),
+            store.Upsert(&store.Item{Key: serialKey, Value: devValue, FirstWrite: true}),
+        )
+        if errors.Is(err, store.ErrEtagMismatch) {
+            log.Debugf("provisioning of product %s changed concurrently, retry", product.Key)
+            continue
+        }
+        return provisionResultOK, false, err
+    }
+    return "", false, errors.Errorf("reserve %s of product %s: too many concurrent attempts", serial, product.Key)
+}
+
+// releaseProvision drops the reservation of serial after a failed attempt.
+func (s *HookService) releaseProvision(ctx context.Context, product *ProvisionProduct, serial string) error {
+    countKey := provisionProductPrefixKey + product.Key
+    serialKey := provisionSerialKey(product.Key, serial)
+    for i := 0; i < provisionRetries; i++ {
+        items, err := s.store.BulkGet(ctx, []string{countKey, serialKey})
+        if err != nil {
+            return err
+        }
+        var count provisionCount
+        if items[0].Value != nil {
+            if err := json.Unmarshal(items[0].Value, &count); err != nil {
+                return err
+            }
+        }
+        if count.Devices > 0 {
+            count.Devices--
+        }
+        countValue, err := json.Marshal(&count)
+        if err != nil {
+            return err
+        }
+        err = s.store.Transaction(ctx,
+            store.Upsert(&store.Item{Key: countKey, Value: countValue, Etag: items[0].Etag}),
+            store.Delete(serialKey, items[1].Etag),
+        )
+        if !errors.Is(err, store.ErrEtagMismatch) {
+            return err
+        }
+    }
+    return errors.Errorf("release %s of product %s: too many concurrent attempts", serial, product.Key)
+}
+
+func (s *HookService) saveProvisioned(ctx context.Context, product *ProvisionProduct, serial, devId, status, etag string) error {
+    value, err := json.Marshal(&provisionedDevice{DeviceID: devId, Status: status, UpdatedAt: time.Now().UnixMilli()})
+    if err != nil {
+        return err
+    }
+    return s.store.Save(ctx, &store.Item{Key: provisionSerialKey(product.Key, serial), Value: value, Etag: etag})
+}
+
+// addTenantAuthHeader authenticates req as user of tenantId, see
+// AddDefaultAuthHeader.
+func addTenantAuthHeader(req *http.Request, tenantId, user string) {
+    authString := fmt.Sprintf("tenant=%s&user=%s&role=%s", tenantId, user, defultRole)
+    req.Header.Add(tkeelAuthHeader, base64.StdEncoding.EncodeToString([]byte(authString)))
+}
+
+// keelPost posts body to the keel api at path as the owner of product,
+// conflict reports whether the api answered 409.
+func (s *HookService) keelPost(ctx context.Context, product *ProvisionProduct, name, path string, body interface{}) (res []byte, conflict bool, err error) {
+    ctx, span := tracing.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+    defer func() { tracing.End(span, err) }()
+    data, err := json.Marshal(body)
+    if err != nil {
+        return nil, false, err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.conf.KeelURL+path, bytes.NewReader(data))
+    if err != nil {
+        return nil, false, err
+    }
+    req.Header.Add("Content-Type", "application/json")
+    addTenantAuthHeader(req, product.TenantID, product.Owner)
+    tracing.InjectHTTP(ctx, req)
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return nil, false, err
+    }
+    defer resp.Body.Close()
+    res, err = ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+    if err != nil {
+        return nil, false, err
+    }
+    if resp.StatusCode == http.StatusConflict {
+        return res, true, nil
+    }
+    if resp.StatusCode/100 != 2 {
+        return nil, false, errors.Errorf("%s: %s %s", name, resp.Status, bytes.TrimSpace(res))
+    }
+    return res, false, nil
+}
+
+type entityTokenRequest struct {
+    EntityID   string `json:"entity_id"`
+    EntityType string `json:"entity_type"`
+    Owner      string `json:"owner"`
+}
+
+type entityTokenResponse struct {
+    Code string `json:"code"`
+    Msg  string `json:"msg"`
+    Data struct {
+        Token string `json:"token"`
+    } `json:"data"`
+}
+
+// createDevice creates the entity of devId in core and returns a new entity
+// token. An existing entity is fine if created by the unfinished attempt
+// retried, or by the provisioning of product.
+func (s *HookService) createDevice(ctx context.Context, product *ProvisionProduct, serial, devId string, retried bool) (string, error) {
+    basicInfo := map[string]interface{}{
+        "name":         devId,
+        "serialNumber": serial,
+        "productKey":   product.Key,
+    }
+    if product.TemplateID != "" {
+        basicInfo["templateId"] = product.TemplateID
+    }
+    query := url.Values{
+        "id":     {devId},
+        "owner":  {product.Owner},
+        "source": {"iothub"},
+        "type":   {"device"},
+    }
+    _, conflict, err := s.keelPost(ctx, product, "core.CreateEntity", "/core/v1/entities?"+query.Encode(), map[string]interface{}{"basicInfo": basicInfo})
+    if err != nil {
+        return "", err
+    }
+    if conflict && !retried {
+        e, err := s.getEntity(ctx, product.TenantID, product.Owner, devId)
+        if err != nil {
+            return "", err
+        }
+        if e == nil || e.Source != "iothub" || e.Owner != product.Owner || e.Properties.BasicInfo["productKey"] != product.Key {
+            return "", errors.Wrapf(errDeviceExists, "entity %s", devId)
+        }
+    }
+    res, conflict, err := s.keelPost(ctx, product, "keel.CreateEntityToken", "/security/v1/entity/token", &entityTokenRequest{
+        EntityID:   devId,
+        EntityType: "device",
+        Owner:      product.Owner,
+    })
+    if err != nil {
+        return "", err
+    }
+    var tokenResp entityTokenResponse
+    if conflict || json.Unmarshal(res, &tokenResp) != nil || tokenResp.Data.Token == "" {
+        return "", errors.Errorf("no token of %s: %s", devId, bytes.TrimSpace(res))
+    }
+    return tokenResp.Data.Token, nil
+}
+
+// auditProvision logs and counts attempt, and keeps it in the audit trail
+// of product, nil if unknown.
+func (s *HookService) auditProvision(ctx context.Context, product *ProvisionProduct, attempt *ProvisionAttempt) {
+    attempt.Time = time.Now().UnixMilli()
+    productKey := provisionUnknownProduct
+    if product != nil {
+        productKey = product.Key
+    }
+    log.Infof("provision %s of product %s over %s from %s: %s", attempt.SerialNumber, productKey, attempt.Protocol, attempt.Peer, attempt.Result)
+    metrics.ProvisionTotal.WithLabelValues(productKey, attempt.Result).Inc()
+    if product == nil {
+        return
+    }
+    key := provisionAuditPrefixKey + product.Key
+    for i := 0; i < provisionRetries; i++ {
+        item, err := s.store.Get(ctx, key)
+        if err != nil {
+            log.Errorf("audit provisioning of %s err, %v", attempt.SerialNumber, err)
+            return
+        }
+        var attempts []ProvisionAttempt
+        if item.Value != nil {
+            if err := json.Unmarshal(item.Value, &attempts); err != nil {
+                log.Errorf("decode provisioning audit of %s err, %v", product.Key, err)
+            }
+        }
+        attempts = append(attempts, *attempt)
+        if n := len(attempts) - s.provision.conf.AuditSize; n > 0 {
+            attempts = attempts[n:]
+        }
+        value, err := json.Marshal(attempts)
+        if err != nil {
+            return
+        }
+        err = s.store.Save(ctx, &store.Item{Key: key, Value: value, Etag: item.Etag, FirstWrite: item.Etag == ""})
+        if errors.Is(err, store.ErrEtagMismatch) {
+            continue
+        }
+        if err != nil {
+            log.Errorf("audit provisioning of %s err, %v", attempt.SerialNumber, err)
+        }
+        return
+    }
+    log.Errorf("audit provisioning of %s: too many concurrent attempts", attempt.SerialNumber)
+}
+
+// ProvisionService serves the http provisioning of devices and the audit
+// trail of products.
+type ProvisionService struct {
+    ctx     context.Context
+    cancel  context.CancelFunc
+    hookSvc *HookService
+}
+
+func NewProvisionService(ctx context.Context, hookSvc *HookService) *ProvisionService {
+    ctx, cancel := context.WithCancel(ctx)
+    return &ProvisionService{ctx: ctx, cancel: cancel, hookSvc: hookSvc}
+}
+
+// Close rejects the following requests.
+func (s *ProvisionService) Close() {
+    s.cancel()
+}
+
+func provisionStatus(result string) int {
+    switch result {
+    case provisionResultInvalidRequest:
+        return http.StatusBadRequest
+    case provisionResultInvalidCredentials:
+        return http.StatusUnauthorized
+    case provisionResultNotAllowed, provisionResultLimitReached:
+        return http.StatusForbidden
+    case provisionResultProvisioned, provisionResultInProgress, provisionResultDeviceExists:
+        return http.StatusConflict
+    }
+    return http.StatusServiceUnavailable
+}
+
+// Provision handles POST /v1/devices/provision with a ProvisionRequest.
+func (s *ProvisionService) Provision(req *go_restful.Request, resp *go_restful.Response) {
+    ctx := tracing.ExtractHTTP(req.Request.Context(), req.Request.Header)
+    if s.ctx.Err() != nil {
+        resp.WriteErrorString(http.StatusServiceUnavailable, "server is shutting down")
+        return
+    }
+    body, err := ioutil.ReadAll(io.LimitReader(req.Request.Body, provisionMaxBodySize))
+    if err != nil {
+        resp.WriteErrorString(http.StatusBadRequest, err.Error())
+        return
+    }
+    var r ProvisionRequest
+    if err := json.Unmarshal(body, &r); err != nil || r.ProductKey == "" {
+        resp.WriteErrorString(http.StatusBadRequest, provisionResultInvalidRequest)
+        return
+    }
+    result := s.hookSvc.provisionDevice(ctx, &r, ProtocolHTTP, peerHost(req.Request))
+    if result.Status != metrics.ResultSuccess {
+        resp.WriteErrorString(provisionStatus(result.Error), result.Error)
+        return
+    }
+    if err := resp.WriteAsJson(result); err != nil {
+        log.Errorf("write provision response err, %v", err)
+    }
+}
+
+type ProvisionAuditResponse struct {
+    Total    int                `json:"total"`
+    PageNum  int                `json:"page_num"`
+    PageSize int                `json:"page_size"`
+    Items    []ProvisionAttempt `json:"items"`
+}
+
+// ListAudit handles GET /v1/provision/audit?product_key=&page_num=&page_size=,
+// the recent attempts of a product, the newest first.
+func (s *ProvisionService) ListAudit(req *go_restful.Request, resp *go_restful.Response) {
+    t := tenantFromAuthHeader(req.Request.Header)
+    if t == "" {
+        resp.WriteErrorString(http.StatusUnauthorized, "no tenant user")
+        return
+    }
+    product, ok := s.hookSvc.provision.products[req.QueryParameter("product_key")]
+    // tenant users only see their own products
+    if ok && t != defaultTenant && t != product.TenantID {
+        ok = false
+    }
+    if !ok {
+        resp.WriteErrorString(http.StatusNotFound, "unknown product")
+        return
+    }
+    item, err := s.hookSvc.store.Get(req.Request.Context(), provisionAuditPrefixKey+product.Key)
+    if err != nil {
+        resp.WriteErrorString(http.StatusServiceUnavailable, err.Error())
+        return
+    }
+    var attempts []ProvisionAttempt
+    if item.Value != nil {
+        if err := json.Unmarshal(item.Value, &attempts); err != nil {
+            resp.WriteErrorString(http.StatusInternalServerError, err.Error())
+            return
+        }
+    }
+    pageNum := queryInt(req, "page_num", 1)
+    pageSize := queryInt(req, "page_size", defaultPresencePageSize)
+    if pageSize > maxPresencePageSize {
+        pageSize = maxPresencePageSize
+    }
+    items := make([]ProvisionAttempt, 0, pageSize)
+    for i := len(attempts) - 1 - (pageNum-1)*pageSize; i >= 0 && len(items) < pageSize; i-- {
+        items = append(items, attempts[i])
+    }
+    if err := resp.WriteAsJson(&ProvisionAuditResponse{
+        Total:    len(attempts),
+        PageNum:  pageNum,
+        PageSize: pageSize,
+        Items:    items,
+    }); err != nil {
+        log.Errorf("write provision audit response err, %v", err)
+    }
+}
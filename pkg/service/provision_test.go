@@ -0,0 +1,193 @@
+package service_test
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "strings"
+    "testing"
+
+    "github.com/tidwall/gjson"
+    "github.com/tkeel-io/iothub/pkg/exhooktest"
+    "github.com/tkeel-io/iothub/pkg/service"
+)
+
+func provisionProducts(c *service.Config) {
+    c.Provision.Products = []service.ProvisionProduct{
+        {Key: "sensor", Secret: "s3cret", Owner: "u1", TenantID: "t1", TemplateID: "tpl-sensor", DeviceIDPrefix: "sensor-", MaxDevices: 2},
+        {Key: "meter", Secret: "m3ter", Owner: "u2", TenantID: "t2", Serials: []string{"M1"}},
+    }
+}
+
+func provisionRequest(key, secret, serial string) string {
+    b, _ := json.Marshal(&service.ProvisionRequest{ProductKey: key, ProductSecret: secret, SerialNumber: serial})
+    return string(b)
+}
+
+func TestProvision_HTTP(t *testing.T) {
+    h := exhooktest.New(t, provisionProducts)
+    ctx := context.Background()
+
+    status, body := deviceRequest(t, h, http.MethodPost, "/v1/devices/provision", "", provisionRequest("sensor", "s3cret", "SN1"))
+    resp := gjson.Parse(body)
+    if status != http.StatusOK || resp.Get("status").String() != "success" || resp.Get("device_id").String() != "sensor-SN1" {
+        t.Fatalf("provision %d %s", status, body)
+    }
+    entity, ok := h.Keel.Entities()["sensor-SN1"]
+    if !ok || entity.Owner != "u1" || entity.TenantID != "t1" || entity.Type != "device" {
+        t.Fatalf("entity %+v", entity)
+    }
+    if info, _ := json.Marshal(entity.Properties); gjson.GetBytes(info, "basicInfo.templateId").String() != "tpl-sensor" ||
+        gjson.GetBytes(info, "basicInfo.serialNumber").String() != "SN1" {
+        t.Fatalf("entity properties %s", info)
+    }
+    // the device connects with its new credentials
+    d := h.Device("sensor-SN1", resp.Get("token").String())
+    if ok, err := d.Connect(ctx); !ok || err != nil {
+        t.Fatalf("connect, %v", err)
+    }
+    rec, err := h.Service.Registry().Get(ctx, "sensor-SN1")
+    if err != nil || rec == nil || rec.TenantID != "t1" {
+        t.Fatalf("record %+v, %v", rec, err)
+    }
+
+    tests := []struct {
+        name, body string
+        status     int
+    }{
+        {"provisioned once", provisionRequest("sensor", "s3cret", "SN1"), http.StatusConflict},
+        {"wrong secret", provisionRequest("sensor", "wrong", "SN2"), http.StatusUnauthorized},
+        {"unknown product", provisionRequest("lamp", "s3cret", "SN2"), http.StatusUnauthorized},
+        {"invalid serial", provisionRequest("sensor", "s3cret", "SN/2"), http.StatusBadRequest},
+        {"not allowlisted", provisionRequest("meter", "m3ter", "M2"), http.StatusForbidden},
+        {"allowlisted", provisionRequest("meter", "m3ter", "M1"), http.StatusOK},
+        {"second device", provisionRequest("sensor", "s3cret", "SN2"), http.StatusOK},
+        {"limit", provisionRequest("sensor", "s3cret", "SN3"), http.StatusForbidden},
+    }
+    for _, tt := range tests {
+        if status, body := deviceRequest(t, h, http.MethodPost, "/v1/devices/provision", "", tt.body); status != tt.status {
+            t.Fatalf("%s: %d %s", tt.name, status, body)
+        }
+    }
+
+    audit := func(tenantId, query string) (int, gjson.Result) {
+        req, err := http.NewRequest(http.MethodGet, h.HTTP.URL+"/v1/provision/audit?"+query, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        req.Header = liveHeader(tenantId)
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        var v json.RawMessage
+        json.NewDecoder(resp.Body).Decode(&v) //nolint
+        return resp.StatusCode, gjson.ParseBytes(v)
+    }
+    status, list := audit("t1", "product_key=sensor&page_size=3")
+    var results []string
+    for _, item := range list.Get("items").Array() {
+        results = append(results, item.Get("serial_number").String()+" "+item.Get("result").String())
+    }
+    // the newest first, unknown products are not audited
+    if status != http.StatusOK || list.Get("total").Int() != 6 ||
+        strings.Join(results, ", ") != "SN3 limit_reached, SN2 ok, SN/2 invalid_request" {
+        t.Fatalf("audit %d %s", status, list.Raw)
+    }
+    if status, _ := audit("t2", "product_key=sensor"); status != http.StatusNotFound {
+        t.Fatalf("audit of another tenant %d", status)
+    }
+    if status, _ := audit("", "product_key=sensor"); status != http.StatusUnauthorized {
+        t.Fatalf("audit without a tenant user %d", status)
+    }
+    if status, list := audit(systemTenant, "product_key=meter"); status != http.StatusOK || list.Get("total").Int() != 2 {
+        t.Fatalf("audit of the system tenant %d %s", status, list.Raw)
+    }
+}
+
+func TestProvision_MQTT(t *testing.T) {
+    h := exhooktest.New(t, provisionProducts)
+    ctx := context.Background()
+
+    if ok, err := h.Device("SN1", "sensor:wrong").Connect(ctx); ok || err != nil {
+        t.Fatalf("connect with a wrong secret %v, %v", ok, err)
+    }
+    if ok, err := h.Device("M2", "meter:m3ter").Connect(ctx); ok || err != nil {
+        t.Fatalf("connect of a serial not allowlisted %v, %v", ok, err)
+    }
+
+    d := h.Device("SN1", "sensor:s3cret")
+    if ok, err := d.Connect(ctx); !ok || err != nil {
+        t.Fatalf("connect, %v", err)
+    }
+    // only the responses of its own product
+    granted, err := d.Subscribe(ctx, service.ProvisionResponseTopic+"/sensor", service.ProvisionResponseTopic+"/meter",
+        service.ProvisionResponseTopic, "v1/devices/me/attributes")
+    if err != nil || !granted[0] || granted[1] || granted[2] || granted[3] {
+        t.Fatalf("subscribe %v, %v", granted, err)
+    }
+    if ok, err := d.Publish(ctx, "v1/devices/me/telemetry", []byte(`{"temp":1}`)); ok || err != nil {
+        t.Fatalf("publish telemetry %v, %v", ok, err)
+    }
+    if ok, err := d.Publish(ctx, service.ProvisionTopic, []byte(`{"product_key":"sensor","product_secret":"s3cret"}`)); !ok || err != nil {
+        t.Fatalf("publish provision request %v, %v", ok, err)
+    }
+    if err := d.Disconnect(ctx); err != nil {
+        t.Fatal(err)
+    }
+    // not a device, nothing reaches core
+    if got := eventTypes(t, h); got != "" {
+        t.Fatalf("events %s", got)
+    }
+    if subs := h.Keel.Subscriptions(); len(subs) != 0 {
+        t.Fatalf("subscriptions %v", subs)
+    }
+
+    published := h.Emqx.Published()
+    if len(published) != 1 || published[0].Topic != "SN1/"+service.ProvisionResponseTopic+"/sensor" {
+        t.Fatalf("published %+v", published)
+    }
+    resp := gjson.ParseBytes(published[0].Payload)
+    if resp.Get("status").String() != "success" || resp.Get("device_id").String() != "sensor-SN1" {
+        t.Fatalf("response %s", resp.Raw)
+    }
+    dev := h.Device("sensor-SN1", resp.Get("token").String())
+    if ok, err := dev.Connect(ctx); !ok || err != nil {
+        t.Fatalf("connect provisioned device, %v", err)
+    }
+    if ok, err := dev.Publish(ctx, "v1/devices/me/telemetry", []byte(`{"temp":1}`)); !ok || err != nil {
+        t.Fatalf("publish, %v", err)
+    }
+    if got := eventTypes(t, h); got != "connectinfo telemetry" {
+        t.Fatalf("events %s", got)
+    }
+    // provisioned once, no longer connects to provision
+    if ok, err := h.Device("SN1", "sensor:s3cret").Connect(ctx); ok || err != nil {
+        t.Fatalf("connect of a provisioned serial %v, %v", ok, err)
+    }
+}
+
+func TestProvision_ExistingEntity(t *testing.T) {
+    h := exhooktest.New(t, provisionProducts)
+
+    // an entity of someone else is not taken over, one of a failed
+    // provisioning of the product is
+    h.Keel.AddEntity(exhooktest.Entity{ID: "sensor-SN1", Owner: "u9", TenantID: "t1", Type: "device"})
+    h.Keel.AddEntity(exhooktest.Entity{ID: "sensor-SN2", Owner: "u1", TenantID: "t1", Type: "device", Source: "iothub",
+        Properties: map[string]interface{}{"basicInfo": map[string]interface{}{"productKey": "sensor", "serialNumber": "SN2"}}})
+    status, body := deviceRequest(t, h, http.MethodPost, "/v1/devices/provision", "", provisionRequest("sensor", "s3cret", "SN1"))
+    if status != http.StatusConflict || strings.TrimSpace(body) != "device_exists" {
+        t.Fatalf("provision over an entity of another owner %d %s", status, body)
+    }
+    if entity := h.Keel.Entities()["sensor-SN1"]; entity.Owner != "u9" {
+        t.Fatalf("entity %+v", entity)
+    }
+    // the rejected attempt is not counted against the limit
+    for _, serial := range []string{"SN2", "SN3"} {
+        status, body := deviceRequest(t, h, http.MethodPost, "/v1/devices/provision", "", provisionRequest("sensor", "s3cret", serial))
+        if resp := gjson.Parse(body); status != http.StatusOK || resp.Get("token").String() == "" {
+            t.Fatalf("provision %s %d %s", serial, status, body)
+        }
+    }
+}
@@ -0,0 +1,268 @@
+package service
+
+import (
+    "context"
+    "sync"
+    "time"
+
+    "github.com/tkeel-io/iothub/pkg/metrics"
+    "github.com/tkeel-io/kit/log"
+)
+
+const (
+    // device event reported to core on flapping transitions
+    flappingEventType = "flapping"
+    eventProperty     = "event"
+)
+
+// QualityConfig configures connection quality tracking.
+type QualityConfig struct {
+    // FlapThreshold is the number of reconnects within FlapWindow above
+    // which a device is flapping, 0 disables flapping detection.
+    FlapThreshold int
+    FlapWindow    time.Duration
+    // Throttle rejects the authentication of flapping devices.
+    Throttle bool
+}
+
+type connQuality struct {
+    tenantId    string
+    owner       string
+    connectedAt time.Time
+    // connect times within the flap window, oldest first
+    connects []time.Time
+    flapping bool
+}
+
+// prune drops the connects older than the window.
+func (q *connQuality) prune(now time.Time, window time.Duration) {
+    i := 0
+    for i < len(q.connects) && now.Sub(q.connects[i]) > window {
+        i++
+    }
+    q.connects = q.connects[i:]
+}
+
+// reconnects is the number of reconnects within the window, the first
+// connect is not a reconnect.
+func (q *connQuality) reconnects() int {
+    if len(q.connects) == 0 {
+        return 0
+    }
+    return len(q.connects) - 1
+}
+
+// FlapEvent is a flapping transition of a device.
+type FlapEvent struct {
+    TenantID   string `json:"tenant_id"`
+    Owner      string `json:"owner"`
+    DeviceID   string `json:"device_id"`
+    Flapping   bool   `json:"flapping"`
+    Reconnects int    `json:"reconnects"`
+    Window     string `json:"window"`
+    Timestamp  int64  `json:"timestamp"`
+}
+
+// ConnectionQuality computes per device connection quality from the
+// connected and disconnected hooks: session durations, reconnects over a
+// sliding window and flapping.
+type ConnectionQuality struct {
+    conf QualityConfig
+    // called on flapping transitions, outside of the lock
+    notify func(FlapEvent)
+
+    lock    sync.Mutex
+    devices map[string]*connQuality
+}
+
+func NewConnectionQuality(conf QualityConfig, notify func(FlapEvent)) *ConnectionQuality {
+    return &ConnectionQuality{
+        conf:    conf,
+        notify:  notify,
+        devices: make(map[string]*connQuality),
+    }
+}
+
+func (c *ConnectionQuality) flapEnabled() bool {
+    return c.conf.FlapThreshold > 0 && c.conf.FlapWindow > 0
+}
+
+func (c *ConnectionQuality) event(devId string, q *connQuality, now time.Time) FlapEvent {
+    return FlapEvent{
+        TenantID:   q.tenantId,
+        Owner:      q.owner,
+        DeviceID:   devId,
+        Flapping:   q.flapping,
+        Reconnects: q.reconnects(),
+        Window:     c.conf.FlapWindow.String(),
+        Timestamp:  now.UnixMilli(),
+    }
+}
+
+// setFlapping updates the flapping flag and returns whether it changed.
+func (c *ConnectionQuality) setFlapping(q *connQuality, flapping bool) bool {
+    if q.flapping == flapping {
+        return false
+    }
+    q.flapping = flapping
+    if flapping {
+        metrics.DevicesFlapping.WithLabelValues(q.tenantId).Inc()
+    } else {
+        metrics.DevicesFlapping.WithLabelValues(q.tenantId).Dec()
+    }
+    return true
+}
+
+// Connected records a connection of devId.
+func (c *ConnectionQuality) Connected(tenantId, owner, devId string) {
+    now := time.Now()
+    c.lock.Lock()
+    q, ok := c.devices[devId]
+    if !ok {
+        q = &connQuality{}
+        c.devices[devId] = q
+    } else {
+        metrics.ReconnectTotal.WithLabelValues(tenantId).Inc()
+    }
+    q.tenantId, q.owner, q.connectedAt = tenantId, owner, now
+    q.connects = append(q.connects, now)
+    q.prune(now, c.conf.FlapWindow)
+    var ev *FlapEvent
+    if c.flapEnabled() && c.setFlapping(q, q.reconnects() > c.conf.FlapThreshold) {
+        e := c.event(devId, q, now)
+        ev = &e
+    }
+    c.lock.Unlock()
+
+    if ev != nil && c.notify != nil {
+        c.notify(*ev)
+    }
+}
+
+// Disconnected records the end of the session of devId.
+func (c *ConnectionQuality) Disconnected(devId string) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    q, ok := c.devices[devId]
+    if !ok || q.connectedAt.IsZero() {
+        return
+    }
+    metrics.SessionDuration.WithLabelValues(q.tenantId).Observe(time.Since(q.connectedAt).Seconds())
+    q.connectedAt = time.Time{}
+}
+
+// Flapping reports whether devId is flapping.
+func (c *ConnectionQuality) Flapping(devId string) bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    q, ok := c.devices[devId]
+    return ok && q.flapping
+}
+
+// Throttled reports whether the authentication of devId should be rejected.
+func (c *ConnectionQuality) Throttled(devId string) bool {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    q, ok := c.devices[devId]
+    return c.conf.Throttle && ok && q.flapping
+}
+
+// SetConfig changes the flapping detection, it applies from the next
+// connect or sweep. The sweep interval follows the window given at start.
+func (c *ConnectionQuality) SetConfig(conf QualityConfig) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.conf = conf
+}
+
+// Reconnects returns the reconnects of devId within the flap window.
+func (c *ConnectionQuality) Reconnects(devId string) int {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if q, ok := c.devices[devId]; ok {
+        q.prune(time.Now(), c.conf.FlapWindow)
+        return q.reconnects()
+    }
+    return 0
+}
+
+// Sweep clears the flapping flag of devices calmed down and forgets the
+// disconnected devices without recent connects.
+func (c *ConnectionQuality) Sweep() {
+    now := time.Now()
+    var events []FlapEvent
+    c.lock.Lock()
+    for id, q := range c.devices {
+        q.prune(now, c.conf.FlapWindow)
+        if c.flapEnabled() && c.setFlapping(q, q.reconnects() > c.conf.FlapThreshold) {
+            events = append(events, c.event(id, q, now))
+        }
+        if len(q.connects) == 0 && q.connectedAt.IsZero() && !q.flapping {
+            delete(c.devices, id)
+        }
+    }
+    c.lock.Unlock()
+
+    if c.notify != nil {
+        for _, ev := range events {
+            c.notify(ev)
+        }
+    }
+}
+
+// Run sweeps every tenth of the flap window until ctx is done.
+func (c *ConnectionQuality) Run(ctx context.Context) {
+    c.lock.Lock()
+    window := c.conf.FlapWindow
+    c.lock.Unlock()
+    if window <= 0 {
+        return
+    }
+    ticker := time.NewTicker(window / 10)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            c.Sweep()
+        }
+    }
+}
+
+// flapEventData builds the device event sent to core for a flapping transition.
+func flapEventData(ev FlapEvent) (map[string]interface{}, error) {
+    v, err := EncodeData(ev)
+    if err != nil {
+        return nil, err
+    }
+    return map[string]interface{}{
+        "id":     ev.DeviceID,
+        "owner":  ev.Owner,
+        "type":   "device",
+        "source": "iothub",
+        "data": map[string]interface{}{
+            rawDataProperty: map[string]interface{}{
+                "id":     ev.DeviceID,
+                "ts":     ev.Timestamp,
+                "values": v,
+                "path":   flappingEventType,
+                "type":   eventProperty,
+                "mark":   MarkConnecting,
+            },
+        },
+    }, nil
+}
+
+// reportFlapping sends flapping transitions to core as device events.
+func (s *HookService) reportFlapping(ev FlapEvent) {
+    log.Warnf("device %s flapping=%v, %d reconnects in %s", ev.DeviceID, ev.Flapping, ev.Reconnects, ev.Window)
+    data, err := flapEventData(ev)
+    if err != nil {
+        log.Errorf("encode flapping event err, %v", err)
+        return
+    }
+    if err := s.forwarder.Send(context.Background(), ev.DeviceID, EventTypeDeviceEvent, time.UnixMilli(ev.Timestamp), data); err != nil {
+        log.Errorf("send flapping event err, %v", err)
+    }
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+    "testing"
+    "time"
+)
+
+func TestConnectionQuality_Flapping(t *testing.T) {
+    var events []FlapEvent
+    c := NewConnectionQuality(QualityConfig{FlapThreshold: 2, FlapWindow: time.Minute, Throttle: true},
+        func(ev FlapEvent) { events = append(events, ev) })
+    for i := 0; i < 3; i++ {
+        c.Connected("t1", "owner", "dev1")
+        c.Disconnected("dev1")
+    }
+    if c.Flapping("dev1") || len(events) != 0 {
+        t.Fatalf("flapping below threshold, events %v", events)
+    }
+    c.Connected("t1", "owner", "dev1")
+    if !c.Throttled("dev1") || len(events) != 1 || !events[0].Flapping {
+        t.Fatalf("flapping not detected, events %v", events)
+    }
+    if n := c.Reconnects("dev1"); n != 3 {
+        t.Fatalf("unexpected reconnects %d", n)
+    }
+
+    // connects out of the window calm the device down
+    q := c.devices["dev1"]
+    for i := range q.connects {
+        q.connects[i] = q.connects[i].Add(-2 * time.Minute)
+    }
+    c.Sweep()
+    if c.Flapping("dev1") || len(events) != 2 || events[1].Flapping {
+        t.Fatalf("flapping not cleared, events %v", events)
+    }
+}
+
+func TestConnectionQuality_Sweep(t *testing.T) {
+    c := NewConnectionQuality(QualityConfig{FlapWindow: time.Minute}, nil)
+    c.Connected("t1", "owner", "dev1")
+    c.Disconnected("dev1")
+    c.devices["dev1"].connects[0] = time.Now().Add(-2 * time.Minute)
+    c.Sweep()
+    if _, ok := c.devices["dev1"]; ok {
+        t.Fatal("idle device not forgotten")
+    }
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+    "sync"
+    "time"
+)
+
+const maxRateLimitBuckets = 100000
+
+// RateLimitConfig configures the uplink rate limit of devices.
+type RateLimitConfig struct {
+    // Messages is the number of messages a device may send per Interval, 0
+    // disables the limit.
+    Messages int
+    Interval time.Duration
+    // Burst is the number of messages a device may send at once, Messages if 0.
+    Burst int
+}
+
+func (c RateLimitConfig) burst() float64 {
+    if c.Burst > 0 {
+        return float64(c.Burst)
+    }
+    return float64(c.Messages)
+}
+
+type rateBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+// RateLimiter drops the uplink messages of devices above their rate, with
+// a token bucket per device.
+type RateLimiter struct {
+    lock    sync.Mutex
+    conf    RateLimitConfig
+    buckets map[string]*rateBucket
+}
+
+func NewRateLimiter(conf RateLimitConfig) *RateLimiter {
+    return &RateLimiter{conf: conf, buckets: make(map[string]*rateBucket)}
+}
+
+// SetConfig changes the rate of the following messages.
+func (l *RateLimiter) SetConfig(conf RateLimitConfig) {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    l.conf = conf
+    if conf.Messages <= 0 || conf.Interval <= 0 {
+        l.buckets = make(map[string]*rateBucket)
+    }
+}
+
+// Allow reports whether devId may send a message now, and takes it from its
+// bucket.
+func (l *RateLimiter) Allow(devId string) bool {
+    if l == nil {
+        return true
+    }
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    if l.conf.Messages <= 0 || l.conf.Interval <= 0 {
+        return true
+    }
+    now := time.Now()
+    b, ok := l.buckets[devId]
+    if !ok {
+        if len(l.buckets) >= maxRateLimitBuckets {
+            l.sweep(now)
+        }
+        b = &rateBucket{tokens: l.conf.burst(), last: now}
+        l.buckets[devId] = b
+    }
+    l.refill(b, now)
+    if b.tokens < 1 {
+        return false
+    }
+    b.tokens--
+    return true
+}
+
+// Forget drops the bucket of devId, e.g. once it is offline.
+func (l *RateLimiter) Forget(devId string) {
+    if l == nil {
+        return
+    }
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    delete(l.buckets, devId)
+}
+
+func (l *RateLimiter) refill(b *rateBucket, now time.Time) {
+    rate := float64(l.conf.Messages) / float64(l.conf.Interval)
+    b.tokens += float64(now.Sub(b.last)) * rate
+    if max := l.conf.burst(); b.tokens > max {
+        b.tokens = max
+    }
+    b.last = now
+}
+
+// sweep drops the full buckets, a device without one starts full.
+func (l *RateLimiter) sweep(now time.Time) {
+    for devId, b := range l.buckets {
+        l.refill(b, now)
+        if b.tokens >= l.conf.burst() {
+            delete(l.buckets, devId)
+        }
+    }
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+    "testing"
+    "time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+    l := NewRateLimiter(RateLimitConfig{Messages: 2, Interval: time.Hour})
+    for i := 0; i < 2; i++ {
+        if !l.Allow("dev1") {
+            t.Fatalf("message %d within the rate dropped", i)
+        }
+    }
+    if l.Allow("dev1") {
+        t.Fatal("message above the rate allowed")
+    }
+    if !l.Allow("dev2") {
+        t.Fatal("message of another device dropped")
+    }
+    l.Forget("dev1")
+    if !l.Allow("dev1") {
+        t.Fatal("message of a forgotten device dropped")
+    }
+}
+
+func TestRateLimiter_Refill(t *testing.T) {
+    l := NewRateLimiter(RateLimitConfig{Messages: 1, Interval: 10 * time.Millisecond})
+    l.Allow("dev1")
+    if l.Allow("dev1") {
+        t.Fatal("message above the rate allowed")
+    }
+    time.Sleep(15 * time.Millisecond)
+    if !l.Allow("dev1") {
+        t.Fatal("message after the interval dropped")
+    }
+}
+
+func TestRateLimiter_SetConfig(t *testing.T) {
+    l := NewRateLimiter(RateLimitConfig{})
+    for i := 0; i < 10; i++ {
+        if !l.Allow("dev1") {
+            t.Fatal("message dropped without a limit")
+        }
+    }
+    l.SetConfig(RateLimitConfig{Messages: 1, Interval: time.Hour, Burst: 2})
+    if !l.Allow("dev1") || !l.Allow("dev1") {
+        t.Fatal("burst dropped")
+    }
+    if l.Allow("dev1") {
+        t.Fatal("message above the burst allowed")
+    }
+    l.SetConfig(RateLimitConfig{})
+    if !l.Allow("dev1") {
+        t.Fatal("message dropped once the limit is removed")
+    }
+}
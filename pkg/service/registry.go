@@ -0,0 +1,338 @@
+package service
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "sort"
+    "time"
+
+    go_restful "github.com/emicklei/go-restful"
+    "github.com/pkg/errors"
+    "github.com/tkeel-io/iothub/pkg/store"
+    "github.com/tkeel-io/kit/log"
+)
+
+const (
+    // device record key, device_<devId>
+    deviceRecordPrefixKey = `device_`
+    // schema of DeviceRecord, bump it and migrate in decodeDeviceRecord
+    deviceRecordSchema = 2
+    // optimistic concurrency retries of one update
+    deviceRecordRetries = 5
+)
+
+// DeviceRecord is everything iothub keeps about one device, read and
+// written as a single versioned value.
+type DeviceRecord struct {
+    Schema int `json:"schema"`
+    // Revision increases with every write
+    Revision uint64 `json:"revision"`
+    DeviceID string `json:"device_id"`
+    Owner    string `json:"owner"`
+    TenantID string `json:"tenant_id"`
+    Protocol string `json:"protocol,omitempty"`
+    // Gateway is the edge node of a device behind one, e.g. sparkplug
+    Gateway string `json:"gateway,omitempty"`
+    // set while the device is connected
+    ConnectInfo *ConnectInfo `json:"connect_info,omitempty"`
+    // topic filters the device subscribed and the core subscriptions serving
+    // them, by subscription mode
+    Topics        []string                    `json:"topics,omitempty"`
+    Subscriptions map[string]CoreSubscription `json:"subscriptions,omitempty"`
+    // schema 1, the realtime "*" subscription
+    LegacySubscriptionID string `json:"subscription_id,omitempty"`
+    // unix milliseconds of the last connect or disconnect
+    LastSeen  int64 `json:"last_seen"`
+    UpdatedAt int64 `json:"updated_at"`
+}
+
+// CoreSubscription is a subscription of device properties in core.
+type CoreSubscription struct {
+    ID string `json:"id"`
+    // Select is the comma separated list of selected properties, "*" for all
+    Select string `json:"select"`
+}
+
+// HasTopic reports whether the device subscribed topic.
+func (r *DeviceRecord) HasTopic(topic string) bool {
+    i := sort.SearchStrings(r.Topics, topic)
+    return i < len(r.Topics) && r.Topics[i] == topic
+}
+
+// AddTopic adds topic to the subscribed topics, kept sorted.
+func (r *DeviceRecord) AddTopic(topic string) {
+    if r.HasTopic(topic) {
+        return
+    }
+    r.Topics = append(r.Topics, topic)
+    sort.Strings(r.Topics)
+}
+
+// RemoveTopic removes topic from the subscribed topics.
+func (r *DeviceRecord) RemoveTopic(topic string) {
+    i := sort.SearchStrings(r.Topics, topic)
+    if i < len(r.Topics) && r.Topics[i] == topic {
+        r.Topics = append(r.Topics[:i], r.Topics[i+1:]...)
+    }
+}
+
+// setSubscription sets the core subscription of mode, clears it if sub is empty.
+func (r *DeviceRecord) setSubscription(mode string, sub CoreSubscription) {
+    if sub.ID == "" {
+        delete(r.Subscriptions, mode)
+        return
+    }
+    if r.Subscriptions == nil {
+        r.Subscriptions = make(map[string]CoreSubscription)
+    }
+    r.Subscriptions[mode] = sub
+}
+
+func deviceRecordKey(devId string) string {
+    return deviceRecordPrefixKey + devId
+}
+
+// legacyDeviceKeys are the per device keys written before DeviceRecord.
+// The <devId>/<topic> markers can not be listed and are left behind,
+// devices subscribe again on their next session.
+func legacyDeviceKeys(devId string) []string {
+    return []string{
+        devId + devEntitySuffixKey,
+        devId + tenantSuffixKey,
+        devId + connectInfoSuffixKey,
+        devId + subEntitySuffixKey,
+        devId,
+    }
+}
+
+// DeviceRegistry stores DeviceRecords.
+type DeviceRegistry struct {
+    store store.StateStore
+}
+
+func NewDeviceRegistry(stateStore store.StateStore) *DeviceRegistry {
+    return &DeviceRegistry{store: stateStore}
+}
+
+func decodeDeviceRecord(value []byte) (*DeviceRecord, error) {
+    rec := &DeviceRecord{}
+    if err := json.Unmarshal(value, rec); err != nil {
+        return nil, errors.Wrap(err, "decode device record")
+    }
+    if rec.Schema > deviceRecordSchema {
+        return nil, errors.Errorf("unsupported device record schema %d", rec.Schema)
+    }
+    if rec.LegacySubscriptionID != "" {
+        rec.setSubscription(realtimeMode, CoreSubscription{ID: rec.LegacySubscriptionID, Select: subscriptionItemType})
+        rec.LegacySubscriptionID = ""
+    }
+    rec.Schema = deviceRecordSchema
+    return rec, nil
+}
+
+// load returns the record of devId and its etag, a missing record is nil.
+func (r *DeviceRegistry) load(ctx context.Context, devId string) (*DeviceRecord, string, error) {
+    item, err := r.store.Get(ctx, deviceRecordKey(devId))
+    if err != nil {
+        return nil, "", err
+    }
+    if len(item.Value) == 0 {
+        return nil, "", nil
+    }
+    rec, err := decodeDeviceRecord(item.Value)
+    return rec, item.Etag, err
+}
+
+// Get returns the record of devId, nil if the device is unknown.
+// Devices stored with the legacy keys are migrated on first read.
+func (r *DeviceRegistry) Get(ctx context.Context, devId string) (*DeviceRecord, error) {
+    rec, _, err := r.load(ctx, devId)
+    if err != nil || rec != nil {
+        return rec, err
+    }
+    return r.migrate(ctx, devId)
+}
+
+// migrate converts the legacy keys of devId to a record and deletes them.
+func (r *DeviceRegistry) migrate(ctx context.Context, devId string) (*DeviceRecord, error) {
+    keys := legacyDeviceKeys(devId)
+    items, err := r.store.BulkGet(ctx, keys)
+    if err != nil {
+        return nil, err
+    }
+    values := make(map[string][]byte, len(items))
+    for _, item := range items {
+        if len(item.Value) > 0 {
+            values[item.Key] = item.Value
+        }
+    }
+    if len(values) == 0 {
+        return nil, nil
+    }
+
+    now := time.Now().UnixMilli()
+    rec := &DeviceRecord{
+        Schema:    deviceRecordSchema,
+        Revision:  1,
+        DeviceID:  devId,
+        Owner:     string(values[devId+devEntitySuffixKey]),
+        TenantID:  string(values[devId+tenantSuffixKey]),
+        UpdatedAt: now,
+    }
+    subId := string(values[devId])
+    if subId != "" {
+        rec.setSubscription(realtimeMode, CoreSubscription{ID: subId, Select: subscriptionItemType})
+    }
+    if v, ok := values[devId+connectInfoSuffixKey]; ok {
+        ci := &ConnectInfo{}
+        if err := json.Unmarshal(v, ci); err != nil {
+            log.Warnf("drop invalid legacy connect info of %s, %v", devId, err)
+        } else {
+            rec.ConnectInfo = ci
+            rec.Protocol = ci.Protocol
+            rec.LastSeen = ci.Timestamp
+        }
+    }
+    value, err := json.Marshal(rec)
+    if err != nil {
+        return nil, err
+    }
+    ops := []*store.Operation{store.Upsert(&store.Item{Key: deviceRecordKey(devId), Value: value, FirstWrite: true})}
+    for _, key := range keys {
+        ops = append(ops, store.Delete(key, ""))
+    }
+    if subId != "" {
+        ops = append(ops, store.Delete(subId, ""))
+    }
+    err = r.store.Transaction(ctx, ops...)
+    if errors.Is(err, store.ErrEtagMismatch) {
+        // migrated or created concurrently
+        rec, _, err = r.load(ctx, devId)
+        return rec, err
+    }
+    if err != nil {
+        return nil, errors.Wrap(err, "migrate device record")
+    }
+    log.Infof("migrated legacy state of device %s", devId)
+    return rec, nil
+}
+
+// Update applies fn to the record of devId and saves it, retrying on
+// concurrent writes. fn gets a new record if the device is unknown.
+func (r *DeviceRegistry) Update(ctx context.Context, devId string, fn func(rec *DeviceRecord) error) (*DeviceRecord, error) {
+    for i := 0; i < deviceRecordRetries; i++ {
+        rec, etag, err := r.load(ctx, devId)
+        if err != nil {
+            return nil, err
+        }
+        if rec == nil {
+            if rec, err = r.migrate(ctx, devId); err != nil {
+                return nil, err
+            }
+            // re-read to get the etag of the migrated record
+            if rec != nil {
+                continue
+            }
+            rec = &DeviceRecord{Schema: deviceRecordSchema, DeviceID: devId}
+        }
+        if err := fn(rec); err != nil {
+            return nil, err
+        }
+        rec.Revision++
+        rec.UpdatedAt = time.Now().UnixMilli()
+        value, err := json.Marshal(rec)
+        if err != nil {
+            return nil, err
+        }
+        // a new record must not overwrite one created concurrently
+        err = r.store.Save(ctx, &store.Item{Key: deviceRecordKey(devId), Value: value, Etag: etag, FirstWrite: etag == ""})
+        if errors.Is(err, store.ErrEtagMismatch) {
+            log.Debugf("device record %s changed concurrently, retry", devId)
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        return rec, nil
+    }
+    return nil, errors.Errorf("update device record %s: too many concurrent writes", devId)
+}
+
+// Delete deletes the record of devId.
+func (r *DeviceRegistry) Delete(ctx context.Context, devId string) error {
+    return r.store.Delete(ctx, deviceRecordKey(devId), "")
+}
+
+// RegistryService exports device records over http, and forgets deleted
+// devices.
+type RegistryService struct {
+    hookSvc  *HookService
+    registry *DeviceRegistry
+}
+
+func NewRegistryService(hookSvc *HookService) *RegistryService {
+    return &RegistryService{hookSvc: hookSvc, registry: hookSvc.registry}
+}
+
+// GetDeviceRecord handles GET /v1/devices/{id}/record.
+func (s *RegistryService) GetDeviceRecord(req *go_restful.Request, resp *go_restful.Response) {
+    devId := req.PathParameter("id")
+    t := tenantFromAuthHeader(req.Request.Header)
+    if t == "" {
+        resp.WriteErrorString(http.StatusUnauthorized, "no tenant user")
+        return
+    }
+    rec, err := s.registry.Get(req.Request.Context(), devId)
+    if err != nil {
+        log.Errorf("get device record %s err, %v", devId, err)
+        resp.WriteErrorString(http.StatusInternalServerError, err.Error())
+        return
+    }
+    // tenant users only see their own devices
+    if rec != nil && t != defaultTenant && t != rec.TenantID {
+        rec = nil
+    }
+    if rec == nil {
+        resp.WriteErrorString(http.StatusNotFound, "device "+devId+" not found")
+        return
+    }
+    result, err := json.Marshal(rec)
+    if err != nil {
+        resp.WriteErrorString(http.StatusInternalServerError, err.Error())
+        return
+    }
+    resp.Header().Set(go_restful.HEADER_ContentType, go_restful.MIME_JSON)
+    if _, err := resp.Write(result); err != nil {
+        log.Errorf("write device record response err, %v", err)
+    }
+}
+
+// DeleteDeviceRecord handles DELETE /v1/devices/{id}/record, called once
+// the device is deleted in core.
+func (s *RegistryService) DeleteDeviceRecord(req *go_restful.Request, resp *go_restful.Response) {
+    ctx := req.Request.Context()
+    devId := req.PathParameter("id")
+    t := tenantFromAuthHeader(req.Request.Header)
+    if t == "" {
+        resp.WriteErrorString(http.StatusUnauthorized, "no tenant user")
+        return
+    }
+    rec, err := s.registry.Get(ctx, devId)
+    if err != nil {
+        log.Errorf("get device record %s err, %v", devId, err)
+        resp.WriteErrorString(http.StatusInternalServerError, err.Error())
+        return
+    }
+    // tenant users only delete their own devices
+    if rec == nil || (t != defaultTenant && t != rec.TenantID) {
+        resp.WriteErrorString(http.StatusNotFound, "device "+devId+" not found")
+        return
+    }
+    if err := s.hookSvc.RemoveDevice(ctx, devId); err != nil {
+        log.Errorf("remove device %s err, %v", devId, err)
+        resp.WriteErrorString(http.StatusInternalServerError, err.Error())
+        return
+    }
+    resp.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+    "context"
+    "sync"
+    "testing"
+
+    "github.com/tkeel-io/iothub/pkg/store"
+)
+
+func TestDeviceRegistry_Migrate(t *testing.T) {
+    ctx := context.Background()
+    m := store.NewMemoryStore()
+    m.Save(ctx, //nolint
+        &store.Item{Key: "dev1" + devEntitySuffixKey, Value: []byte("owner1")},
+        &store.Item{Key: "dev1" + tenantSuffixKey, Value: []byte("t1")},
+        &store.Item{Key: "dev1" + connectInfoSuffixKey, Value: []byte(`{"_protocol":"mqtt","_timestamp":100}`)},
+        &store.Item{Key: "dev1", Value: []byte("sub-1")},
+        &store.Item{Key: "sub-1", Value: []byte("dev1")},
+    )
+    r := NewDeviceRegistry(m)
+    rec, err := r.Get(ctx, "dev1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if rec.Owner != "owner1" || rec.TenantID != "t1" || rec.Subscriptions[realtimeMode].ID != "sub-1" || rec.Protocol != "mqtt" || rec.LastSeen != 100 {
+        t.Fatalf("unexpected migrated record %+v", rec)
+    }
+    for _, key := range append(legacyDeviceKeys("dev1"), "sub-1") {
+        if item, _ := m.Get(ctx, key); item.Value != nil {
+            t.Fatalf("legacy key %s not deleted", key)
+        }
+    }
+    if rec, _ := r.Get(ctx, "unknown"); rec != nil {
+        t.Fatalf("unexpected record of unknown device %+v", rec)
+    }
+}
+
+func TestDeviceRegistry_Update(t *testing.T) {
+    ctx := context.Background()
+    r := NewDeviceRegistry(store.NewMemoryStore())
+    var wg sync.WaitGroup
+    for _, topic := range []string{"v1/devices/me/attributes", "v1/devices/me/commands", "v1/devices/me/raw"} {
+        wg.Add(1)
+        go func(topic string) {
+            defer wg.Done()
+            if _, err := r.Update(ctx, "dev1", func(rec *DeviceRecord) error {
+                rec.AddTopic(topic)
+                return nil
+            }); err != nil {
+                t.Error(err)
+            }
+        }(topic)
+    }
+    wg.Wait()
+    rec, err := r.Get(ctx, "dev1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(rec.Topics) != 3 || rec.Revision != 3 {
+        t.Fatalf("lost concurrent update %+v", rec)
+    }
+    rec.RemoveTopic("v1/devices/me/commands")
+    if rec.HasTopic("v1/devices/me/commands") || !rec.HasTopic("v1/devices/me/raw") {
+        t.Fatalf("unexpected topics %v", rec.Topics)
+    }
+}
@@ -0,0 +1,481 @@
+package service
+
+import (
+    "context"
+    "encoding/json"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pkg/errors"
+    "github.com/tkeel-io/iothub/pkg/sparkplug"
+    "github.com/tkeel-io/iothub/pkg/store"
+    pb "github.com/tkeel-io/iothub/protobuf"
+    "github.com/tkeel-io/kit/log"
+)
+
+// Sparkplug B edge nodes connect as MQTT devices authenticated by their
+// entity token, their topics spBv1.0/... are mounted under the username
+// like the iothub topics. The births of a node and its devices are kept
+// from NBIRTH to NDEATH to decode the metrics sent by alias, each device is
+// an entity of its own of the owner of the node in core, online from DBIRTH
+// to DDEATH. Core commands and attributes are sent as NCMD and DCMD
+// metrics, devices report the result in their data, there is no command
+// response.
+
+const (
+    ProtocolSparkplug = "sparkplugb"
+
+    // births of an edge node and its devices, spb_<nodeId>
+    sparkplugPrefixKey = `spb_`
+    // rebirth requests of a node are sent at most once per interval
+    sparkplugRebirthInterval = 10 * time.Second
+
+    defaultSparkplugDeviceID = "%d"
+)
+
+// SparkplugConfig configures the Sparkplug B edge nodes.
+type SparkplugConfig struct {
+    // Enabled decodes the Sparkplug messages, otherwise they are
+    // forwarded as raw data.
+    Enabled bool
+    // DeviceID is the entity id of a device of an edge node, %g is the
+    // group id, %n the edge node id and %d the device id.
+    DeviceID string
+}
+
+// spDevice is a device of an edge node, from its DBIRTH.
+type spDevice struct {
+    Entity string           `json:"entity"`
+    Birth  *sparkplug.Birth `json:"birth"`
+}
+
+// spNode is an edge node, from its NBIRTH.
+type spNode struct {
+    Group    string           `json:"group"`
+    Node     string           `json:"node"`
+    BdSeq    uint64           `json:"bd_seq"`
+    HasBdSeq bool             `json:"has_bd_seq,omitempty"`
+    Birth    *sparkplug.Birth `json:"birth"`
+    // devices by Sparkplug device id
+    Devices map[string]*spDevice `json:"devices,omitempty"`
+}
+
+func (n *spNode) deviceOf(entity string) (string, *spDevice) {
+    for id, d := range n.Devices {
+        if d.Entity == entity {
+            return id, d
+        }
+    }
+    return "", nil
+}
+
+type sparkplugMapper struct {
+    conf SparkplugConfig
+
+    lock     sync.Mutex
+    rebirths map[string]time.Time
+}
+
+func newSparkplugMapper(conf SparkplugConfig) *sparkplugMapper {
+    if conf.DeviceID == "" {
+        conf.DeviceID = defaultSparkplugDeviceID
+    }
+    return &sparkplugMapper{conf: conf, rebirths: make(map[string]time.Time)}
+}
+
+func (m *sparkplugMapper) deviceEntity(t sparkplug.Topic) string {
+    return strings.NewReplacer("%g", t.Group, "%n", t.Node, "%d", t.Device).Replace(m.conf.DeviceID)
+}
+
+// rebirthDue reports whether a rebirth of nodeId may be requested, and
+// records it.
+func (m *sparkplugMapper) rebirthDue(nodeId string) bool {
+    now := time.Now()
+    m.lock.Lock()
+    defer m.lock.Unlock()
+    for id, at := range m.rebirths {
+        if now.Sub(at) >= sparkplugRebirthInterval {
+            delete(m.rebirths, id)
+        }
+    }
+    if _, ok := m.rebirths[nodeId]; ok {
+        return false
+    }
+    m.rebirths[nodeId] = now
+    return true
+}
+
+func isSparkplugTopic(userNameTopic string) bool {
+    return sparkplug.IsTopic(topicFromUserNameTopic(userNameTopic))
+}
+
+func sparkplugKey(nodeId string) string {
+    return sparkplugPrefixKey + nodeId
+}
+
+func (s *HookService) loadSparkplugNode(ctx context.Context, nodeId string) (*spNode, error) {
+    item, err := s.store.Get(ctx, sparkplugKey(nodeId))
+    if err != nil {
+        return nil, err
+    }
+    if len(item.Value) == 0 {
+        return nil, nil
+    }
+    var node spNode
+    if err := json.Unmarshal(item.Value, &node); err != nil {
+        log.Warnf("drop invalid sparkplug node %s, %v", nodeId, err)
+        return nil, nil
+    }
+    if node.Birth == nil {
+        node.Birth = &sparkplug.Birth{}
+    }
+    return &node, nil
+}
+
+func (s *HookService) saveSparkplugNode(ctx context.Context, nodeId string, node *spNode) error {
+    b, err := json.Marshal(node)
+    if err != nil {
+        return err
+    }
+    return s.store.Save(ctx, &store.Item{Key: sparkplugKey(nodeId), Value: b})
+}
+
+// sparkplugUplink decodes a message of an edge node, the messages it does
+// not decode are forwarded raw.
+func (s *HookService) sparkplugUplink(ctx context.Context, rec *DeviceRecord, msg *pb.Message) error {
+    t, err := sparkplug.ParseTopic(topicFromUserNameTopic(msg.GetTopic()))
+    if err != nil || t.Type == sparkplug.STATE || t.Type == sparkplug.NCMD || t.Type == sparkplug.DCMD {
+        return s.uplink(ctx, rec, msg)
+    }
+    p, err := sparkplug.Unmarshal(msg.GetPayload())
+    if err != nil {
+        log.Warnf("sparkplug message of %s, %v", rec.DeviceID, err)
+        return s.uplink(ctx, rec, msg)
+    }
+    switch t.Type {
+    case sparkplug.NBIRTH:
+        return s.sparkplugNodeBirth(ctx, rec, t, p, msg)
+    case sparkplug.NDEATH:
+        return s.sparkplugNodeDeath(ctx, rec, p)
+    case sparkplug.DBIRTH:
+        return s.sparkplugDeviceBirth(ctx, rec, t, p, msg)
+    case sparkplug.DDEATH:
+        return s.sparkplugDeviceDeath(ctx, rec, t)
+    }
+    return s.sparkplugData(ctx, rec, t, p, msg)
+}
+
+// sparkplugSend sends the values of metrics as telemetry of the entity of rec.
+func (s *HookService) sparkplugSend(ctx context.Context, rec *DeviceRecord, msg *pb.Message, p *sparkplug.Payload) error {
+    values := sparkplug.Values(p.Metrics)
+    if len(values) == 0 {
+        return nil
+    }
+    payload, err := json.Marshal(values)
+    if err != nil {
+        return err
+    }
+    ts := msg.GetTimestamp()
+    if p.Timestamp != 0 {
+        ts = p.Timestamp
+    }
+    return s.uplink(ctx, rec, &pb.Message{
+        Node:      msg.GetNode(),
+        Id:        msg.GetId(),
+        Qos:       msg.GetQos(),
+        From:      msg.GetFrom(),
+        Topic:     buildTopic(rec.DeviceID, TelemetryTopic),
+        Payload:   payload,
+        Timestamp: ts,
+    })
+}
+
+// sparkplugSubscribe subscribes an edge node or a device to its commands
+// and attributes, a failure is only logged.
+func (s *HookService) sparkplugSubscribe(ctx context.Context, rec *DeviceRecord) {
+    if rec.HasTopic(CommandTopic) && rec.HasTopic(AttributesTopic) {
+        return
+    }
+    if err := s.subscriptions.Subscribe(ctx, rec.DeviceID, []string{CommandTopic, AttributesTopic}); err != nil {
+        log.Errorf("subscribe sparkplug %s err, %v", rec.DeviceID, err)
+    }
+}
+
+func (s *HookService) sparkplugNodeBirth(ctx context.Context, rec *DeviceRecord, t sparkplug.Topic, p *sparkplug.Payload, msg *pb.Message) error {
+    nodeId := rec.DeviceID
+    prev, err := s.loadSparkplugNode(ctx, nodeId)
+    if err != nil {
+        return err
+    }
+    // the devices of the previous session are born again after NBIRTH
+    if prev != nil {
+        s.sparkplugDevicesOffline(ctx, prev)
+    }
+    node := &spNode{Group: t.Group, Node: t.Node, Birth: sparkplug.NewBirth(p)}
+    node.BdSeq, node.HasBdSeq = sparkplug.BdSeqOf(p)
+    if err := s.saveSparkplugNode(ctx, nodeId, node); err != nil {
+        return err
+    }
+    rec, err = s.registry.Update(ctx, nodeId, func(rec *DeviceRecord) error {
+        rec.Protocol = ProtocolSparkplug
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    s.sparkplugSubscribe(ctx, rec)
+    return s.sparkplugSend(ctx, rec, msg, p)
+}
+
+func (s *HookService) sparkplugNodeDeath(ctx context.Context, rec *DeviceRecord, p *sparkplug.Payload) error {
+    node, err := s.loadSparkplugNode(ctx, rec.DeviceID)
+    if err != nil || node == nil {
+        return err
+    }
+    // the will of a previous connection
+    if bdSeq, ok := sparkplug.BdSeqOf(p); ok && node.HasBdSeq && bdSeq != node.BdSeq {
+        log.Infof("ignore stale NDEATH of %s, bdSeq %d, born %d", rec.DeviceID, bdSeq, node.BdSeq)
+        return nil
+    }
+    return s.sparkplugNodeGone(ctx, rec.DeviceID, node)
+}
+
+// sparkplugDisconnected ends the devices of an edge node disconnected
+// without NDEATH, the node itself is offline with its connection.
+func (s *HookService) sparkplugDisconnected(ctx context.Context, nodeId string) error {
+    node, err := s.loadSparkplugNode(ctx, nodeId)
+    if err != nil || node == nil {
+        return err
+    }
+    return s.sparkplugNodeGone(ctx, nodeId, node)
+}
+
+func (s *HookService) sparkplugNodeGone(ctx context.Context, nodeId string, node *spNode) error {
+    s.sparkplugDevicesOffline(ctx, node)
+    return s.store.Delete(ctx, sparkplugKey(nodeId), "")
+}
+
+// sparkplugDevicesOffline marks the devices of node offline, failures are
+// only logged.
+func (s *HookService) sparkplugDevicesOffline(ctx context.Context, node *spNode) {
+    for _, d := range node.Devices {
+        if err := s.sparkplugDeviceOffline(ctx, d.Entity); err != nil {
+            log.Errorf("mark sparkplug device %s offline err, %v", d.Entity, err)
+        }
+    }
+}
+
+func (s *HookService) sparkplugDeviceOffline(ctx context.Context, entity string) error {
+    if err := s.markOffline(ctx, entity); err != nil {
+        return err
+    }
+    return s.subscriptions.Terminate(ctx, entity)
+}
+
+func (s *HookService) sparkplugDeviceBirth(ctx context.Context, rec *DeviceRecord, t sparkplug.Topic, p *sparkplug.Payload, msg *pb.Message) error {
+    nodeId := rec.DeviceID
+    node, err := s.loadSparkplugNode(ctx, nodeId)
+    if err != nil {
+        return err
+    }
+    if node == nil {
+        s.requestRebirth(ctx, nodeId, t)
+        return nil
+    }
+    entity := s.sparkplug.deviceEntity(t)
+    devRec, err := s.registry.Get(ctx, entity)
+    if err != nil {
+        return err
+    }
+    owned := devRec != nil && devRec.Owner == rec.Owner && devRec.TenantID == rec.TenantID
+    if !owned && entity != nodeId {
+        // not bound yet, the entity must be of the owner of the node
+        if owned, err = s.ownsEntity(ctx, rec, entity); err != nil {
+            return err
+        }
+    }
+    if entity == nodeId || !owned {
+        log.Warnf("reject sparkplug device %s of edge node %s", entity, nodeId)
+        return nil
+    }
+    if node.Devices == nil {
+        node.Devices = make(map[string]*spDevice)
+    }
+    node.Devices[t.Device] = &spDevice{Entity: entity, Birth: sparkplug.NewBirth(p)}
+    if err := s.saveSparkplugNode(ctx, nodeId, node); err != nil {
+        return err
+    }
+    if _, err := s.registry.Update(ctx, entity, func(r *DeviceRecord) error {
+        r.Owner = rec.Owner
+        r.TenantID = rec.TenantID
+        r.Gateway = nodeId
+        return nil
+    }); err != nil {
+        return err
+    }
+    ci := &ConnectInfo{
+        ClientID:  msg.GetFrom(),
+        UserName:  entity,
+        Protocol:  ProtocolSparkplug,
+        Online:    true,
+        Timestamp: time.Now().UnixMilli(),
+    }
+    if rec.ConnectInfo != nil {
+        ci.PeerHost = rec.ConnectInfo.PeerHost
+    }
+    if devRec, err = s.markOnline(ctx, ci); err != nil {
+        return err
+    }
+    s.sparkplugSubscribe(ctx, devRec)
+    return s.sparkplugSend(ctx, devRec, msg, p)
+}
+
+// ownsEntity reports whether the owner of the edge node of rec owns the core
+// entity of a device not bound yet.
+func (s *HookService) ownsEntity(ctx context.Context, rec *DeviceRecord, entity string) (bool, error) {
+    e, err := s.getEntity(ctx, rec.TenantID, rec.Owner, entity)
+    if err != nil {
+        return false, err
+    }
+    return e != nil && e.Owner == rec.Owner, nil
+}
+
+func (s *HookService) sparkplugDeviceDeath(ctx context.Context, rec *DeviceRecord, t sparkplug.Topic) error {
+    node, err := s.loadSparkplugNode(ctx, rec.DeviceID)
+    if err != nil || node == nil {
+        return err
+    }
+    d, ok := node.Devices[t.Device]
+    if !ok {
+        return nil
+    }
+    delete(node.Devices, t.Device)
+    if err := s.saveSparkplugNode(ctx, rec.DeviceID, node); err != nil {
+        return err
+    }
+    return s.sparkplugDeviceOffline(ctx, d.Entity)
+}
+
+// sparkplugData forwards the metrics of NDATA and DDATA, a node or device
+// without birth, or a metric not in it, asks the node for a rebirth.
+func (s *HookService) sparkplugData(ctx context.Context, rec *DeviceRecord, t sparkplug.Topic, p *sparkplug.Payload, msg *pb.Message) error {
+    nodeId := rec.DeviceID
+    node, err := s.loadSparkplugNode(ctx, nodeId)
+    if err != nil {
+        return err
+    }
+    if node == nil {
+        s.requestRebirth(ctx, nodeId, t)
+        return nil
+    }
+    birth := node.Birth
+    if t.IsDevice() {
+        d, ok := node.Devices[t.Device]
+        if !ok {
+            s.requestRebirth(ctx, nodeId, t)
+            return nil
+        }
+        birth = d.Birth
+        if rec, err = s.registry.Get(ctx, d.Entity); err != nil {
+            return err
+        }
+        if rec == nil {
+            rec = &DeviceRecord{DeviceID: d.Entity}
+        }
+    }
+    for i := range p.Metrics {
+        if !birth.Resolve(&p.Metrics[i]) && p.Metrics[i].Name == "" {
+            s.requestRebirth(ctx, nodeId, t)
+        }
+    }
+    return s.sparkplugSend(ctx, rec, msg, p)
+}
+
+// requestRebirth sends the NCMD asking the node of t for its births.
+func (s *HookService) requestRebirth(ctx context.Context, nodeId string, t sparkplug.Topic) {
+    if !s.sparkplug.rebirthDue(nodeId) {
+        return
+    }
+    log.Infof("request rebirth of sparkplug edge node %s", nodeId)
+    cmd := sparkplug.Topic{Group: t.Group, Type: sparkplug.NCMD, Node: t.Node}
+    metrics := []sparkplug.Metric{{Name: sparkplug.Rebirth, DataType: sparkplug.Boolean, Value: true}}
+    if err := s.publishSparkplug(ctx, nodeId, cmd, metrics); err != nil {
+        log.Errorf("request rebirth of %s err, %v", nodeId, err)
+    }
+}
+
+func (s *HookService) publishSparkplug(ctx context.Context, nodeId string, t sparkplug.Topic, metrics []sparkplug.Metric) error {
+    p := &sparkplug.Payload{Timestamp: uint64(time.Now().UnixMilli()), Metrics: metrics}
+    b, err := p.Marshal()
+    if err != nil {
+        return err
+    }
+    return s.emqx.PublishBinary(ctx, nodeId, buildTopic(nodeId, t.String()), defaultDownStreamClientId, 0, false, b)
+}
+
+// sparkplugDownlink sends the commands and attributes of dl to the edge
+// node or device of rec as metrics of an NCMD or DCMD, typed as in its
+// birth.
+func (s *HookService) sparkplugDownlink(ctx context.Context, rec *DeviceRecord, dl downlink) error {
+    nodeId := rec.DeviceID
+    if rec.Gateway != "" {
+        nodeId = rec.Gateway
+    }
+    node, err := s.loadSparkplugNode(ctx, nodeId)
+    if err != nil {
+        return err
+    }
+    if node == nil {
+        return errors.Errorf("sparkplug edge node %s is not born", nodeId)
+    }
+    t := sparkplug.Topic{Group: node.Group, Type: sparkplug.NCMD, Node: node.Node}
+    birth := node.Birth
+    if rec.Gateway != "" {
+        id, d := node.deviceOf(rec.DeviceID)
+        if d == nil {
+            return errors.Errorf("sparkplug device %s is not born", rec.DeviceID)
+        }
+        t.Type, t.Device, birth = sparkplug.DCMD, id, d.Birth
+    }
+
+    values := make(map[string]interface{})
+    switch {
+    case dl.Topic == CommandTopic:
+        commands, _ := dl.Value.(map[string]interface{})
+        for name, v := range commands {
+            invocation, _ := v.(map[string]interface{})
+            values[name] = invocation["input"]
+        }
+    case strings.HasPrefix(dl.Topic, CommandTopic+"/"):
+        invocation, _ := dl.Value.(map[string]interface{})
+        values[strings.TrimPrefix(dl.Topic, CommandTopic+"/")] = invocation["input"]
+    case dl.Topic == AttributesTopic:
+        values, _ = dl.Value.(map[string]interface{})
+    case strings.HasPrefix(dl.Topic, AttributesTopic+"/"):
+        values[strings.TrimPrefix(dl.Topic, AttributesTopic+"/")] = dl.Value
+    default:
+        log.Warnf("drop %s of sparkplug %s", dl.Topic, rec.DeviceID)
+        return nil
+    }
+
+    metrics := make([]sparkplug.Metric, 0, len(values))
+    for name, v := range values {
+        dt := sparkplug.Infer(v)
+        if def, ok := birth.Def(name); ok {
+            dt = def.DataType
+        }
+        value, err := sparkplug.Convert(dt, v)
+        if err != nil {
+            log.Warnf("sparkplug metric %s of %s, %v", name, rec.DeviceID, err)
+            continue
+        }
+        metrics = append(metrics, sparkplug.Metric{Name: name, DataType: dt, Value: value})
+    }
+    if len(metrics) == 0 {
+        return nil
+    }
+    sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+    return s.publishSparkplug(ctx, nodeId, t, metrics)
+}
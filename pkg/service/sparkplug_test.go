@@ -0,0 +1,212 @@
+package service_test
+
+import (
+    "context"
+    "testing"
+
+    "github.com/tidwall/gjson"
+    "github.com/tkeel-io/iothub/pkg/exhooktest"
+    "github.com/tkeel-io/iothub/pkg/service"
+    "github.com/tkeel-io/iothub/pkg/sparkplug"
+)
+
+func sparkplugEnabled(c *service.Config) {
+    c.Sparkplug.Enabled = true
+}
+
+func sparkplugPayload(t *testing.T, seq uint64, metrics ...sparkplug.Metric) []byte {
+    t.Helper()
+    b, err := (&sparkplug.Payload{Timestamp: 1650000000000, Seq: seq, HasSeq: true, Metrics: metrics}).Marshal()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return b
+}
+
+// connectEdgeNode connects edge1 and births it and its device pump, both
+// of u1.
+func connectEdgeNode(t *testing.T, h *exhooktest.Harness) *exhooktest.Device {
+    t.Helper()
+    ctx := context.Background()
+    h.Keel.AddToken("token1", "edge1", "u1", "t1")
+    h.Keel.AddEntity(exhooktest.Entity{ID: "pump", Owner: "u1", TenantID: "t1", Type: "device"})
+    d := h.Device("edge1", "token1")
+    if ok, err := d.Connect(ctx); err != nil || !ok {
+        t.Fatalf("connect %v, %v", ok, err)
+    }
+    if ok, err := d.Subscribe(ctx, "spBv1.0/g1/NCMD/edge1", "spBv1.0/g1/DCMD/edge1/+"); err != nil || !ok[0] || !ok[1] {
+        t.Fatalf("subscribe %v, %v", ok, err)
+    }
+    nbirth := sparkplugPayload(t, 0,
+        sparkplug.Metric{Name: sparkplug.BdSeq, DataType: sparkplug.Int64, Value: int64(3)},
+        sparkplug.Metric{Name: sparkplug.Rebirth, DataType: sparkplug.Boolean, Value: false},
+        sparkplug.Metric{Name: "uptime", Alias: 1, HasAlias: true, DataType: sparkplug.UInt32, Value: uint64(10)},
+    )
+    if ok, err := d.Publish(ctx, "spBv1.0/g1/NBIRTH/edge1", nbirth); err != nil || !ok {
+        t.Fatalf("nbirth %v, %v", ok, err)
+    }
+    dbirth := sparkplugPayload(t, 1,
+        sparkplug.Metric{Name: "speed", Alias: 2, HasAlias: true, DataType: sparkplug.Int16, Value: int64(100)},
+        sparkplug.Metric{Name: "running", Alias: 3, HasAlias: true, DataType: sparkplug.Boolean, Value: true},
+    )
+    if ok, err := d.Publish(ctx, "spBv1.0/g1/DBIRTH/edge1/pump", dbirth); err != nil || !ok {
+        t.Fatalf("dbirth %v, %v", ok, err)
+    }
+    return d
+}
+
+func TestSparkplug_Uplink(t *testing.T) {
+    h := exhooktest.New(t, sparkplugEnabled)
+    ctx := context.Background()
+    d := connectEdgeNode(t, h)
+
+    if got := eventTypes(t, h); got != "connectinfo telemetry connectinfo telemetry" {
+        t.Fatalf("events %s", got)
+    }
+    if got := subscriptionTopics(h); got != "realtime:sub-core realtime:sub-core" {
+        t.Fatalf("subscriptions %s", got)
+    }
+    ev := lastEvent(t, h)
+    if id, values := ev.Get("id").String(), rawValues(t, ev); id != "pump" || values != `{"running":true,"speed":100}` {
+        t.Fatalf("dbirth telemetry %s %s", id, values)
+    }
+
+    // the entities of another owner, or missing in core, are not claimed
+    h.Keel.AddEntity(exhooktest.Entity{ID: "valve", Owner: "u2", TenantID: "t1", Type: "device"})
+    for _, device := range []string{"valve", "fan"} {
+        dbirth := sparkplugPayload(t, 1, sparkplug.Metric{Name: "open", DataType: sparkplug.Boolean, Value: true})
+        if _, err := d.Publish(ctx, "spBv1.0/g1/DBIRTH/edge1/"+device, dbirth); err != nil {
+            t.Fatal(err)
+        }
+        if rec, err := h.Service.Registry().Get(ctx, device); err != nil || rec != nil {
+            t.Fatalf("record of %s %+v, %v", device, rec, err)
+        }
+    }
+    if got := eventTypes(t, h); got != "connectinfo telemetry connectinfo telemetry" {
+        t.Fatalf("events of rejected devices %s", got)
+    }
+
+    // data by alias, typed by the birth
+    ddata := sparkplugPayload(t, 2, sparkplug.Metric{Alias: 2, HasAlias: true, DataType: sparkplug.Int16, Value: int64(-5)})
+    if _, err := d.Publish(ctx, "spBv1.0/g1/DDATA/edge1/pump", ddata); err != nil {
+        t.Fatal(err)
+    }
+    eventTypes(t, h)
+    ev = lastEvent(t, h)
+    if path, values := ev.Get("data.rawData.path").String(), rawValues(t, ev); path != "pump/v1/devices/me/telemetry" || values != `{"speed":-5}` {
+        t.Fatalf("ddata %s %s", path, values)
+    }
+
+    // an unknown alias asks for a rebirth, once
+    for i := 0; i < 2; i++ {
+        ndata := sparkplugPayload(t, 3, sparkplug.Metric{Alias: 9, HasAlias: true, DataType: sparkplug.Int32, Value: int64(1)})
+        if _, err := d.Publish(ctx, "spBv1.0/g1/NDATA/edge1", ndata); err != nil {
+            t.Fatal(err)
+        }
+    }
+    published := h.Emqx.Published()
+    if len(published) != 1 || published[0].Topic != "edge1/spBv1.0/g1/NCMD/edge1" {
+        t.Fatalf("published %+v", published)
+    }
+    b, err := published[0].Bytes()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if p, err := sparkplug.Unmarshal(b); err != nil || len(p.Metrics) != 1 || p.Metrics[0].Name != sparkplug.Rebirth || p.Metrics[0].Value != true {
+        t.Fatalf("rebirth %+v, %v", p, err)
+    }
+
+    // a stale will is ignored, the death of the node ends its devices
+    ndeath := func(bdSeq int64) []byte {
+        b, _ := (&sparkplug.Payload{Metrics: []sparkplug.Metric{{Name: sparkplug.BdSeq, DataType: sparkplug.Int64, Value: bdSeq}}}).Marshal()
+        return b
+    }
+    if _, err := d.Publish(ctx, "spBv1.0/g1/NDEATH/edge1", ndeath(2)); err != nil {
+        t.Fatal(err)
+    }
+    if got := subscriptionTopics(h); got != "realtime:sub-core realtime:sub-core" {
+        t.Fatalf("subscriptions after stale death %s", got)
+    }
+    if _, err := d.Publish(ctx, "spBv1.0/g1/NDEATH/edge1", ndeath(3)); err != nil {
+        t.Fatal(err)
+    }
+    if got := subscriptionTopics(h); got != "realtime:sub-core" {
+        t.Fatalf("subscriptions after death %s", got)
+    }
+    ev = lastEvent(t, h)
+    if ev.Get("id").String() != "pump" || gjson.Get(rawValues(t, ev), "_online").Bool() {
+        t.Fatalf("device offline %s", ev.Raw)
+    }
+}
+
+func TestSparkplug_Downlink(t *testing.T) {
+    h := exhooktest.New(t, sparkplugEnabled)
+    ctx := context.Background()
+    connectEdgeNode(t, h)
+
+    event := map[string]interface{}{
+        "id":    "pump",
+        "owner": "u1",
+        "properties": map[string]interface{}{
+            "commands":   map[string]interface{}{"running": map[string]interface{}{"id": "c1", "input": false}},
+            "attributes": map[string]interface{}{"speed": 120.0, "mode": "auto"},
+        },
+    }
+    if _, err := h.CoreEvent(ctx, exhooktest.CoreTopic, event); err != nil {
+        t.Fatal(err)
+    }
+    published := h.Emqx.Published()
+    if len(published) != 2 {
+        t.Fatalf("published %+v", published)
+    }
+    var metrics []sparkplug.Metric
+    for _, p := range published {
+        if p.Topic != "edge1/spBv1.0/g1/DCMD/edge1/pump" {
+            t.Fatalf("published to %s", p.Topic)
+        }
+        b, err := p.Bytes()
+        if err != nil {
+            t.Fatal(err)
+        }
+        payload, err := sparkplug.Unmarshal(b)
+        if err != nil {
+            t.Fatal(err)
+        }
+        metrics = append(metrics, payload.Metrics...)
+    }
+    types := make(map[string]sparkplug.DataType)
+    values := make(map[string]interface{})
+    for _, m := range metrics {
+        types[m.Name], values[m.Name] = m.DataType, m.Value
+    }
+    // typed as born, or inferred
+    if types["speed"] != sparkplug.Int16 || values["speed"] != int64(120) ||
+        types["running"] != sparkplug.Boolean || values["running"] != false ||
+        types["mode"] != sparkplug.String || values["mode"] != "auto" {
+        t.Fatalf("metrics %+v", metrics)
+    }
+}
+
+func TestSparkplug_Raw(t *testing.T) {
+    h := exhooktest.New(t)
+    ctx := context.Background()
+    h.Keel.AddToken("token1", "edge1", "u1", "t1")
+    d := h.Device("edge1", "token1")
+    if ok, err := d.Connect(ctx); err != nil || !ok {
+        t.Fatalf("connect %v, %v", ok, err)
+    }
+    // not decoded unless enabled
+    if ok, err := d.Subscribe(ctx, "spBv1.0/g1/NCMD/edge1"); err != nil || ok[0] {
+        t.Fatalf("subscribe %v, %v", ok, err)
+    }
+    nbirth := sparkplugPayload(t, 0, sparkplug.Metric{Name: sparkplug.BdSeq, DataType: sparkplug.Int64, Value: int64(3)})
+    if ok, err := d.Publish(ctx, "spBv1.0/g1/NBIRTH/edge1", nbirth); err != nil || !ok {
+        t.Fatalf("nbirth %v, %v", ok, err)
+    }
+    if err := d.Disconnect(ctx); err != nil {
+        t.Fatal(err)
+    }
+    if got := eventTypes(t, h); got != "connectinfo raw connectinfo" {
+        t.Fatalf("events %s", got)
+    }
+}
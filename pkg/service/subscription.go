@@ -0,0 +1,228 @@
+package service
+
+import (
+    "context"
+    "crypto/md5"
+    "fmt"
+    "sort"
+    "strings"
+
+    "github.com/pkg/errors"
+    "github.com/tkeel-io/kit/log"
+)
+
+const (
+    // IoTHub 订阅设备的全部数据 “*”
+    subscriptionItemType = "*"
+
+    // dapr pubsub topics core publishes to, one per subscription mode
+    corePubsubTopic        = "sub-core"
+    coreChangedPubsubTopic = "sub-core-changed"
+
+    // rounds of reconciliation before giving up on a device whose topics
+    // keep changing
+    reconcileRounds = 3
+)
+
+func pubsubTopicOfMode(mode string) string {
+    if mode == onChangeMode {
+        return coreChangedPubsubTopic
+    }
+    return corePubsubTopic
+}
+
+func modeOfPubsubTopic(topic string) string {
+    if topic == coreChangedPubsubTopic {
+        return onChangeMode
+    }
+    return realtimeMode
+}
+
+// subscriptionID is the core subscription id of devId selecting sel in mode.
+// The realtime "*" id is md5(devId+"*"), the same as before modes existed.
+func subscriptionID(devId, mode, sel string) string {
+    key := sel
+    if mode != realtimeMode {
+        key = mode + ":" + sel
+    }
+    return fmt.Sprintf("sub-%x", md5.Sum([]byte(devId+key)))
+}
+
+// coreFilter is the core filter of subscription subId selecting sel of devId.
+func coreFilter(subId, devId, sel string) string {
+    items := strings.Split(sel, ",")
+    for i, item := range items {
+        items[i] = devId + "." + item
+    }
+    return fmt.Sprintf("insert into %s select %s", subId, strings.Join(items, ", "))
+}
+
+// mergeItems returns the minimal select list of items, a property covers
+// its keys and "*" covers everything.
+func mergeItems(items map[string]bool) string {
+    if items[subscriptionItemType] {
+        return subscriptionItemType
+    }
+    out := make([]string, 0, len(items))
+    for item := range items {
+        if i := strings.IndexByte(item, '.'); i > 0 && items[item[:i]] {
+            continue
+        }
+        out = append(out, item)
+    }
+    sort.Strings(out)
+    return strings.Join(out, ",")
+}
+
+// desiredSubscriptions returns the select list of each mode needed to serve
+// the topic filters.
+func desiredSubscriptions(topics []string) map[string]string {
+    byMode := make(map[string]map[string]bool)
+    for _, filter := range topics {
+        for _, st := range expandFilter(filter) {
+            if byMode[st.Mode] == nil {
+                byMode[st.Mode] = make(map[string]bool)
+            }
+            byMode[st.Mode][st.coreItem()] = true
+        }
+    }
+    desired := make(map[string]string, len(byMode))
+    for mode, items := range byMode {
+        desired[mode] = mergeItems(items)
+    }
+    return desired
+}
+
+// coreSubscriber creates and deletes device subscriptions in core.
+type coreSubscriber interface {
+    CreateSubscribeEntity(ctx context.Context, owner, devId, subId, selects, mode string) error
+    DeleteSubscribeEntity(ctx context.Context, owner, devId, subId string) error
+}
+
+// SubscriptionManager keeps the MQTT topics each device subscribed in its
+// DeviceRecord and reconciles them with the fewest core subscriptions: at
+// most one per subscription mode, selecting the union of the properties
+// behind the topics.
+//
+// Every step is idempotent: a core subscription id is derived from the
+// device, mode and selection, it is recorded only once core accepted it, and
+// it is forgotten only once core deleted it, so a failed step is retried by
+// the next subscribe, unsubscribe or session termination.
+type SubscriptionManager struct {
+    registry *DeviceRegistry
+    core     coreSubscriber
+}
+
+func NewSubscriptionManager(registry *DeviceRegistry, core coreSubscriber) *SubscriptionManager {
+    return &SubscriptionManager{registry: registry, core: core}
+}
+
+// Subscribe adds topics of devId.
+func (m *SubscriptionManager) Subscribe(ctx context.Context, devId string, topics []string) error {
+    rec, err := m.registry.Get(ctx, devId)
+    if err != nil {
+        return err
+    }
+    if rec == nil {
+        return errors.Errorf("unknown device %s", devId)
+    }
+    if _, err := m.registry.Update(ctx, devId, func(rec *DeviceRecord) error {
+        for _, topic := range topics {
+            rec.AddTopic(topic)
+        }
+        return nil
+    }); err != nil {
+        return err
+    }
+    return m.reconcile(ctx, devId)
+}
+
+// Unsubscribe removes topics of devId.
+func (m *SubscriptionManager) Unsubscribe(ctx context.Context, devId string, topics []string) error {
+    if _, err := m.registry.Update(ctx, devId, func(rec *DeviceRecord) error {
+        for _, topic := range topics {
+            rec.RemoveTopic(topic)
+        }
+        return nil
+    }); err != nil {
+        return err
+    }
+    return m.reconcile(ctx, devId)
+}
+
+// Terminate drops all topics of devId when its session ends, persistent
+// sessions keep their subscriptions over disconnects until then.
+func (m *SubscriptionManager) Terminate(ctx context.Context, devId string) error {
+    rec, err := m.registry.Get(ctx, devId)
+    if err != nil || rec == nil {
+        return err
+    }
+    if len(rec.Topics) > 0 {
+        if _, err := m.registry.Update(ctx, devId, func(rec *DeviceRecord) error {
+            rec.Topics = nil
+            return nil
+        }); err != nil {
+            return err
+        }
+    }
+    return m.reconcile(ctx, devId)
+}
+
+func (m *SubscriptionManager) setSubscription(ctx context.Context, devId, mode string, sub CoreSubscription) error {
+    _, err := m.registry.Update(ctx, devId, func(rec *DeviceRecord) error {
+        rec.setSubscription(mode, sub)
+        return nil
+    })
+    return err
+}
+
+// reconcile creates, replaces and deletes the core subscriptions of devId
+// until they match its topics.
+func (m *SubscriptionManager) reconcile(ctx context.Context, devId string) error {
+    for i := 0; i < reconcileRounds; i++ {
+        rec, err := m.registry.Get(ctx, devId)
+        if err != nil || rec == nil {
+            return err
+        }
+        desired := desiredSubscriptions(rec.Topics)
+        changed := false
+        for mode, sel := range desired {
+            cur := rec.Subscriptions[mode]
+            if cur.ID != "" && cur.Select == sel {
+                continue
+            }
+            changed = true
+            sub := CoreSubscription{ID: subscriptionID(devId, mode, sel), Select: sel}
+            log.Debugf("create %s subscription %s of %s, select %s", mode, sub.ID, devId, sel)
+            if err := m.core.CreateSubscribeEntity(ctx, rec.Owner, devId, sub.ID, sel, mode); err != nil {
+                return err
+            }
+            if cur.ID != "" && cur.ID != sub.ID {
+                log.Debugf("delete replaced subscription %s of %s", cur.ID, devId)
+                if err := m.core.DeleteSubscribeEntity(ctx, rec.Owner, devId, cur.ID); err != nil {
+                    return err
+                }
+            }
+            if err := m.setSubscription(ctx, devId, mode, sub); err != nil {
+                return err
+            }
+        }
+        for mode, cur := range rec.Subscriptions {
+            if _, ok := desired[mode]; ok {
+                continue
+            }
+            changed = true
+            log.Debugf("delete %s subscription %s of %s", mode, cur.ID, devId)
+            if err := m.core.DeleteSubscribeEntity(ctx, rec.Owner, devId, cur.ID); err != nil {
+                return err
+            }
+            if err := m.setSubscription(ctx, devId, mode, CoreSubscription{}); err != nil {
+                return err
+            }
+        }
+        if !changed {
+            return nil
+        }
+    }
+    return errors.Errorf("subscriptions of %s keep changing", devId)
+}
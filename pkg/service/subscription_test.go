@@ -0,0 +1,159 @@
+package service
+
+import (
+    "context"
+    "errors"
+    "testing"
+
+    "github.com/tkeel-io/iothub/pkg/store"
+)
+
+type fakeCore struct {
+    // subscription id to filter
+    subs      map[string]string
+    creates   int
+    deleteErr error
+}
+
+func (f *fakeCore) CreateSubscribeEntity(_ context.Context, _, devId, subId, selects, mode string) error {
+    f.creates++
+    f.subs[subId] = mode + " " + coreFilter(subId, devId, selects)
+    return nil
+}
+
+func (f *fakeCore) DeleteSubscribeEntity(_ context.Context, _, _, subId string) error {
+    if f.deleteErr != nil {
+        return f.deleteErr
+    }
+    delete(f.subs, subId)
+    return nil
+}
+
+func newTestSubscriptionManager(t *testing.T) (*SubscriptionManager, *DeviceRegistry, *fakeCore) {
+    registry := NewDeviceRegistry(store.NewMemoryStore())
+    if _, err := registry.Update(context.Background(), "dev1", func(rec *DeviceRecord) error {
+        rec.Owner = "owner1"
+        return nil
+    }); err != nil {
+        t.Fatal(err)
+    }
+    core := &fakeCore{subs: make(map[string]string)}
+    return NewSubscriptionManager(registry, core), registry, core
+}
+
+func TestSubscriptionManager_Lifecycle(t *testing.T) {
+    ctx := context.Background()
+    m, registry, core := newTestSubscriptionManager(t)
+    if err := m.Subscribe(ctx, "dev1", []string{AttributesTopic, CommandTopic}); err != nil {
+        t.Fatal(err)
+    }
+    if err := m.Subscribe(ctx, "dev1", []string{AttributesTopic}); err != nil {
+        t.Fatal(err)
+    }
+    if core.creates != 1 || len(core.subs) != 1 {
+        t.Fatalf("unexpected core subscriptions %v, %d creates", core.subs, core.creates)
+    }
+
+    if err := m.Unsubscribe(ctx, "dev1", []string{AttributesTopic}); err != nil {
+        t.Fatal(err)
+    }
+    if len(core.subs) != 1 {
+        t.Fatal("core subscription deleted while a topic is left")
+    }
+    if err := m.Unsubscribe(ctx, "dev1", []string{CommandTopic}); err != nil {
+        t.Fatal(err)
+    }
+    rec, _ := registry.Get(ctx, "dev1")
+    if len(core.subs) != 0 || len(rec.Subscriptions) != 0 {
+        t.Fatalf("core subscription not deleted %v, %+v", core.subs, rec)
+    }
+    // unsubscribe again is a no-op
+    if err := m.Unsubscribe(ctx, "dev1", []string{CommandTopic}); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestSubscriptionManager_Terminate(t *testing.T) {
+    ctx := context.Background()
+    m, registry, core := newTestSubscriptionManager(t)
+    if err := m.Subscribe(ctx, "dev1", []string{AttributesTopic}); err != nil {
+        t.Fatal(err)
+    }
+    // a failed delete is retried by the next termination
+    core.deleteErr = errors.New("core unavailable")
+    if err := m.Terminate(ctx, "dev1"); err == nil {
+        t.Fatal("expected delete error")
+    }
+    rec, _ := registry.Get(ctx, "dev1")
+    if len(rec.Topics) != 0 || len(rec.Subscriptions) == 0 {
+        t.Fatalf("unexpected record after failed delete %+v", rec)
+    }
+    core.deleteErr = nil
+    if err := m.Terminate(ctx, "dev1"); err != nil {
+        t.Fatal(err)
+    }
+    if len(core.subs) != 0 {
+        t.Fatalf("core subscription not deleted %v", core.subs)
+    }
+    if err := m.Terminate(ctx, "unknown"); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestSubscriptionManager_Merge(t *testing.T) {
+    ctx := context.Background()
+    m, registry, core := newTestSubscriptionManager(t)
+    topics := []string{
+        AttributesTopic + "/temperature",
+        AttributesTopic + "/humidity",
+        CommandTopic + "/reboot",
+        OnChangeTopicPrefix + "attributes/mode",
+    }
+    if err := m.Subscribe(ctx, "dev1", topics); err != nil {
+        t.Fatal(err)
+    }
+    rec, _ := registry.Get(ctx, "dev1")
+    realtime, changed := rec.Subscriptions[realtimeMode], rec.Subscriptions[onChangeMode]
+    if realtime.Select != "attributes.humidity,attributes.temperature,commands.reboot" || changed.Select != "attributes.mode" {
+        t.Fatalf("unexpected subscriptions %+v", rec.Subscriptions)
+    }
+    if len(core.subs) != 2 || core.subs[changed.ID] != onChangeMode+" insert into "+changed.ID+" select dev1.attributes.mode" {
+        t.Fatalf("unexpected core subscriptions %v", core.subs)
+    }
+
+    // the whole attributes replace the single ones
+    if err := m.Subscribe(ctx, "dev1", []string{AttributesTopic}); err != nil {
+        t.Fatal(err)
+    }
+    rec, _ = registry.Get(ctx, "dev1")
+    if sel := rec.Subscriptions[realtimeMode].Select; sel != "attributes,commands.reboot" {
+        t.Fatalf("unexpected realtime selection %s", sel)
+    }
+    if _, ok := core.subs[realtime.ID]; ok || len(core.subs) != 2 {
+        t.Fatalf("replaced subscription not deleted %v", core.subs)
+    }
+}
+
+func TestRouteCoreEvent(t *testing.T) {
+    event := `{"id":"dev1","properties":{"attributes":{"temperature":20,"mode":"eco"},"commands":{"reboot":{"input":{}}}}}`
+    topics := []string{
+        AttributesTopic + "/temperature",
+        AttributesTopic + "/humidity",
+        CommandTopic + "/reboot",
+        OnChangeTopicPrefix + "attributes/mode",
+    }
+    downlinks := routeCoreEvent(event, realtimeMode, topics)
+    if len(downlinks) != 2 || downlinks[0].Topic != AttributesTopic+"/temperature" || downlinks[1].Topic != CommandTopic+"/reboot" {
+        t.Fatalf("unexpected realtime downlinks %+v", downlinks)
+    }
+    downlinks = routeCoreEvent(event, onChangeMode, topics)
+    if len(downlinks) != 1 || downlinks[0].Value != "eco" {
+        t.Fatalf("unexpected onchange downlinks %+v", downlinks)
+    }
+
+    // each key to its own topic, once
+    downlinks = routeCoreEvent(event, realtimeMode, []string{AttributesTopic + "/+", "$share/g/" + AttributesTopic + "/temperature"})
+    if len(downlinks) != 2 || downlinks[0].Topic != AttributesTopic+"/temperature" || downlinks[1].Topic != AttributesTopic+"/mode" {
+        t.Fatalf("unexpected wildcard downlinks %+v", downlinks)
+    }
+}
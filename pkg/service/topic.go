@@ -6,9 +6,11 @@ import (
     "strings"
     "time"
 
-    "github.com/Shopify/sarama"
     pb "github.com/tkeel-io/iothub/api/iothub/v1"
+    "github.com/tkeel-io/iothub/pkg/tracing"
     "github.com/tkeel-io/kit/log"
+    transportHTTP "github.com/tkeel-io/kit/transport/http"
+    "go.opentelemetry.io/otel/trace"
 
     "github.com/tidwall/gjson"
 )
@@ -20,11 +22,75 @@ var _validTopics = map[string]string{
     RawDataTopic:     _rawPropPath,
 }
 
-func validSubTopic(topic string) bool {
-    if _, ok := _validTopics[topic]; ok {
-        return true
+// subTopic is an iothub topic a device subscription covers.
+type subTopic struct {
+    // Base is the topic without mode and key, one of _validTopics
+    Base string
+    // Key narrows Base to one attribute or command, "+" to each of them
+    Key string
+    // Mode is the core subscription mode, realtimeMode or onChangeMode
+    Mode string
+}
+
+// Name is the topic data of st is published to.
+func (st subTopic) Name() string {
+    name := st.Base
+    if st.Mode == onChangeMode {
+        name = OnChangeTopicPrefix + strings.TrimPrefix(st.Base, deviceTopicPrefix)
+    }
+    if st.Key != "" {
+        name += "/" + st.Key
+    }
+    return name
+}
+
+func (st subTopic) withKey(key string) subTopic {
+    st.Key = key
+    return st
+}
+
+func validSubTopic(filter string) bool {
+    return len(expandFilter(filter)) > 0
+}
+
+// coreItem is the core property selected for st, "*" for all.
+func (st subTopic) coreItem() string {
+    var prop string
+    switch st.Base {
+    case AttributesTopic:
+        prop = _attrProp
+    case CommandTopic:
+        prop = _cmdProp
+    case RawDataTopic:
+        prop = _rawProp
+    default:
+        return "*"
+    }
+    if st.Key != "" && st.Key != topicKeyWildcard {
+        return prop + "." + st.Key
+    }
+    return prop
+}
+
+// dataPath is the path of the data published to st in a core event.
+func (st subTopic) dataPath() string {
+    path := _validTopics[st.Base]
+    if st.Key != "" && st.Key != topicKeyWildcard {
+        path += "." + escapePath(st.Key)
+    }
+    return path
+}
+
+// escapePath escapes the gjson path syntax in key.
+func escapePath(key string) string {
+    var b strings.Builder
+    for _, c := range key {
+        if strings.ContainsRune(`.*?|#@\`, c) {
+            b.WriteByte('\\')
+        }
+        b.WriteRune(c)
     }
-    return false
+    return b.String()
 }
 
 func getKeyFromTopic(topic string) (string, bool) {
@@ -40,9 +106,8 @@ type TopicService struct {
     cancel  context.CancelFunc
     hookSvc *HookService
 
-    producer sarama.AsyncProducer
-    // the topic pub to core
-    corePubTopic string
+    // ordered outbound channel to core, shared with hookSvc
+    forwarder *Forwarder
 }
 
 const (
@@ -55,41 +120,20 @@ const (
 )
 
 func NewTopicService(ctx context.Context, hookSvc *HookService) (*TopicService, error) {
-    config := sarama.NewConfig()
-    config.Producer.Return.Successes = true
-    config.Producer.Return.Errors = true
-    ad := envWithDefault(_envKafkaService, `kafka.keel-system.svc.cluster.local:9092`)
-    ads := strings.Split(ad, ";")
-    p, err := sarama.NewAsyncProducer(ads, config)
-    // TODO: error
-    if err != nil {
-        panic("error")
-    }
-    go func(p sarama.AsyncProducer) {
-        errs := p.Errors()
-        success := p.Successes()
-        for {
-            select {
-            case rc := <-errs:
-                if rc != nil {
-                    // TODO:
-                }
-                return
-            case _ = <-success:
-            }
-        }
-    }(p)
-
     ctx, cancel := context.WithCancel(ctx)
     return &TopicService{
-        ctx:          ctx,
-        cancel:       cancel,
-        hookSvc:      hookSvc,
-        producer:     p,
-        corePubTopic: envWithDefault(_envCorePubTopic, "core-pub"),
+        ctx:       ctx,
+        cancel:    cancel,
+        hookSvc:   hookSvc,
+        forwarder: hookSvc.forwarder,
     }, nil
 }
 
+// Close stops handling core events, the following ones are retried.
+func (s *TopicService) Close() {
+    s.cancel()
+}
+
 func getValue(strReqJson string, subTypePath string) (bool, interface{}) {
     res := gjson.Get(strReqJson, subTypePath)
     //
@@ -103,6 +147,10 @@ func buildTopic(devId, topic string) string {
 
 //
 const (
+    _cmdProp  = `commands`
+    _attrProp = `attributes`
+    _rawProp  = `rawDown`
+
     _cmdPropPath  = `properties.commands`
     _attrPropPath = `properties.attributes`
     // 原始数据只取 value 后面的
@@ -143,48 +191,168 @@ func getTopicFromCoreReq(strReqJson string) string {
     return ""
 }
 
+// commandInput reports whether command data is an invocation, not a response.
+func commandInput(v interface{}) bool {
+    b, err := json.Marshal(v)
+    return err == nil && strings.Contains(string(b), "input")
+}
+
+// downlink is data of a core event published to a device topic.
+type downlink struct {
+    Topic string
+    Value interface{}
+}
+
+// routeCoreEvent returns the downlinks of a core event delivered in mode
+// to the topic filters subscribed by the device, once per topic.
+func routeCoreEvent(strReqJson, mode string, filters []string) []downlink {
+    var out []downlink
+    seen := make(map[string]bool)
+    add := func(st subTopic, v interface{}) {
+        if v == nil || (st.Base == CommandTopic && !commandInput(v)) || seen[st.Name()] {
+            return
+        }
+        seen[st.Name()] = true
+        out = append(out, downlink{Topic: st.Name(), Value: v})
+    }
+    for _, filter := range filters {
+        for _, st := range expandFilter(filter) {
+            if st.Mode != mode || st.Base == DeviceDebugTopic {
+                continue
+            }
+            res := gjson.Get(strReqJson, st.dataPath())
+            if !res.Exists() {
+                continue
+            }
+            if st.Key != topicKeyWildcard {
+                add(st, res.Value())
+                continue
+            }
+            // each key to its own topic
+            res.ForEach(func(key, value gjson.Result) bool {
+                if validTopicKey(key.String()) {
+                    add(st.withKey(key.String()), value.Value())
+                }
+                return true
+            })
+        }
+    }
+    return out
+}
+
+// legacyRouteCoreEvent routes a core event of a device without recorded
+// topics, by the kind of data in it.
+func legacyRouteCoreEvent(strReqJson string) []downlink {
+    topic := getTopicFromCoreReq(strReqJson)
+    propPath, ok := getKeyFromTopic(topic)
+    if !ok || propPath == "" {
+        return nil
+    }
+    ok, v := getValue(strReqJson, propPath)
+    if !ok || v == nil {
+        return nil
+    }
+    return []downlink{{Topic: topic, Value: v}}
+}
+
 //
 func (s *TopicService) TopicEventHandler(ctx context.Context, req *pb.TopicEventRequest) (out *pb.TopicEventResponse, err error) {
+    ctx = tracing.ExtractHTTP(ctx, transportHTTP.HeaderFromContext(ctx))
+    ctx, span := tracing.Start(ctx, "TopicEventHandler", trace.WithSpanKind(trace.SpanKindServer))
+    defer func() { tracing.End(span, err) }()
     log.Debugf("receive pubsub topic: %s, payload: %v", req.GetTopic(), req.GetData())
+    // closing, let dapr redeliver the event to another instance
+    if s.ctx.Err() != nil {
+        return &pb.TopicEventResponse{Status: SubscriptionResponseStatusRetry}, nil
+    }
 
     bys, err := req.Data.MarshalJSON()
     if err != nil {
         return nil, err
     }
     log.Debugf("receive pubsub topic: %s, payload: %v", req.GetTopic(), string(bys))
-    // TODO: 根据变化的内容确定发送到哪个 topic
     strReqJson := string(bys)
     devId := gjson.Get(strReqJson, "id").String()
+    mode := modeOfPubsubTopic(req.GetTopic())
 
-    // TODO: topic 验证
-    topic := getTopicFromCoreReq(strReqJson)
-
-    if !validSubTopic(topic) {
-        return &pb.TopicEventResponse{Status: SubscriptionResponseStatusSuccess}, err
+    // 根据设备订阅的 topic 确定发送到哪个 topic
+    rec, err := s.hookSvc.registry.Get(ctx, devId)
+    if err != nil {
+        return &pb.TopicEventResponse{Status: SubscriptionResponseStatusRetry}, err
+    }
+    var downlinks []downlink
+    if rec != nil && len(rec.Topics) > 0 {
+        downlinks = routeCoreEvent(strReqJson, mode, rec.Topics)
+    } else if mode == realtimeMode {
+        downlinks = legacyRouteCoreEvent(strReqJson)
+    }
+    if len(downlinks) == 0 {
+        return &pb.TopicEventResponse{Status: SubscriptionResponseStatusSuccess}, nil
     }
 
-    // 根据从 core 来的消息处理不同的 topic
-    var dataValue interface{}
-    userNameTopic := ""
-    if propPath, ok := getKeyFromTopic(topic); ok && propPath != "" {
-        ok, dataValue = getValue(strReqJson, propPath)
-        if !ok || dataValue == nil {
-            return &pb.TopicEventResponse{Status: SubscriptionResponseStatusDrop}, err
+    owner := gjson.Get(strReqJson, "owner").String()
+    // http devices poll their downlinks, CoAP devices are notified
+    polling := rec != nil && (rec.Protocol == ProtocolHTTP || rec.Protocol == ProtocolCoAP)
+    // a failed downlink does not stop the others, and the event is not
+    // redelivered, it would send the delivered ones again
+    failed := 0
+    for _, dl := range downlinks {
+        userNameTopic := buildTopic(devId, dl.Topic)
+        var dlErr error
+        if polling {
+            if dlErr = s.pushDownlink(ctx, devId, dl); dlErr != nil {
+                log.Errorf("TopicEventHandler: mailbox of %s err=%v", devId, dlErr)
+            }
+        } else if rec != nil && rec.Protocol == ProtocolLwM2M && s.hookSvc.conf.LwM2M.Enabled {
+            if dlErr = s.hookSvc.lwm2mDownlink(ctx, rec, dl); dlErr != nil {
+                log.Errorf("TopicEventHandler: lwm2m device %s err=%v", devId, dlErr)
+            }
+        } else if rec != nil && rec.Protocol == ProtocolSparkplug && s.hookSvc.conf.Sparkplug.Enabled {
+            if dlErr = s.hookSvc.sparkplugDownlink(ctx, rec, dl); dlErr != nil {
+                log.Errorf("TopicEventHandler: sparkplug device %s err=%v", devId, dlErr)
+            }
+        } else if rec != nil && rec.Protocol == ProtocolLoRaWAN {
+            if dlErr = s.hookSvc.lorawanDownlink(ctx, rec, dl); dlErr != nil {
+                log.Errorf("TopicEventHandler: lorawan device %s err=%v", devId, dlErr)
+            }
+        } else if dlErr = s.hookSvc.emqx.Publish(ctx, devId, userNameTopic, defaultDownStreamClientId, 0, false, dl.Value); dlErr != nil {
+            log.Errorf("TopicEventHandler: topic=%s err=%v", userNameTopic, dlErr)
         }
+        if dlErr != nil {
+            failed++
+            continue
+        }
+        s.hookSvc.live.downlink(rec, devId, dl.Topic, dl.Value)
+        if dlErr = s.echo(ctx, devId, owner, userNameTopic, dl.Value); dlErr != nil {
+            log.Errorf("TopicEventHandler: echo topic=%s err=%v", userNameTopic, dlErr)
+        }
+    }
+    if failed > 0 {
+        log.Warnf("TopicEventHandler: drop %d of %d downlinks of %s", failed, len(downlinks), devId)
+    }
 
-        userNameTopic = buildTopic(devId, topic)
+    return &pb.TopicEventResponse{Status: SubscriptionResponseStatusDrop}, nil
+}
 
-        if err = Publish(devId, userNameTopic, defaultDownStreamClientId, 0, false, dataValue); err != nil {
-            log.Errorf("TopicEventHandler: topic=%s err=%v", userNameTopic, err)
-            return &pb.TopicEventResponse{Status: SubscriptionResponseStatusSuccess}, err
-        }
+// pushDownlink keeps dl for devId until it polls or is notified.
+func (s *TopicService) pushDownlink(ctx context.Context, devId string, dl downlink) error {
+    payload, err := json.Marshal(dl.Value)
+    if err != nil {
+        return err
     }
+    return s.hookSvc.mailbox.Push(ctx, devId, PendingDownlink{
+        Topic:   dl.Topic,
+        Payload: payload,
+        Ts:      time.Now().UnixMilli(),
+    })
+}
 
-    payloadBytes, err := json.Marshal(dataValue)
+// echo sends the data published to a device back to core as a downstream event.
+func (s *TopicService) echo(ctx context.Context, devId, owner, userNameTopic string, value interface{}) error {
+    payloadBytes, err := json.Marshal(value)
     if err != nil {
-        return &pb.TopicEventResponse{Status: SubscriptionResponseStatusDrop}, err
+        return err
     }
-    owner := gjson.Get(strReqJson, "owner").String()
     data := make(map[string]interface{})
     data["id"] = devId
     data["owner"] = owner
@@ -202,17 +370,9 @@ func (s *TopicService) TopicEventHandler(ctx context.Context, req *pb.TopicEvent
         },
     }
     data["data"] = md
-    dd, err := toCloudEventData(data)
-    if err != nil {
-        log.Errorf("toCloudEventData %s", err.Error())
-        return &pb.TopicEventResponse{Status: SubscriptionResponseStatusDrop}, err
-    }
-    s.producer.Input() <- &sarama.ProducerMessage{
-        Topic: s.corePubTopic,
-        Value: sarama.ByteEncoder(dd),
-        Key:   sarama.StringEncoder(devId),
+    if err := s.forwarder.Send(ctx, devId, EventTypeDownstream, time.UnixMilli(ts), data); err != nil {
+        return err
     }
     log.Debug("OnMessagePublish", data)
-
-    return &pb.TopicEventResponse{Status: SubscriptionResponseStatusDrop}, err
+    return nil
 }
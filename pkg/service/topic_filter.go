@@ -0,0 +1,118 @@
+package service
+
+import (
+    "strings"
+)
+
+const (
+    // shared subscription prefixes, $share/<group>/<filter> and $queue/<filter>
+    sharePrefix = "$share/"
+    queuePrefix = "$queue/"
+
+    // topicKeyWildcard stands for any key in _subTopicPatterns
+    topicKeyWildcard = "+"
+)
+
+// _subTopicPatterns is the tree of topics devices may subscribe.
+var _subTopicPatterns = []subTopic{
+    {Base: DeviceDebugTopic, Mode: realtimeMode},
+    {Base: RawDataTopic, Mode: realtimeMode},
+    {Base: AttributesTopic, Mode: realtimeMode},
+    {Base: AttributesTopic, Key: topicKeyWildcard, Mode: realtimeMode},
+    {Base: CommandTopic, Mode: realtimeMode},
+    {Base: CommandTopic, Key: topicKeyWildcard, Mode: realtimeMode},
+    {Base: RawDataTopic, Mode: onChangeMode},
+    {Base: AttributesTopic, Mode: onChangeMode},
+    {Base: AttributesTopic, Key: topicKeyWildcard, Mode: onChangeMode},
+    {Base: CommandTopic, Mode: onChangeMode},
+    {Base: CommandTopic, Key: topicKeyWildcard, Mode: onChangeMode},
+}
+
+func validTopicKey(key string) bool {
+    return key != "" && !strings.ContainsAny(key, "/+#")
+}
+
+// stripShare returns the topic filter of a shared subscription.
+func stripShare(filter string) (string, bool) {
+    switch {
+    case strings.HasPrefix(filter, queuePrefix):
+        return strings.TrimPrefix(filter, queuePrefix), true
+    case strings.HasPrefix(filter, sharePrefix):
+        rest := strings.TrimPrefix(filter, sharePrefix)
+        i := strings.IndexByte(rest, '/')
+        if i <= 0 || strings.ContainsAny(rest[:i], "+#") {
+            return "", false
+        }
+        return rest[i+1:], true
+    }
+    return filter, true
+}
+
+// validFilter checks the MQTT topic filter syntax: + and # fill a whole
+// level and # is the last one.
+func validFilter(filter string) bool {
+    if filter == "" {
+        return false
+    }
+    levels := strings.Split(filter, "/")
+    for i, level := range levels {
+        if strings.ContainsAny(level, "+#") && len(level) > 1 {
+            return false
+        }
+        if level == "#" && i != len(levels)-1 {
+            return false
+        }
+    }
+    return true
+}
+
+// matchPattern matches filter levels against the levels of a pattern, it
+// returns the key the filter selects for a keyed pattern, "+" for any.
+func matchPattern(filter, pattern []string) (string, bool) {
+    key := ""
+    for i, f := range filter {
+        if f == "#" {
+            // # also matches the parent level
+            if len(pattern) > i && pattern[len(pattern)-1] == topicKeyWildcard {
+                key = topicKeyWildcard
+            }
+            return key, len(pattern) >= i
+        }
+        if i >= len(pattern) {
+            return "", false
+        }
+        p := pattern[i]
+        switch {
+        case p == topicKeyWildcard && f == topicKeyWildcard:
+            key = topicKeyWildcard
+        case p == topicKeyWildcard:
+            if !validTopicKey(f) {
+                return "", false
+            }
+            key = f
+        case f != topicKeyWildcard && f != p:
+            return "", false
+        }
+    }
+    return key, len(filter) == len(pattern)
+}
+
+// expandFilter returns the iothub topics an MQTT topic filter covers,
+// shared subscription prefixes are ignored. A keyed topic with the "+" key
+// stands for each key.
+func expandFilter(filter string) []subTopic {
+    f, ok := stripShare(filter)
+    if !ok || !validFilter(f) {
+        return nil
+    }
+    levels := strings.Split(f, "/")
+    var out []subTopic
+    for _, pattern := range _subTopicPatterns {
+        key, ok := matchPattern(levels, strings.Split(pattern.Name(), "/"))
+        if !ok {
+            continue
+        }
+        out = append(out, pattern.withKey(key))
+    }
+    return out
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+    "sort"
+    "strings"
+    "testing"
+)
+
+func expandedNames(filter string) string {
+    var names []string
+    for _, st := range expandFilter(filter) {
+        names = append(names, st.Name()+"@"+st.coreItem())
+    }
+    sort.Strings(names)
+    return strings.Join(names, " ")
+}
+
+func TestExpandFilter(t *testing.T) {
+    for filter, want := range map[string]string{
+        AttributesTopic:                         AttributesTopic + "@attributes",
+        AttributesTopic + "/temperature":        AttributesTopic + "/temperature@attributes.temperature",
+        CommandTopic + "/reboot":                CommandTopic + "/reboot@commands.reboot",
+        OnChangeTopicPrefix + "attributes/mode": OnChangeTopicPrefix + "attributes/mode@attributes.mode",
+        DeviceDebugTopic:                        DeviceDebugTopic + "@*",
+        "v1/devices/me/attributes/+":            AttributesTopic + "/+@attributes",
+        "v1/devices/me/attributes/#":            AttributesTopic + "/+@attributes " + AttributesTopic + "@attributes",
+        "v1/devices/me/+":                       AttributesTopic + "@attributes " + CommandTopic + "@commands " + RawDataTopic + "@rawDown",
+        "v1/devices/+/attributes/temperature":   AttributesTopic + "/temperature@attributes.temperature",
+        "$share/group/v1/devices/me/raw":        RawDataTopic + "@rawDown",
+        "$queue/v1/devices/debug":               DeviceDebugTopic + "@*",
+    } {
+        if got := expandedNames(filter); got != want {
+            t.Errorf("filter %s: got %s, want %s", filter, got, want)
+        }
+    }
+    if n := len(expandFilter("#")); n != len(_subTopicPatterns) {
+        t.Errorf("# covers %d topics", n)
+    }
+    for _, filter := range []string{
+        "v1/devices/me/other",
+        AttributesTopic + "/a/b",
+        OnChangeTopicPrefix + "telemetry",
+        "v1/devices/me/attr+",
+        "v1/#/attributes",
+        "$share/+/v1/devices/me/raw",
+        "$share/group",
+        "",
+    } {
+        if validSubTopic(filter) {
+            t.Errorf("invalid filter %q accepted", filter)
+        }
+    }
+}
@@ -9,3 +9,11 @@ const (
     CommandTopic string = "v1/devices/me/commands"
     CommandTopicResponse string = "v1/devices/me/command/response"
 )
+
+const (
+    // OnChangeTopicPrefix selects change-only delivery of the topic after it,
+    // e.g. v1/devices/me/onchange/attributes/temperature
+    OnChangeTopicPrefix = "v1/devices/me/onchange/"
+    // device topic prefix the onchange prefix replaces
+    deviceTopicPrefix = "v1/devices/me/"
+)
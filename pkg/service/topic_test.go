@@ -1,7 +0,0 @@
-package service
-
-//
-//func TestIsAttributes(t *testing.T) {
-//    js := `{"properties":{"attributes":{"hello":"world"}}}`
-//    t.Log(isAttributes(js))
-//}
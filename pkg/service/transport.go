@@ -0,0 +1,114 @@
+package service
+
+import (
+    "context"
+    "sync"
+    "time"
+
+    "github.com/tkeel-io/kit/log"
+)
+
+// Devices of the device http api and the CoAP server have no connection
+// through EMQX: each request carries the entity token, the first request
+// marks the device online and no request for a while marks it offline.
+
+type cachedToken struct {
+    devId   string
+    expires time.Time
+}
+
+// tokenCache keeps the device of a token for ttl, sparing keel a call per
+// request. A ttl of 0 disables it.
+type tokenCache struct {
+    ttl    time.Duration
+    lock   sync.Mutex
+    tokens map[string]cachedToken
+}
+
+func newTokenCache(ttl time.Duration) *tokenCache {
+    return &tokenCache{ttl: ttl, tokens: make(map[string]cachedToken)}
+}
+
+func (c *tokenCache) get(token string) string {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    if t, ok := c.tokens[token]; ok && time.Now().Before(t.expires) {
+        return t.devId
+    }
+    return ""
+}
+
+func (c *tokenCache) put(token, devId string) {
+    if c.ttl <= 0 {
+        return
+    }
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.tokens[token] = cachedToken{devId: devId, expires: time.Now().Add(c.ttl)}
+}
+
+// expire forgets the expired tokens.
+func (c *tokenCache) expire() {
+    now := time.Now()
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    for token, t := range c.tokens {
+        if !now.Before(t.expires) {
+            delete(c.tokens, token)
+        }
+    }
+}
+
+// authCached returns the device of token, asking keel if it is not in
+// cache. The reason is set when the device is empty, see authToken.
+func (s *HookService) authCached(ctx context.Context, cache *tokenCache, token string) (devId string, reason string) {
+    if devId = cache.get(token); devId != "" {
+        return devId, ""
+    }
+    devId, reason = s.authToken(ctx, token, "")
+    if devId != "" {
+        cache.put(token, devId)
+    }
+    return devId, reason
+}
+
+// connectDevice returns the record of devId, marking it online over
+// protocol from peer unless it already is.
+func (s *HookService) connectDevice(ctx context.Context, devId, protocol, peer string) (*DeviceRecord, error) {
+    if s.presence.Seen(devId) {
+        rec, err := s.registry.Get(ctx, devId)
+        if err != nil {
+            log.Errorf("get device record %s err, %v", devId, err)
+            return nil, err
+        }
+        if rec != nil {
+            return rec, nil
+        }
+    }
+    return s.markOnline(ctx, &ConnectInfo{
+        ClientID:  devId,
+        UserName:  devId,
+        PeerHost:  peer,
+        Protocol:  protocol,
+        Online:    true,
+        Timestamp: time.Now().UnixMilli(),
+    })
+}
+
+// expireIdle marks the devices online over protocol and not seen for
+// longer than timeout offline, except those kept. It returns how many.
+func (s *HookService) expireIdle(ctx context.Context, protocol string, timeout time.Duration, keep func(devId string) bool) int {
+    deadline := time.Now().Add(-timeout).UnixMilli()
+    n := 0
+    for _, d := range s.presence.Online() {
+        if d.Protocol != protocol || d.LastSeen >= deadline || (keep != nil && keep(d.DeviceID)) {
+            continue
+        }
+        if err := s.markOffline(ctx, d.DeviceID); err != nil {
+            log.Errorf("mark idle %s offline err, %v", d.DeviceID, err)
+            continue
+        }
+        n++
+    }
+    return n
+}
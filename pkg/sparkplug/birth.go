@@ -0,0 +1,121 @@
+package sparkplug
+
+import "strings"
+
+// Metrics of an edge node with a meaning of their own.
+const (
+	// BdSeq is the birth/death sequence number, an NDEATH with another one
+	// than the last NBIRTH is stale.
+	BdSeq = "bdSeq"
+	// Rebirth is the NCMD metric asking an edge node for its births.
+	Rebirth = "Node Control/Rebirth"
+
+	nodeControlPrefix = "Node Control/"
+	propertiesPrefix  = "Properties/"
+)
+
+// MetricDef is a metric of a birth certificate.
+type MetricDef struct {
+	Name     string   `json:"name"`
+	Alias    uint64   `json:"alias,omitempty"`
+	HasAlias bool     `json:"has_alias,omitempty"`
+	DataType DataType `json:"datatype"`
+}
+
+// Birth is the birth certificate of an edge node or a device, the names,
+// types and aliases of its metrics, by which its data messages are decoded.
+type Birth struct {
+	Metrics []MetricDef `json:"metrics"`
+
+	byName  map[string]int
+	byAlias map[uint64]int
+}
+
+// NewBirth returns the birth certificate of an NBIRTH or DBIRTH payload.
+func NewBirth(p *Payload) *Birth {
+	b := &Birth{}
+	for _, m := range p.Metrics {
+		if m.Name == "" {
+			continue
+		}
+		b.Metrics = append(b.Metrics, MetricDef{Name: m.Name, Alias: m.Alias, HasAlias: m.HasAlias, DataType: m.DataType})
+	}
+	return b
+}
+
+func (b *Birth) index() {
+	if b.byName != nil {
+		return
+	}
+	b.byName = make(map[string]int, len(b.Metrics))
+	b.byAlias = make(map[uint64]int)
+	for i, d := range b.Metrics {
+		b.byName[d.Name] = i
+		if d.HasAlias {
+			b.byAlias[d.Alias] = i
+		}
+	}
+}
+
+// Def returns the definition of the metric name.
+func (b *Birth) Def(name string) (MetricDef, bool) {
+	b.index()
+	i, ok := b.byName[name]
+	if !ok {
+		return MetricDef{}, false
+	}
+	return b.Metrics[i], true
+}
+
+// Resolve sets the name and the type of metric m of a data message from its
+// definition, m may only carry an alias. It reports whether m is defined.
+func (b *Birth) Resolve(m *Metric) bool {
+	b.index()
+	i, ok := b.byName[m.Name]
+	if m.Name == "" && m.HasAlias {
+		i, ok = b.byAlias[m.Alias]
+	}
+	if !ok {
+		return false
+	}
+	d := b.Metrics[i]
+	m.Name = d.Name
+	if m.DataType == Unknown {
+		m.DataType = d.DataType
+		if !m.IsNull {
+			m.Value = m.DataType.decode(m.raw)
+		}
+	}
+	return true
+}
+
+// Values returns the values of metrics by name, the metrics without a
+// name, the Node Control and Properties metrics and bdSeq are left out.
+func Values(metrics []Metric) map[string]interface{} {
+	values := make(map[string]interface{}, len(metrics))
+	for _, m := range metrics {
+		if m.Name == "" || m.Name == BdSeq || strings.HasPrefix(m.Name, nodeControlPrefix) || strings.HasPrefix(m.Name, propertiesPrefix) {
+			continue
+		}
+		if m.Value == nil && !m.IsNull {
+			continue
+		}
+		values[m.Name] = m.Value
+	}
+	return values
+}
+
+// BdSeqOf returns the bdSeq metric of an NBIRTH or NDEATH payload.
+func BdSeqOf(p *Payload) (uint64, bool) {
+	for _, m := range p.Metrics {
+		if m.Name == BdSeq {
+			switch v := m.Value.(type) {
+			case int64:
+				return uint64(v), true
+			case uint64:
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
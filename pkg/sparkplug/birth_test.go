@@ -0,0 +1,58 @@
+package sparkplug
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestBirth(t *testing.T) {
+	birth := NewBirth(&Payload{Metrics: []Metric{
+		{Name: BdSeq, DataType: Int64, Value: int64(4)},
+		{Name: Rebirth, DataType: Boolean, Value: false},
+		{Name: "temp", Alias: 1, HasAlias: true, DataType: Double, Value: 20.5},
+		{Name: "level", Alias: 2, HasAlias: true, DataType: Int16, Value: int64(-2)},
+	}})
+	// stored and loaded as json
+	b, err := json.Marshal(birth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	birth = &Birth{}
+	if err := json.Unmarshal(b, birth); err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := birth.Def("level"); !ok || d.DataType != Int16 {
+		t.Fatalf("def %+v", d)
+	}
+
+	// data of aliases only
+	data := &Payload{Metrics: []Metric{
+		{Alias: 2, HasAlias: true, DataType: Int16, Value: int64(-7)},
+		{Name: "temp", DataType: Double, Value: 21.0},
+		{Alias: 9, HasAlias: true, DataType: Int16, Value: int64(1)},
+	}}
+	if b, err = data.Marshal(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// senders of aliases may leave the type out
+	p.Metrics[0].DataType, p.Metrics[0].Value = Unknown, nil
+	known := []bool{birth.Resolve(&p.Metrics[0]), birth.Resolve(&p.Metrics[1]), birth.Resolve(&p.Metrics[2])}
+	if !reflect.DeepEqual(known, []bool{true, true, false}) {
+		t.Fatalf("resolved %v", known)
+	}
+	if got := Values(p.Metrics); !reflect.DeepEqual(got, map[string]interface{}{"level": int64(-7), "temp": 21.0}) {
+		t.Fatalf("values %v", got)
+	}
+
+	if v, ok := BdSeqOf(&Payload{Metrics: []Metric{{Name: BdSeq, DataType: UInt64, Value: uint64(4)}}}); !ok || v != 4 {
+		t.Fatalf("bdSeq %d", v)
+	}
+	if got := Values([]Metric{{Name: BdSeq, Value: int64(1)}, {Name: "Properties/Hardware", Value: "x"}, {Name: "null", IsNull: true}}); !reflect.DeepEqual(got, map[string]interface{}{"null": nil}) {
+		t.Fatalf("values %v", got)
+	}
+}
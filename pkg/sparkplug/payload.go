@@ -0,0 +1,340 @@
+// Package sparkplug implements the Sparkplug B topics and payloads of
+// industrial edge nodes: the protobuf codec of metrics, the birth
+// certificates and the alias tables. DataSet, Template, PropertySet and
+// MetaData values are skipped.
+package sparkplug
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DataType is the type of a metric value.
+type DataType uint32
+
+const (
+	Unknown  DataType = 0
+	Int8     DataType = 1
+	Int16    DataType = 2
+	Int32    DataType = 3
+	Int64    DataType = 4
+	UInt8    DataType = 5
+	UInt16   DataType = 6
+	UInt32   DataType = 7
+	UInt64   DataType = 8
+	Float    DataType = 9
+	Double   DataType = 10
+	Boolean  DataType = 11
+	String   DataType = 12
+	DateTime DataType = 13
+	Text     DataType = 14
+	UUID     DataType = 15
+	DataSet  DataType = 16
+	Bytes    DataType = 17
+	File     DataType = 18
+	Template DataType = 19
+)
+
+// Field numbers of the Payload and Metric messages.
+const (
+	payloadTimestamp = 1
+	payloadMetrics   = 2
+	payloadSeq       = 3
+	payloadUUID      = 4
+	payloadBody      = 5
+
+	metricName         = 1
+	metricAlias        = 2
+	metricTimestamp    = 3
+	metricDataType     = 4
+	metricIsHistorical = 5
+	metricIsTransient  = 6
+	metricIsNull       = 7
+	metricIntValue     = 10
+	metricLongValue    = 11
+	metricFloatValue   = 12
+	metricDoubleValue  = 13
+	metricBooleanValue = 14
+	metricStringValue  = 15
+	metricBytesValue   = 16
+)
+
+// Payload is a Sparkplug B payload.
+type Payload struct {
+	// Timestamp is in unix milliseconds.
+	Timestamp uint64
+	Metrics   []Metric
+	// Seq is the sequence number 0-255 of the messages of an edge node,
+	// NDEATH has none.
+	Seq    uint64
+	HasSeq bool
+	UUID   string
+	Body   []byte
+}
+
+// Metric is a metric of a payload. A metric of data messages may only carry
+// the alias its birth certificate defined for it.
+type Metric struct {
+	Name         string
+	Alias        uint64
+	HasAlias     bool
+	Timestamp    uint64
+	DataType     DataType
+	IsHistorical bool
+	IsTransient  bool
+	IsNull       bool
+	// Value is int64 of signed integers, uint64 of unsigned ones and
+	// DateTime, float32, float64, bool, string, []byte, nil for a null
+	// value or an unsupported type.
+	Value interface{}
+	// raw is the decoded field of the value, typed once DataType is known
+	raw interface{}
+}
+
+// Unmarshal decodes a protobuf payload.
+func Unmarshal(b []byte) (*Payload, error) {
+	p := &Payload{}
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v uint64, bs []byte) error {
+		switch num {
+		case payloadTimestamp:
+			p.Timestamp = v
+		case payloadMetrics:
+			if typ != protowire.BytesType {
+				return errors.New("metric is not a message")
+			}
+			m, err := unmarshalMetric(bs)
+			if err != nil {
+				return err
+			}
+			p.Metrics = append(p.Metrics, *m)
+		case payloadSeq:
+			p.Seq, p.HasSeq = v, true
+		case payloadUUID:
+			p.UUID = string(bs)
+		case payloadBody:
+			p.Body = append([]byte(nil), bs...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "decode sparkplug payload")
+	}
+	return p, nil
+}
+
+func unmarshalMetric(b []byte) (*Metric, error) {
+	m := &Metric{}
+	var raw interface{}
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v uint64, bs []byte) error {
+		switch num {
+		case metricName:
+			m.Name = string(bs)
+		case metricAlias:
+			m.Alias, m.HasAlias = v, true
+		case metricTimestamp:
+			m.Timestamp = v
+		case metricDataType:
+			m.DataType = DataType(v)
+		case metricIsHistorical:
+			m.IsHistorical = v != 0
+		case metricIsTransient:
+			m.IsTransient = v != 0
+		case metricIsNull:
+			m.IsNull = v != 0
+		case metricIntValue, metricLongValue, metricBooleanValue:
+			raw = v
+		case metricFloatValue:
+			raw = math.Float32frombits(uint32(v))
+		case metricDoubleValue:
+			raw = math.Float64frombits(v)
+		case metricStringValue:
+			raw = string(bs)
+		case metricBytesValue:
+			raw = append([]byte(nil), bs...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.raw = raw
+	if !m.IsNull {
+		m.Value = m.DataType.decode(raw)
+	}
+	return m, nil
+}
+
+// walk calls fn with each field of b, v is the value of varint and fixed
+// fields, bs the value of length delimited ones.
+func walk(b []byte, fn func(num protowire.Number, typ protowire.Type, v uint64, bs []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v uint64
+		var bs []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(b)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			bs, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(num, typ, v, bs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decode converts the raw value of a field to the value of t.
+func (t DataType) decode(raw interface{}) interface{} {
+	switch v := raw.(type) {
+	case uint64:
+		switch t {
+		case Int8:
+			return int64(int8(v))
+		case Int16:
+			return int64(int16(v))
+		case Int32:
+			return int64(int32(v))
+		case Int64:
+			return int64(v)
+		case UInt8, UInt16, UInt32:
+			return uint64(uint32(v))
+		case UInt64, DateTime:
+			return v
+		case Boolean:
+			return v != 0
+		}
+	case float32:
+		if t == Float {
+			return v
+		}
+	case float64:
+		if t == Double {
+			return v
+		}
+	case string:
+		if t == String || t == Text || t == UUID {
+			return v
+		}
+	case []byte:
+		if t == Bytes || t == File {
+			return v
+		}
+	}
+	return nil
+}
+
+// Marshal encodes p as protobuf.
+func (p *Payload) Marshal() ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, payloadTimestamp, protowire.VarintType)
+	b = protowire.AppendVarint(b, p.Timestamp)
+	for i := range p.Metrics {
+		mb, err := p.Metrics[i].marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, payloadMetrics, protowire.BytesType)
+		b = protowire.AppendBytes(b, mb)
+	}
+	if p.HasSeq {
+		b = protowire.AppendTag(b, payloadSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, p.Seq)
+	}
+	if p.UUID != "" {
+		b = protowire.AppendTag(b, payloadUUID, protowire.BytesType)
+		b = protowire.AppendString(b, p.UUID)
+	}
+	if p.Body != nil {
+		b = protowire.AppendTag(b, payloadBody, protowire.BytesType)
+		b = protowire.AppendBytes(b, p.Body)
+	}
+	return b, nil
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func (m *Metric) marshal() ([]byte, error) {
+	var b []byte
+	if m.Name != "" {
+		b = protowire.AppendTag(b, metricName, protowire.BytesType)
+		b = protowire.AppendString(b, m.Name)
+	}
+	if m.HasAlias {
+		b = protowire.AppendTag(b, metricAlias, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Alias)
+	}
+	if m.Timestamp != 0 {
+		b = protowire.AppendTag(b, metricTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Timestamp)
+	}
+	b = protowire.AppendTag(b, metricDataType, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.DataType))
+	b = appendBool(b, metricIsHistorical, m.IsHistorical)
+	b = appendBool(b, metricIsTransient, m.IsTransient)
+	if m.IsNull || m.Value == nil {
+		return appendBool(b, metricIsNull, true), nil
+	}
+	v, err := Convert(m.DataType, m.Value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "metric %s", m.Name)
+	}
+	switch v := v.(type) {
+	case int64:
+		if m.DataType == Int64 {
+			b = protowire.AppendTag(b, metricLongValue, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(v))
+		} else {
+			// sign extended to 32 bits
+			b = protowire.AppendTag(b, metricIntValue, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(uint32(int32(v))))
+		}
+	case uint64:
+		if m.DataType == UInt64 || m.DataType == DateTime {
+			b = protowire.AppendTag(b, metricLongValue, protowire.VarintType)
+		} else {
+			b = protowire.AppendTag(b, metricIntValue, protowire.VarintType)
+		}
+		b = protowire.AppendVarint(b, v)
+	case float32:
+		b = protowire.AppendTag(b, metricFloatValue, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(v))
+	case float64:
+		b = protowire.AppendTag(b, metricDoubleValue, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case bool:
+		b = protowire.AppendTag(b, metricBooleanValue, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case string:
+		b = protowire.AppendTag(b, metricStringValue, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	case []byte:
+		b = protowire.AppendTag(b, metricBytesValue, protowire.BytesType)
+		b = protowire.AppendBytes(b, v)
+	}
+	return b, nil
+}
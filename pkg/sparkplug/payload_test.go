@@ -0,0 +1,113 @@
+package sparkplug
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestPayloadRoundTrip(t *testing.T) {
+	in := &Payload{
+		Timestamp: 1650000000000,
+		Seq:       0,
+		HasSeq:    true,
+		UUID:      "u1",
+		Body:      []byte{1, 2},
+		Metrics: []Metric{
+			{Name: "i8", Alias: 0, HasAlias: true, DataType: Int8, Value: int64(-3)},
+			{Name: "i32", DataType: Int32, Value: int64(math.MinInt32)},
+			{Name: "i64", DataType: Int64, Value: int64(-1)},
+			{Name: "u16", DataType: UInt16, Value: uint64(65535)},
+			{Name: "u64", DataType: UInt64, Value: uint64(math.MaxUint64)},
+			{Name: "time", DataType: DateTime, Value: uint64(1650000000000)},
+			{Name: "f", DataType: Float, Value: float32(1.5)},
+			{Name: "d", DataType: Double, Value: 2.25, Timestamp: 7, IsHistorical: true},
+			{Name: "b", DataType: Boolean, Value: true},
+			{Name: "s", DataType: String, Value: "on", IsTransient: true},
+			{Name: "bytes", DataType: Bytes, Value: []byte{0xff}},
+			{Name: "null", DataType: Int32, IsNull: true},
+		},
+	}
+	b, err := in.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range out.Metrics {
+		out.Metrics[i].raw = nil
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip\n%+v\n%+v", in, out)
+	}
+
+	// ndeath has no seq
+	b, _ = (&Payload{Timestamp: 1}).Marshal()
+	if p, err := Unmarshal(b); err != nil || p.HasSeq {
+		t.Fatalf("without seq %+v, %v", p, err)
+	}
+	if _, err := (&Payload{Metrics: []Metric{{Name: "x", DataType: Int8, Value: int64(300)}}}).Marshal(); err == nil {
+		t.Fatal("marshalled an Int8 of 300")
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	// a metric of a newer version with a dataset value and unknown fields
+	var m []byte
+	m = protowire.AppendTag(m, metricName, protowire.BytesType)
+	m = protowire.AppendString(m, "ds")
+	m = protowire.AppendTag(m, metricDataType, protowire.VarintType)
+	m = protowire.AppendVarint(m, uint64(DataSet))
+	m = protowire.AppendTag(m, 17, protowire.BytesType)
+	m = protowire.AppendBytes(m, []byte{8, 1})
+	m = protowire.AppendTag(m, 30, protowire.Fixed64Type)
+	m = protowire.AppendFixed64(m, 1)
+	var b []byte
+	b = protowire.AppendTag(b, payloadMetrics, protowire.BytesType)
+	b = protowire.AppendBytes(b, m)
+	p, err := Unmarshal(b)
+	if err != nil || len(p.Metrics) != 1 || p.Metrics[0].Name != "ds" || p.Metrics[0].Value != nil {
+		t.Fatalf("payload %+v, %v", p, err)
+	}
+
+	for _, bad := range [][]byte{{0x08}, {0x12, 0x05, 0x0a}, {0x10, 0x01}} {
+		if p, err := Unmarshal(bad); err == nil {
+			t.Fatalf("decoded %x to %+v", bad, p)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		typ DataType
+		in  interface{}
+		out interface{}
+	}{
+		{Int16, 300.0, int64(300)},
+		{Int16, 1e6, nil},
+		{Int32, 1.5, nil},
+		{UInt8, -1.0, nil},
+		{UInt32, 7.0, uint64(7)},
+		{Float, 1.5, float32(1.5)},
+		{Double, int64(2), 2.0},
+		{Boolean, "true", nil},
+		{String, "s", "s"},
+		{Bytes, "ab", []byte("ab")},
+		{DataSet, "x", nil},
+	}
+	for _, tt := range tests {
+		out, err := Convert(tt.typ, tt.in)
+		if (err != nil) != (tt.out == nil) || !reflect.DeepEqual(out, tt.out) {
+			t.Fatalf("convert %v to %d: %v, %v", tt.in, tt.typ, out, err)
+		}
+	}
+	for v, want := range map[interface{}]DataType{true: Boolean, "s": String, 3.0: Int64, 3.5: Double, nil: Unknown} {
+		if got := Infer(v); got != want {
+			t.Fatalf("infer %v: %d", v, got)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package sparkplug
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Namespace is the first level of the Sparkplug B topics.
+const Namespace = "spBv1.0"
+
+// Message types.
+const (
+	NBIRTH = "NBIRTH"
+	NDEATH = "NDEATH"
+	NDATA  = "NDATA"
+	NCMD   = "NCMD"
+	DBIRTH = "DBIRTH"
+	DDEATH = "DDEATH"
+	DDATA  = "DDATA"
+	DCMD   = "DCMD"
+	// STATE is the state of a host application, spBv1.0/STATE/<host>.
+	STATE = "STATE"
+)
+
+var deviceTypes = map[string]bool{DBIRTH: true, DDEATH: true, DDATA: true, DCMD: true}
+var nodeTypes = map[string]bool{NBIRTH: true, NDEATH: true, NDATA: true, NCMD: true}
+
+// Topic is a topic spBv1.0/<group>/<type>/<edge node>[/<device>].
+type Topic struct {
+	Group  string
+	Type   string
+	Node   string
+	Device string
+}
+
+// IsTopic reports whether topic is in the Sparkplug B namespace.
+func IsTopic(topic string) bool {
+	return topic == Namespace || strings.HasPrefix(topic, Namespace+"/")
+}
+
+// ParseTopic parses a Sparkplug B topic, the host of a STATE topic is
+// returned as Node.
+func ParseTopic(topic string) (Topic, error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 3 || parts[0] != Namespace {
+		return Topic{}, errors.Errorf("invalid sparkplug topic %s", topic)
+	}
+	if parts[1] == STATE && len(parts) == 3 {
+		return Topic{Type: STATE, Node: parts[2]}, nil
+	}
+	t := Topic{Group: parts[1], Type: parts[2]}
+	switch {
+	case nodeTypes[t.Type] && len(parts) == 4:
+		t.Node = parts[3]
+	case deviceTypes[t.Type] && len(parts) == 5:
+		t.Node, t.Device = parts[3], parts[4]
+	default:
+		return Topic{}, errors.Errorf("invalid sparkplug topic %s", topic)
+	}
+	for _, part := range parts[1:] {
+		if part == "" || strings.ContainsAny(part, "+#") {
+			return Topic{}, errors.Errorf("invalid sparkplug topic %s", topic)
+		}
+	}
+	return t, nil
+}
+
+func (t Topic) String() string {
+	if t.Type == STATE {
+		return Namespace + "/" + STATE + "/" + t.Node
+	}
+	s := Namespace + "/" + t.Group + "/" + t.Type + "/" + t.Node
+	if t.Device != "" {
+		s += "/" + t.Device
+	}
+	return s
+}
+
+// IsDevice reports whether t is a topic of a device of an edge node.
+func (t Topic) IsDevice() bool {
+	return deviceTypes[t.Type]
+}
@@ -0,0 +1,32 @@
+package sparkplug
+
+import "testing"
+
+func TestParseTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  Topic
+		ok    bool
+	}{
+		{"spBv1.0/plant1/NBIRTH/edge1", Topic{Group: "plant1", Type: NBIRTH, Node: "edge1"}, true},
+		{"spBv1.0/plant1/DDATA/edge1/pump", Topic{Group: "plant1", Type: DDATA, Node: "edge1", Device: "pump"}, true},
+		{"spBv1.0/STATE/scada", Topic{Type: STATE, Node: "scada"}, true},
+		{"spBv1.0/plant1/NDATA/edge1/pump", Topic{}, false},
+		{"spBv1.0/plant1/DDATA/edge1", Topic{}, false},
+		{"spBv1.0/plant1/XDATA/edge1", Topic{}, false},
+		{"spBv1.0/plant1/NCMD/+", Topic{}, false},
+		{"spAv1.0/plant1/NDATA/edge1", Topic{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseTopic(tt.topic)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Fatalf("%s: %+v, %v", tt.topic, got, err)
+		}
+		if tt.ok && got.String() != tt.topic {
+			t.Fatalf("%s: string %s", tt.topic, got)
+		}
+	}
+	if !IsTopic("spBv1.0/#") || IsTopic("spBv1.0x/a") {
+		t.Fatal("IsTopic")
+	}
+}
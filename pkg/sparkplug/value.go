@@ -0,0 +1,141 @@
+package sparkplug
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+var intRanges = map[DataType][2]int64{
+	Int8:  {math.MinInt8, math.MaxInt8},
+	Int16: {math.MinInt16, math.MaxInt16},
+	Int32: {math.MinInt32, math.MaxInt32},
+	Int64: {math.MinInt64, math.MaxInt64},
+}
+
+var uintMax = map[DataType]uint64{
+	UInt8:    math.MaxUint8,
+	UInt16:   math.MaxUint16,
+	UInt32:   math.MaxUint32,
+	UInt64:   math.MaxUint64,
+	DateTime: math.MaxUint64,
+}
+
+// Convert returns v, e.g. a value decoded from json, as the value of a
+// metric of type t, see Metric.Value.
+func Convert(t DataType, v interface{}) (interface{}, error) {
+	if r, ok := intRanges[t]; ok {
+		if i, ok := toInt(v); ok && i >= r[0] && i <= r[1] {
+			return i, nil
+		}
+		return nil, errors.Errorf("%v is not an integer of type %d", v, t)
+	}
+	if max, ok := uintMax[t]; ok {
+		if u, ok := toUint(v); ok && u <= max {
+			return u, nil
+		}
+		return nil, errors.Errorf("%v is not an unsigned integer of type %d", v, t)
+	}
+	switch t {
+	case Float, Double:
+		f, ok := toFloat(v)
+		if !ok {
+			return nil, errors.Errorf("%v is not a number", v)
+		}
+		if t == Float {
+			return float32(f), nil
+		}
+		return f, nil
+	case Boolean:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+		return nil, errors.Errorf("%v is not a boolean", v)
+	case String, Text, UUID:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+		return nil, errors.Errorf("%v is not a string", v)
+	case Bytes, File:
+		switch b := v.(type) {
+		case []byte:
+			return b, nil
+		case string:
+			return []byte(b), nil
+		}
+		return nil, errors.Errorf("%v is not bytes", v)
+	}
+	return nil, errors.Errorf("unsupported data type %d", t)
+}
+
+// Infer returns the type of a metric of value v, Unknown if there is none.
+func Infer(v interface{}) DataType {
+	switch v := v.(type) {
+	case bool:
+		return Boolean
+	case string:
+		return String
+	case []byte:
+		return Bytes
+	case int, int64:
+		return Int64
+	case uint64:
+		return UInt64
+	case float32:
+		return Float
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+			return Int64
+		}
+		return Double
+	}
+	return Unknown
+}
+
+func toInt(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint64:
+		return int64(v), v <= math.MaxInt64
+	case float32:
+		return toInt(float64(v))
+	case float64:
+		return int64(v), v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64
+	}
+	return 0, false
+}
+
+func toUint(v interface{}) (uint64, bool) {
+	switch v := v.(type) {
+	case int:
+		return uint64(v), v >= 0
+	case int64:
+		return uint64(v), v >= 0
+	case uint64:
+		return v, true
+	case float32:
+		return toUint(float64(v))
+	case float64:
+		return uint64(v), v == math.Trunc(v) && v >= 0 && v < math.MaxUint64
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,181 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/pkg/errors"
+	"github.com/tkeel-io/iothub/pkg/metrics"
+	"github.com/tkeel-io/iothub/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// dapr state metadata of the item ttl
+	ttlMetadata = "ttlInSeconds"
+	// number of keys fetched in parallel by the sidecar
+	bulkParallelism = 10
+)
+
+// DaprStore is a StateStore backed by a dapr state store component.
+type DaprStore struct {
+	client dapr.Client
+	name   string
+}
+
+func NewDaprStore(client dapr.Client, name string) *DaprStore {
+	if name == "" {
+		name = DefaultName
+	}
+	return &DaprStore{client: client, name: name}
+}
+
+// Name returns the state store component name.
+func (d *DaprStore) Name() string {
+	return d.name
+}
+
+func (d *DaprStore) start(ctx context.Context, op string) (context.Context, trace.Span) {
+	ctx, span := tracing.Start(ctx, "state."+op, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.name", d.name)))
+	return tracing.OutgoingGRPC(ctx), span
+}
+
+func (d *DaprStore) end(span trace.Span, op string, start time.Time, err error) error {
+	metrics.ObserveState(op, start, err)
+	tracing.End(span, err)
+	return convertError(err)
+}
+
+// convertError maps the dapr etag mismatch to ErrEtagMismatch.
+func convertError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if status.Code(errors.Cause(err)) == codes.Aborted {
+		return ErrEtagMismatch
+	}
+	return err
+}
+
+func etag(v string) *dapr.ETag {
+	if v == "" {
+		return nil
+	}
+	return &dapr.ETag{Value: v}
+}
+
+func toSetStateItem(item *Item) *dapr.SetStateItem {
+	si := &dapr.SetStateItem{
+		Key:   item.Key,
+		Value: item.Value,
+		Etag:  etag(item.Etag),
+		Options: &dapr.StateOptions{
+			Concurrency: dapr.StateConcurrencyLastWrite,
+			Consistency: dapr.StateConsistencyStrong,
+		},
+	}
+	if item.Etag != "" || item.FirstWrite {
+		si.Options.Concurrency = dapr.StateConcurrencyFirstWrite
+	}
+	if item.TTL > 0 {
+		seconds := int(item.TTL.Seconds())
+		if seconds < 1 {
+			seconds = 1
+		}
+		si.Metadata = map[string]string{ttlMetadata: strconv.Itoa(seconds)}
+	}
+	return si
+}
+
+func (d *DaprStore) Get(ctx context.Context, key string) (_ *Item, err error) {
+	ctx, span := d.start(ctx, "Get")
+	defer func(start time.Time) { err = d.end(span, metrics.OpGet, start, err) }(time.Now())
+	si, err := d.client.GetState(ctx, d.name, key)
+	if err != nil {
+		return nil, err
+	}
+	return &Item{Key: key, Value: si.Value, Etag: si.Etag}, nil
+}
+
+func (d *DaprStore) BulkGet(ctx context.Context, keys []string) (_ []*Item, err error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	ctx, span := d.start(ctx, "BulkGet")
+	defer func(start time.Time) { err = d.end(span, metrics.OpGet, start, err) }(time.Now())
+	res, err := d.client.GetBulkState(ctx, d.name, keys, nil, bulkParallelism)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]*dapr.BulkStateItem, len(res))
+	for _, bi := range res {
+		if bi.Error != "" {
+			return nil, errors.Errorf("get state %s: %s", bi.Key, bi.Error)
+		}
+		byKey[bi.Key] = bi
+	}
+	items := make([]*Item, 0, len(keys))
+	for _, key := range keys {
+		item := &Item{Key: key}
+		if bi, ok := byKey[key]; ok {
+			item.Value, item.Etag = bi.Value, bi.Etag
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (d *DaprStore) Save(ctx context.Context, items ...*Item) (err error) {
+	if len(items) == 0 {
+		return nil
+	}
+	ctx, span := d.start(ctx, "Save")
+	defer func(start time.Time) { err = d.end(span, metrics.OpSave, start, err) }(time.Now())
+	sis := make([]*dapr.SetStateItem, 0, len(items))
+	for _, item := range items {
+		sis = append(sis, toSetStateItem(item))
+	}
+	return d.client.SaveBulkState(ctx, d.name, sis...)
+}
+
+func (d *DaprStore) Delete(ctx context.Context, key, etagValue string) (err error) {
+	ctx, span := d.start(ctx, "Delete")
+	defer func(start time.Time) { err = d.end(span, metrics.OpDelete, start, err) }(time.Now())
+	var opts *dapr.StateOptions
+	if etagValue != "" {
+		opts = &dapr.StateOptions{Concurrency: dapr.StateConcurrencyFirstWrite}
+	}
+	return d.client.DeleteStateWithETag(ctx, d.name, key, etag(etagValue), nil, opts)
+}
+
+func (d *DaprStore) BulkDelete(ctx context.Context, keys ...string) (err error) {
+	if len(keys) == 0 {
+		return nil
+	}
+	ctx, span := d.start(ctx, "BulkDelete")
+	defer func(start time.Time) { err = d.end(span, metrics.OpDelete, start, err) }(time.Now())
+	return d.client.DeleteBulkState(ctx, d.name, keys)
+}
+
+func (d *DaprStore) Transaction(ctx context.Context, ops ...*Operation) (err error) {
+	if len(ops) == 0 {
+		return nil
+	}
+	ctx, span := d.start(ctx, "Transaction")
+	defer func(start time.Time) { err = d.end(span, metrics.OpTransaction, start, err) }(time.Now())
+	dops := make([]*dapr.StateOperation, 0, len(ops))
+	for _, op := range ops {
+		t := dapr.StateOperationTypeUpsert
+		if op.Type == OpDelete {
+			t = dapr.StateOperationTypeDelete
+		}
+		dops = append(dops, &dapr.StateOperation{Type: t, Item: toSetStateItem(op.Item)})
+	}
+	return d.client.ExecuteStateTransaction(ctx, d.name, nil, dops)
+}
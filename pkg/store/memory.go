@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memEntry struct {
+	value   []byte
+	version uint64
+	expires time.Time
+}
+
+func (e *memEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// MemoryStore is an in process StateStore.
+type MemoryStore struct {
+	lock    sync.Mutex
+	version uint64
+	entries map[string]*memEntry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*memEntry)}
+}
+
+// get returns the live entry of key, the lock must be held.
+func (m *MemoryStore) get(key string, now time.Time) *memEntry {
+	e, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	if e.expired(now) {
+		delete(m.entries, key)
+		return nil
+	}
+	return e
+}
+
+func (m *MemoryStore) item(key string, now time.Time) *Item {
+	item := &Item{Key: key}
+	if e := m.get(key, now); e != nil {
+		item.Value = append([]byte(nil), e.value...)
+		item.Etag = strconv.FormatUint(e.version, 10)
+	}
+	return item
+}
+
+// check verifies the etag of item against the stored version.
+func (m *MemoryStore) check(item *Item, now time.Time) error {
+	e := m.get(item.Key, now)
+	if item.Etag == "" {
+		if item.FirstWrite && e != nil {
+			return ErrEtagMismatch
+		}
+		return nil
+	}
+	if e == nil || strconv.FormatUint(e.version, 10) != item.Etag {
+		return ErrEtagMismatch
+	}
+	return nil
+}
+
+func (m *MemoryStore) apply(op *Operation, now time.Time) {
+	if op.Type == OpDelete {
+		delete(m.entries, op.Item.Key)
+		return
+	}
+	m.version++
+	e := &memEntry{
+		value:   append([]byte(nil), op.Item.Value...),
+		version: m.version,
+	}
+	if op.Item.TTL > 0 {
+		e.expires = now.Add(op.Item.TTL)
+	}
+	m.entries[op.Item.Key] = e
+}
+
+func (m *MemoryStore) Get(_ context.Context, key string) (*Item, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.item(key, time.Now()), nil
+}
+
+func (m *MemoryStore) BulkGet(_ context.Context, keys []string) ([]*Item, error) {
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	items := make([]*Item, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, m.item(key, now))
+	}
+	return items, nil
+}
+
+func (m *MemoryStore) Save(ctx context.Context, items ...*Item) error {
+	ops := make([]*Operation, 0, len(items))
+	for _, item := range items {
+		ops = append(ops, Upsert(item))
+	}
+	return m.Transaction(ctx, ops...)
+}
+
+func (m *MemoryStore) Delete(ctx context.Context, key, etag string) error {
+	return m.Transaction(ctx, Delete(key, etag))
+}
+
+func (m *MemoryStore) BulkDelete(ctx context.Context, keys ...string) error {
+	ops := make([]*Operation, 0, len(keys))
+	for _, key := range keys {
+		ops = append(ops, Delete(key, ""))
+	}
+	return m.Transaction(ctx, ops...)
+}
+
+func (m *MemoryStore) Transaction(_ context.Context, ops ...*Operation) error {
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, op := range ops {
+		if err := m.check(op.Item, now); err != nil {
+			return err
+		}
+	}
+	for _, op := range ops {
+		m.apply(op, now)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore_Etag(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	item, err := m.Get(ctx, "k")
+	if err != nil || item.Value != nil || item.Etag != "" {
+		t.Fatalf("unexpected missing item %+v, %v", item, err)
+	}
+	if err := m.Save(ctx, &Item{Key: "k", Value: []byte("v1")}); err != nil {
+		t.Fatal(err)
+	}
+	item, _ = m.Get(ctx, "k")
+	if string(item.Value) != "v1" || item.Etag == "" {
+		t.Fatalf("unexpected item %+v", item)
+	}
+	if err := m.Save(ctx, &Item{Key: "k", Value: []byte("v2"), Etag: item.Etag}); err != nil {
+		t.Fatal(err)
+	}
+	// stale etag
+	if err := m.Save(ctx, &Item{Key: "k", Value: []byte("v3"), Etag: item.Etag}); err != ErrEtagMismatch {
+		t.Fatalf("expected etag mismatch, got %v", err)
+	}
+	if err := m.Delete(ctx, "k", item.Etag); err != ErrEtagMismatch {
+		t.Fatalf("expected etag mismatch, got %v", err)
+	}
+	if err := m.Save(ctx, &Item{Key: "k", Value: []byte("v3"), FirstWrite: true}); err != ErrEtagMismatch {
+		t.Fatalf("expected etag mismatch, got %v", err)
+	}
+	items, _ := m.BulkGet(ctx, []string{"k", "x"})
+	if string(items[0].Value) != "v2" || items[1].Value != nil {
+		t.Fatalf("unexpected items %+v %+v", items[0], items[1])
+	}
+}
+
+func TestMemoryStore_Transaction(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	m.Save(ctx, &Item{Key: "a", Value: []byte("1")}, &Item{Key: "b", Value: []byte("2")}) //nolint
+	a, _ := m.Get(ctx, "a")
+	err := m.Transaction(ctx,
+		Upsert(&Item{Key: "c", Value: []byte("3")}),
+		Delete("b", "stale"),
+	)
+	if err != ErrEtagMismatch {
+		t.Fatalf("expected etag mismatch, got %v", err)
+	}
+	if c, _ := m.Get(ctx, "c"); c.Value != nil {
+		t.Fatal("failed transaction partially applied")
+	}
+	if err := m.Transaction(ctx, Upsert(&Item{Key: "c", Value: []byte("3")}), Delete("a", a.Etag)); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := m.Get(ctx, "a"); a.Value != nil {
+		t.Fatal("a not deleted")
+	}
+}
+
+func TestMemoryStore_TTL(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	m.Save(ctx, &Item{Key: "k", Value: []byte("v"), TTL: time.Millisecond}) //nolint
+	time.Sleep(2 * time.Millisecond)
+	if item, _ := m.Get(ctx, "k"); item.Value != nil {
+		t.Fatal("expired item returned")
+	}
+}
@@ -0,0 +1,96 @@
+// Package store is the state store of iothub, device owner, tenant,
+// connect info and subscriptions live here.
+package store
+
+import (
+	"context"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultName is the default dapr state store component of iothub.
+	DefaultName = "iothub-private-store"
+
+	// TypeDapr stores state through the dapr sidecar.
+	TypeDapr = "dapr"
+	// TypeMemory stores state in process, for tests and single replica setups.
+	TypeMemory = "memory"
+)
+
+// ErrEtagMismatch is returned when a conditional write loses against a
+// concurrent writer, callers re-read and retry.
+var ErrEtagMismatch = errors.New("state etag mismatch")
+
+// Item is a value of the state store.
+type Item struct {
+	Key   string
+	Value []byte
+	// Etag is the version read with Get, a write carrying an etag only
+	// succeeds if the stored version still matches, empty writes always.
+	Etag string
+	// FirstWrite without an etag only creates the item, the write fails
+	// with ErrEtagMismatch if the key already exists.
+	FirstWrite bool
+	// TTL expires the item, 0 keeps it forever.
+	TTL time.Duration
+}
+
+// OpType is the type of a transaction operation.
+type OpType int
+
+const (
+	OpUpsert OpType = iota + 1
+	OpDelete
+)
+
+// Operation is one step of a transaction.
+type Operation struct {
+	Type OpType
+	Item *Item
+}
+
+// Upsert returns an upsert operation of item.
+func Upsert(item *Item) *Operation {
+	return &Operation{Type: OpUpsert, Item: item}
+}
+
+// Delete returns a delete operation of key, conditional on etag if not empty.
+func Delete(key, etag string) *Operation {
+	return &Operation{Type: OpDelete, Item: &Item{Key: key, Etag: etag}}
+}
+
+// StateStore is a key value store with optimistic concurrency.
+//
+// Missing keys are not errors, Get returns an item with a nil value and an
+// empty etag, the same as dapr.
+type StateStore interface {
+	// Get returns the item of key.
+	Get(ctx context.Context, key string) (*Item, error)
+	// BulkGet returns the items of keys, in the order of keys.
+	BulkGet(ctx context.Context, keys []string) ([]*Item, error)
+	// Save upserts items, each one conditional on its etag.
+	Save(ctx context.Context, items ...*Item) error
+	// Delete deletes key, conditional on etag if not empty.
+	Delete(ctx context.Context, key, etag string) error
+	// BulkDelete deletes keys unconditionally.
+	BulkDelete(ctx context.Context, keys ...string) error
+	// Transaction applies ops atomically, all or none.
+	Transaction(ctx context.Context, ops ...*Operation) error
+}
+
+// New returns the state store of typ, name is the dapr component name.
+func New(typ string, client dapr.Client, name string) (StateStore, error) {
+	switch typ {
+	case TypeDapr, "":
+		if client == nil {
+			return nil, errors.New("dapr state store requires a dapr client")
+		}
+		return NewDaprStore(client, name), nil
+	case TypeMemory:
+		return NewMemoryStore(), nil
+	}
+	return nil, errors.Errorf("invalid state store type %s", typ)
+}
@@ -0,0 +1,29 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestInjectKafka(t *testing.T) {
+	if _, err := Init(context.Background(), "iothub", ExporterNone); err != nil {
+		t.Fatal(err)
+	}
+	ctx, span := Start(context.Background(), "test")
+	defer span.End()
+
+	msg := &sarama.ProducerMessage{}
+	InjectKafka(ctx, msg)
+	carrier := KafkaHeaderCarrier{Headers: &msg.Headers}
+	tp, _ := Traceparent(ctx)
+	if tp == "" || carrier.Get("traceparent") != tp {
+		t.Fatalf("traceparent not injected, headers %v", msg.Headers)
+	}
+	// injecting again replaces instead of duplicating
+	InjectKafka(ctx, msg)
+	if len(carrier.Keys()) != 1 {
+		t.Fatalf("unexpected headers %v", carrier.Keys())
+	}
+}